@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+
+	"github.com/spf13/cobra"
+)
+
+var cleanupOlderThan time.Duration
+
+// cleanupTempCmd represents the cleanup-temp command
+var cleanupTempCmd = &cobra.Command{
+	Use:   "cleanup-temp",
+	Short: "Remove stale temporary files left behind by interrupted runs",
+	Run: func(cmd *cobra.Command, args []string) {
+		removed, err := lib.CleanupTempFiles(cleanupOlderThan)
+		for _, path := range removed {
+			fmt.Printf("Removed %s\n", path)
+		}
+		if err != nil {
+			slog.Error("error cleaning up temp files", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d stale temp files from %s\n", len(removed), lib.TempDir())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupTempCmd)
+
+	cleanupTempCmd.Flags().DurationVar(&cleanupOlderThan, "older-than", 24*time.Hour, "Only remove temp files last modified longer ago than this")
+}
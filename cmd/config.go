@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// defaultConfigName is the config file looked for when --config is not set,
+// first in the working directory and then in the home directory
+const defaultConfigName = ".instagramrc"
+
+// envPrefix prefixes the environment variable that sets each flag, e.g.
+// INSTAGRAM_RECENTS_OUTPUT_DIR for --output-dir
+const envPrefix = "INSTAGRAM_RECENTS_"
+
+var configFile string
+
+// flagEnvName returns the environment variable that sets a flag
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// findConfigFile returns the config file to load: --config when set,
+// otherwise .instagramrc in the working or home directory, or "" for none
+func findConfigFile() string {
+	if configFile != "" {
+		return configFile
+	}
+	candidates := []string{defaultConfigName}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, defaultConfigName))
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readConfigFile parses a YAML config file of flag names to values. A
+// missing file gives an empty config.
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Warn("config file not found, using defaults", "path", path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// allFlagNames returns the name of every flag of cmd and its subcommands
+func allFlagNames(cmd *cobra.Command) map[string]bool {
+	names := make(map[string]bool)
+	collect := func(flag *pflag.Flag) { names[flag.Name] = true }
+	var walk func(*cobra.Command)
+	walk = func(c *cobra.Command) {
+		c.PersistentFlags().VisitAll(collect)
+		c.Flags().VisitAll(collect)
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(cmd)
+	return names
+}
+
+// setFlagValue sets a flag from a config value: a scalar, or a list for
+// flags that take several values
+func setFlagValue(flags *pflag.FlagSet, flag *pflag.Flag, value any) error {
+	items, isList := value.([]any)
+	if !isList {
+		if _, isMap := value.(map[string]any); isMap {
+			return fmt.Errorf("%s must be a value or a list, not a map", flag.Name)
+		}
+		return flags.Set(flag.Name, fmt.Sprint(value))
+	}
+
+	values := make([]string, len(items))
+	for i, item := range items {
+		values[i] = fmt.Sprint(item)
+	}
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(values); err != nil {
+			return err
+		}
+		flag.Changed = true
+		return nil
+	}
+	return flags.Set(flag.Name, strings.Join(values, ","))
+}
+
+// applyConfig fills in the flags cmd was run with that were not set on the
+// command line, first from their INSTAGRAM_RECENTS_* environment variable
+// and then from the config file, keyed by flag name:
+//
+//	output-dir: ./public/instagram
+//	sizes: "1600:xl,1024:large"
+//	webp-quality: 80
+//	retry-status-codes: [429, 503]
+//
+// Keys that are not a flag of any command are warned about, so one file can
+// hold settings for every subcommand.
+func applyConfig(cmd *cobra.Command) error {
+	var values map[string]any
+	if path := findConfigFile(); path != "" {
+		var err error
+		if values, err = readConfigFile(path); err != nil {
+			return err
+		}
+		slog.Debug("loaded config file", "path", path)
+	}
+
+	known := allFlagNames(cmd.Root())
+	for key := range values {
+		if !known[key] {
+			slog.Warn("unknown key in config file", "key", key)
+		}
+	}
+
+	flags := cmd.Flags()
+	var errs []error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed || flag.Name == "config" {
+			return
+		}
+		if env, ok := os.LookupEnv(flagEnvName(flag.Name)); ok {
+			if err := flags.Set(flag.Name, env); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", flagEnvName(flag.Name), err))
+			}
+			return
+		}
+		if value, ok := values[flag.Name]; ok {
+			if err := setFlagValue(flags, flag, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s in config file: %w", flag.Name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// configFlags are the resolved flags of a command run under configRoot
+type configFlags struct {
+	outputDir   string
+	sizes       string
+	quality     int
+	concurrency string
+	retryCodes  []int
+	inputDir    string
+}
+
+// runWithConfig runs a subcommand of a root set up like rootCmd, loading
+// config file path, and returns the flags it resolved
+func runWithConfig(t *testing.T, path string, args ...string) (configFlags, error) {
+	t.Helper()
+	saved := configFile
+	t.Cleanup(func() { configFile = saved })
+
+	var flags configFlags
+	root := &cobra.Command{
+		Use:               "root",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return applyConfig(cmd) },
+		SilenceUsage:      true,
+		SilenceErrors:     true,
+	}
+	root.PersistentFlags().StringVar(&configFile, "config", "", "")
+	root.PersistentFlags().StringVar(&flags.outputDir, "output-dir", "./output", "")
+	root.PersistentFlags().StringVar(&flags.sizes, "sizes", "1024:large", "")
+	root.PersistentFlags().IntVar(&flags.quality, "webp-quality", 80, "")
+	root.PersistentFlags().StringVar(&flags.concurrency, "concurrency", "4", "")
+	root.PersistentFlags().IntSliceVar(&flags.retryCodes, "retry-status-codes", []int{429, 500}, "")
+	sub := &cobra.Command{Use: "convert", Run: func(cmd *cobra.Command, args []string) {}}
+	sub.Flags().StringVar(&flags.inputDir, "input-dir", "", "")
+	root.AddCommand(sub)
+
+	root.SetArgs(append([]string{"convert", "--config", path}, args...))
+	err := root.Execute()
+	return flags, err
+}
+
+func TestConfigFilePropagatesToFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	config := `output-dir: ./public/instagram
+sizes: "1600:xl,800:medium"
+webp-quality: 60
+concurrency: 2
+retry-status-codes: [429, 503]
+input-dir: ./photos
+not-a-flag: true
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("from the file", func(t *testing.T) {
+		flags, err := runWithConfig(t, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := configFlags{"./public/instagram", "1600:xl,800:medium", 60, "2", []int{429, 503}, "./photos"}
+		if flags.outputDir != want.outputDir || flags.sizes != want.sizes || flags.quality != want.quality ||
+			flags.concurrency != want.concurrency || !slices.Equal(flags.retryCodes, want.retryCodes) || flags.inputDir != want.inputDir {
+			t.Errorf("resolved %+v, want %+v", flags, want)
+		}
+	})
+
+	t.Run("flags and env override the file", func(t *testing.T) {
+		t.Setenv(flagEnvName("concurrency"), "7")
+		flags, err := runWithConfig(t, path, "--webp-quality", "95", "--output-dir", "./site")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags.quality != 95 || flags.outputDir != "./site" {
+			t.Errorf("command line gave quality %d and output %q, want 95 and ./site", flags.quality, flags.outputDir)
+		}
+		if flags.concurrency != "7" {
+			t.Errorf("concurrency = %q, want 7 from %s", flags.concurrency, flagEnvName("concurrency"))
+		}
+		if flags.sizes != "1600:xl,800:medium" {
+			t.Errorf("sizes = %q, want the file's value", flags.sizes)
+		}
+	})
+
+	t.Run("missing file keeps the defaults", func(t *testing.T) {
+		flags, err := runWithConfig(t, filepath.Join(dir, "missing.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags.outputDir != "./output" || flags.quality != 80 || !slices.Equal(flags.retryCodes, []int{429, 500}) {
+			t.Errorf("resolved %+v, want the defaults", flags)
+		}
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		bad := filepath.Join(dir, "bad.yaml")
+		if err := os.WriteFile(bad, []byte("webp-quality: high\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runWithConfig(t, bad); err == nil {
+			t.Error("got no error for a non-numeric webp-quality")
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+	"github.com/spf13/cobra"
+)
+
+var convertInput string
+
+// convertCmd represents the convert command
+var convertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Convert local images without Instagram",
+	Long: `Convert the images in a local directory, or matching a glob, into the same
+sizes and converted_media.json manifest the Instagram commands produce. Files
+that are not images are skipped with a warning.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if convertInput == "" {
+			slog.Error("no input specified, use the --input-dir flag to provide a directory or glob")
+			os.Exit(1)
+		}
+
+		localMedia, err := lib.LocalMedia(convertInput)
+		if err != nil {
+			slog.Error("error listing local images", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("found local images", "count", len(localMedia))
+
+		if localMedia, err = selectMedia(localMedia); err != nil {
+			slog.Error("error selecting media", "error", err)
+			os.Exit(1)
+		}
+
+		slog.Info("converting local images")
+		runPipeline(cmd, localMedia)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(convertCmd)
+
+	addSelectionFlags(convertCmd)
+	convertCmd.Flags().StringVar(&convertInput, "input-dir", "", "Directory of images, or a glob such as \"photos/*.jpg\", to convert")
+	convertCmd.Flags().BoolVar(&dryRun, "dry-run", false, "List what would be converted and written without doing it")
+}
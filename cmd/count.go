@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+	"github.com/spf13/cobra"
+)
+
+// printCounts prints a label followed by each key's count in sorted order
+func printCounts(w io.Writer, label string, counts map[string]int) {
+	fmt.Fprintln(w, label)
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %-16s %d\n", key, counts[key])
+	}
+}
+
+// countCmd represents the count command
+var countCmd = &cobra.Command{
+	Use:   "count",
+	Short: "Count media by type without downloading anything",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		// Reject bad selection flags before anything is fetched
+		_, err := selectMedia(nil)
+		return err
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		// Counting stores no token and leaves none for a pipeline
+		recentMedia, _, _, err := fetchRecentMedia(lib.FetchState{})
+		if err != nil {
+			slog.Error("error fetching media", "error", err)
+			os.Exit(1)
+		}
+		if recentMedia, err = selectMedia(recentMedia); err != nil {
+			slog.Error("error selecting media", "error", err)
+			os.Exit(1)
+		}
+
+		byType := make(map[string]int)
+		byProductType := make(map[string]int)
+		for _, media := range recentMedia {
+			byType[media.MediaType]++
+			productType := media.MediaProductType
+			if productType == "" {
+				productType = "UNKNOWN"
+			}
+			byProductType[productType]++
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Total media: %d\n", len(recentMedia))
+		printCounts(out, "By media type:", byType)
+		printCounts(out, "By product type:", byProductType)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(countCmd)
+	addSelectionFlags(countCmd)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+func TestCountAppliesSelectionWithoutSideEffects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(lib.MediaResponse{Data: []lib.Media{
+			{ID: "3", MediaType: "VIDEO", MediaProductType: "REELS", Timestamp: "2024-01-03T00:00:00+0000"},
+			{ID: "2", MediaType: "IMAGE", MediaProductType: "FEED", Timestamp: "2024-01-02T00:00:00+0000"},
+			{ID: "1", MediaType: "IMAGE", MediaProductType: "FEED", Timestamp: "2024-01-01T00:00:00+0000"},
+		}})
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+
+	t.Setenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN", "token")
+	previous := tokenFile
+	tokenFile = filepath.Join(t.TempDir(), "token.json")
+	userIDOverride, storeToken, pipelineToken, mediaLimit = "17841400000000001", true, "", 2
+	t.Cleanup(func() { tokenFile, userIDOverride, storeToken, pipelineToken, mediaLimit = previous, "", false, "", 0 })
+
+	var out bytes.Buffer
+	countCmd.SetOut(&out)
+	t.Cleanup(func() { countCmd.SetOut(nil) })
+	if err := countCmd.PreRunE(countCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	countCmd.Run(countCmd, nil)
+
+	// Only the two most recent are counted
+	counts := make(map[string]string)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			counts[fields[0]] = fields[1]
+		}
+	}
+	if !strings.HasPrefix(out.String(), "Total media: 2\n") || counts["IMAGE"] != "1" || counts["FEED"] != "1" {
+		t.Errorf("counts ignore --limit 2:\n%s", out.String())
+	}
+	if pipelineToken != "" {
+		t.Errorf("count left token %q for a pipeline", pipelineToken)
+	}
+	if _, err := os.Stat(tokenFile); err == nil {
+		t.Error("count stored the token")
+	}
+}
@@ -1,8 +1,7 @@
 package cmd
 
 import (
-	"encoding/json"
-	"fmt"
+	"log/slog"
 	"os"
 
 	"github.com/agoodkind/instagram-recents-go/lib"
@@ -12,33 +11,40 @@ import (
 // fetchMediaCmd represents the fetch-media command
 var fetchMediaCmd = &cobra.Command{
 	Use:   "fetch-media",
-	Short: "Fetch and transform media from a JSON file",
+	Short: "Fetch and transform media from one or more JSON files",
 	Run: func(cmd *cobra.Command, args []string) {
+		// Keep the stored token fresh; it is also used to refresh expired media URLs
+		pipelineToken = storedOrEnvToken()
+
 		var recentMedia []lib.Media
 
-		if jsonFile != "" {
-			// Read from JSON file
-			jsonData, err := os.ReadFile(jsonFile)
+		if len(jsonFiles) > 0 {
+			// Read and merge the JSON files
+			var err error
+			recentMedia, err = lib.LoadMediaFiles(jsonFiles)
 			if err != nil {
-				fmt.Printf("Error reading JSON file %s: %v\n", jsonFile, err)
+				slog.Error("error loading media", "error", err)
 				os.Exit(1)
 			}
+			slog.Info("loaded media items", "count", len(recentMedia))
 
-			if err := json.Unmarshal(jsonData, &recentMedia); err != nil {
-				fmt.Printf("Error parsing JSON from file %s: %v\n", jsonFile, err)
+			if recentMedia, err = selectMedia(recentMedia); err != nil {
+				slog.Error("error selecting media", "error", err)
 				os.Exit(1)
 			}
-			fmt.Printf("Successfully loaded media data from %s\n", jsonFile)
 		} else {
-			fmt.Println("No JSON file specified. Please use --json-file flag to provide a JSON file path.")
+			slog.Error("no JSON file specified, use the --json-file flag to provide a JSON file path")
 			os.Exit(1)
 		}
 
-		fmt.Println("Fetching and transforming media...")
-		lib.FetchAndTransformImages(recentMedia, mediaDir, outputDir)
+		slog.Info("fetching and transforming media")
+		runPipeline(cmd, recentMedia)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(fetchMediaCmd)
+
+	addSelectionFlags(fetchMediaCmd)
+	fetchMediaCmd.Flags().BoolVar(&dryRun, "dry-run", false, "List what would be downloaded and written without doing it")
 } 
\ No newline at end of file
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print a JSON Schema describing the manifest written with --schema",
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := lib.ManifestJSONSchema(schema)
+		if err != nil {
+			slog.Error("failed to generate JSON schema", "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
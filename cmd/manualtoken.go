@@ -2,9 +2,13 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/agoodkind/instagram-recents-go/lib"
 
@@ -12,26 +16,87 @@ import (
 )
 
 var fetchMedia bool
+var resumeFetch bool
+var userIDOverride string
+var storeToken bool
 
 
-// runManualTokenProcess executes the manual token process directly
-func runManualTokenProcess(outputDir string) ([]lib.Media, error) {
-	// Get env variable INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN
-	accessToken := os.Getenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN")
+// fetchRecentMedia fetches recent media using the stored token, falling back
+// to the development access token, and only fetches media newer than the
+// recorded state when it belongs to the same user. It returns the user ID and
+// token used without recording either, so read-only commands can use it.
+func fetchRecentMedia(state lib.FetchState) (media []lib.Media, userId, accessToken string, err error) {
+	// Prefer the stored long-lived token, refreshed if close to expiry
+	accessToken = storedOrEnvToken()
 	if accessToken == "" {
-		return nil, fmt.Errorf("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN is not set")
+		return nil, "", "", fmt.Errorf("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN is not set and no token is stored in %s", tokenFile)
+	}
+
+	// A known user ID saves the /me round trip
+	userId = userIDOverride
+	if userId == "" {
+		if userId, err = lib.GetUserIdFromToken(accessToken); err != nil {
+			return nil, "", "", fmt.Errorf("error getting user ID from token: %w", err)
+		}
+	}
+
+	since := lib.FetchState{}
+	if state.UserID == userId {
+		since = state
+	}
+
+	if media, err = lib.FetchRecentMediaSince(userId, accessToken, since, 0); err != nil {
+		return nil, "", "", fmt.Errorf("error fetching recent media: %w", err)
 	}
+	return media, userId, accessToken, nil
+}
 
-	userId, err := lib.GetUserIdFromToken(accessToken)
+// fetchRecentMediaWithEnvToken fetches recent media as fetchRecentMedia does,
+// then records it in state, keeps the token when --store-token is set and
+// hands the token to the pipeline
+func fetchRecentMediaWithEnvToken(state *lib.FetchState) ([]lib.Media, error) {
+	recentMedia, userId, accessToken, err := fetchRecentMedia(*state)
 	if err != nil {
-		return nil, fmt.Errorf("error getting user ID from token: %w", err)
+		return nil, err
+	}
+
+	state.Record(userId, recentMedia)
+	if storeToken {
+		seedStoredToken(accessToken, userId)
 	}
+	pipelineToken = accessToken
+	return recentMedia, nil
+}
 
-	recentMedia, err := lib.FetchRecentMedia(userId, accessToken)
+// runManualTokenProcess executes the manual token process directly
+func runManualTokenProcess(outputDir string) ([]lib.Media, error) {
+	statePath := filepath.Join(outputDir, lib.FetchStateFileName)
+	state := &lib.FetchState{}
+	if resumeFetch {
+		var err error
+		if state, err = lib.LoadFetchState(statePath); err != nil {
+			return nil, err
+		}
+	}
+
+	recentMedia, err := fetchRecentMediaWithEnvToken(state)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching recent media: %w", err)
+		return nil, err
+	}
+
+	if resumeFetch {
+		// A resumed fetch only returns media published since the last one,
+		// so keep what earlier runs already wrote, newest first
+		existing, err := lib.LoadMediaFile(filepath.Join(outputDir, "recent_media.json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		recentMedia = mergeMedia(recentMedia, existing)
 	}
 
+	// recent_media.json and the fetch state always cover everything fetched;
+	// --since, --until and --limit only narrow what is processed, so a
+	// resumed run never loses media an earlier selection left out
 	recentMediaJSON, err := json.Marshal(recentMedia)
 	if err != nil {
 		return nil, fmt.Errorf("error marshalling recent media: %w", err)
@@ -43,29 +108,62 @@ func runManualTokenProcess(outputDir string) ([]lib.Media, error) {
 	}
 
 	// Write JSON to file
-	if err := os.WriteFile(filepath.Join(outputDir, "recent_media.json"), recentMediaJSON, 0644); err != nil {
+	if err := lib.WriteFileAtomic(filepath.Join(outputDir, "recent_media.json"), recentMediaJSON, 0644); err != nil {
 		return nil, fmt.Errorf("error writing to file %s: %w", outputDir, err)
 	}
 
-	fmt.Printf("Successfully wrote recent media data to %s\n", filepath.Join(outputDir, "recent_media.json"))
+	slog.Info("wrote recent media data", "path", filepath.Join(outputDir, "recent_media.json"))
+
+	if err := state.Save(statePath); err != nil {
+		return nil, err
+	}
 	return recentMedia, nil
 }
 
+// mergeMedia appends existing media to freshly fetched media, skipping IDs
+// already fetched
+func mergeMedia(fetched, existing []lib.Media) []lib.Media {
+	seen := make(map[string]bool, len(fetched))
+	for _, item := range fetched {
+		seen[item.ID] = true
+	}
+	for _, item := range existing {
+		if !seen[item.ID] {
+			seen[item.ID] = true
+			fetched = append(fetched, item)
+		}
+	}
+	return fetched
+}
+
 
 // manualTokenCmd represents the manual-token command
 var manualTokenCmd = &cobra.Command{
 	Use:   "manual-token",
 	Short: "Run the manual token process directly",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := strconv.ParseUint(userIDOverride, 10, 64); userIDOverride != "" && err != nil {
+			return fmt.Errorf("invalid --user-id %q: must be a numeric Instagram user ID", userIDOverride)
+		}
+		// Reject bad selection flags before anything is fetched
+		_, err := selectMedia(nil)
+		return err
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Running manual token process...")
+		slog.Info("running manual token process")
 		recentMedia, err := runManualTokenProcess(outputDir)
 		if err != nil {
-			fmt.Println("Error running manual token process:", err)
+			slog.Error("error running manual token process", "error", err)
 			os.Exit(1)
 		}
-		if fetchMedia {
-			fmt.Println("Fetching and transforming media...")
-			lib.FetchAndTransformImages(recentMedia, mediaDir, outputDir)
+		if fetchMedia || dryRun {
+			selected, err := selectMedia(recentMedia)
+			if err != nil {
+				slog.Error("error selecting media", "error", err)
+				os.Exit(1)
+			}
+			slog.Info("fetching and transforming media")
+			runPipeline(cmd, selected)
 		}
 	},
 }
@@ -75,4 +173,9 @@ func init() {
 	
 	// Add local flags for this command
 	manualTokenCmd.Flags().BoolVar(&fetchMedia, "fetch-media", false, "Fetch and transform media after getting token")
+	addSelectionFlags(manualTokenCmd)
+	manualTokenCmd.Flags().BoolVar(&dryRun, "dry-run", false, "List what would be downloaded and written without doing it (only recent_media.json is written)")
+	manualTokenCmd.Flags().BoolVar(&resumeFetch, "resume", false, "Only fetch media newer than recorded in fetch_state.json, keeping what earlier runs wrote")
+	manualTokenCmd.Flags().StringVar(&userIDOverride, "user-id", "", "Numeric Instagram user ID to fetch for, skipping the /me lookup")
+	manualTokenCmd.Flags().BoolVar(&storeToken, "store-token", false, "Keep the token used in --token-file, when none is stored yet, so later runs refresh it before it expires")
 } 
\ No newline at end of file
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+func TestUserIDSkipsTheMeLookup(t *testing.T) {
+	var meCalls atomic.Int32
+	var listedUser atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/me" {
+			meCalls.Add(1)
+			w.Write([]byte(`{"id":"17841400000000001"}`))
+			return
+		}
+		user, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/media")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		listedUser.Store(user)
+		json.NewEncoder(w).Encode(lib.MediaResponse{Data: []lib.Media{
+			{ID: "1", MediaType: "IMAGE", Timestamp: "2024-01-01T00:00:00+0000"},
+		}})
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+
+	t.Setenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN", "token")
+	previous := tokenFile
+	t.Cleanup(func() { tokenFile, userIDOverride = previous, "" })
+
+	tests := []struct {
+		override    string
+		wantMeCalls int32
+		wantUser    string
+	}{
+		{"17841400000000002", 0, "17841400000000002"},
+		{"", 1, "17841400000000001"},
+	}
+	for _, tt := range tests {
+		meCalls.Store(0)
+		userIDOverride = tt.override
+		tokenFile = filepath.Join(t.TempDir(), "token.json")
+
+		media, err := runManualTokenProcess(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(media) != 1 {
+			t.Errorf("--user-id %q: fetched %d items, want 1", tt.override, len(media))
+		}
+		if meCalls.Load() != tt.wantMeCalls {
+			t.Errorf("--user-id %q: /me was called %d times, want %d", tt.override, meCalls.Load(), tt.wantMeCalls)
+		}
+		if user := listedUser.Load(); user != tt.wantUser {
+			t.Errorf("--user-id %q: listed media of %v, want %s", tt.override, user, tt.wantUser)
+		}
+	}
+}
+
+func TestUserIDMustBeNumeric(t *testing.T) {
+	t.Cleanup(func() { userIDOverride = "" })
+	for _, id := range []string{"me", "-5", "12ab", "1.5"} {
+		userIDOverride = id
+		if err := manualTokenCmd.PreRunE(manualTokenCmd, nil); err == nil {
+			t.Errorf("--user-id %q was accepted", id)
+		}
+	}
+	userIDOverride = "17841400000000002"
+	if err := manualTokenCmd.PreRunE(manualTokenCmd, nil); err != nil {
+		t.Errorf("numeric --user-id rejected: %v", err)
+	}
+}
+
+func TestResumeWithLimitKeepsEveryFetchedItem(t *testing.T) {
+	var feed atomic.Value
+	feed.Store([]lib.Media{
+		{ID: "3", MediaType: "IMAGE", Timestamp: "2024-01-03T00:00:00+0000"},
+		{ID: "2", MediaType: "IMAGE", Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "1", MediaType: "IMAGE", Timestamp: "2024-01-01T00:00:00+0000"},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(lib.MediaResponse{Data: feed.Load().([]lib.Media)})
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+
+	t.Setenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN", "token")
+	previous := tokenFile
+	tokenFile = filepath.Join(t.TempDir(), "token.json")
+	userIDOverride, resumeFetch, mediaLimit = "17841400000000001", true, 1
+	t.Cleanup(func() { tokenFile, userIDOverride, resumeFetch, mediaLimit = previous, "", false, 0 })
+
+	outputDir := t.TempDir()
+	written := func() []string {
+		t.Helper()
+		media, err := lib.LoadMediaFile(filepath.Join(outputDir, "recent_media.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, item := range media {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	if _, err := runManualTokenProcess(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := written(), []string{"3", "2", "1"}; !slices.Equal(got, want) {
+		t.Fatalf("recent_media.json holds %v, want every fetched item %v despite --limit 1", got, want)
+	}
+
+	// The next resume adds the new post to what was already written
+	feed.Store(append([]lib.Media{{ID: "4", MediaType: "IMAGE", Timestamp: "2024-01-04T00:00:00+0000"}}, feed.Load().([]lib.Media)...))
+	if _, err := runManualTokenProcess(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := written(), []string{"4", "3", "2", "1"}; !slices.Equal(got, want) {
+		t.Errorf("after resuming recent_media.json holds %v, want %v", got, want)
+	}
+}
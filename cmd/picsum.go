@@ -1,11 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/agoodkind/instagram-recents-go/lib"
@@ -13,6 +18,20 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	picsumCacheDir string
+	picsumNoCache  bool
+	picsumSpan     string
+	picsumSeed     uint64
+)
+
+// instagramTimeLayout is the timestamp layout the Graph API returns
+const instagramTimeLayout = "2006-01-02T15:04:05-0700"
+
+// picsumSeedEpoch is when seeded fake timestamps end, so a seed gives the
+// same data whenever it is run
+var picsumSeedEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
 type PicsumPhoto struct {
 	ID          string `json:"id"`
 	Author      string `json:"author"`
@@ -22,11 +41,23 @@ type PicsumPhoto struct {
 	DownloadURL string `json:"download_url"`
 }
 
-// fetchPicsumPhotos fetches images from the Picsum Photos API
-func fetchPicsumPhotos(limit int) ([]PicsumPhoto, error) {
+// fetchPicsumPhotos fetches images from the Picsum Photos API, reusing the
+// list cached in cacheDir by an earlier run when cacheDir is set
+func fetchPicsumPhotos(limit int, cacheDir string) ([]PicsumPhoto, error) {
 	url := fmt.Sprintf("https://picsum.photos/v2/list?limit=%d", limit)
 	
-	resp, err := http.Get(url)
+	var cachePath string
+	if cacheDir != "" {
+		cachePath = filepath.Join(cacheDir, fmt.Sprintf("list-%d.json", limit))
+		if data, err := os.ReadFile(cachePath); err == nil {
+			var photos []PicsumPhoto
+			if err := json.Unmarshal(data, &photos); err == nil {
+				return photos, nil
+			}
+		}
+	}
+	
+	resp, err := lib.HTTPGet(context.Background(), url)
 	if err != nil {
 		return nil, fmt.Errorf("HTTP request failed: %w", err)
 	}
@@ -41,18 +72,28 @@ func fetchPicsumPhotos(limit int) ([]PicsumPhoto, error) {
 		return nil, fmt.Errorf("failed to decode JSON: %w", err)
 	}
 	
+	if cachePath != "" {
+		if data, err := json.Marshal(photos); err == nil {
+			lib.WriteFileAtomic(cachePath, data, 0644)
+		}
+	}
+	
 	return photos, nil
 }
 
-// convertPicsumToMedia converts Picsum Photos to Media format
-func convertPicsumToMedia(photos []PicsumPhoto) []lib.Media {
+// convertPicsumToMedia converts Picsum Photos to Media format, spreading the
+// timestamps pseudo-randomly over span before end. The same seed always
+// gives the same offsets.
+func convertPicsumToMedia(photos []PicsumPhoto, span time.Duration, seed uint64, end time.Time) []lib.Media {
 	var media []lib.Media
+	rng := rand.New(rand.NewPCG(seed, seed))
+	end = end.UTC()
 	
 	for _, photo := range photos {
-		// Create a timestamp for the current time minus a random offset
-		// This simulates having photos from different times
-		randomOffset := time.Duration(len(media) * 24) * time.Hour
-		timestamp := time.Now().Add(-randomOffset).Format(time.RFC3339)
+		// Unordered offsets simulate photos from different times and
+		// exercise the sort
+		randomOffset := time.Duration(rng.Int64N(int64(span)))
+		timestamp := end.Add(-randomOffset).Format(instagramTimeLayout)
 		
 		media = append(media, lib.Media{
 			ID:        photo.ID,
@@ -72,42 +113,105 @@ var picsumCmd = &cobra.Command{
 	Use:   "picsum",
 	Short: "Use Picsum Photos API for test images instead of Instagram",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Fetching images from Picsum Photos API...")
+		slog.Info("fetching images from Picsum Photos API")
 		// Limit the number of images to fetch (max 100)
 		limit := min(picsumLimit, 100)
 		
-		picsumPhotos, err := fetchPicsumPhotos(limit)
+		// Cache the list and the images so repeated runs work offline
+		cacheDir, err := resolvePicsumCacheDir()
 		if err != nil {
-			fmt.Printf("Error fetching images from Picsum Photos API: %v\n", err)
+			slog.Error("error setting up the Picsum cache", "error", err)
+			os.Exit(1)
+		}
+		if err := lib.SetDownloadCacheDir(cacheDir); err != nil {
+			slog.Error("error setting up the Picsum cache", "error", err)
 			os.Exit(1)
 		}
 		
+		picsumPhotos, err := fetchPicsumPhotos(limit, cacheDir)
+		if err != nil {
+			slog.Error("error fetching images from Picsum Photos API", "error", err)
+			os.Exit(1)
+		}
+		
+		span, err := parseSpan(picsumSpan)
+		if err != nil {
+			slog.Error("invalid --picsum-span", "error", err)
+			os.Exit(1)
+		}
+		seed, end := picsumSeed, picsumSeedEpoch
+		if !cmd.Flags().Changed("seed") {
+			seed, end = uint64(time.Now().UnixNano()), time.Now()
+		}
+		
 		// Convert Picsum Photos to Media format
-		media := convertPicsumToMedia(picsumPhotos)
+		media := convertPicsumToMedia(picsumPhotos, span, seed, end)
 		
 		// Create output directory if it doesn't exist
 		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			fmt.Printf("Error creating output directory %s: %v\n", outputDir, err)
+			slog.Error("error creating output directory", "path", outputDir, "error", err)
 			os.Exit(1)
 		}
 		
 		// Write JSON to file for reference
 		mediaJSON, err := json.MarshalIndent(media, "", "  ")
 		if err != nil {
-			fmt.Printf("Error marshalling media data: %v\n", err)
+			slog.Error("error marshalling media data", "error", err)
 			os.Exit(1)
 		}
 		
-		if err := os.WriteFile(filepath.Join(outputDir, "picsum_media.json"), mediaJSON, 0644); err != nil {
-			fmt.Printf("Error writing to file %s: %v\n", filepath.Join(outputDir, "picsum_media.json"), err)
+		if err := lib.WriteFileAtomic(filepath.Join(outputDir, "picsum_media.json"), mediaJSON, 0644); err != nil {
+			slog.Error("error writing file", "path", filepath.Join(outputDir, "picsum_media.json"), "error", err)
 			os.Exit(1)
 		}
 		
-		fmt.Println("Fetching and transforming Picsum Photos images...")
-		lib.FetchAndTransformImages(media, mediaDir, outputDir)
+		slog.Info("fetching and transforming Picsum Photos images")
+		runPipeline(cmd, media)
 	},
 }
 
+// parseSpan parses a positive duration, also accepting whole days such as "90d"
+func parseSpan(value string) (time.Duration, error) {
+	var span time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number of days", value)
+		}
+		span = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if span, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+	if span <= 0 {
+		return 0, fmt.Errorf("span must be positive, got %s", value)
+	}
+	return span, nil
+}
+
+// resolvePicsumCacheDir returns the Picsum cache directory, defaulting to
+// one under the user cache dir, or "" when --no-cache is set
+func resolvePicsumCacheDir() (string, error) {
+	if picsumNoCache {
+		return "", nil
+	}
+	if picsumCacheDir != "" {
+		return picsumCacheDir, nil
+	}
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no user cache dir, pass --cache-dir: %w", err)
+	}
+	return filepath.Join(userCache, "instagram-recents-go", "picsum"), nil
+}
+
 func init() {
 	rootCmd.AddCommand(picsumCmd)
+
+	picsumCmd.Flags().StringVar(&picsumCacheDir, "cache-dir", "", "Directory Picsum downloads are cached in (defaults to a directory under the user cache dir)")
+	picsumCmd.Flags().BoolVar(&picsumNoCache, "no-cache", false, "Ignore the Picsum cache and fetch everything again")
+	picsumCmd.Flags().StringVar(&picsumSpan, "picsum-span", "90d", "Spread fake timestamps over this long before now, or before 2024-01-01 with --seed (e.g. 90d or 36h)")
+	picsumCmd.Flags().Uint64Var(&picsumSeed, "seed", 0, "Seed for the fake timestamps, which then end at 2024-01-01 for reproducible data (random when unset)")
 } 
\ No newline at end of file
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+func TestConvertPicsumToMediaIsReproducible(t *testing.T) {
+	photos := []PicsumPhoto{{ID: "0"}, {ID: "1"}, {ID: "2"}, {ID: "3"}}
+	span := 90 * 24 * time.Hour
+
+	first := convertPicsumToMedia(photos, span, 42, picsumSeedEpoch)
+	second := convertPicsumToMedia(photos, span, 42, picsumSeedEpoch)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("the same seed gave different media:\n%v\n%v", first, second)
+	}
+
+	for _, item := range first {
+		timestamp, err := time.Parse(instagramTimeLayout, item.Timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timestamp.After(picsumSeedEpoch) || timestamp.Before(picsumSeedEpoch.Add(-span)) {
+			t.Errorf("timestamp %s is outside the span before %s", item.Timestamp, picsumSeedEpoch)
+		}
+	}
+
+	if other := convertPicsumToMedia(photos, span, 43, picsumSeedEpoch); reflect.DeepEqual(first, other) {
+		t.Error("different seeds gave the same timestamps")
+	}
+}
+
+func TestPicsumCacheSkipsTheNetwork(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 32, 32))); err != nil {
+		t.Fatal(err)
+	}
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/v2/list" {
+			json.NewEncoder(w).Encode([]PicsumPhoto{
+				{ID: "0", URL: "https://unsplash.com/photos/a", DownloadURL: "https://picsum.photos/id/0/64/64"},
+				{ID: "1", URL: "https://unsplash.com/photos/b", DownloadURL: "https://picsum.photos/id/1/64/64"},
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+	t.Cleanup(func() { lib.SetDownloadCacheDir("") })
+
+	cacheDir := t.TempDir()
+	fetch := func(cacheDir string) int32 {
+		t.Helper()
+		hits.Store(0)
+		if err := lib.SetDownloadCacheDir(cacheDir); err != nil {
+			t.Fatal(err)
+		}
+		photos, err := fetchPicsumPhotos(2, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		media := convertPicsumToMedia(photos, time.Hour, 1, picsumSeedEpoch)
+		output := t.TempDir()
+		entries, err := lib.FetchAndTransformImagesResult(context.Background(), media, filepath.Join(output, "media"), output, lib.ProcessOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("converted %d photos, want 2", len(entries))
+		}
+		return hits.Load()
+	}
+
+	if got := fetch(cacheDir); got != 3 {
+		t.Errorf("first run made %d requests, want the list and two images", got)
+	}
+	if got := fetch(cacheDir); got != 0 {
+		t.Errorf("cached run made %d requests, want none", got)
+	}
+	if got := fetch(""); got != 3 {
+		t.Errorf("run without the cache made %d requests, want 3", got)
+	}
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// progressBarWidth is the number of cells in the rendered bar
+const progressBarWidth = 30
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgressFunc returns a lib.ProcessOptions.Progress callback. On a
+// terminal it redraws a single bar line in place; otherwise it logs a plain
+// line per finished item.
+func newProgressFunc(out *os.File) func(done, total int, currentID string) {
+	if !isTerminal(out) {
+		return func(done, total int, currentID string) {
+			slog.Info("progress", "done", done, "total", total, "media_id", currentID)
+		}
+	}
+
+	return func(done, total int, currentID string) {
+		filled := progressBarWidth * done / max(total, 1)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+		// \r returns to the start of the line and \033[K clears what was there
+		fmt.Fprintf(out, "\r\033[K[%s] %d/%d %s", bar, done, total, currentID)
+		if done == total {
+			fmt.Fprintln(out)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	refreshTokenValue string
+	saveRefreshed     bool
+)
+
+// refreshAccessToken refreshes token, prints the new token and its expiry
+// to out and, when save is set, writes it to the token file
+func refreshAccessToken(token string, save bool, out io.Writer) error {
+	if token == "" {
+		return errors.New("no token given, pass --token or set INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN")
+	}
+
+	refreshed, err := lib.RefreshToken(token)
+	if errors.Is(err, lib.ErrInvalidToken) {
+		return fmt.Errorf("the token is invalid or has expired and can no longer be refreshed, get a new one with manual-token: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("error refreshing token: %w", err)
+	}
+	if refreshed.AccessToken == "" {
+		return errors.New("error refreshing token: the API returned no access token")
+	}
+
+	fmt.Fprintf(out, "Access token: %s\n", refreshed.AccessToken)
+	fmt.Fprintf(out, "Expires in: %d seconds\n", refreshed.ExpiresIn)
+
+	if save {
+		store := lib.TokenStore{Path: tokenFile}
+		if stored, err := store.Load(); err == nil && stored != nil && refreshed.UserID == "" {
+			refreshed.UserID = stored.UserID
+		}
+		if err := store.Save(refreshed); err != nil {
+			return fmt.Errorf("error saving token: %w", err)
+		}
+		slog.Info("saved token", "path", tokenFile)
+	}
+	return nil
+}
+
+// refreshTokenCmd represents the refresh-token command
+var refreshTokenCmd = &cobra.Command{
+	Use:   "refresh-token",
+	Short: "Refresh a long-lived access token before it expires",
+	Run: func(cmd *cobra.Command, args []string) {
+		token := refreshTokenValue
+		if token == "" {
+			token = os.Getenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN")
+		}
+		if err := refreshAccessToken(token, saveRefreshed, os.Stdout); err != nil {
+			slog.Error("refresh-token failed", "error", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(refreshTokenCmd)
+
+	refreshTokenCmd.Flags().StringVar(&refreshTokenValue, "token", "", "Token to refresh (defaults to INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN)")
+	refreshTokenCmd.Flags().BoolVar(&saveRefreshed, "save", false, "Write the refreshed token to --token-file")
+}
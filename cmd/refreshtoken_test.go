@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+// rewriteTransport sends every request to the test server instead
+type rewriteTransport struct{ target *url.URL }
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/refresh_access_token" || r.URL.Query().Get("grant_type") != "ig_refresh_token" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("access_token") != "good-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Error validating access token: Session has expired","type":"OAuthException","code":190}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(lib.TokenResponse{AccessToken: "fresh-token", ExpiresIn: 5184000})
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+
+	previous := tokenFile
+	tokenFile = filepath.Join(t.TempDir(), "token.json")
+	t.Cleanup(func() { tokenFile = previous })
+	if err := (lib.TokenStore{Path: tokenFile}).Save(&lib.TokenResponse{AccessToken: "good-token", UserID: "42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := refreshAccessToken("good-token", true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Access token: fresh-token\nExpires in: 5184000 seconds\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+	saved, err := lib.TokenStore{Path: tokenFile}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "fresh-token" || saved.UserID != "42" {
+		t.Errorf("saved %+v, want fresh-token kept for user 42", saved)
+	}
+
+	err = refreshAccessToken("expired-token", false, &out)
+	if err == nil || !strings.Contains(err.Error(), "Session has expired") {
+		t.Errorf("rejected token: got %v, want the API's message", err)
+	}
+	if err := refreshAccessToken("", false, &out); err == nil || !strings.Contains(err.Error(), "--token") {
+		t.Errorf("empty token: got %v, want a hint about --token", err)
+	}
+}
@@ -1,43 +1,494 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"image/color"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/agoodkind/instagram-recents-go/lib"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/spf13/cobra"
 )
 
 var (
 	// Common flags
-	outputDir string
-	mediaDir  string
-	jsonFile  string
+	outputDir   string
+	mediaDir    string
+	jsonFiles   []string
 	picsumLimit int
+	tempDir     string
+	concurrency string
+	sizeWorkers int
+
+	// Output flags
+	emitRSS       string
+	feedFormat    string
+	verifyEncode  bool
+	checksum      bool
+	aspectRatio   bool
+	background    string
+	failOnEmpty   bool
+	failOnError   bool
+	waitForLock   bool
+	thumbFormat   string
+	resizeFilter  string
+	shardDepth    int
+	targetSizeKB  int
+	sourceURL     bool
+	maxPixels     int
+	summaryJSON   string
+	passthrough   bool
+	videoPosters  bool
+	videoPreview  string
+	previewFrames int
+	webpQuality   int
+	webpPreset    string
+	webpHint      string
+	outputFormat  string
+	manifestFmt   string
+	schema        string
+	sizes         string
+	incremental   bool
+	overwrite     bool
+	dryRun        bool
+	baseURL       string
+	contentHash   bool
+	placeholder   string
+	keepOriginals bool
+	allowUpscale  bool
+	sprite        bool
+	stripMeta     bool
+
+	// Logging flags
+	logLevel  string
+	logFormat string
+
+	// manifestStdout sends the manifest to stdout and everything else to stderr
+	manifestStdout bool
+	manifestOut    io.Writer
+	// humanOut receives logs, progress and other output meant for people
+	humanOut = os.Stdout
+
+	// HTTP flags
+	retryBackoffBase   time.Duration
+	retryBackoffMax    time.Duration
+	requestRetries     int
+	downloadTimeout    time.Duration
+	itemTimeout        time.Duration
+	maxDownloadSize    string
+	maxRedirects       int
+	perHostLimit       int
+	retryStatusCodes   []int
+	insecureSkipVerify bool
+	proxy              string
+	httpTimeout        time.Duration
+	requestsPerSecond  float64
+
+	// Storage flags
+	s3Bucket      string
+	s3Endpoint    string
+	outputStorage lib.Storage
+
+	// Graph API flags
+	tokenFile    string
+	fieldsPreset string
+	fields       string
+	fetchEmbed   bool
+	embedToken   string
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "instagram-recents-go",
-	Short: "A tool to download and transform Instagram recent media",
+	Use:     "instagram-recents-go",
+	Version: lib.Version,
+	Short:   "A tool to download and transform Instagram recent media",
 	Long: `Instagram Recents Go is a tool to manage your Instagram media.
 It can authenticate with Instagram, download your recent media,
 transform the images, and display them in a web interface.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := applyConfig(cmd); err != nil {
+			return err
+		}
+		if manifestStdout {
+			// Keep stdout pure JSON by routing all other output to stderr
+			manifestOut, humanOut = os.Stdout, os.Stderr
+		}
+		return configureLib(cmd)
+	},
 }
 
+// configureLib applies the global flags to the lib package
+func configureLib(cmd *cobra.Command) error {
+	var err error
+	if err := configureLogging(); err != nil {
+		return err
+	}
+	if err := resolveConcurrency(cmd); err != nil {
+		return err
+	}
+	if sizeWorkers < 1 {
+		return fmt.Errorf("invalid --size-concurrency %d: must be at least 1", sizeWorkers)
+	}
+	if err := encodeOptions().Validate(); err != nil {
+		return err
+	}
+	if err := lib.ValidatePlaceholder(placeholder); err != nil {
+		return fmt.Errorf("invalid --placeholder: %w", err)
+	}
+	if cmd.Flags().Changed("manifest-format") && !cmd.Flags().Changed("schema") {
+		schema = manifestFmt
+	}
+	if s3Bucket != "" {
+		storage, err := lib.NewS3Storage(s3Bucket, s3Endpoint)
+		if err != nil {
+			return err
+		}
+		outputStorage = storage
+	} else if s3Endpoint != "" {
+		return fmt.Errorf("--s3-endpoint needs --s3-bucket")
+	}
+	if err := lib.ValidateFeedFormat(feedFormat); err != nil {
+		return fmt.Errorf("invalid --feed: %w", err)
+	}
+	// Feed readers need absolute enclosure URLs
+	if (feedFormat != "" || emitRSS != "") && baseURL == "" {
+		return fmt.Errorf("a feed needs --base-url to link each item's image")
+	}
+	if err := lib.ValidateManifestSchema(schema); err != nil {
+		return fmt.Errorf("invalid --schema: %w", err)
+	}
+	if err := lib.ValidateFormat(outputFormat); err != nil {
+		return fmt.Errorf("invalid --format: %w", err)
+	}
+	if thumbFormat != "" {
+		if err := lib.ValidateFormat(thumbFormat); err != nil {
+			return fmt.Errorf("invalid --thumb-format: %w", err)
+		}
+	}
+	// --video-posters is the older spelling of --video-preview poster
+	if !cmd.Flags().Changed("video-preview") && videoPosters {
+		videoPreview = lib.VideoPreviewPoster
+	}
+	if err := lib.ValidateVideoPreview(videoPreview); err != nil {
+		return fmt.Errorf("invalid --video-preview: %w", err)
+	}
+	if previewFrames < 1 {
+		return fmt.Errorf("invalid --video-preview-frames %d: must be at least 1", previewFrames)
+	}
+	videoPosters = videoPreview != lib.VideoPreviewNone
+	if targetSizeKB < 0 {
+		return fmt.Errorf("invalid --target-size-kb %d: must not be negative", targetSizeKB)
+	}
+	if err := lib.ValidateShardDepth(shardDepth); err != nil {
+		return fmt.Errorf("invalid --shard-depth: %w", err)
+	}
+	if err := lib.ValidateResizeFilter(resizeFilter); err != nil {
+		return fmt.Errorf("invalid --resize-filter: %w", err)
+	}
+	if flattenBackground, err = lib.ParseBackgroundColor(background); err != nil {
+		return err
+	}
+	imageSizes, err := lib.ParseSizes(sizes)
+	if err != nil {
+		return fmt.Errorf("invalid --sizes: %w", err)
+	}
+	if err := lib.SetImageSizes(imageSizes); err != nil {
+		return err
+	}
+	if err := lib.SetTempDir(tempDir); err != nil {
+		return err
+	}
+	if err := lib.SetHTTPTimeout(httpTimeout); err != nil {
+		return err
+	}
+	if err := lib.SetProxy(proxy); err != nil {
+		return fmt.Errorf("invalid --proxy: %w", err)
+	}
+	if err := lib.SetRequestsPerSecond(requestsPerSecond); err != nil {
+		return err
+	}
+	if err := lib.SetRetryAttempts(requestRetries); err != nil {
+		return err
+	}
+	if itemTimeout < 0 {
+		return fmt.Errorf("invalid --item-timeout %s: must not be negative", itemTimeout)
+	}
+	if err := lib.SetDownloadTimeout(downloadTimeout); err != nil {
+		return err
+	}
+	maxDownloadBytes, err := lib.ParseByteSize(maxDownloadSize)
+	if err != nil {
+		return fmt.Errorf("invalid --max-download-size: %w", err)
+	}
+	if err := lib.SetMaxDownloadSize(maxDownloadBytes); err != nil {
+		return err
+	}
+	if err := lib.SetRetryBackoff(retryBackoffBase, retryBackoffMax); err != nil {
+		return err
+	}
+	if err := lib.SetRetryStatusCodes(retryStatusCodes); err != nil {
+		return err
+	}
+	if err := lib.SetMaxRedirects(maxRedirects); err != nil {
+		return err
+	}
+	if err := lib.SetPerHostConcurrency(perHostLimit); err != nil {
+		return err
+	}
+
+	if insecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled (--insecure-skip-verify), use this for local testing only")
+	}
+	lib.SetInsecureSkipVerify(insecureSkipVerify)
+	resolvedFields, err := lib.ResolveMediaFields(fieldsPreset, fields)
+	if err != nil {
+		return err
+	}
+	return lib.SetMediaFields(resolvedFields)
+}
+
+// configureLogging builds the logger from --log-level and --log-format and
+// installs it for both this package and lib
+func configureLogging() error {
+	logger, err := lib.NewLogger(humanOut, logLevel, logFormat)
+	if err != nil {
+		return fmt.Errorf("invalid logging flags: %w", err)
+	}
+	slog.SetDefault(logger)
+	lib.SetLogger(logger)
+	return nil
+}
+
+// concurrencyLevel is the parsed --concurrency value
+var concurrencyLevel int
+
+// resolveConcurrency parses --concurrency. "auto" processes one item per CPU
+// and allows a multiple of that per host, unless --per-host-concurrency was
+// given explicitly.
+func resolveConcurrency(cmd *cobra.Command) error {
+	switch concurrency {
+	case "auto":
+		concurrencyLevel = runtime.NumCPU()
+		if !cmd.Flags().Changed("per-host-concurrency") {
+			perHostLimit = runtime.NumCPU() * 2
+		}
+		slog.Info("auto concurrency", "items", concurrencyLevel, "per_host", perHostLimit)
+	default:
+		n, err := strconv.Atoi(concurrency)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid --concurrency %q: expected a positive number or auto", concurrency)
+		}
+		concurrencyLevel = n
+	}
+	return nil
+}
+
+// flattenBackground is the parsed --flatten-background colour
+var flattenBackground color.Color
+
+// encodeOptions collects the flags that control output encoding
+func encodeOptions() lib.EncodeOptions {
+	return lib.EncodeOptions{
+		Quality:   webpQuality,
+		Preset:    webpPreset,
+		ImageHint: webpHint,
+	}
+}
+
+// processOptions collects the flags that control media processing
+func processOptions() lib.ProcessOptions {
+	return lib.ProcessOptions{
+		FlattenBackground: flattenBackground,
+		RSSPath:           emitRSS,
+		Feed:              feedFormat,
+		VerifyEncode:      verifyEncode,
+		Checksum:          checksum,
+		EmitAspectRatio:   aspectRatio,
+		ManifestWriter:    manifestOut,
+		ReportWriter:      humanOut,
+		FailOnEmpty:       failOnEmpty,
+		FailFast:          failOnError,
+		ItemTimeout:       itemTimeout,
+		Overwrite:         overwrite,
+		ShardDepth:        shardDepth,
+		TargetSize:        int64(targetSizeKB) * 1024,
+		FetchEmbed:        fetchEmbed,
+		EmbedToken:        embedToken,
+		ThumbFormat:       thumbFormat,
+		ResizeFilter:      resizeFilter,
+		IncludeSourceURL:  sourceURL,
+		MaxPixels:         maxPixels,
+		SummaryPath:       summaryJSON,
+		PassthroughSmall:  passthrough,
+		VideoPosters:      videoPosters,
+		VideoPreview:      videoPreview,
+		PreviewFrames:     previewFrames,
+		Concurrency:       concurrencyLevel,
+		SizeConcurrency:   sizeWorkers,
+		Encode:            encodeOptions(),
+		Format:            outputFormat,
+		ManifestFormat:    schema,
+		Incremental:       incremental,
+		DryRun:            dryRun,
+		BaseURL:           baseURL,
+		ContentHash:       contentHash,
+		Placeholder:       placeholder,
+		KeepOriginals:     keepOriginals,
+		AllowUpscale:      allowUpscale,
+		Sprite:            sprite,
+		AccessToken:       pipelineToken,
+		KeepMetadata:      !stripMeta,
+		Storage:           outputStorage,
+	}
+}
+
+// runPipeline fetches and transforms media with the current flags, exiting
+// non-zero when the run fails
+func runPipeline(cmd *cobra.Command, recentMedia []lib.Media) {
+	// Keep a concurrent run from interleaving writes to the same output dir
+	var lock *lib.OutputLock
+	if !dryRun {
+		var err error
+		if lock, err = lib.LockOutputDir(cmd.Context(), outputDir, waitForLock); err != nil {
+			if cmd.Context().Err() != nil {
+				os.Exit(exitInterrupted)
+			}
+			slog.Error("error locking output directory, pass --wait-for-lock to wait for the other run", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	opts := processOptions()
+	opts.Progress = newProgressFunc(humanOut)
+	err := lib.FetchAndTransformImages(cmd.Context(), recentMedia, mediaDir, outputDir, opts)
+	if lock != nil {
+		if err := lock.Unlock(); err != nil {
+			slog.Warn("error releasing output directory lock", "error", err)
+		}
+	}
+	if cmd.Context().Err() != nil {
+		slog.Warn("interrupted, wrote a partial manifest")
+		os.Exit(exitInterrupted)
+	}
+	if errors.Is(err, lib.ErrOutputExists) {
+		slog.Error("refusing to replace the previous run's output, pass --overwrite to replace it or --incremental to update it", "error", err)
+		os.Exit(1)
+	}
+	if errors.Is(err, lib.ErrNoMediaProcessed) {
+		slog.Error("processed 0 items, failing due to --fail-on-empty")
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("error processing media", "error", err)
+		os.Exit(1)
+	}
+}
+
+// exitInterrupted is the conventional exit code after SIGINT
+const exitInterrupted = 130
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// SIGINT and SIGTERM cancel the command's context so in-flight work can stop.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// Restore default handling so a second signal exits immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+	if ctx.Err() != nil {
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		fmt.Fprintln(humanOut, err)
 		os.Exit(1)
 	}
 }
 
 func init() {
 	// Define common flags that can be used by multiple commands
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML file of flag defaults keyed by flag name (defaults to .instagramrc in the working or home directory)")
 	rootCmd.PersistentFlags().StringVar(&outputDir, "output-dir", "./output", "Directory to save output files")
 	rootCmd.PersistentFlags().StringVar(&mediaDir, "media-dir", "./output/media", "Directory to save media files")
-	rootCmd.PersistentFlags().StringVar(&jsonFile, "json-file", "./output/recent_media.json", "Path to recent_media.json file")
+	rootCmd.PersistentFlags().StringArrayVar(&jsonFiles, "json-file", []string{"./output/recent_media.json"}, "Path, glob or directory of recent_media.json files (repeatable)")
 	rootCmd.PersistentFlags().IntVar(&picsumLimit, "picsum-limit", 10, "Number of images to fetch from Picsum Photos API (max 100)")
-} 
\ No newline at end of file
+	rootCmd.PersistentFlags().StringVar(&tempDir, "temp-dir", "", "Directory for temporary files (defaults to the system temp dir)")
+	rootCmd.PersistentFlags().StringVar(&concurrency, "concurrency", "4", "Media items processed at once: a number, or auto to size by CPU count")
+	rootCmd.PersistentFlags().IntVar(&sizeWorkers, "size-concurrency", 1, "Sizes of a single image resized at once")
+	rootCmd.PersistentFlags().StringVar(&emitRSS, "emit-rss", "", "Write an RSS feed of the processed media to this path")
+	rootCmd.PersistentFlags().MarkDeprecated("emit-rss", "use --feed rss, which writes feed.xml to the output dir")
+	rootCmd.PersistentFlags().StringVar(&feedFormat, "feed", "", "Write feed.xml to the output dir in this format: rss or atom (needs --base-url for enclosure URLs)")
+	rootCmd.PersistentFlags().BoolVar(&verifyEncode, "verify-encode", false, "Decode every written image to verify it is valid")
+	rootCmd.PersistentFlags().BoolVar(&checksum, "checksum", false, "Record a SHA-256 checksum of each output file in the manifest")
+	rootCmd.PersistentFlags().BoolVar(&aspectRatio, "emit-aspect-ratio", false, "Record each entry's aspect ratio (e.g. \"4 / 3\") in the manifest")
+	rootCmd.PersistentFlags().StringVar(&background, "flatten-background", "white", "Colour (white, black or hex) to flatten transparent sources onto, except in lossless output")
+	rootCmd.PersistentFlags().BoolVar(&failOnEmpty, "fail-on-empty", false, "Exit non-zero when no media ends up processed")
+	rootCmd.PersistentFlags().BoolVar(&failOnError, "fail-on-error", false, "Stop at the first media item that fails and exit non-zero instead of writing a partial result")
+	rootCmd.PersistentFlags().BoolVar(&waitForLock, "wait-for-lock", false, "Wait for another run using the same --output-dir to finish instead of failing")
+	rootCmd.PersistentFlags().StringVar(&sizes, "sizes", "1024:large,768:medium,384:small,256:thumb", "Comma-separated widths to generate, each optionally named as width:name")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "format", lib.FormatWebP, "Output format: webp, webp-lossless, avif (needs avifenc) or jpeg")
+	rootCmd.PersistentFlags().IntVar(&shardDepth, "shard-depth", 0, "Spread media files over this many levels (0-2) of subdirectories named by the media ID's leading characters, two per level (e.g. media/17/89/17895695668004550_...); 0 keeps the media dir flat")
+	rootCmd.PersistentFlags().StringVar(&resizeFilter, "resize-filter", lib.DefaultResizeFilter, "Resampling filter: lanczos, catmullrom, linear, nearest (for pixel art) or box")
+	rootCmd.PersistentFlags().StringVar(&thumbFormat, "thumb-format", "", "Output format for the smallest (thumb) size (defaults to --format)")
+	rootCmd.PersistentFlags().BoolVar(&sourceURL, "include-source-url", false, "Record each entry's source URL in the manifest (signed URLs expire, so treat them as possibly stale)")
+	rootCmd.PersistentFlags().IntVar(&maxPixels, "max-pixels", lib.DefaultMaxPixels, "Reject source images whose header declares more than this many pixels (0 disables)")
+	rootCmd.PersistentFlags().StringVar(&summaryJSON, "summary-json", "", "Write a JSON summary of the run (counts, bytes, duration) to this path")
+	rootCmd.PersistentFlags().BoolVar(&passthrough, "passthrough-small", false, "Copy JPEG/WebP sources narrower than the smallest size as a single version instead of upscaling")
+	rootCmd.PersistentFlags().BoolVar(&videoPosters, "video-posters", false, "Download videos and convert a poster frame extracted with ffmpeg (skipped if ffmpeg is not on PATH)")
+	rootCmd.PersistentFlags().StringVar(&videoPreview, "video-preview", lib.VideoPreviewNone, "What to make of videos: frames (poster plus an animated WebP preview), poster, or none to skip them")
+	rootCmd.PersistentFlags().IntVar(&previewFrames, "video-preview-frames", lib.DefaultPreviewFrames, "Frames sampled into each animated video preview")
+	rootCmd.PersistentFlags().IntVar(&webpQuality, "webp-quality", 80, "Lossy output quality (1-100)")
+	rootCmd.PersistentFlags().IntVar(&targetSizeKB, "target-size-kb", 0, "Encode each lossy version at the highest quality (30-90) that keeps it under this many KB, overriding --webp-quality (0 disables)")
+	rootCmd.PersistentFlags().StringVar(&webpPreset, "webp-preset", "default", "WebP encoder preset: default, photo, picture, drawing, icon or text")
+	rootCmd.PersistentFlags().StringVar(&webpHint, "webp-image-hint", "default", "WebP image hint: default, picture, photo or graph")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Minimum level to log: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", lib.LogFormatText, "Log output format: text or json")
+	rootCmd.PersistentFlags().BoolVar(&manifestStdout, "manifest-stdout", false, "Write the final manifest JSON to stdout and all other output to stderr")
+	rootCmd.PersistentFlags().StringVar(&schema, "schema", lib.SchemaV2Array, "Manifest schema: v2-array, or v1-map for the old map keyed by media ID")
+	rootCmd.PersistentFlags().StringVar(&manifestFmt, "manifest-format", lib.ManifestFormatArray, "Manifest shape: array or legacy")
+	rootCmd.PersistentFlags().MarkDeprecated("manifest-format", "use --schema v2-array or --schema v1-map instead")
+	rootCmd.PersistentFlags().BoolVar(&overwrite, "overwrite", false, "Replace the output of an earlier run in the output dir; without it or --incremental such runs are refused")
+	rootCmd.PersistentFlags().BoolVar(&incremental, "incremental", false, "Reuse files recorded in the previous converted_media.json and only generate what is missing")
+	rootCmd.PersistentFlags().StringVar(&baseURL, "base-url", "", "URL prefix for file names in each manifest entry's srcset and in feed enclosures")
+	rootCmd.PersistentFlags().BoolVar(&contentHash, "content-hash", false, "Add a short hash of the encoded bytes to each file name (e.g. abc_256w_thumb.8f3a2c.webp)")
+	rootCmd.PersistentFlags().BoolVar(&sprite, "sprite", false, "Pack every item's smallest version into sprite.webp, with positions in sprite.json")
+	rootCmd.PersistentFlags().BoolVar(&allowUpscale, "allow-upscale", false, "Upscale sources narrower than a size instead of keeping their own width")
+	rootCmd.PersistentFlags().BoolVar(&stripMeta, "strip-metadata", true, "Write images without EXIF, GPS or XMP; false copies the source EXIF into JPEG and WebP versions")
+	rootCmd.PersistentFlags().BoolVar(&keepOriginals, "keep-originals", false, "Also keep each downloaded source under original/ in the media dir and record it in the manifest")
+	rootCmd.PersistentFlags().StringVar(&placeholder, "placeholder", lib.PlaceholderNone, "Loading placeholder to record per entry: blurhash, color or none")
+	rootCmd.PersistentFlags().IntVar(&requestRetries, "retries", 2, "Times a failed download or Graph API request is retried before giving up")
+	rootCmd.PersistentFlags().IntVar(&requestRetries, "download-retries", 2, "Times a failed request is retried before giving up")
+	rootCmd.PersistentFlags().MarkDeprecated("download-retries", "use --retries, which covers Graph API requests as well as downloads")
+	rootCmd.PersistentFlags().DurationVar(&downloadTimeout, "download-timeout", 0, "Maximum time for a single download including retries (0 disables)")
+	rootCmd.PersistentFlags().DurationVar(&itemTimeout, "item-timeout", 0, "Maximum time to download and convert a single media item, albums included (0 disables)")
+	rootCmd.PersistentFlags().StringVar(&maxDownloadSize, "max-download-size", "25MB", "Largest source image to download, e.g. 25MB or 512KB (0 disables)")
+	rootCmd.PersistentFlags().DurationVar(&retryBackoffBase, "retry-backoff-base", 500*time.Millisecond, "Initial delay before retrying a failed request")
+	rootCmd.PersistentFlags().DurationVar(&retryBackoffMax, "retry-backoff-max", 30*time.Second, "Maximum delay between retries of a failed request")
+	rootCmd.PersistentFlags().IntSliceVar(&retryStatusCodes, "retry-status-codes", []int{429, 500, 502, 503, 504}, "HTTP status codes that trigger a retry")
+	rootCmd.PersistentFlags().IntVar(&maxRedirects, "max-redirects", 3, "Maximum number of redirects to follow per request (0 disables redirects)")
+	rootCmd.PersistentFlags().IntVar(&perHostLimit, "per-host-concurrency", 4, "Maximum concurrent downloads from any single host")
+	rootCmd.PersistentFlags().StringVar(&s3Bucket, "s3-bucket", "", "Also publish outputs to this S3-compatible bucket, using AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION")
+	rootCmd.PersistentFlags().StringVar(&s3Endpoint, "s3-endpoint", "", "S3-compatible endpoint URL, e.g. for R2 or MinIO (defaults to AWS S3)")
+	rootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "Proxy URL for all outbound requests (defaults to HTTP_PROXY/HTTPS_PROXY)")
+	rootCmd.PersistentFlags().DurationVar(&httpTimeout, "http-timeout", lib.DefaultHTTPTimeout, "How long each outbound request may wait for a response, not counting the body download (0 disables)")
+	rootCmd.PersistentFlags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Disable TLS certificate verification (local testing only)")
+	rootCmd.PersistentFlags().Float64Var(&requestsPerSecond, "requests-per-second", 0, "Maximum Graph API requests per second (0 disables the limit)")
+	rootCmd.PersistentFlags().StringVar(&fieldsPreset, "fields-preset", "standard", "Media fields to request: minimal, standard, rich or insights")
+	rootCmd.PersistentFlags().StringVar(&tokenFile, "token-file", ".instagram-token.json", "File the long-lived token is stored in and auto-refreshed from")
+	rootCmd.PersistentFlags().StringVar(&fields, "fields", "", "Comma-separated media fields to request, overriding --fields-preset")
+	rootCmd.PersistentFlags().BoolVar(&fetchEmbed, "fetch-embed", false, "Add each post's oEmbed metadata (author, thumbnail) to its entry, one extra API call per item")
+	rootCmd.PersistentFlags().StringVar(&embedToken, "embed-token", "", "App token (app-id|client-token) for oEmbed requests (defaults to the access token)")
+}
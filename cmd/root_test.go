@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runCommandEnv names the environment variable that makes the test binary
+// run the CLI with its value's arguments instead of the tests
+const runCommandEnv = "INSTAGRAM_RECENTS_TEST_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(runCommandEnv); args != "" {
+		rootCmd.SetArgs(strings.Split(args, "\n"))
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs the CLI in a separate process and returns its exit code
+func runCommand(t *testing.T, args ...string) int {
+	t.Helper()
+	code, _ := runCommandOutput(t, args...)
+	return code
+}
+
+// runCommandOutput runs the CLI in a separate process and returns its exit
+// code and combined output
+func runCommandOutput(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), runCommandEnv+"="+strings.Join(args, "\n"))
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(output)
+	}
+	if err != nil {
+		t.Fatalf("running %v: %v\n%s", args, err, output)
+	}
+	return 0, string(output)
+}
+
+func TestFailOnErrorExitCode(t *testing.T) {
+	input := t.TempDir()
+	file, err := os.Create(filepath.Join(input, "good.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(file, image.NewGray(image.Rect(0, 0, 64, 64)))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A PNG cut off after its header sniffs as an image but fails to decode
+	good, err := os.ReadFile(filepath.Join(input, "good.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(input, "bad.png"), good[:40], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		flags    []string
+		wantExit int
+	}{
+		{"best effort", nil, 0},
+		{"fail on error", []string{"--fail-on-error"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "output")
+			args := append([]string{"convert", "--input-dir", input, "--output-dir", output, "--media-dir", filepath.Join(output, "media")}, tt.flags...)
+			if code := runCommand(t, args...); code != tt.wantExit {
+				t.Errorf("exit code = %d, want %d", code, tt.wantExit)
+			}
+			_, err := os.Stat(filepath.Join(output, "converted_media.json"))
+			if wrote := err == nil; wrote != (tt.wantExit == 0) {
+				t.Errorf("wrote a manifest = %v, want %v", wrote, tt.wantExit == 0)
+			}
+		})
+	}
+}
+
+func TestPopulatedOutputDirNeedsOverwrite(t *testing.T) {
+	input := t.TempDir()
+	file, err := os.Create(filepath.Join(input, "photo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(file, image.NewGray(image.Rect(0, 0, 64, 48)))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier run's manifest, left empty so a replaced one is told apart
+	const previous = "[]"
+	tests := []struct {
+		name         string
+		flags        []string
+		wantExit     int
+		wantReplaced bool
+	}{
+		{"without a flag", nil, 1, false},
+		{"overwrite", []string{"--overwrite"}, 0, true},
+		{"incremental", []string{"--incremental"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := t.TempDir()
+			manifest := filepath.Join(output, "converted_media.json")
+			if err := os.WriteFile(manifest, []byte(previous), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			args := append([]string{"convert", "--input-dir", input, "--output-dir", output, "--media-dir", filepath.Join(output, "media")}, tt.flags...)
+			code, out := runCommandOutput(t, args...)
+			if code != tt.wantExit {
+				t.Fatalf("exit code = %d, want %d\n%s", code, tt.wantExit, out)
+			}
+			if tt.wantExit != 0 && (!strings.Contains(out, "--overwrite") || !strings.Contains(out, "--incremental")) {
+				t.Errorf("refusal does not name the flags to add:\n%s", out)
+			}
+
+			data, err := os.ReadFile(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := string(data) != previous; replaced != tt.wantReplaced {
+				t.Errorf("manifest replaced = %v, want %v", replaced, tt.wantReplaced)
+			}
+		})
+	}
+}
+
+func TestFeedNeedsBaseURL(t *testing.T) {
+	input := t.TempDir()
+	file, err := os.Create(filepath.Join(input, "photo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(file, image.NewGray(image.Rect(0, 0, 64, 48)))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		flags    []string
+		wantExit int
+		wantFeed string
+	}{
+		{"feed without base url", []string{"--feed", "rss"}, 1, ""},
+		{"emit-rss without base url", []string{"--emit-rss", "rss.xml"}, 1, ""},
+		{"feed", []string{"--feed", "rss", "--base-url", "https://example.com/media"}, 0, "feed.xml"},
+		{"emit-rss", []string{"--emit-rss", "rss.xml", "--base-url", "https://example.com/media"}, 0, "rss.xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := t.TempDir()
+			args := []string{"convert", "--input-dir", input, "--output-dir", output, "--media-dir", filepath.Join(output, "media")}
+			for _, flag := range tt.flags {
+				if flag == "rss.xml" {
+					flag = filepath.Join(output, flag)
+				}
+				args = append(args, flag)
+			}
+			code, out := runCommandOutput(t, args...)
+			if code != tt.wantExit {
+				t.Fatalf("exit code = %d, want %d\n%s", code, tt.wantExit, out)
+			}
+			if tt.wantExit != 0 && !strings.Contains(out, "--base-url") {
+				t.Errorf("refusal does not name --base-url:\n%s", out)
+			}
+			if tt.wantFeed != "" {
+				if _, err := os.Stat(filepath.Join(output, tt.wantFeed)); err != nil {
+					t.Errorf("no feed written: %v", err)
+				}
+			}
+			if deprecated := strings.Contains(out, "--emit-rss has been deprecated"); deprecated != slices.Contains(tt.flags, "--emit-rss") {
+				t.Errorf("deprecation notice shown = %v for %v:\n%s", deprecated, tt.flags, out)
+			}
+		})
+	}
+}
+
+func TestManifestStdoutKeepsStdoutJSON(t *testing.T) {
+	input := t.TempDir()
+	file, err := os.Create(filepath.Join(input, "photo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(file, image.NewGray(image.Rect(0, 0, 64, 48)))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := t.TempDir()
+	args := []string{"convert", "--input-dir", input, "--output-dir", output, "--media-dir", filepath.Join(output, "media"), "--manifest-stdout"}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), runCommandEnv+"="+strings.Join(args, "\n"))
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.String())
+	}
+
+	var manifest []map[string]any
+	if err := json.Unmarshal([]byte(stdout.String()), &manifest); err != nil || len(manifest) != 1 {
+		t.Errorf("stdout is not the one-entry manifest (%v):\n%s", err, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "image processing complete") {
+		t.Errorf("logs did not go to stderr:\n%s", stderr.String())
+	}
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+	"github.com/spf13/cobra"
+)
+
+// Media selection flags shared by fetch-media and manual-token
+var (
+	sinceDate  string
+	untilDate  string
+	mediaLimit int
+)
+
+// addSelectionFlags registers --since, --until and --limit on cmd
+func addSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&sinceDate, "since", "", "Only keep media posted at or after this time (RFC3339 or YYYY-MM-DD)")
+	cmd.Flags().StringVar(&untilDate, "until", "", "Only keep media posted at or before this time (RFC3339 or YYYY-MM-DD)")
+	cmd.Flags().IntVar(&mediaLimit, "limit", 0, "Only keep the N most recent media items (0 means no limit)")
+}
+
+// selectMedia applies --since, --until and then --limit to media
+func selectMedia(media []lib.Media) ([]lib.Media, error) {
+	var since, until time.Time
+	var err error
+	if sinceDate != "" {
+		if since, err = lib.ParseDate(sinceDate, false); err != nil {
+			return nil, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if untilDate != "" {
+		if until, err = lib.ParseDate(untilDate, true); err != nil {
+			return nil, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	if !since.IsZero() && !until.IsZero() && until.Before(since) {
+		return nil, fmt.Errorf("--until (%s) is before --since (%s)", untilDate, sinceDate)
+	}
+	if mediaLimit < 0 {
+		return nil, fmt.Errorf("--limit must not be negative, got %d", mediaLimit)
+	}
+
+	media = lib.FilterMediaByDate(media, since, until)
+	return lib.LimitMostRecent(media, mediaLimit), nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+func TestLimitKeepsMostRecentInOutput(t *testing.T) {
+	t.Cleanup(func() { sinceDate, untilDate, mediaLimit = "", "", 0 })
+	if err := fetchMediaCmd.Flags().Parse([]string{"--limit", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var media []lib.Media
+	for _, day := range []int{3, 5, 1, 4, 2} {
+		path := filepath.Join(dir, fmt.Sprintf("day%d.png", day))
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(file, image.NewGray(image.Rect(0, 0, 40+day, 40)))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		media = append(media, lib.Media{
+			ID:        fmt.Sprint("day", day),
+			MediaType: "IMAGE",
+			MediaURL:  "file://" + filepath.ToSlash(path),
+			Timestamp: fmt.Sprintf("2024-01-%02dT00:00:00+0000", day),
+		})
+	}
+
+	selected, err := selectMedia(media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := filepath.Join(dir, "output")
+	if err := lib.FetchAndTransformImages(context.Background(), selected, filepath.Join(outDir, "media"), outDir, lib.ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outDir, "converted_media.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []lib.MediaFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.MediaID)
+	}
+	if want := []string{"day5", "day4", "day3"}; !slices.Equal(ids, want) {
+		t.Errorf("output holds %v, want the three most recent %v", ids, want)
+	}
+}
@@ -1,61 +1,128 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"html/template"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/agoodkind/instagram-recents-go/lib"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
 )
 
-// runServer starts the web server with all routes
-func runServer(cfg lib.InstagramConfig) {
+var shutdownTimeout time.Duration
+var readinessCheckUpstream bool
+
+// runServer starts the web server with all routes and shuts it down
+// gracefully once ctx is cancelled
+func runServer(ctx context.Context, cfg lib.InstagramConfig) error {
+	router, err := newRouter(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Automatically find an available port starting from 8080
+	listener, err := listenAvailable(8080, 8100)
+	if err != nil {
+		return err
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	slog.Info("server is running", "url", fmt.Sprintf("http://localhost:%d", port))
+	return serve(ctx, router, listener)
+}
+
+// newRouter sets up the sessions, templates and routes of the web server
+func newRouter(cfg lib.InstagramConfig) (*gin.Engine, error) {
+	sessionStore, err := lib.NewSessionStore(os.Getenv("SESSION_SECRET"))
+	if err != nil {
+		return nil, err
+	}
 	router := gin.Default()
-	sessionStore := cookie.NewStore([]byte(os.Getenv("SESSION_SECRET")))
 	router.Use(sessions.Sessions("instagram-recents-go", sessionStore))
-	router.LoadHTMLGlob("templates/*")
+
+	// A missing template leaves the server up but not ready, so a load
+	// balancer keeps traffic away instead of the process crash-looping
+	templates, err := template.ParseGlob("templates/*")
+	if err != nil {
+		slog.Error("error loading templates", "error", err)
+	} else {
+		router.SetHTMLTemplate(templates)
+	}
 
 	// Define routes
+	router.GET("/healthz", lib.HealthHandler())
+	router.GET("/readyz", lib.ReadinessHandler(templates, readinessCheckUpstream))
 	router.GET("/", lib.IndexHandler(cfg))
-	router.GET("/auth/callback", lib.AuthCallbackHandler(cfg))
+	router.GET("/auth/callback", lib.AuthCallbackHandler(cfg, lib.TokenStore{Path: tokenFile}))
+	router.GET("/recent", lib.RecentHandler())
+	router.GET("/logout", lib.LogoutHandler())
 
 	// Add new routes for manual token handling
 	router.GET("/manual-token", lib.ManualTokenFormHandler())
 	router.POST("/manual-token", lib.ProcessManualTokenHandler())
 
-	// Automatically find an available port starting from 8080
-	port := findAvailablePort(8080, 8100)
-	if port == -1 {
-		fmt.Fprintln(os.Stderr, "No available ports in range 8080-8099")
-		os.Exit(1)
-	}
+	// Serve the converted manifest, whole or one entry at a time
+	manifest := lib.NewManifestCache(outputDir)
+	router.GET("/media.json", lib.MediaJSONHandler(manifest))
+	router.GET("/media/:id", lib.MediaEntryHandler(manifest))
+
+	// Run the media pipeline and stream its progress
+	router.GET("/api/fetch/stream", lib.FetchStreamHandler(jsonFiles, mediaDir, outputDir, processOptions()))
+
+	return router, nil
+}
+
+// serve runs handler on listener until ctx is cancelled, then lets
+// in-flight requests drain for up to the shutdown timeout
+func serve(ctx context.Context, handler http.Handler, listener net.Listener) error {
+	srv := &http.Server{Handler: handler}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
 
-	host := "localhost"
-	url := fmt.Sprintf("http://%s:%d", host, port)
-	fmt.Printf("Server is running at %s\n", url)
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	}
 
-	addr := ":" + strconv.Itoa(port)
-	if err := router.Run(addr); err != nil {
-		panic(err)
+	// Let in-flight requests drain before exiting
+	slog.Info("shutting down, waiting for active requests", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("server shutdown failed: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server failed: %w", err)
 	}
+
+	slog.Info("server stopped")
+	return nil
 }
 
-// findAvailablePort tries to find an available port within a range.
-func findAvailablePort(start, end int) int {
+// listenAvailable listens on the first free port within a range. The
+// listener is kept open, so no other process can take the port before the
+// server starts on it.
+func listenAvailable(start, end int) (net.Listener, error) {
 	for port := start; port <= end; port++ {
-		addr := ":" + strconv.Itoa(port)
-		listener, err := net.Listen("tcp", addr)
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 		if err == nil {
-			listener.Close() // Close the listener after finding a free port
-			return port
+			return listener, nil
 		}
 	}
-	return -1 // No available ports found
+	return nil, fmt.Errorf("no available ports in range %d-%d", start, end)
 }
 
 
@@ -65,11 +132,21 @@ var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Run the web server",
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg := lib.LoadConfig()
-		runServer(cfg)
+		cfg, err := lib.LoadConfig()
+		if err != nil {
+			slog.Error("invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		if err := runServer(cmd.Context(), cfg); err != nil {
+			slog.Error("server error", "error", err)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
+
+	serverCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for active requests to finish when shutting down")
+	serverCmd.Flags().BoolVar(&readinessCheckUpstream, "readiness-check-upstream", false, "Have /readyz also check that the Instagram Graph API is reachable")
 } 
\ No newline at end of file
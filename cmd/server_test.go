@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+	"github.com/gin-gonic/gin"
+)
+
+func TestServeShutsDownGracefully(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Chdir("..") // templates/ lives at the repository root
+	t.Setenv("SESSION_SECRET", strings.Repeat("s", lib.MinSessionSecretLength))
+	previous := shutdownTimeout
+	shutdownTimeout = 5 * time.Second
+	t.Cleanup(func() { shutdownTimeout = previous })
+
+	router, err := newRouter(lib.InstagramConfig{ClientID: "id", ClientSecret: "secret", RedirectURI: "https://example.com/auth/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	router.GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		c.String(http.StatusOK, "drained")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, router, listener) }()
+
+	resp, err := http.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET / = %d, want 200", resp.StatusCode)
+	}
+
+	// Shut down while a request is in flight; it still gets its response
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve returned %v, want nil after a graceful shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the context was cancelled")
+	}
+	if body := <-slow; body != "drained" {
+		t.Errorf("in-flight request got %q, want it to finish", body)
+	}
+	if _, err := http.Get(base + "/"); err == nil {
+		t.Error("server still accepts requests after shutting down")
+	}
+}
+
+func TestListenAvailableSkipsBusyPorts(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	listener, err := listenAvailable(port, port+20)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	if got := listener.Addr().(*net.TCPAddr).Port; got == port {
+		t.Errorf("listened on the busy port %d", port)
+	}
+
+	if _, err := listenAvailable(port, port); err == nil {
+		t.Error("got no error when every port in the range is busy")
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+// loadStoredToken refreshes the token in --token-file when it is close to
+// expiry and returns it. A missing file means no token has been stored yet;
+// a corrupt one is reported and ignored.
+func loadStoredToken() *lib.TokenResponse {
+	tok, err := lib.TokenStore{Path: tokenFile}.RefreshIfNeeded()
+	if err != nil {
+		slog.Warn("ignoring stored token", "error", err)
+		return nil
+	}
+	return tok
+}
+
+// seedStoredToken keeps a token that was just used successfully in
+// --token-file when nothing is stored there yet, so it is refreshed from then
+// on. Its expiry is unknown, so the next run refreshes it to learn it.
+func seedStoredToken(accessToken, userID string) {
+	seeded, err := lib.TokenStore{Path: tokenFile}.Seed(&lib.TokenResponse{AccessToken: accessToken, UserID: userID})
+	if err != nil {
+		slog.Warn("could not store token", "path", tokenFile, "error", err)
+		return
+	}
+	if seeded {
+		slog.Info("stored token", "path", tokenFile)
+	}
+}
+
+// pipelineToken, when set by a command, lets the pipeline refresh expired
+// media URLs
+var pipelineToken string
+
+// storedOrEnvToken returns the development access token from the
+// environment when it is set, unless the stored token was seeded from it and
+// so is its refreshed continuation. Otherwise it returns the stored token. A
+// rotated environment token therefore wins over a store seeded earlier.
+func storedOrEnvToken() string {
+	env := os.Getenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN")
+	if env != "" {
+		seeded, err := lib.TokenStore{Path: tokenFile}.SeededFrom(env)
+		if err != nil {
+			slog.Warn("ignoring stored token", "error", err)
+		}
+		if !seeded {
+			return env
+		}
+	}
+	if stored := loadStoredToken(); stored != nil {
+		return stored.AccessToken
+	}
+	return env
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+func TestStoredOrEnvTokenFollowsARotatedEnvToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(lib.TokenResponse{AccessToken: "refreshed", ExpiresIn: 5184000})
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+
+	previous := tokenFile
+	t.Cleanup(func() { tokenFile = previous })
+
+	t.Run("nothing stored", func(t *testing.T) {
+		tokenFile = filepath.Join(t.TempDir(), "token.json")
+		t.Setenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN", "from-env")
+		if got := storedOrEnvToken(); got != "from-env" {
+			t.Errorf("got %q, want the environment token", got)
+		}
+		if _, err := os.Stat(tokenFile); err == nil {
+			t.Error("looking up the token wrote a token file")
+		}
+	})
+
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{"seeded from the env token", "from-env", "refreshed"},
+		{"env token rotated", "rotated", "rotated"},
+		{"env token unset", "", "refreshed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenFile = filepath.Join(t.TempDir(), "token.json")
+			t.Setenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN", tt.env)
+			seedStoredToken("from-env", "42")
+			if got := storedOrEnvToken(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
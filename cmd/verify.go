@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the output files against the sizes and SHA-256 sums in manifest.json",
+	Run: func(cmd *cobra.Command, args []string) {
+		problems, err := lib.VerifyFileManifest(mediaDir, outputDir)
+		if err != nil {
+			slog.Error("verification failed", "error", err)
+			os.Exit(1)
+		}
+
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			slog.Error("output files do not match the manifest", "mismatches", len(problems))
+			os.Exit(1)
+		}
+		fmt.Println("All files match manifest.json")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
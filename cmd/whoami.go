@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+
+	"github.com/spf13/cobra"
+)
+
+var whoamiToken string
+
+// printAccountInfo looks up the account token belongs to and prints it to
+// out. expiresAt is the token's expiry in Unix seconds, or 0 when unknown.
+func printAccountInfo(token string, expiresAt int64, out io.Writer) error {
+	if token == "" {
+		return errors.New("no token given, pass --token, store one in --token-file or set INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN")
+	}
+
+	info, err := lib.GetAccountInfo(token)
+	if err != nil {
+		return fmt.Errorf("token is not valid: %w", err)
+	}
+
+	fmt.Fprintf(out, "User ID:      %s\n", info.ID)
+	fmt.Fprintf(out, "Username:     %s\n", info.Username)
+	fmt.Fprintf(out, "Account type: %s\n", info.AccountType)
+	fmt.Fprintf(out, "Media count:  %d\n", info.MediaCount)
+	if expiresAt > 0 {
+		expiry := time.Unix(expiresAt, 0)
+		fmt.Fprintf(out, "Expires:      %s (in %s)\n", expiry.Format(time.RFC1123), time.Until(expiry).Round(time.Minute))
+	} else {
+		fmt.Fprintln(out, "Expires:      unknown")
+	}
+	return nil
+}
+
+// whoamiCmd represents the whoami command
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Show which account a token belongs to and when it expires",
+	Run: func(cmd *cobra.Command, args []string) {
+		// Expiry is only known for the stored token, which records it
+		token := whoamiToken
+		var expiresAt int64
+		if token == "" {
+			if stored := loadStoredToken(); stored != nil {
+				token = stored.AccessToken
+				expiresAt = stored.ExpiresAt
+			}
+		}
+		if token == "" {
+			token = os.Getenv("INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN")
+		}
+
+		if err := printAccountInfo(token, expiresAt, os.Stdout); err != nil {
+			slog.Error("whoami failed", "error", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(whoamiCmd)
+
+	whoamiCmd.Flags().StringVar(&whoamiToken, "token", "", "Token to check (defaults to the stored token, then INSTAGRAM_DEVELOPMENT_ACCESS_TOKEN)")
+}
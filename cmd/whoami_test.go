@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agoodkind/instagram-recents-go/lib"
+)
+
+func TestPrintAccountInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/me" || r.URL.Query().Get("fields") != "id,username,account_type,media_count" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("access_token") != "good-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Invalid OAuth access token - Cannot parse access token","type":"OAuthException","code":190}}`))
+			return
+		}
+		w.Write([]byte(`{"id":"17841400000000000","username":"example.user","account_type":"BUSINESS","media_count":42}`))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	lib.SetHTTPClient(&http.Client{Transport: rewriteTransport{target}})
+	t.Cleanup(func() { lib.SetHTTPClient(&http.Client{}) })
+
+	var out bytes.Buffer
+	if err := printAccountInfo("good-token", 0, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "User ID:      17841400000000000\n" +
+		"Username:     example.user\n" +
+		"Account type: BUSINESS\n" +
+		"Media count:  42\n" +
+		"Expires:      unknown\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	expiry := time.Now().Add(30 * 24 * time.Hour)
+	if err := printAccountInfo("good-token", expiry.Unix(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Expires:      "+expiry.Format(time.RFC1123)) {
+		t.Errorf("printed %q, want the expiry %s", out.String(), expiry.Format(time.RFC1123))
+	}
+
+	err := printAccountInfo("bad-token", 0, &out)
+	if err == nil || !strings.Contains(err.Error(), "Cannot parse access token") {
+		t.Errorf("invalid token: got %v, want the API's message", err)
+	}
+	if err := printAccountInfo("", 0, &out); err == nil || !strings.Contains(err.Error(), "--token") {
+		t.Errorf("empty token: got %v, want a hint about --token", err)
+	}
+}
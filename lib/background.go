@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ParseBackgroundColor parses "white", "black" or a hex colour such as
+// "#ff8800" or "f80"
+func ParseBackgroundColor(value string) (color.Color, error) {
+	switch strings.ToLower(value) {
+	case "white":
+		return color.White, nil
+	case "black":
+		return color.Black, nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return nil, fmt.Errorf("invalid background colour %q (expected white, black or a hex colour)", value)
+	}
+
+	return color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, nil
+}
+
+// hexColor formats a colour as #rrggbb
+func hexColor(c color.Color) string {
+	nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x", nrgba.R, nrgba.G, nrgba.B)
+}
+
+// keepsAlpha reports whether versions in format keep a source's
+// transparency, so it is not flattened for them; only lossless output does
+func keepsAlpha(format string) bool {
+	return format == FormatWebPLossless
+}
+
+// flattenAlpha composites a source with transparency over bg. Opaque
+// sources are returned unchanged and reported as not flattened.
+func flattenAlpha(src image.Image, bg color.Color) (image.Image, bool) {
+	if opaque, ok := src.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return src, false
+	}
+
+	bounds := src.Bounds()
+	canvas := imaging.New(bounds.Dx(), bounds.Dy(), bg)
+	return imaging.Overlay(canvas, src, image.Pt(0, 0), 1.0), true
+}
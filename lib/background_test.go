@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// transparentPNG encodes a PNG whose left half is fully transparent
+func transparentPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := width / 2; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// cornerAlpha decodes a written version and returns the alpha of its top
+// left pixel, which is transparent in the source
+func cornerAlpha(t *testing.T, mediaDir string, version ImageVersionEntry) uint32 {
+	t.Helper()
+	file, err := os.Open(filepath.Join(mediaDir, version.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := decodeImage(context.Background(), file, formatFromFileName(version.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, alpha := img.At(img.Bounds().Min.X, img.Bounds().Min.Y).RGBA()
+	return alpha
+}
+
+func TestFlattenBackgroundSkipsLosslessOutput(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         string
+		wantBackground string
+		wantOpaque     bool
+	}{
+		{"lossy", FormatWebP, "#ffffff", true},
+		{"lossless", FormatWebPLossless, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mediaDir := t.TempDir()
+			opts := ProcessOptions{Format: tt.format, FlattenBackground: color.White}
+			result, err := convertImageData(context.Background(), transparentPNG(t, 64, 32), "alpha", mediaDir, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Background != tt.wantBackground {
+				t.Errorf("background = %q, want %q", result.Background, tt.wantBackground)
+			}
+			for _, version := range result.Versions {
+				if opaque := cornerAlpha(t, mediaDir, version) == 0xffff; opaque != tt.wantOpaque {
+					t.Errorf("%s: opaque = %v, want %v", version.FileName, opaque, tt.wantOpaque)
+				}
+			}
+		})
+	}
+}
+
+func TestFlattenBackgroundOnlyFlattensLossySizes(t *testing.T) {
+	mediaDir := t.TempDir()
+	opts := ProcessOptions{Format: FormatWebPLossless, ThumbFormat: FormatJPEG, FlattenBackground: color.Black}
+	result, err := convertImageData(context.Background(), transparentPNG(t, 64, 32), "mixed", mediaDir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Background != "#000000" {
+		t.Errorf("background = %q, want #000000", result.Background)
+	}
+
+	for i, size := range imageVersions {
+		wantOpaque := sizeFormat(size, opts) == FormatJPEG
+		if opaque := cornerAlpha(t, mediaDir, result.Versions[i]) == 0xffff; opaque != wantOpaque {
+			t.Errorf("%s: opaque = %v, want %v", result.Versions[i].FileName, opaque, wantOpaque)
+		}
+	}
+}
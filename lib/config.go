@@ -1,6 +1,11 @@
 package lib
 
-import "os"
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
 
 type InstagramConfig struct {
 	ClientID     string
@@ -8,10 +13,41 @@ type InstagramConfig struct {
 	RedirectURI  string
 }
 
-func LoadConfig() InstagramConfig {
-	return InstagramConfig{
+// LoadConfig reads the config from the environment and validates it. The
+// config is returned even when invalid so callers can decide what to do.
+func LoadConfig() (InstagramConfig, error) {
+	cfg := InstagramConfig{
 		ClientID:     os.Getenv("INSTAGRAM_APP_ID"),
 		ClientSecret: os.Getenv("INSTAGRAM_APP_SECRET"),
 		RedirectURI:  os.Getenv("REDIRECT_URI"),
 	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that every field is set and that RedirectURI is an
+// absolute URL, naming the environment variables that need fixing
+func (cfg InstagramConfig) Validate() error {
+	var missing []string
+	if cfg.ClientID == "" {
+		missing = append(missing, "INSTAGRAM_APP_ID")
+	}
+	if cfg.ClientSecret == "" {
+		missing = append(missing, "INSTAGRAM_APP_SECRET")
+	}
+	if cfg.RedirectURI == "" {
+		missing = append(missing, "REDIRECT_URI")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	redirect, err := url.Parse(cfg.RedirectURI)
+	if err != nil {
+		return fmt.Errorf("REDIRECT_URI is not a valid URL: %w", err)
+	}
+	if redirect.Scheme == "" || redirect.Host == "" {
+		return fmt.Errorf("REDIRECT_URI must be an absolute URL, got %q", cfg.RedirectURI)
+	}
+
+	return nil
 }
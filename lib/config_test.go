@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInstagramConfigValidateMissingFields(t *testing.T) {
+	vars := []string{"INSTAGRAM_APP_ID", "INSTAGRAM_APP_SECRET", "REDIRECT_URI"}
+	values := []string{"id", "secret", "https://example.com/auth/callback"}
+
+	// Each bit of mask unsets one variable, covering every combination
+	for mask := 0; mask < 1<<len(vars); mask++ {
+		var missing []string
+		for i, name := range vars {
+			value := values[i]
+			if mask&(1<<i) != 0 {
+				value = ""
+				missing = append(missing, name)
+			}
+			t.Setenv(name, value)
+		}
+
+		_, err := LoadConfig()
+		if len(missing) == 0 {
+			if err != nil {
+				t.Errorf("all set: got %v", err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("missing %v: got no error", missing)
+			continue
+		}
+		for i, name := range vars {
+			if named := strings.Contains(err.Error(), name); named != (mask&(1<<i) != 0) {
+				t.Errorf("missing %v: error %q names %s = %v", missing, err, name, named)
+			}
+		}
+	}
+}
+
+func TestInstagramConfigValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		redirect string
+		wantErr  bool
+	}{
+		{"https://example.com/auth/callback", false},
+		{"http://localhost:8080/auth/callback", false},
+		{"/auth/callback", true},
+		{"example.com/auth/callback", true},
+		{"https://exa mple.com/", true},
+		{"://missing-scheme", true},
+	}
+	for _, tt := range tests {
+		cfg := InstagramConfig{ClientID: "id", ClientSecret: "secret", RedirectURI: tt.redirect}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.redirect, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how many leading bytes http.DetectContentType considers
+const sniffLen = 512
+
+// errVideoContent marks a download whose content turned out to be a video
+var errVideoContent = errors.New("content is a video")
+
+// contentType returns the media type of a response, taken from its
+// Content-Type header or, when that is missing or generic, sniffed from the
+// first bytes of the body
+func contentType(header string, head []byte) string {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	// The standard sniffer does not know HEIF images
+	if format := sniffSourceFormat(head); format != "" && mediaType == "application/octet-stream" {
+		mediaType = "image/" + format
+	}
+	return mediaType
+}
+
+// checkImageContent accepts image content, and rejects video with
+// errVideoContent and anything else as unsupported
+func checkImageContent(header string, head []byte) error {
+	mediaType := contentType(header, head)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return nil
+	case strings.HasPrefix(mediaType, "video/"):
+		return fmt.Errorf("%w (%s)", errVideoContent, mediaType)
+	default:
+		return fmt.Errorf("unsupported content type %q", mediaType)
+	}
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDownloadChecksContentType(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	png, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "image.png", 16, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp4 := append([]byte("\x00\x00\x00\x18ftypmp42"), make([]byte, 32)...)
+
+	responses := map[string]struct {
+		header string
+		body   []byte
+	}{
+		"/photo.jpg":       {"image/jpeg", jpg.Bytes()},
+		"/clip.mp4":        {"video/mp4", mp4},
+		"/v/t51.2885-15":   {"", png},
+		"/v/t50.2886-16":   {"application/octet-stream", mp4},
+		"/mislabelled.jpg": {"text/html; charset=utf-8", []byte("<html><body>Not found</body></html>")},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[r.URL.Path]
+		// An empty header is left empty rather than sniffed by the server
+		w.Header()["Content-Type"] = []string{response.header}
+		w.Write(response.body)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		wantErr  error
+		wantText string
+	}{
+		{"/photo.jpg", nil, ""},
+		{"/clip.mp4", errVideoContent, "video/mp4"},
+		{"/v/t51.2885-15?stp=dst-jpg&_nc_ht=scontent", nil, ""},
+		{"/v/t50.2886-16?efg=video", errVideoContent, "video/mp4"},
+		{"/mislabelled.jpg", nil, `unsupported content type "text/html"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			data, err := downloadImageToBytes(context.Background(), server.URL+tt.path)
+			if tt.wantText == "" {
+				if err != nil || len(data) == 0 {
+					t.Fatalf("got %d bytes, %v, want the image", len(data), err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantText) {
+				t.Fatalf("got %v, want an error mentioning %s", err, tt.wantText)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+)
+
+// sourceDedupe tracks the sources converted during a run by the SHA-256 of
+// their bytes, so an identical source, such as a repost, reuses the files
+// already written for it instead of being encoded again
+type sourceDedupe struct {
+	mu      sync.Mutex
+	sources map[[sha256.Size]byte]*dedupeSource
+}
+
+// dedupeSource is a source being converted, or already converted, by the
+// item that downloaded it first
+type dedupeSource struct {
+	mediaID string
+	done    chan struct{}
+	result  *imageResult
+}
+
+func newSourceDedupe() *sourceDedupe {
+	return &sourceDedupe{sources: make(map[[sha256.Size]byte]*dedupeSource)}
+}
+
+// claim looks up a source by its bytes. The first item to claim it owns the
+// conversion and must call finish; later items get the owner's source to
+// wait on. A nil dedupe makes every item an owner.
+func (d *sourceDedupe) claim(data []byte, mediaID string) (*dedupeSource, bool) {
+	if d == nil {
+		return nil, true
+	}
+	sum := sha256.Sum256(data)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if source, ok := d.sources[sum]; ok && source.mediaID != mediaID {
+		return source, false
+	}
+	source := &dedupeSource{mediaID: mediaID, done: make(chan struct{})}
+	d.sources[sum] = source
+	return source, true
+}
+
+// finish records a copy of the owner's result, shared with the waiting
+// items when err is nil, and wakes them. The copy leaves the owner free to
+// keep filling in its own result while the waiters read theirs.
+func (s *dedupeSource) finish(result *imageResult, err error) {
+	if s == nil {
+		return
+	}
+	if err == nil && result != nil {
+		shared := *result
+		s.result = &shared
+	}
+	close(s.done)
+}
+
+// wait blocks until the owner has finished and returns a copy of its result
+// marked as a duplicate, or nil when the owner failed and the caller should
+// convert the source itself
+func (s *dedupeSource) wait(ctx context.Context) (*imageResult, error) {
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.result == nil {
+		return nil, nil
+	}
+	shared := *s.result
+	shared.DedupOf = s.mediaID
+	// Nothing was downloaded for the duplicate beyond what it shares
+	shared.SourceSize = 0
+	return &shared, nil
+}
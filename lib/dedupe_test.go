@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIdenticalSourcesShareOneSetOfFiles(t *testing.T) {
+	dir := t.TempDir()
+	repost, err := os.ReadFile(writeTestPNG(t, dir, "repost.png", 640, 480))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := os.ReadFile(writeTestPNG(t, dir, "other.png", 480, 640))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/original.png", "/repost.png":
+			w.Write(repost)
+		case "/other.png":
+			w.Write(other)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	routeTo(t, server)
+
+	media := []Media{
+		{ID: "original", MediaType: "IMAGE", MediaURL: server.URL + "/original.png", Timestamp: "2024-01-01T00:00:00+0000"},
+		{ID: "repost", MediaType: "IMAGE", MediaURL: server.URL + "/repost.png", Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "other", MediaType: "IMAGE", MediaURL: server.URL + "/other.png", Timestamp: "2024-01-03T00:00:00+0000"},
+	}
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	entries, err := FetchAndTransformImagesResult(context.Background(), media, mediaDir, outputDir, ProcessOptions{Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byID := make(map[string]MediaFileEntry)
+	for _, entry := range readManifest(t, outputDir) {
+		byID[entry.MediaID] = entry
+	}
+	if len(entries) != 3 || len(byID) != 3 {
+		t.Fatalf("got %d entries, %d in the manifest, want 3", len(entries), len(byID))
+	}
+
+	// Either identical item may win the race to convert the source
+	canonical, duplicate := byID["original"], byID["repost"]
+	if canonical.DedupOf != "" {
+		canonical, duplicate = duplicate, canonical
+	}
+	if canonical.DedupOf != "" || duplicate.DedupOf != canonical.MediaID {
+		t.Fatalf("dedup_of is %q on %s and %q on %s, want exactly one pointing at the other",
+			canonical.DedupOf, canonical.MediaID, duplicate.DedupOf, duplicate.MediaID)
+	}
+	if byID["other"].DedupOf != "" {
+		t.Errorf("a different image was marked a duplicate of %s", byID["other"].DedupOf)
+	}
+	for name, version := range duplicate.Versions {
+		if version.FileName != canonical.Versions[name].FileName {
+			t.Errorf("%s: duplicate references %s, want the canonical %s", name, version.FileName, canonical.Versions[name].FileName)
+		}
+	}
+
+	// Only the canonical and the other image have files of their own
+	var want []string
+	for _, entry := range []MediaFileEntry{canonical, byID["other"]} {
+		for version := range maps.Values(entry.Versions) {
+			want = append(want, version.FileName)
+		}
+	}
+	var written []string
+	files, err := os.ReadDir(mediaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		written = append(written, file.Name())
+	}
+	slices.Sort(want)
+	if !slices.Equal(written, want) {
+		t.Errorf("media dir holds %v, want only %v", written, want)
+	}
+}
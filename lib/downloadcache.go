@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// downloadCacheDir, when set, keeps downloaded sources keyed by a hash of
+// their URL so later runs can skip the network; empty disables the cache
+var downloadCacheDir string
+
+// SetDownloadCacheDir configures the directory downloaded sources are cached
+// in, creating it if needed; an empty dir disables caching
+func SetDownloadCacheDir(dir string) error {
+	if dir != "" {
+		if err := ensureDirectoryExists(dir); err != nil {
+			return fmt.Errorf("cache dir %s is not usable: %w", dir, err)
+		}
+	}
+	downloadCacheDir = dir
+	return nil
+}
+
+// downloadCachePath returns where the bytes downloaded from url are cached
+func downloadCachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(downloadCacheDir, hex.EncodeToString(sum[:]))
+}
+
+// readDownloadCache returns the cached bytes for url, if any
+func readDownloadCache(url string) ([]byte, bool) {
+	if downloadCacheDir == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(downloadCachePath(url))
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	return data, true
+}
+
+// writeDownloadCache stores the bytes downloaded from url. The file is
+// written atomically so an interrupted write never leaves a truncated entry.
+func writeDownloadCache(url string, data []byte) {
+	if downloadCacheDir == "" {
+		return
+	}
+	if err := WriteFileAtomic(downloadCachePath(url), data, 0644); err != nil {
+		logger.Warn("could not cache download", "url", url, "error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+)
+
+// printDryRun lists to w, for each media item, the URL that would be
+// downloaded and the files that would be written, without touching the
+// network or disk
+func printDryRun(w io.Writer, recentMedia []Media, opts ProcessOptions) {
+	var images, videos, skipped int
+	for i, media := range recentMedia {
+		fmt.Fprintf(w, "[%d/%d] %s (%s)\n", i+1, len(recentMedia), media.ID, media.MediaType)
+
+		url, err := sourceURL(media)
+		if err != nil {
+			fmt.Fprintf(w, "  skip: %v\n", err)
+			skipped++
+			continue
+		}
+
+		poster := false
+		if wantsVideoPoster(media, opts) {
+			_, poster = findFFmpeg()
+		}
+		if poster {
+			url = media.MediaURL
+			fmt.Fprintf(w, "  video: would write %s.mp4\n", mediaFileBase(media.ID, opts.ShardDepth))
+		} else if shouldSkip(media) {
+			fmt.Fprintln(w, "  skip: not convertible as an image")
+			skipped++
+			continue
+		}
+
+		fmt.Fprintf(w, "  source: %s\n", url)
+		for _, size := range imageVersions {
+			fileName := versionFileName(mediaFileBase(media.ID, opts.ShardDepth), size.Width, size.Name, sizeFormat(size, opts))
+			if opts.ContentHash {
+				fileName += " (with content hash)"
+			}
+			fmt.Fprintf(w, "  would write %s\n", fileName)
+		}
+
+		if media.MediaType == "VIDEO" {
+			videos++
+		} else {
+			images++
+		}
+	}
+
+	fmt.Fprintf(w, "Dry run: %d images, %d videos, %d skipped (nothing downloaded or written)\n", images, videos, skipped)
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDryRunWritesNothing(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+	media := []Media{
+		{ID: "photo", MediaType: "IMAGE", MediaURL: server.URL + "/photo.jpg", Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "reel", MediaType: "VIDEO", MediaURL: server.URL + "/reel.mp4", Timestamp: "2024-01-01T00:00:00+0000"},
+	}
+
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "output")
+	var report bytes.Buffer
+	opts := ProcessOptions{DryRun: true, KeepOriginals: true, Sprite: true, ReportWriter: &report}
+	if err := FetchAndTransformImages(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if names := dirNames(t, dir); len(names) != 0 {
+		t.Errorf("dry run wrote %v", names)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("dry run made %d requests", hits.Load())
+	}
+	if !strings.Contains(report.String(), "would write photo_1024w_large.webp") {
+		t.Errorf("listing does not name the files to write:\n%s", report.String())
+	}
+}
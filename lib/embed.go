@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// oEmbedEndpoint is the Graph API's Instagram oEmbed endpoint
+const oEmbedEndpoint = "https://graph.facebook.com/v22.0/instagram_oembed"
+
+// EmbedEntry is the link-preview metadata of a post from Instagram's oEmbed
+// endpoint. Width and Height are those of the thumbnail.
+type EmbedEntry struct {
+	Title        string `json:"title,omitempty"`
+	AuthorName   string `json:"author_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// oEmbedResponse is the part of an oEmbed response kept in the manifest
+type oEmbedResponse struct {
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name"`
+	ThumbnailURL    string `json:"thumbnail_url"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+// fetchEmbed fetches the oEmbed metadata of a post by its permalink. The
+// endpoint needs an app token ("app-id|client-token") or an access token
+// with oEmbed Read; private and deleted posts return a Graph API error.
+func fetchEmbed(ctx context.Context, token, permalink string) (*EmbedEntry, error) {
+	query := url.Values{
+		"url":          {permalink},
+		"omitscript":   {"true"},
+		"access_token": {token},
+	}
+	resp, err := graphGet(ctx, oEmbedEndpoint+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var oembed oEmbedResponse
+	if err := decodeGraphResponse(resp, &oembed); err != nil {
+		return nil, err
+	}
+	if oembed.ThumbnailURL == "" {
+		return nil, fmt.Errorf("oEmbed response has no thumbnail")
+	}
+	return &EmbedEntry{
+		Title:        oembed.Title,
+		AuthorName:   oembed.AuthorName,
+		ThumbnailURL: oembed.ThumbnailURL,
+		Width:        oembed.ThumbnailWidth,
+		Height:       oembed.ThumbnailHeight,
+	}, nil
+}
+
+// embedFor returns the oEmbed metadata of media, or nil with a warning when
+// it cannot be fetched, e.g. because the post is private or was deleted
+func embedFor(ctx context.Context, media Media, token string) *EmbedEntry {
+	if media.Permalink == "" {
+		return nil
+	}
+	embed, err := fetchEmbed(ctx, token, media.Permalink)
+	if err != nil {
+		logger.Warn("omitting embed metadata", "media_id", media.ID, "error", err)
+		return nil
+	}
+	return embed
+}
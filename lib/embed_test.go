@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// oEmbedServer mocks the oEmbed endpoint: the public permalink gets its
+// metadata, any other a Graph API error as for a private post. It counts
+// the calls.
+func oEmbedServer(t *testing.T, public string) *atomic.Int32 {
+	t.Helper()
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v22.0/instagram_oembed" {
+			http.NotFound(w, r)
+			return
+		}
+		calls.Add(1)
+		query := r.URL.Query()
+		if query.Get("access_token") != "app|client" || query.Get("url") != public {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Media is private or unavailable","code":100}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"version":          "1.0",
+			"title":            "Sunset at the pier",
+			"author_name":      "someone",
+			"provider_name":    "Instagram",
+			"thumbnail_url":    "https://cdn.example/thumb.jpg",
+			"thumbnail_width":  640,
+			"thumbnail_height": 800,
+			"html":             "<blockquote></blockquote>",
+		})
+	}))
+	t.Cleanup(server.Close)
+	routeTo(t, server)
+	return calls
+}
+
+func TestFetchEmbedPopulatesEntries(t *testing.T) {
+	dir := t.TempDir()
+	public := Media{
+		ID:        "public",
+		MediaType: "IMAGE",
+		MediaURL:  localFileURL(writeTestPNG(t, dir, "public.png", 320, 240)),
+		Timestamp: "2024-01-02T00:00:00+0000",
+		Permalink: "https://www.instagram.com/p/public/",
+	}
+	private := Media{
+		ID:        "private",
+		MediaType: "IMAGE",
+		MediaURL:  localFileURL(writeTestPNG(t, dir, "private.png", 240, 320)),
+		Timestamp: "2024-01-01T00:00:00+0000",
+		Permalink: "https://www.instagram.com/p/private/",
+	}
+
+	t.Run("fetched", func(t *testing.T) {
+		calls := oEmbedServer(t, public.Permalink)
+		outputDir := t.TempDir()
+		opts := ProcessOptions{FetchEmbed: true, EmbedToken: "app|client"}
+		if err := FetchAndTransformImages(context.Background(), []Media{public, private}, filepath.Join(outputDir, "media"), outputDir, opts); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("made %d oEmbed calls, want one per item", calls.Load())
+		}
+
+		entries := readManifest(t, outputDir)
+		if len(entries) != 2 {
+			t.Fatalf("manifest has %d entries, want 2 with the private post kept", len(entries))
+		}
+		for _, entry := range entries {
+			switch entry.MediaID {
+			case "public":
+				want := EmbedEntry{Title: "Sunset at the pier", AuthorName: "someone", ThumbnailURL: "https://cdn.example/thumb.jpg", Width: 640, Height: 800}
+				if entry.Embed == nil || *entry.Embed != want {
+					t.Errorf("public embed = %+v, want %+v", entry.Embed, want)
+				}
+			case "private":
+				if entry.Embed != nil {
+					t.Errorf("private post has embed %+v, want it omitted", entry.Embed)
+				}
+			}
+		}
+	})
+
+	t.Run("not asked for", func(t *testing.T) {
+		calls := oEmbedServer(t, public.Permalink)
+		outputDir := t.TempDir()
+		opts := ProcessOptions{EmbedToken: "app|client"}
+		if err := FetchAndTransformImages(context.Background(), []Media{public}, filepath.Join(outputDir, "media"), outputDir, opts); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 0 {
+			t.Errorf("made %d oEmbed calls without FetchEmbed", calls.Load())
+		}
+		if entries := readManifest(t, outputDir); len(entries) != 1 || entries[0].Embed != nil {
+			t.Errorf("manifest = %+v, want one entry without an embed", entries)
+		}
+	})
+}
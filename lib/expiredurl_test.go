@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// expiringCDN serves png at /fresh.png, answers the stale URL with status
+// and serves the Graph API lookup of a media item's URLs, which it counts
+func expiringCDN(t *testing.T, png []byte, status int) *atomic.Int32 {
+	t.Helper()
+	lookups := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stale.png":
+			w.WriteHeader(status)
+		case "/fresh.png":
+			w.Write(png)
+		case "/42":
+			lookups.Add(1)
+			if r.URL.Query().Get("access_token") != "token" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"message":"Invalid OAuth access token","code":190}}`))
+				return
+			}
+			json.NewEncoder(w).Encode(Media{ID: "42", MediaType: "IMAGE", MediaURL: "https://cdn.example/fresh.png"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	routeTo(t, server)
+	return lookups
+}
+
+func TestExpiredMediaURLIsRefreshed(t *testing.T) {
+	png, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "source.png", 320, 240))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := Media{ID: "42", MediaType: "IMAGE", MediaURL: "https://cdn.example/stale.png", Timestamp: "2024-01-01T00:00:00+0000"}
+
+	for _, status := range []int{http.StatusForbidden, http.StatusGone} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			lookups := expiringCDN(t, png, status)
+			outputDir := t.TempDir()
+			opts := ProcessOptions{AccessToken: "token", IncludeSourceURL: true}
+			if err := FetchAndTransformImages(context.Background(), []Media{stale}, filepath.Join(outputDir, "media"), outputDir, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := readManifest(t, outputDir)
+			if len(entries) != 1 || len(entries[0].Versions) == 0 {
+				t.Fatalf("manifest = %+v, want the item converted from the fresh URL", entries)
+			}
+			if source := entries[0].Source; source == nil || source.URL != "https://cdn.example/fresh.png" {
+				t.Errorf("source = %+v, want the refreshed URL", source)
+			}
+			if lookups.Load() != 1 {
+				t.Errorf("looked the URL up %d times, want once", lookups.Load())
+			}
+		})
+	}
+
+	t.Run("no token", func(t *testing.T) {
+		lookups := expiringCDN(t, png, http.StatusForbidden)
+		outputDir := t.TempDir()
+		if err := FetchAndTransformImages(context.Background(), []Media{stale}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if entries := readManifest(t, outputDir); len(entries) != 0 {
+			t.Errorf("manifest = %+v, want the expired item skipped", entries)
+		}
+		if lookups.Load() != 0 {
+			t.Errorf("looked the URL up %d times without a token", lookups.Load())
+		}
+	})
+
+	t.Run("no token under FailFast", func(t *testing.T) {
+		expiringCDN(t, png, http.StatusGone)
+		outputDir := t.TempDir()
+		err := FetchAndTransformImages(context.Background(), []Media{stale}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{FailFast: true})
+		if err == nil || !strings.Contains(err.Error(), "no token") {
+			t.Errorf("got %v, want the expired item to fail the run", err)
+		}
+	})
+}
+
+func TestRefreshMediaURL(t *testing.T) {
+	expiringCDN(t, nil, http.StatusForbidden)
+
+	fresh, err := RefreshMediaURL("17841400000000001", "token", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh != "https://cdn.example/fresh.png" {
+		t.Errorf("got %q, want the fresh media_url", fresh)
+	}
+	_, err = RefreshMediaURL("17841400000000001", "expired", "42")
+	if err == nil || !strings.Contains(err.Error(), "17841400000000001") {
+		t.Errorf("got %v, want an error naming the user for a rejected token", err)
+	}
+}
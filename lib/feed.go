@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/relvacode/iso8601"
+)
+
+// rssFeed is the root element of an RSS 2.0 document
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link,omitempty"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate,omitempty"`
+	Description string        `xml:"description,omitempty"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// Feed formats written by ProcessOptions.Feed
+const (
+	FeedRSS  = "rss"
+	FeedAtom = "atom"
+)
+
+// FeedFileName is the feed written to the output dir next to the manifest
+const FeedFileName = "feed.xml"
+
+// feedTitleLength caps the caption-derived title of a feed item, in runes
+const feedTitleLength = 80
+
+// ValidateFeedFormat checks that a feed format name is known
+func ValidateFeedFormat(format string) error {
+	switch format {
+	case "", FeedRSS, FeedAtom:
+		return nil
+	}
+	return fmt.Errorf("unknown feed format %q (expected %s or %s)", format, FeedRSS, FeedAtom)
+}
+
+// feedItemTitle returns the first line of the caption, truncated, or a
+// generic title when there is no caption
+func feedItemTitle(entry MediaFileEntry) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(entry.Caption), "\n")
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return fmt.Sprintf("Instagram post %s", entry.MediaID)
+	}
+	if runes := []rune(title); len(runes) > feedTitleLength {
+		title = strings.TrimSpace(string(runes[:feedTitleLength-1])) + "…"
+	}
+	return title
+}
+
+// feedEnclosure describes the largest version of an entry as a link, its
+// URL prefixed with baseURL like the entry's srcset
+type feedEnclosure struct {
+	URL    string
+	Length int64
+	Type   string
+}
+
+// largestEnclosure returns the enclosure for an entry's largest version
+func largestEnclosure(entry MediaFileEntry, mediaDir, baseURL string) (ImageVersionEntry, *feedEnclosure) {
+	largest, ok := largestVersion(entry)
+	if !ok {
+		return largest, nil
+	}
+
+	var length int64
+	if info, err := os.Stat(filepath.Join(mediaDir, largest.FileName)); err == nil {
+		length = info.Size()
+	}
+	url := largest.FileName
+	if baseURL != "" {
+		url = strings.TrimSuffix(baseURL, "/") + "/" + largest.FileName
+	}
+	return largest, &feedEnclosure{
+		URL:    url,
+		Length: length,
+		Type:   mime.TypeByExtension(filepath.Ext(largest.FileName)),
+	}
+}
+
+// buildRSSItem converts a processed media entry into a feed item
+func buildRSSItem(entry MediaFileEntry, mediaDir, baseURL string) rssItem {
+	item := rssItem{
+		Title: feedItemTitle(entry),
+		Link:  entry.Permalink,
+		GUID:  rssGUID{Value: entry.MediaID},
+	}
+
+	if entry.Permalink != "" {
+		item.GUID = rssGUID{Value: entry.Permalink, IsPermaLink: true}
+	}
+
+	if timestamp, err := iso8601.ParseString(entry.Timestamp); err == nil {
+		item.PubDate = timestamp.Format(time.RFC1123Z)
+	}
+
+	if largest, enclosure := largestEnclosure(entry, mediaDir, baseURL); enclosure != nil {
+		item.Enclosure = &rssEnclosure{URL: enclosure.URL, Length: enclosure.Length, Type: enclosure.Type}
+		item.Description = fmt.Sprintf("%s (%dx%d)", largest.FileName, largest.Width, largest.Height)
+	}
+	if entry.Caption != "" {
+		item.Description = entry.Caption
+	}
+
+	return item
+}
+
+// writeRSSFeed writes an RSS 2.0 feed with one item per processed media entry
+func writeRSSFeed(mediaFilesArray []MediaFileEntry, mediaDir, baseURL, path string) error {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         "Instagram recent media",
+			Link:          "https://www.instagram.com/",
+			Description:   "Recent media archived by instagram-recents-go",
+			LastBuildDate: time.Now().Format(time.RFC1123Z),
+		},
+	}
+
+	for _, entry := range mediaFilesArray {
+		feed.Channel.Items = append(feed.Channel.Items, buildRSSItem(entry, mediaDir, baseURL))
+	}
+
+	return writeFeedXML(feed, path)
+}
+
+// atomFeed is the root element of an Atom 1.0 document
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published,omitempty"`
+	Links     []atomLink `xml:"link"`
+	Summary   string     `xml:"summary,omitempty"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+// buildAtomEntry converts a processed media entry into an Atom entry. Atom
+// requires an id and updated time, so entries without a permalink get a URN
+// and entries without a parseable timestamp use now.
+func buildAtomEntry(entry MediaFileEntry, mediaDir, baseURL string, now time.Time) atomEntry {
+	item := atomEntry{
+		Title:   feedItemTitle(entry),
+		ID:      "urn:instagram:media:" + entry.MediaID,
+		Updated: now.Format(time.RFC3339),
+		Summary: entry.Caption,
+	}
+
+	if entry.Permalink != "" {
+		item.ID = entry.Permalink
+		item.Links = append(item.Links, atomLink{Href: entry.Permalink, Rel: "alternate", Type: "text/html"})
+	}
+
+	if timestamp, err := iso8601.ParseString(entry.Timestamp); err == nil {
+		item.Updated = timestamp.Format(time.RFC3339)
+		item.Published = item.Updated
+	}
+
+	if _, enclosure := largestEnclosure(entry, mediaDir, baseURL); enclosure != nil {
+		item.Links = append(item.Links, atomLink{Href: enclosure.URL, Rel: "enclosure", Type: enclosure.Type, Length: enclosure.Length})
+	}
+
+	return item
+}
+
+// writeAtomFeed writes an Atom 1.0 feed with one entry per processed media
+// entry
+func writeAtomFeed(mediaFilesArray []MediaFileEntry, mediaDir, baseURL, path string) error {
+	now := time.Now()
+	feed := atomFeed{
+		Title:   "Instagram recent media",
+		ID:      "urn:instagram-recents-go:feed",
+		Updated: now.Format(time.RFC3339),
+		Author:  atomAuthor{Name: "instagram-recents-go"},
+		Links:   []atomLink{{Href: "https://www.instagram.com/", Rel: "alternate"}},
+	}
+
+	for _, entry := range mediaFilesArray {
+		feed.Entries = append(feed.Entries, buildAtomEntry(entry, mediaDir, baseURL, now))
+	}
+
+	return writeFeedXML(feed, path)
+}
+
+// writeFeed writes the feed in the given format to path
+func writeFeed(format string, mediaFilesArray []MediaFileEntry, mediaDir, baseURL, path string) error {
+	switch format {
+	case FeedRSS:
+		return writeRSSFeed(mediaFilesArray, mediaDir, baseURL, path)
+	case FeedAtom:
+		return writeAtomFeed(mediaFilesArray, mediaDir, baseURL, path)
+	}
+	return ValidateFeedFormat(format)
+}
+
+// writeFeedXML encodes a feed document and writes it atomically to path
+func writeFeedXML(feed any, path string) error {
+	feedXML, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error creating feed XML: %w", err)
+	}
+
+	if err := ensureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, append([]byte(xml.Header), feedXML...), 0644)
+}
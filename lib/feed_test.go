@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// feedMedia returns three local photos: one with a caption and permalink,
+// one without a caption and one without a permalink
+func feedMedia(t *testing.T) []Media {
+	t.Helper()
+	dir := t.TempDir()
+	return []Media{
+		{ID: "captioned", MediaType: "IMAGE", Caption: "Sunset over the bay\nwith friends", Permalink: "https://www.instagram.com/p/one/",
+			MediaURL: localFileURL(writeTestPNG(t, dir, "one.png", 600, 400)), Timestamp: "2024-03-03T12:00:00+0000"},
+		{ID: "uncaptioned", MediaType: "IMAGE", Permalink: "https://www.instagram.com/p/two/",
+			MediaURL: localFileURL(writeTestPNG(t, dir, "two.png", 500, 400)), Timestamp: "2024-03-02T12:00:00+0000"},
+		{ID: "unlinked", MediaType: "IMAGE", Caption: "No link",
+			MediaURL: localFileURL(writeTestPNG(t, dir, "three.png", 400, 400)), Timestamp: "2024-03-01T12:00:00+0000"},
+	}
+}
+
+// writeTestFeed processes media with the given feed format and returns the
+// written feed and the media dir
+func writeTestFeed(t *testing.T, format string, media []Media) ([]byte, string) {
+	t.Helper()
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	opts := ProcessOptions{Feed: format, BaseURL: "https://cdn.example/media/"}
+	if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, FeedFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, mediaDir
+}
+
+// checkEnclosure checks that an enclosure URL is under the base URL and names
+// a written file of the given length
+func checkEnclosure(t *testing.T, mediaDir, url string, length int64) {
+	t.Helper()
+	fileName, ok := strings.CutPrefix(url, "https://cdn.example/media/")
+	if !ok {
+		t.Errorf("enclosure %s is not under the base URL", url)
+		return
+	}
+	info, err := os.Stat(filepath.Join(mediaDir, fileName))
+	if err != nil {
+		t.Errorf("enclosure %s: %v", url, err)
+		return
+	}
+	if info.Size() != length {
+		t.Errorf("enclosure %s has length %d, the file is %d bytes", url, length, info.Size())
+	}
+}
+
+func TestRSSFeed(t *testing.T) {
+	media := feedMedia(t)
+	data, mediaDir := writeTestFeed(t, FeedRSS, media)
+
+	var feed rssFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("feed.xml does not parse: %v", err)
+	}
+	if feed.Version != "2.0" {
+		t.Errorf("version = %q, want 2.0", feed.Version)
+	}
+	items := feed.Channel.Items
+	if len(items) != len(media) {
+		t.Fatalf("feed has %d items, want %d", len(items), len(media))
+	}
+
+	byGUID := make(map[string]rssItem)
+	for _, item := range items {
+		byGUID[item.GUID.Value] = item
+		if _, err := time.Parse(time.RFC1123Z, item.PubDate); err != nil {
+			t.Errorf("%s: pubDate %q is not RFC1123Z", item.Title, item.PubDate)
+		}
+		if item.Enclosure == nil || item.Enclosure.Type != "image/webp" {
+			t.Errorf("%s: enclosure = %+v, want a WebP", item.Title, item.Enclosure)
+			continue
+		}
+		checkEnclosure(t, mediaDir, item.Enclosure.URL, item.Enclosure.Length)
+	}
+
+	captioned := byGUID["https://www.instagram.com/p/one/"]
+	if captioned.Title != "Sunset over the bay" || captioned.Link != "https://www.instagram.com/p/one/" || !captioned.GUID.IsPermaLink {
+		t.Errorf("captioned item = %+v, want the first caption line linked to its permalink", captioned)
+	}
+	if want := "Sun, 03 Mar 2024 12:00:00 +0000"; captioned.PubDate != want {
+		t.Errorf("pubDate = %q, want %q", captioned.PubDate, want)
+	}
+	if uncaptioned := byGUID["https://www.instagram.com/p/two/"]; uncaptioned.Title != "Instagram post uncaptioned" {
+		t.Errorf("uncaptioned item is titled %q, want a generic title", uncaptioned.Title)
+	}
+	unlinked, ok := byGUID["unlinked"]
+	if !ok || unlinked.Link != "" || unlinked.GUID.IsPermaLink {
+		t.Errorf("unlinked item = %+v, want no link and the media ID as its guid", unlinked)
+	}
+}
+
+func TestAtomFeed(t *testing.T) {
+	media := feedMedia(t)
+	data, mediaDir := writeTestFeed(t, FeedAtom, media)
+
+	var feed atomFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("feed.xml does not parse: %v", err)
+	}
+	if len(feed.Entries) != len(media) {
+		t.Fatalf("feed has %d entries, want %d", len(feed.Entries), len(media))
+	}
+	for _, entry := range feed.Entries {
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("%s: updated %q is not RFC 3339", entry.ID, entry.Updated)
+		}
+		enclosures := 0
+		for _, link := range entry.Links {
+			if link.Rel == "enclosure" {
+				enclosures++
+				checkEnclosure(t, mediaDir, link.Href, link.Length)
+			}
+		}
+		if enclosures != 1 {
+			t.Errorf("%s has %d enclosures, want 1", entry.ID, enclosures)
+		}
+	}
+	ids := make(map[string]bool)
+	for _, entry := range feed.Entries {
+		ids[entry.ID] = true
+	}
+	if !ids["https://www.instagram.com/p/one/"] || !ids["urn:instagram:media:unlinked"] {
+		t.Errorf("entry IDs = %v, want permalinks and a URN for the unlinked item", ids)
+	}
+}
+
+func TestFeedItemTitle(t *testing.T) {
+	long := strings.Repeat("é", feedTitleLength+10)
+	tests := []struct {
+		caption string
+		want    string
+	}{
+		{"  First line  \nsecond line", "First line"},
+		{"", "Instagram post 7"},
+		{"\n\nbelow blank lines", "below blank lines"},
+		{long, strings.Repeat("é", feedTitleLength-1) + "…"},
+	}
+	for _, tt := range tests {
+		if got := feedItemTitle(MediaFileEntry{MediaID: "7", Caption: tt.caption}); got != tt.want {
+			t.Errorf("feedItemTitle(%q) = %q, want %q", tt.caption, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/relvacode/iso8601"
+)
+
+// FetchStateFileName is the name of the fetch state file in the output dir
+const FetchStateFileName = "fetch_state.json"
+
+// FetchState records the newest media the previous fetch returned, so the
+// next run only pages through what was published since. The media edge
+// lists newest first and its paging.cursors.after points further into the
+// past, so a stored cursor would skip new posts instead of finding them;
+// stopping at the recorded media also survives cursors expiring.
+type FetchState struct {
+	UserID          string `json:"user_id"`
+	NewestID        string `json:"newest_id,omitempty"`
+	NewestTimestamp string `json:"newest_timestamp,omitempty"`
+	UpdatedAt       string `json:"updated_at,omitempty"`
+}
+
+// Record notes the newest of media as where the next fetch stops. The state
+// is left unchanged when media is empty, so an empty fetch keeps its place.
+func (s *FetchState) Record(userID string, media []Media) {
+	if len(media) == 0 {
+		return
+	}
+
+	newest := media[0]
+	newestTime, _ := iso8601.ParseString(newest.Timestamp)
+	for _, item := range media[1:] {
+		if timestamp, err := iso8601.ParseString(item.Timestamp); err == nil && timestamp.After(newestTime) {
+			newest, newestTime = item, timestamp
+		}
+	}
+
+	s.UserID = userID
+	s.NewestID = newest.ID
+	s.NewestTimestamp = newest.Timestamp
+}
+
+// seen reports whether media was already returned by the recorded fetch: it
+// is the newest media recorded or was published before it. The timestamp
+// still stops the walk when the recorded media has since been deleted.
+func (s FetchState) seen(media Media) bool {
+	if s.NewestID == "" {
+		return false
+	}
+	if media.ID == s.NewestID {
+		return true
+	}
+	newest, err := iso8601.ParseString(s.NewestTimestamp)
+	if err != nil {
+		return false
+	}
+	timestamp, err := iso8601.ParseString(media.Timestamp)
+	return err == nil && timestamp.Before(newest)
+}
+
+// LoadFetchState reads the fetch state at path, returning an empty state if
+// no state has been saved yet
+func LoadFetchState(path string) (*FetchState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &FetchState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading fetch state %s: %w", path, err)
+	}
+
+	var state FetchState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing fetch state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// Save writes the fetch state to path
+func (s *FetchState) Save(path string) error {
+	s.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling fetch state: %w", err)
+	}
+	if err := WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing fetch state %s: %w", path, err)
+	}
+	return nil
+}
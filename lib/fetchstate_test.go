@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// numberedMedia returns n media items newest first, with IDs counting down
+// from first and an hour between timestamps
+func numberedMedia(first, n int) []Media {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	media := make([]Media, n)
+	for i := range media {
+		id := first - i
+		media[i] = Media{
+			ID:        fmt.Sprint(id),
+			MediaType: "IMAGE",
+			Timestamp: base.Add(time.Duration(id) * time.Hour).Format(localTimestampLayout),
+		}
+	}
+	return media
+}
+
+// mediaIDs returns the IDs of media in order
+func mediaIDs(media []Media) []string {
+	ids := make([]string, len(media))
+	for i, item := range media {
+		ids[i] = item.ID
+	}
+	return ids
+}
+
+func TestFetchRecentMediaSincePicksUpNewMedia(t *testing.T) {
+	feed := numberedMedia(5, 5)
+	_, pages := mediaListingServer(t, &feed, 2)
+
+	statePath := filepath.Join(t.TempDir(), FetchStateFileName)
+	state, err := LoadFetchState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := FetchRecentMediaSince("1", "token", *state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 5 {
+		t.Fatalf("first fetch returned %d items, want 5", len(media))
+	}
+	state.Record("1", media)
+	if err := state.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing new: the first page already reaches the recorded media
+	if state, err = LoadFetchState(statePath); err != nil {
+		t.Fatal(err)
+	}
+	pages.Store(0)
+	media, err = FetchRecentMediaSince("1", "token", *state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 0 || pages.Load() != 1 {
+		t.Errorf("unchanged feed returned %v over %d pages, want nothing over 1 page", mediaIDs(media), pages.Load())
+	}
+	state.Record("1", media)
+	if state.NewestID != "5" {
+		t.Errorf("empty fetch moved the newest ID to %q, want it kept at 5", state.NewestID)
+	}
+
+	// Three new posts at the top are returned, and only they
+	feed = append(numberedMedia(8, 3), feed...)
+	media, err = FetchRecentMediaSince("1", "token", *state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaIDs(media), []string{"8", "7", "6"}; !slices.Equal(got, want) {
+		t.Errorf("fetch after new posts returned %v, want %v", got, want)
+	}
+	state.Record("1", media)
+	if state.NewestID != "8" {
+		t.Errorf("newest ID = %q, want 8", state.NewestID)
+	}
+}
+
+func TestFetchRecentMediaSinceStopsWhenNewestWasDeleted(t *testing.T) {
+	feed := numberedMedia(6, 6)
+	mediaListingServer(t, &feed, 2)
+
+	state := FetchState{}
+	state.Record("1", feed[2:])
+
+	// The recorded newest post (4) is gone, so its timestamp stops the walk
+	feed = slices.Delete(feed, 2, 3)
+	media, err := FetchRecentMediaSince("1", "token", state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaIDs(media), []string{"6", "5"}; !slices.Equal(got, want) {
+		t.Errorf("returned %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileManifestName is the list of every produced file with its size and
+// SHA-256, written to the output dir next to converted_media.json
+const FileManifestName = "manifest.json"
+
+// FileManifest lists the files a run produced, for integrity-checked deploys
+type FileManifest struct {
+	Files []FileManifestEntry `json:"files"`
+}
+
+// FileManifestEntry is one produced file. Path is keyed like Storage keys:
+// media files under "media/", output dir files by name.
+type FileManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// fileDigest is the size and hex SHA-256 of a file
+type fileDigest struct {
+	size int64
+	sum  string
+}
+
+// entryFiles lists the media dir files an entry and its children refer to
+func entryFiles(entry MediaFileEntry) []string {
+	var files []string
+	for _, version := range entry.Versions {
+		files = append(files, version.FileName)
+	}
+	if entry.Original != nil {
+		files = append(files, entry.Original.FileName)
+	}
+	if entry.VideoFileName != "" {
+		files = append(files, entry.VideoFileName)
+	}
+	if entry.Preview != nil {
+		files = append(files, entry.Preview.FileName)
+	}
+	for _, child := range entry.Children {
+		files = append(files, entryFiles(child)...)
+	}
+	return files
+}
+
+// mediaFileNames lists the media dir files a run produced, once each; a
+// video's original is its downloaded file, so names can repeat. The sprite
+// sheet is skipped when writing it failed.
+func mediaFileNames(mediaFilesArray []MediaFileEntry, mediaDir string, opts ProcessOptions) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, entry := range mediaFilesArray {
+		for _, name := range entryFiles(entry) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if opts.Sprite {
+		if _, err := os.Stat(filepath.Join(mediaDir, SpriteImageName)); err == nil {
+			names = append(names, SpriteImageName)
+		}
+	}
+	return names
+}
+
+// outputFileNames lists the output dir files a run produced. The sprite map
+// and feed are skipped when writing them failed; the file manifest and then
+// converted_media.json come last.
+func outputFileNames(outputDir string, opts ProcessOptions) []string {
+	var optional []string
+	if opts.Sprite {
+		optional = append(optional, SpriteMapName)
+	}
+	if opts.Feed != "" {
+		optional = append(optional, FeedFileName)
+	}
+
+	var names []string
+	for _, name := range optional {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err == nil {
+			names = append(names, name)
+		}
+	}
+	return append(names, FileManifestName, "converted_media.json")
+}
+
+// knownDigests collects the digests recorded while files were written this
+// run, keyed by media dir file name
+func knownDigests(mediaFilesArray []MediaFileEntry) map[string]fileDigest {
+	digests := make(map[string]fileDigest)
+	var add func(entry MediaFileEntry)
+	add = func(entry MediaFileEntry) {
+		for _, version := range entry.Versions {
+			if version.digest != "" {
+				digests[version.FileName] = fileDigest{size: version.Size, sum: version.digest}
+			}
+		}
+		if entry.Original != nil && entry.Original.digest != "" {
+			digests[entry.Original.FileName] = fileDigest{size: entry.Original.size, sum: entry.Original.digest}
+		}
+		for _, child := range entry.Children {
+			add(child)
+		}
+	}
+	for _, entry := range mediaFilesArray {
+		add(entry)
+	}
+	return digests
+}
+
+// hashFile streams a file through SHA-256
+func hashFile(path string) (fileDigest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	return fileDigest{size: size, sum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// writeFileManifest writes manifest.json for the run's media files and the
+// output files written before it. Files reused from an earlier run, or
+// rewritten after conversion such as a remuxed video, are hashed from disk.
+func writeFileManifest(ctx context.Context, mediaFilesArray []MediaFileEntry, mediaDir, outputDir string, opts ProcessOptions) error {
+	known := knownDigests(mediaFilesArray)
+	var manifest FileManifest
+
+	for _, name := range mediaFileNames(mediaFilesArray, mediaDir, opts) {
+		digest, ok := known[name]
+		if !ok {
+			var err error
+			if digest, err = hashFile(filepath.Join(mediaDir, filepath.FromSlash(name))); err != nil {
+				return fmt.Errorf("error hashing %s: %w", name, err)
+			}
+		}
+		manifest.Files = append(manifest.Files, FileManifestEntry{Path: mediaKey(name), Size: digest.size, SHA256: digest.sum})
+	}
+
+	for _, name := range outputFileNames(outputDir, opts) {
+		if name == FileManifestName {
+			continue
+		}
+		digest, err := hashFile(filepath.Join(outputDir, name))
+		if err != nil {
+			return fmt.Errorf("error hashing %s: %w", name, err)
+		}
+		manifest.Files = append(manifest.Files, FileManifestEntry{Path: name, Size: digest.size, SHA256: digest.sum})
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error creating file manifest JSON: %w", err)
+	}
+	store := opts.store
+	if store == nil {
+		store = newRunStorage(mediaDir, outputDir, nil)
+	}
+	return store.Put(ctx, FileManifestName, bytes.NewReader(manifestJSON), contentTypeFor(FileManifestName))
+}
+
+// VerifyFileManifest re-reads every file listed in the output dir's
+// manifest.json and returns a description of each one that is missing or
+// whose size or SHA-256 no longer matches
+func VerifyFileManifest(mediaDir, outputDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, FileManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading file manifest: %w", err)
+	}
+	var manifest FileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing file manifest: %w", err)
+	}
+
+	var problems []string
+	for _, file := range manifest.Files {
+		localPath := filepath.Join(outputDir, filepath.FromSlash(file.Path))
+		if name, ok := strings.CutPrefix(file.Path, storageMediaPrefix); ok {
+			localPath = filepath.Join(mediaDir, filepath.FromSlash(name))
+		}
+
+		digest, err := hashFile(localPath)
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("%s: missing", file.Path))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Path, err))
+		case digest.size != file.Size:
+			problems = append(problems, fmt.Sprintf("%s: size is %d, expected %d", file.Path, digest.size, file.Size))
+		case digest.sum != file.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: sha256 is %s, expected %s", file.Path, digest.sum, file.SHA256))
+		}
+	}
+	return problems, nil
+}
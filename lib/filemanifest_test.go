@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeManifestRun converts two local photos, keeping originals, and returns
+// the media and output dirs
+func writeManifestRun(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	media := []Media{
+		{ID: "one", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "one.png", 600, 400)), Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "two", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "two.png", 500, 400)), Timestamp: "2024-01-01T00:00:00+0000"},
+	}
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, ProcessOptions{KeepOriginals: true}); err != nil {
+		t.Fatal(err)
+	}
+	return mediaDir, outputDir
+}
+
+func TestFileManifestListsEveryFile(t *testing.T) {
+	mediaDir, outputDir := writeManifestRun(t)
+
+	data, err := os.ReadFile(filepath.Join(outputDir, FileManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest FileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file in the media dir, plus converted_media.json
+	var want []string
+	err = filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(mediaDir, path)
+		want = append(want, "media/"+filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "converted_media.json")
+
+	var got []string
+	for _, file := range manifest.Files {
+		got = append(got, file.Path)
+		localPath := filepath.Join(outputDir, filepath.FromSlash(file.Path))
+		if name, ok := strings.CutPrefix(file.Path, "media/"); ok {
+			localPath = filepath.Join(mediaDir, filepath.FromSlash(name))
+		}
+		data, err := os.ReadFile(localPath)
+		if err != nil {
+			t.Errorf("%s: %v", file.Path, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if file.Size != int64(len(data)) || file.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s is recorded as %d bytes %s, the file is %d bytes %x", file.Path, file.Size, file.SHA256, len(data), sum)
+		}
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("manifest lists %v, want %v", got, want)
+	}
+
+	problems, err := VerifyFileManifest(mediaDir, outputDir)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("fresh output: got %v, %v, want no problems", problems, err)
+	}
+}
+
+func TestVerifyFileManifestReportsTampering(t *testing.T) {
+	mediaDir, outputDir := writeManifestRun(t)
+	versions := readManifest(t, outputDir)[0].Versions
+	var names []string
+	for _, version := range versions {
+		names = append(names, version.FileName)
+	}
+	slices.Sort(names)
+	if len(names) < 3 {
+		t.Fatalf("need three versions to tamper with, got %v", names)
+	}
+	edited, truncated, deleted := names[0], names[1], names[2]
+
+	// Same size, one byte changed
+	path := filepath.Join(mediaDir, edited)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(mediaDir, truncated), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(mediaDir, deleted)); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := VerifyFileManifest(mediaDir, outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"media/" + edited + ": sha256 is",
+		"media/" + truncated + ": size is 10",
+		"media/" + deleted + ": missing",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got problems %q, want %d", problems, len(want))
+	}
+	for _, prefix := range want {
+		if !slices.ContainsFunc(problems, func(p string) bool { return strings.HasPrefix(p, prefix) }) {
+			t.Errorf("problems %q do not include %q", problems, prefix)
+		}
+	}
+}
+
+func TestVerifyFileManifestNeedsAManifest(t *testing.T) {
+	if _, err := VerifyFileManifest(t.TempDir(), t.TempDir()); err == nil {
+		t.Error("got no error without a manifest")
+	}
+}
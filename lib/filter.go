@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/relvacode/iso8601"
+)
+
+// ParseDate parses an RFC3339 timestamp or a YYYY-MM-DD date. A bare date
+// means the start of that day (UTC), or its last instant when endOfDay is set,
+// so date-only ranges include the whole final day.
+func ParseDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: expected RFC3339 or YYYY-MM-DD", value)
+	}
+	if endOfDay {
+		return day.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return day, nil
+}
+
+// FilterMediaByDate keeps media whose timestamp falls within since and until,
+// inclusive. A zero since or until leaves that end of the range open. Media
+// with unparseable timestamps are dropped with a warning.
+func FilterMediaByDate(media []Media, since, until time.Time) []Media {
+	if since.IsZero() && until.IsZero() {
+		return media
+	}
+
+	var filtered []Media
+	for _, item := range media {
+		timestamp, err := iso8601.ParseString(item.Timestamp)
+		if err != nil {
+			logger.Warn("skipping media with unparseable timestamp", "media_id", item.ID, "timestamp", item.Timestamp)
+			continue
+		}
+		if !since.IsZero() && timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && timestamp.After(until) {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+
+	logger.Info("date filter applied", "kept", len(filtered), "total", len(media))
+	return filtered
+}
+
+// LimitMostRecent returns the n most recent media, newest first. Media with
+// unparseable timestamps sort last; n <= 0 returns media unchanged.
+func LimitMostRecent(media []Media, n int) []Media {
+	if n <= 0 || len(media) <= n {
+		return media
+	}
+
+	sorted := slices.Clone(media)
+	slices.SortStableFunc(sorted, func(a, b Media) int {
+		timeA, errA := iso8601.ParseString(a.Timestamp)
+		timeB, errB := iso8601.ParseString(b.Timestamp)
+		switch {
+		case errA != nil && errB != nil:
+			return 0
+		case errA != nil:
+			return 1
+		case errB != nil:
+			return -1
+		}
+		return timeB.Compare(timeA)
+	})
+
+	logger.Info("limiting to most recent media", "limit", n, "total", len(media))
+	return sorted[:n]
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFilterMediaByDate(t *testing.T) {
+	media := []Media{
+		{ID: "new-year", Timestamp: "2023-01-01T00:00:00+0000"},
+		{ID: "summer", Timestamp: "2023-07-15T12:30:00+0000"},
+		{ID: "eve", Timestamp: "2023-12-31T23:59:59+0000"},
+		{ID: "next-year", Timestamp: "2024-01-01T00:00:00+0000"},
+		{ID: "broken", Timestamp: "yesterday"},
+	}
+	date := func(value string, endOfDay bool) time.Time {
+		t.Helper()
+		parsed, err := ParseDate(value, endOfDay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name         string
+		since, until time.Time
+		want         []string
+	}{
+		{"whole year", date("2023-01-01", false), date("2023-12-31", true), []string{"new-year", "summer", "eve"}},
+		{"only since", date("2023-07-15T12:30:00Z", false), time.Time{}, []string{"summer", "eve", "next-year"}},
+		{"only until", time.Time{}, date("2023-07-15", true), []string{"new-year", "summer"}},
+		{"offset until", time.Time{}, date("2023-12-31T23:59:59-01:00", false), []string{"new-year", "summer", "eve", "next-year"}},
+		{"no range", time.Time{}, time.Time{}, mediaIDs(media)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mediaIDs(FilterMediaByDate(media, tt.since, tt.until)); !slices.Equal(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value    string
+		endOfDay bool
+		want     time.Time
+		wantErr  bool
+	}{
+		{"2023-03-04", false, time.Date(2023, 3, 4, 0, 0, 0, 0, time.UTC), false},
+		{"2023-03-04", true, time.Date(2023, 3, 4, 23, 59, 59, 999999999, time.UTC), false},
+		{"2023-03-04T05:06:07Z", true, time.Date(2023, 3, 4, 5, 6, 7, 0, time.UTC), false},
+		{"04/03/2023", false, time.Time{}, true},
+		{"2023-13-01", false, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDate(tt.value, tt.endOfDay)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("ParseDate(%q, %v) = %v, %v, want %v", tt.value, tt.endOfDay, got, err, tt.want)
+		}
+	}
+}
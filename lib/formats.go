@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/kolesa-team/go-webp/decoder"
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+)
+
+// Output formats an image version can be encoded as
+const (
+	FormatWebP         = "webp"
+	FormatWebPLossless = "webp-lossless"
+	FormatAVIF         = "avif"
+	FormatJPEG         = "jpeg"
+)
+
+// losslessLevel is the go-webp lossless effort level (0 fastest, 9 smallest)
+const losslessLevel = 6
+
+// EncodeOptions controls how output images are encoded
+type EncodeOptions struct {
+	// Quality is the lossy quality from 1 to 100; 0 uses the default of 80
+	Quality int
+	// Preset is a WebP preset name; empty uses "default"
+	Preset string
+	// ImageHint is a WebP image hint name; empty uses "default"
+	ImageHint string
+}
+
+// webpPresets maps preset names to go-webp encoding presets
+var webpPresets = map[string]encoder.EncodingPreset{
+	"default": encoder.PresetDefault,
+	"picture": encoder.PresetPicture,
+	"photo":   encoder.PresetPhoto,
+	"drawing": encoder.PresetDrawing,
+	"icon":    encoder.PresetIcon,
+	"text":    encoder.PresetText,
+}
+
+// webpImageHints maps hint names to go-webp image hints
+var webpImageHints = map[string]encoder.ImageHint{
+	"default": encoder.HintDefault,
+	"picture": encoder.HintPicture,
+	"photo":   encoder.HintPhoto,
+	"graph":   encoder.HintGraph,
+}
+
+// withDefaults fills in unset fields
+func (o EncodeOptions) withDefaults() EncodeOptions {
+	if o.Quality == 0 {
+		o.Quality = 80
+	}
+	if o.Preset == "" {
+		o.Preset = "default"
+	}
+	if o.ImageHint == "" {
+		o.ImageHint = "default"
+	}
+	return o
+}
+
+// Validate checks the quality range, preset and image hint names
+func (o EncodeOptions) Validate() error {
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100, got %d", o.Quality)
+	}
+	if _, ok := webpPresets[o.withDefaults().Preset]; !ok {
+		return fmt.Errorf("unknown WebP preset %q (expected default, photo, picture, drawing, icon or text)", o.Preset)
+	}
+	if _, ok := webpImageHints[o.withDefaults().ImageHint]; !ok {
+		return fmt.Errorf("unknown WebP image hint %q (expected default, picture, photo or graph)", o.ImageHint)
+	}
+	return nil
+}
+
+// ValidateFormat checks that format is a supported output format. AVIF is
+// encoded with libavif's avifenc and decoded back, for the sprite sheet and
+// verification, with avifdec; both must be on PATH.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatWebP, FormatWebPLossless, FormatJPEG:
+		return nil
+	case FormatAVIF:
+		for _, tool := range []string{"avifenc", "avifdec"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				return fmt.Errorf("avif output needs %s on PATH: %w", tool, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported output format %q (expected %s, %s, %s or %s)",
+		format, FormatWebP, FormatWebPLossless, FormatAVIF, FormatJPEG)
+}
+
+// formatExtension returns the file extension for an output format
+func formatExtension(format string) string {
+	switch format {
+	case FormatJPEG:
+		return "jpg"
+	case FormatAVIF:
+		return "avif"
+	default:
+		return "webp"
+	}
+}
+
+// encodeImage encodes img to w in the given output format. ctx bounds the
+// external encoder, when the format needs one.
+func encodeImage(ctx context.Context, w io.Writer, img image.Image, format string, opts EncodeOptions) error {
+	opts = opts.withDefaults()
+	switch format {
+	case FormatJPEG:
+		if err := jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
+			return fmt.Errorf("failed to encode to JPEG: %w", err)
+		}
+		return nil
+	case FormatAVIF:
+		return encodeAVIF(ctx, w, img, opts)
+	}
+
+	preset, ok := webpPresets[opts.Preset]
+	if !ok {
+		return fmt.Errorf("unknown WebP preset %q", opts.Preset)
+	}
+
+	var options *encoder.Options
+	var err error
+	if format == FormatWebPLossless {
+		options, err = encoder.NewLosslessEncoderOptions(preset, losslessLevel)
+	} else {
+		options, err = encoder.NewLossyEncoderOptions(preset, float32(opts.Quality))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create encoder options: %w", err)
+	}
+
+	hint, ok := webpImageHints[opts.ImageHint]
+	if !ok {
+		return fmt.Errorf("unknown WebP image hint %q", opts.ImageHint)
+	}
+	options.ImageHint = hint
+
+	if err := webp.Encode(w, img, options); err != nil {
+		return fmt.Errorf("failed to encode to WebP: %w", err)
+	}
+	return nil
+}
+
+// encodeAVIF encodes img through avifenc, using temporary PNG and AVIF files
+func encodeAVIF(ctx context.Context, w io.Writer, img image.Image, opts EncodeOptions) error {
+	return withTempFile("avif-src-*.png", func(src *os.File) error {
+		if err := png.Encode(src, img); err != nil {
+			return fmt.Errorf("failed to write AVIF source: %w", err)
+		}
+		if err := src.Close(); err != nil {
+			return err
+		}
+
+		return withTempFile("avif-out-*.avif", func(dst *os.File) error {
+			cmd := exec.CommandContext(ctx, "avifenc", "-q", strconv.Itoa(opts.Quality), src.Name(), dst.Name())
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to encode to AVIF: %w: %s", err, bytes.TrimSpace(output))
+			}
+
+			_, err := io.Copy(w, dst)
+			return err
+		})
+	})
+}
+
+// decodeAVIF decodes an AVIF file through avifdec
+func decodeAVIF(ctx context.Context, r io.Reader) (image.Image, error) {
+	var decoded image.Image
+	err := withTempFile("avif-in-*.avif", func(src *os.File) error {
+		if _, err := io.Copy(src, r); err != nil {
+			return err
+		}
+		if err := src.Close(); err != nil {
+			return err
+		}
+
+		return withTempFile("avif-dec-*.png", func(dst *os.File) error {
+			cmd := exec.CommandContext(ctx, "avifdec", src.Name(), dst.Name())
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("avifdec failed: %w: %s", err, bytes.TrimSpace(output))
+			}
+
+			var err error
+			decoded, err = png.Decode(dst)
+			return err
+		})
+	})
+	return decoded, err
+}
+
+// decodeImage decodes an encoded output file in the given format
+func decodeImage(ctx context.Context, r io.Reader, format string) (image.Image, error) {
+	switch format {
+	case FormatJPEG:
+		return jpeg.Decode(r)
+	case FormatAVIF:
+		return decodeAVIF(ctx, r)
+	default:
+		return webp.Decode(r, &decoder.Options{})
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"image"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubTool writes an executable shell script named name into a directory
+// put first on PATH for the rest of the test
+func stubTool(t *testing.T, name, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub tools are shell scripts")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestEncodeAVIFStopsWithContext(t *testing.T) {
+	stubTool(t, "avifenc", "exec sleep 30")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err := encodeImage(ctx, &bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 4, 4)), FormatAVIF, EncodeOptions{})
+	if err == nil {
+		t.Fatal("got no error from an encoder that never finished")
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("avifenc ran for %s after the context ended", elapsed)
+	}
+}
+
+func TestDecodeAVIFStopsWithContext(t *testing.T) {
+	stubTool(t, "avifdec", "exec sleep 30")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := decodeImage(ctx, strings.NewReader("avif"), FormatAVIF); err == nil {
+		t.Fatal("got no error from a decoder that never finished")
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("avifdec ran for %s after the context ended", elapsed)
+	}
+}
+
+func TestValidateFormatNeedsBothAVIFTools(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub tools are shell scripts")
+	}
+	// Only avifenc is reachable: PATH holds nothing but its stub
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "avifenc"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	err := ValidateFormat(FormatAVIF)
+	if err == nil || !strings.Contains(err.Error(), "avifdec") {
+		t.Errorf("got %v, want an error naming avifdec", err)
+	}
+}
+
+func TestEachFormatDecodesAtRecordedSize(t *testing.T) {
+	source := writeTestPNG(t, t.TempDir(), "source.png", 300, 200)
+	data, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{FormatWebP, FormatWebPLossless, FormatJPEG, FormatAVIF} {
+		t.Run(format, func(t *testing.T) {
+			if err := ValidateFormat(format); err != nil {
+				t.Skip(err)
+			}
+			mediaDir := t.TempDir()
+			result, err := convertImageData(context.Background(), data, "formats", mediaDir, ProcessOptions{Format: format}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, version := range result.Versions {
+				file, err := os.Open(filepath.Join(mediaDir, version.FileName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				img, err := decodeImage(context.Background(), file, format)
+				file.Close()
+				if err != nil {
+					t.Fatalf("%s does not decode: %v", version.FileName, err)
+				}
+				if got := img.Bounds().Size(); got.X != version.Width || got.Y != version.Height {
+					t.Errorf("%s is %dx%d, recorded as %dx%d", version.FileName, got.X, got.Y, version.Width, version.Height)
+				}
+			}
+		})
+	}
+}
+
+func TestLowerQualityEncodesSmaller(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i*7 + i/256*13)
+	}
+
+	size := func(quality int) int {
+		var buf bytes.Buffer
+		if err := encodeImage(context.Background(), &buf, img, FormatWebP, EncodeOptions{Quality: quality, Preset: "photo"}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Len()
+	}
+	if low, high := size(10), size(95); low >= high {
+		t.Errorf("quality 10 gave %d bytes, quality 95 gave %d, want the low quality smaller", low, high)
+	}
+}
+
+func TestEncodeOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    EncodeOptions
+		wantErr bool
+	}{
+		{EncodeOptions{Quality: 80}, false},
+		{EncodeOptions{Quality: 1, Preset: "text", ImageHint: "graph"}, false},
+		{EncodeOptions{Quality: 0}, true},
+		{EncodeOptions{Quality: 101}, true},
+		{EncodeOptions{Quality: 80, Preset: "vivid"}, true},
+		{EncodeOptions{Quality: 80, ImageHint: "sketch"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: got error %v, want error %v", tt.opts, err, tt.wantErr)
+		}
+	}
+}
+
+func TestContentHashNamesFollowEncodedBytes(t *testing.T) {
+	source, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "source.png", 800, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	convert := func(quality int) []ImageVersionEntry {
+		t.Helper()
+		mediaDir := t.TempDir()
+		opts := ProcessOptions{ContentHash: true, Encode: EncodeOptions{Quality: quality}}
+		result, err := convertImageData(context.Background(), source, "abc", mediaDir, opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, version := range result.Versions {
+			data, err := os.ReadFile(filepath.Join(mediaDir, version.FileName))
+			if err != nil {
+				t.Fatalf("file_name %s is not on disk: %v", version.FileName, err)
+			}
+			sum := sha256.Sum256(data)
+			if want := contentHashedName(versionFileName("abc", version.Width, version.name, FormatWebP), sum); version.FileName != want {
+				t.Errorf("%s does not carry the hash of its bytes, want %s", version.FileName, want)
+			}
+		}
+		return result.Versions
+	}
+
+	low, high, again := convert(40), convert(90), convert(90)
+	for i := range low {
+		if low[i].FileName == high[i].FileName {
+			t.Errorf("qualities 40 and 90 both wrote %s", low[i].FileName)
+		}
+		if high[i].FileName != again[i].FileName {
+			t.Errorf("the same encode was named %s and then %s", high[i].FileName, again[i].FileName)
+		}
+	}
+}
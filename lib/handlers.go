@@ -1,19 +1,61 @@
 package lib
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 )
 
+// newOAuthState returns a random value tying an authorize redirect to the
+// session that started it
+func newOAuthState() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
 func IndexHandler(cfg InstagramConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authURL := "https://api.instagram.com/oauth/authorize?client_id=" + cfg.ClientID +
-			"&redirect_uri=" + cfg.RedirectURI +
-			"&scope=user_profile,user_media&response_type=code"
+		// The callback only accepts the state stored in this session, so a
+		// code obtained by someone else cannot be fed to it (CSRF)
+		state, err := newOAuthState()
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "index.html", gin.H{
+				"Error": "Failed to start login",
+			})
+			return
+		}
+		session := sessions.Default(c)
+		session.Set(sessionOAuthStateKey, state)
+		if err := session.Save(); err != nil {
+			c.HTML(http.StatusInternalServerError, "index.html", gin.H{
+				"Error": "Failed to save session",
+			})
+			return
+		}
+
+		authURL := "https://api.instagram.com/oauth/authorize?" + url.Values{
+			"client_id":     {cfg.ClientID},
+			"redirect_uri":  {cfg.RedirectURI},
+			"scope":         {"user_profile,user_media"},
+			"response_type": {"code"},
+			"state":         {state},
+		}.Encode()
 		c.HTML(http.StatusOK, "index.html", gin.H{
 			"AuthURL": authURL,
 			"DevMode": true, // Flag to show manual token option
@@ -21,8 +63,23 @@ func IndexHandler(cfg InstagramConfig) gin.HandlerFunc {
 	}
 }
 
-func AuthCallbackHandler(cfg InstagramConfig) gin.HandlerFunc {
+// AuthCallbackHandler completes the web login, keeping the long-lived token
+// in the session. The first token obtained is also seeded into tokens, so
+// the CLI can use and refresh it.
+func AuthCallbackHandler(cfg InstagramConfig, tokens TokenStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// The state is single use whether or not it matches
+		session := sessions.Default(c)
+		expected, _ := session.Get(sessionOAuthStateKey).(string)
+		session.Delete(sessionOAuthStateKey)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(expected)) != 1 {
+			session.Save()
+			c.HTML(http.StatusBadRequest, "index.html", gin.H{
+				"Error": "Login request did not match this session, please try again",
+			})
+			return
+		}
+
 		code := c.Query("code")
 
 		tokenRes, err := ExchangeCodeForToken(cfg, code)
@@ -41,17 +98,78 @@ func AuthCallbackHandler(cfg InstagramConfig) gin.HandlerFunc {
 			return
 		}
 
-		accessToken := longTokenRes.AccessToken
+		// The long-lived exchange does not always echo the user ID
 		userId := longTokenRes.UserID
+		if userId == "" {
+			userId = tokenRes.UserID
+		}
+
+		session.Set(sessionAccessTokenKey, longTokenRes.AccessToken)
+		session.Set(sessionUserIDKey, userId)
+		if err := session.Save(); err != nil {
+			c.HTML(http.StatusInternalServerError, "index.html", gin.H{
+				"Error": "Failed to save session",
+			})
+			return
+		}
+
+		seed := &TokenResponse{AccessToken: longTokenRes.AccessToken, UserID: userId, ExpiresIn: longTokenRes.ExpiresIn}
+		if seeded, err := tokens.Seed(seed); err != nil {
+			logger.Warn("could not store token", "path", tokens.Path, "error", err)
+		} else if seeded {
+			logger.Info("stored token", "path", tokens.Path)
+		}
+
+		c.Redirect(http.StatusFound, "/recent")
+	}
+}
+
+// Session keys the web auth flow stores the token under
+const (
+	sessionAccessTokenKey = "access_token"
+	sessionUserIDKey      = "user_id"
+	sessionOAuthStateKey  = "oauth_state"
+)
+
+// RecentHandler shows the recent media of the account logged in to this
+// session, redirecting to the index when there is no session
+func RecentHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		accessToken, _ := session.Get(sessionAccessTokenKey).(string)
+		userId, _ := session.Get(sessionUserIDKey).(string)
+		if accessToken == "" || userId == "" {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		recentMedia, err := FetchRecentMedia(userId, accessToken)
+		if err != nil {
+			c.HTML(http.StatusBadGateway, "posts.html", gin.H{
+				"Error": fmt.Sprintf("Error fetching media: %v", err),
+			})
+			return
+		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"AccessToken": accessToken,
-			"UserID":      userId,
-			"ExpiresIn":   longTokenRes.ExpiresIn,
+		c.HTML(http.StatusOK, "posts.html", gin.H{
+			"Media": recentMedia,
 		})
 	}
 }
 
+// LogoutHandler clears the session and returns to the index
+func LogoutHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		session.Clear()
+		session.Options(sessionOptions(-1))
+		if err := session.Save(); err != nil {
+			logger.Error("error clearing session", "error", err)
+		}
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
 // ManualTokenFormHandler New handler for manual token entry form
 func ManualTokenFormHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -82,13 +200,231 @@ func ProcessManualTokenHandler() gin.HandlerFunc {
 			return
 		}
 
-		recentMedia, nil := FetchRecentMedia(userId, accessToken) // Fetch media to validate token
-		recentMediaJSON, err := json.Marshal(recentMedia)
-		if !errors.Is(nil, err) {
-			c.AbortWithError(http.StatusInternalServerError, err)
+		recentMedia, err := FetchRecentMedia(userId, accessToken) // Fetch media to validate token
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "manual.html", gin.H{
+				"Error": fmt.Sprintf("Error fetching media: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, recentMedia)
+	}
+}
+
+// channelReporter forwards progress events to a channel until ctx is done
+type channelReporter struct {
+	ctx    context.Context
+	events chan<- ProgressEvent
+}
+
+func (r channelReporter) Report(event ProgressEvent) {
+	select {
+	case r.events <- event:
+	case <-r.ctx.Done():
+	}
+}
+
+// sameSiteRequest reports whether a request came from this site's own pages
+// rather than being triggered by another site. Browsers mark cross-site
+// requests with Sec-Fetch-Site and Origin; requests carrying neither, such as
+// from curl, are not cross-site.
+func sameSiteRequest(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		parsed, err := url.Parse(origin)
+		return err == nil && parsed.Host == r.Host
+	}
+	return true
+}
+
+// FetchStreamHandler runs the media pipeline on the media listed in jsonFiles and
+// streams per-item progress to the client as Server-Sent Events. Disconnecting
+// cancels the run. Only callers logged in to this session may start a run, and
+// not from another site. The output dir is locked for the whole run, so it
+// cannot overlap another run on the same dir, in this process or not.
+func FetchStreamHandler(jsonFiles []string, mediaDir, outputDir string, opts ProcessOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !sameSiteRequest(c.Request) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cross-site requests may not start a fetch"})
+			return
+		}
+		session := sessions.Default(c)
+		if accessToken, _ := session.Get(sessionAccessTokenKey).(string); accessToken == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "log in to start a fetch"})
+			return
+		}
+
+		lock, err := LockOutputDir(c.Request.Context(), outputDir, false)
+		if errors.Is(err, ErrLocked) {
+			c.JSON(http.StatusConflict, gin.H{"error": "a fetch is already running"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer func() {
+			if err := lock.Unlock(); err != nil {
+				logger.Warn("error releasing output directory lock", "error", err)
+			}
+		}()
+
+		recentMedia, err := LoadMediaFiles(jsonFiles)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		events := make(chan ProgressEvent)
+		done := make(chan struct{})
+		runOpts := opts
+		runOpts.Reporter = channelReporter{ctx: ctx, events: events}
+
+		go func() {
+			defer close(done)
+			if err := FetchAndTransformImages(ctx, recentMedia, mediaDir, outputDir, runOpts); err != nil {
+				logger.Error("error running fetch stream", "error", err)
+			}
+		}()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event := <-events:
+				c.SSEvent(event.Type, event)
+				return true
+			case <-done:
+				return false
+			case <-ctx.Done():
+				return false
+			}
+		})
+
+		// Stop the run if the client went away and wait for it to wind down
+		cancel()
+		<-done
+	}
+}
+
+// MediaJSONHandler serves the converted_media.json written by the pipeline
+func MediaJSONHandler(manifest *ManifestCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, _, err := manifest.load()
+		if data == nil {
+			manifestError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/json", data)
+	}
+}
+
+// MediaEntryHandler serves the single manifest entry matching the :id parameter
+func MediaEntryHandler(manifest *ManifestCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, entries, err := manifest.load()
+		if err != nil {
+			manifestError(c, err)
+			return
+		}
+
+		entry, ok := entries[c.Param("id")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("media %s not found", c.Param("id"))})
 			return
 		}
+		c.JSON(http.StatusOK, entry)
+	}
+}
+
+// manifestError reports a manifest that could not be loaded, using 404 when
+// the pipeline has not written one yet
+func manifestError(c *gin.Context, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "converted_media.json not found, run the media pipeline first"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// requiredTemplates are the pages the server renders
+var requiredTemplates = []string{"index.html", "manual.html", "posts.html"}
+
+// graphAPIHealthURL is requested to check that the Graph API is reachable
+const graphAPIHealthURL = "https://graph.instagram.com/"
+
+// upstreamCheckTTL is how long an upstream check result is reused, so
+// frequent probes don't each reach out to Instagram
+const upstreamCheckTTL = 30 * time.Second
+
+// upstreamCheckTimeout bounds a single upstream check
+const upstreamCheckTimeout = 5 * time.Second
+
+// HealthHandler reports liveness; it succeeds whenever the server is up
+func HealthHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ReadinessHandler reports whether the server can serve pages: the templates
+// must have loaded and, when checkUpstream is set, the Graph API must answer.
+// Failures return 503 with the reason.
+func ReadinessHandler(templates *template.Template, checkUpstream bool) gin.HandlerFunc {
+	var mu sync.Mutex
+	var checkedAt time.Time
+	var upstreamErr error
+
+	return func(c *gin.Context) {
+		for _, name := range requiredTemplates {
+			if templates == nil || templates.Lookup(name) == nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": fmt.Sprintf("template %s is not loaded", name)})
+				return
+			}
+		}
 
-		c.JSON(http.StatusOK, string(recentMediaJSON))
+		if checkUpstream {
+			mu.Lock()
+			if time.Since(checkedAt) > upstreamCheckTTL {
+				upstreamErr = checkGraphAPI(c.Request.Context())
+				checkedAt = time.Now()
+			}
+			err := upstreamErr
+			mu.Unlock()
+
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": fmt.Sprintf("Graph API unreachable: %v", err)})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	}
+}
+
+// checkGraphAPI reports whether the Graph API answers at all; any HTTP
+// response, even an error status, means it is reachable
+func checkGraphAPI(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, graphAPIHealthURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %s", resp.Status)
 	}
+	return nil
 }
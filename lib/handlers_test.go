@@ -0,0 +1,554 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// streamRecorder is a ResponseRecorder gin can stream to, which needs a
+// CloseNotifier; the client never goes away on its own
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (streamRecorder) CloseNotify() <-chan bool {
+	return nil
+}
+
+// testSessionSecret is long enough for NewSessionStore
+const testSessionSecret = "test-session-secret-of-32-characters"
+
+// newTestRouter returns a router with a session store, logged in when
+// loggedIn is set
+func newTestRouter(loggedIn bool) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	store, err := NewSessionStore(testSessionSecret)
+	if err != nil {
+		panic(err)
+	}
+	router.Use(sessions.Sessions("test", store))
+	if loggedIn {
+		router.Use(func(c *gin.Context) {
+			session := sessions.Default(c)
+			session.Set(sessionAccessTokenKey, "token")
+			session.Set(sessionUserIDKey, "1")
+		})
+	}
+	return router
+}
+
+func TestFetchStreamHandlerRequiresSession(t *testing.T) {
+	dir := t.TempDir()
+	router := newTestRouter(false)
+	router.GET("/api/fetch/stream", FetchStreamHandler(nil, filepath.Join(dir, "media"), dir, ProcessOptions{}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/fetch/stream", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestFetchStreamHandlerRefusesCrossSite(t *testing.T) {
+	dir := t.TempDir()
+	router := newTestRouter(true)
+	router.GET("/api/fetch/stream", FetchStreamHandler(nil, filepath.Join(dir, "media"), dir, ProcessOptions{}))
+
+	for _, header := range [][2]string{
+		{"Sec-Fetch-Site", "cross-site"},
+		{"Origin", "https://attacker.example"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/fetch/stream", nil)
+		req.Header.Set(header[0], header[1])
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: %s: status = %d, want %d", header[0], header[1], w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestFetchStreamHandlerRefusesLockedOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockOutputDir(context.Background(), dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	router := newTestRouter(true)
+	router.GET("/api/fetch/stream", FetchStreamHandler(nil, filepath.Join(dir, "media"), dir, ProcessOptions{}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/fetch/stream", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestFetchStreamHandlerStreamsEvents(t *testing.T) {
+	dir := t.TempDir()
+	source := writeTestPNG(t, dir, "a.png", 64, 48)
+	jsonFile := writeMediaJSON(t, dir, "recent_media.json", []Media{
+		{ID: "a", MediaType: "IMAGE", MediaURL: localFileURL(source), Timestamp: "2024-01-01T00:00:00+0000"},
+	})
+	outputDir := filepath.Join(dir, "output")
+
+	router := newTestRouter(true)
+	router.GET("/api/fetch/stream", FetchStreamHandler([]string{jsonFile}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{}))
+
+	w := streamRecorder{httptest.NewRecorder()}
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/fetch/stream", nil))
+
+	body := w.Body.String()
+	for _, event := range []string{EventStarted, EventProcessed, EventComplete} {
+		if !strings.Contains(body, "event:"+event+"\n") {
+			t.Errorf("stream has no %s event:\n%s", event, body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, LockFileName)); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind after the run: %v", err)
+	}
+}
+
+func TestFetchStreamHandlerDisconnectCancelsRun(t *testing.T) {
+	requested := make(chan struct{})
+	aborted := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	jsonFile := writeMediaJSON(t, dir, "recent_media.json", []Media{
+		{ID: "slow", MediaType: "IMAGE", MediaURL: upstream.URL + "/slow.jpg", Timestamp: "2024-01-01T00:00:00+0000"},
+	})
+	outputDir := filepath.Join(dir, "output")
+
+	router := newTestRouter(true)
+	router.GET("/api/fetch/stream", FetchStreamHandler([]string{jsonFile}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{}))
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/api/fetch/stream", nil).WithContext(ctx)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		router.ServeHTTP(streamRecorder{httptest.NewRecorder()}, req)
+	}()
+
+	select {
+	case <-requested:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the run never reached the download")
+	}
+	disconnect()
+
+	for name, done := range map[string]chan struct{}{"download": aborted, "handler": served} {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s still running after the client disconnected", name)
+		}
+	}
+}
+
+func TestNewSessionStoreRejectsShortSecrets(t *testing.T) {
+	for _, secret := range []string{"", "short-secret"} {
+		if _, err := NewSessionStore(secret); err == nil {
+			t.Errorf("secret %q was accepted", secret)
+		}
+	}
+}
+
+// instagramServer mocks the OAuth and Graph API endpoints the web login
+// uses, for user 42 with a single post
+func instagramServer(t *testing.T) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/access_token":
+			json.NewEncoder(w).Encode(TokenResponse{AccessToken: "short-token", UserID: "42"})
+		case "/access_token":
+			json.NewEncoder(w).Encode(TokenResponse{AccessToken: "long-token", ExpiresIn: 60 * 24 * 60 * 60})
+		case "/42/media":
+			if r.URL.Query().Get("access_token") != "long-token" {
+				http.Error(w, "wrong token", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(MediaResponse{Data: []Media{{ID: "post-1", MediaType: "IMAGE"}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	routeTo(t, server)
+}
+
+// sessionCookie returns the session cookie a response set
+func sessionCookie(t *testing.T, resp *http.Response) *http.Cookie {
+	t.Helper()
+	for _, c := range resp.Cookies() {
+		if c.Name == "instagram-recents-go" {
+			return c
+		}
+	}
+	t.Fatalf("%s set no session cookie", resp.Request.URL.Path)
+	return nil
+}
+
+// loginServer serves the web login routes over TLS with a cookie-keeping
+// client that does not follow redirects, and returns a function that GETs a
+// path and reads the body
+func loginServer(t *testing.T, tokens TokenStore) func(path string) (*http.Response, string) {
+	t.Helper()
+	store, err := NewSessionStore(testSessionSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(sessions.Sessions("instagram-recents-go", store))
+	templates := template.Must(template.New("index.html").Parse(`{{.Error}}{{.AuthURL}}`))
+	template.Must(templates.New("posts.html").Parse(`{{.Error}}{{range .Media}}{{.ID}} {{end}}`))
+	router.SetHTMLTemplate(templates)
+	router.GET("/", IndexHandler(InstagramConfig{ClientID: "client"}))
+	router.GET("/auth/callback", AuthCallbackHandler(InstagramConfig{ClientID: "client"}, tokens))
+	router.GET("/recent", RecentHandler())
+	router.GET("/logout", LogoutHandler())
+
+	server := httptest.NewTLSServer(router)
+	t.Cleanup(server.Close)
+	client := server.Client()
+	client.Jar, _ = cookiejar.New(nil)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+}
+
+// authState starts a login at the index and returns the state in its
+// authorize URL
+func authState(t *testing.T, get func(path string) (*http.Response, string)) string {
+	t.Helper()
+	_, body := get("/")
+	authURL, err := url.Parse(html.UnescapeString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authURL.Query().Get("state")
+}
+
+func TestWebLoginFlow(t *testing.T) {
+	instagramServer(t)
+	tokens := TokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+	get := loginServer(t, tokens)
+
+	// Logged out, /recent sends the visitor to the index
+	if resp, _ := get("/recent"); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("/recent before login: %s to %q, want a redirect to /", resp.Status, resp.Header.Get("Location"))
+	}
+
+	// The index starts the login with a state the callback must echo
+	state := authState(t, get)
+	resp, _ := get("/auth/callback?code=code&state=" + url.QueryEscape(state))
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/recent" {
+		t.Fatalf("callback: %s to %q, want a redirect to /recent", resp.Status, resp.Header.Get("Location"))
+	}
+	cookie := sessionCookie(t, resp)
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie is not HttpOnly, Secure and SameSite=Lax: %s", cookie)
+	}
+	if strings.Contains(cookieValue(t, cookie), "long-token") {
+		t.Error("the session cookie holds the access token in the clear")
+	}
+	if tok, err := tokens.Load(); err != nil || tok == nil || tok.AccessToken != "long-token" {
+		t.Errorf("token store holds %+v, %v, want the long-lived token", tok, err)
+	}
+
+	if resp, body := get("/recent"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "post-1") {
+		t.Fatalf("/recent after login: %s %q, want the user's posts", resp.Status, body)
+	}
+
+	resp, _ = get("/logout")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("logout: %s to %q, want a redirect to /", resp.Status, resp.Header.Get("Location"))
+	}
+	if cookie := sessionCookie(t, resp); cookie.MaxAge >= 0 || !cookie.Secure {
+		t.Errorf("logout did not delete the session cookie: %s", cookie)
+	}
+	if resp, _ := get("/recent"); resp.StatusCode != http.StatusFound {
+		t.Errorf("/recent after logout: %s, want a redirect", resp.Status)
+	}
+}
+
+func TestOAuthStateRejectsTampering(t *testing.T) {
+	instagramServer(t)
+	tokens := TokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+	get := loginServer(t, tokens)
+
+	// No login was started in this session, so there is no state to match
+	if resp, body := get("/auth/callback?code=code&state=guess"); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "did not match") {
+		t.Errorf("callback without a started login: %s %q, want 400", resp.Status, body)
+	}
+
+	state := authState(t, get)
+	if raw, err := base64.RawURLEncoding.DecodeString(state); err != nil || len(raw) != 32 {
+		t.Errorf("state %q is not 32 random bytes", state)
+	}
+	if again := authState(t, get); again == state {
+		t.Error("two logins were given the same state")
+	}
+
+	state = authState(t, get)
+	tampered := []byte(state)
+	tampered[0] ^= 1
+	for _, query := range []string{"code=code", "code=code&state=" + url.QueryEscape(string(tampered))} {
+		if resp, _ := get("/auth/callback?" + query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("callback with %q: %s, want 400", query, resp.Status)
+		}
+	}
+	// The state was spent by the failed attempt, so it cannot be replayed
+	if resp, _ := get("/auth/callback?code=code&state=" + url.QueryEscape(state)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed state: %s, want 400", resp.Status)
+	}
+	if tok, err := tokens.Load(); err != nil || tok != nil {
+		t.Errorf("token store holds %+v, %v, want nothing after rejected logins", tok, err)
+	}
+
+	// A fresh login still succeeds
+	state = authState(t, get)
+	if resp, _ := get("/auth/callback?code=code&state=" + url.QueryEscape(state)); resp.StatusCode != http.StatusFound {
+		t.Errorf("matching state: %s, want a redirect", resp.Status)
+	}
+}
+
+// cookieValue decodes a securecookie value down to its payload
+func cookieValue(t *testing.T, c *http.Cookie) string {
+	t.Helper()
+	outer, err := base64.URLEncoding.DecodeString(c.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// date|value|mac, with the value base64 encoded again; the binary mac
+	// may hold more separators
+	parts := strings.SplitN(string(outer), "|", 3)
+	if len(parts) < 3 {
+		t.Fatalf("unexpected cookie layout %q", outer)
+	}
+	payload, err := base64.URLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+func TestProcessManualTokenHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		mediaStatus int
+		wantStatus  int
+		wantBody    string
+	}{
+		{"media as a JSON array", "token", http.StatusOK, http.StatusOK, `[{"id":"post-1"`},
+		{"media fetch fails", "token", http.StatusBadRequest, http.StatusInternalServerError, "Error fetching media"},
+		{"no token", "", http.StatusOK, http.StatusBadRequest, "Access token is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/me":
+					json.NewEncoder(w).Encode(map[string]string{"id": "42"})
+				case "/42/media":
+					w.WriteHeader(tt.mediaStatus)
+					if tt.mediaStatus != http.StatusOK {
+						w.Write([]byte(`{"error": {"message": "media is unavailable", "code": 100}}`))
+						return
+					}
+					json.NewEncoder(w).Encode(MediaResponse{Data: []Media{{ID: "post-1", MediaType: "IMAGE"}}})
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+			routeTo(t, server)
+
+			router := newTestRouter(false)
+			router.SetHTMLTemplate(template.Must(template.New("manual.html").Parse(`{{.Error}}`)))
+			router.POST("/manual-token", ProcessManualTokenHandler())
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/manual-token", strings.NewReader(url.Values{"access_token": {tt.token}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d containing %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestManifestHandlers(t *testing.T) {
+	dir := t.TempDir()
+	router := newTestRouter(false)
+	manifest := NewManifestCache(dir)
+	router.GET("/media.json", MediaJSONHandler(manifest))
+	router.GET("/media/:id", MediaEntryHandler(manifest))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Missing file: the pipeline has not run yet
+	for _, path := range []string{"/media.json", "/media/first"} {
+		if w := get(path); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "run the media pipeline") {
+			t.Errorf("%s before a run = %d %s, want 404 naming the pipeline", path, w.Code, w.Body)
+		}
+	}
+
+	writeManifest := func(entries []MediaFileEntry, modTime time.Time) []byte {
+		t.Helper()
+		data, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "converted_media.json")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	data := writeManifest([]MediaFileEntry{{MediaID: "first", Timestamp: "2024-01-01T00:00:00+0000"}}, time.Now().Add(-time.Hour))
+
+	w := get("/media.json")
+	if w.Code != http.StatusOK || w.Body.String() != string(data) {
+		t.Errorf("/media.json = %d %s, want the manifest", w.Code, w.Body)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+
+	// Found
+	w = get("/media/first")
+	var entry MediaFileEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); w.Code != http.StatusOK || err != nil || entry.MediaID != "first" {
+		t.Errorf("/media/first = %d %s", w.Code, w.Body)
+	}
+
+	// Not found
+	if w := get("/media/second"); w.Code != http.StatusNotFound {
+		t.Errorf("/media/second = %d, want 404", w.Code)
+	}
+
+	// A rewritten manifest is picked up rather than served from the cache
+	writeManifest([]MediaFileEntry{{MediaID: "first"}, {MediaID: "second"}}, time.Now())
+	if w := get("/media/second"); w.Code != http.StatusOK {
+		t.Errorf("/media/second after a new run = %d, want 200", w.Code)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	var upstreamStatus, upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.WriteHeader(int(upstreamStatus.Load()))
+	}))
+	defer upstream.Close()
+	routeTo(t, upstream)
+
+	all := template.New("all")
+	for _, name := range requiredTemplates {
+		template.Must(all.New(name).Parse(name))
+	}
+	partial := template.Must(template.New("index.html").Parse("index"))
+
+	tests := []struct {
+		name          string
+		templates     *template.Template
+		checkUpstream bool
+		upstream      int
+		wantStatus    int
+		wantReason    string
+	}{
+		{"ready", all, false, http.StatusServiceUnavailable, http.StatusOK, ""},
+		{"ready with upstream", all, true, http.StatusOK, http.StatusOK, ""},
+		{"upstream error status still reachable", all, true, http.StatusNotFound, http.StatusOK, ""},
+		{"upstream down", all, true, http.StatusBadGateway, http.StatusServiceUnavailable, "Graph API unreachable"},
+		{"template missing", partial, false, http.StatusOK, http.StatusServiceUnavailable, "template manual.html is not loaded"},
+		{"no templates", nil, false, http.StatusOK, http.StatusServiceUnavailable, "template index.html is not loaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamStatus.Store(int32(tt.upstream))
+			upstreamHits.Store(0)
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/healthz", HealthHandler())
+			router.GET("/readyz", ReadinessHandler(tt.templates, tt.checkUpstream))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("/healthz = %d, want 200 whatever the readiness", w.Code)
+			}
+
+			// Probe twice: the upstream result is reused between them
+			for range 2 {
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("/readyz = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			var body struct{ Status, Reason string }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body.Reason, tt.wantReason) || (tt.wantReason == "") != (body.Status == "ready") {
+				t.Errorf("/readyz said %+v, want reason %q", body, tt.wantReason)
+			}
+
+			wantHits := int32(0)
+			if tt.checkUpstream {
+				wantHits = 1
+			}
+			if upstreamHits.Load() != wantHits {
+				t.Errorf("Graph API was checked %d times, want %d", upstreamHits.Load(), wantHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// writeTestPNG writes an opaque PNG of the given size and returns its path
+func writeTestPNG(t *testing.T, dir, name string, width, height int) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeMediaJSON writes media as a recent_media.json style file and returns
+// its path
+func writeMediaJSON(t *testing.T, dir, name string, media []Media) string {
+	t.Helper()
+	data, err := json.Marshal(media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readManifest reads the converted_media.json written to outputDir
+func readManifest(t *testing.T, outputDir string) []MediaFileEntry {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(outputDir, "converted_media.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []MediaFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// routeTo sends every request made through the shared client to server,
+// whichever host it was addressed to, until the test ends
+func routeTo(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, previousBase := httpClient, baseTransport
+	SetHTTPClient(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return server.Client().Transport.RoundTrip(req)
+	})})
+	t.Cleanup(func() { httpClient, baseTransport = previous, previousBase })
+}
+
+// mediaListingServer serves *media as a Graph API media listing of pageSize
+// items per page, linked by paging.next, and counts the pages served
+func mediaListingServer(t *testing.T, media *[]Media, pageSize int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	pages := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages.Add(1)
+		start, _ := strconv.Atoi(r.URL.Query().Get("after"))
+		end := min(start+pageSize, len(*media))
+
+		result := MediaResponse{Data: (*media)[start:end]}
+		if end < len(*media) {
+			next := *r.URL
+			next.Scheme, next.Host = "https", "graph.instagram.com"
+			query := next.Query()
+			query.Set("after", strconv.Itoa(end))
+			next.RawQuery = query.Encode()
+			result.Paging = &MediaPaging{Next: next.String()}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(server.Close)
+	routeTo(t, server)
+	return server, pages
+}
@@ -0,0 +1,517 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHTTPTimeout bounds each outbound request unless configured otherwise
+const DefaultHTTPTimeout = 2 * time.Minute
+
+// httpClient is the shared client used for all outbound requests
+var httpClient = &http.Client{
+	CheckRedirect: checkRedirect,
+}
+
+// httpTimeout bounds how long a request may wait for its response headers;
+// 0 disables it. Bodies are not covered, so a long download keeps going.
+var httpTimeout = DefaultHTTPTimeout
+
+// HTTPClient returns the shared client used for all outbound requests
+func HTTPClient() *http.Client {
+	return httpClient
+}
+
+// SetHTTPClient replaces the shared client, e.g. to route requests through
+// a custom transport. The client is copied, keeping its transport as the one
+// the proxy and TLS settings are layered over, and gets the redirect limit
+// when it has no CheckRedirect of its own.
+func SetHTTPClient(c *http.Client) {
+	client := *c
+	if client.CheckRedirect == nil {
+		client.CheckRedirect = checkRedirect
+	}
+	httpClient = &client
+	baseTransport = c.Transport
+	applyTransport()
+}
+
+// SetHTTPTimeout configures how long each request may wait for its response
+// headers; zero disables it
+func SetHTTPTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("HTTP timeout must not be negative, got %s", timeout)
+	}
+	httpTimeout = timeout
+	return nil
+}
+
+// cancelOnClose ends a request's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// doRequest sends req on the shared client, giving up if its response
+// headers take longer than the HTTP timeout
+func doRequest(req *http.Request) (*http.Response, error) {
+	if httpTimeout <= 0 {
+		return httpClient.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(httpTimeout, cancel)
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if !timer.Stop() && err != nil && ctx.Err() != nil && req.Context().Err() == nil {
+		err = fmt.Errorf("no response within %s: %w", httpTimeout, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// Transport settings layered over the client's own transport
+var (
+	baseTransport      http.RoundTripper
+	insecureSkipVerify bool
+	proxyURL           *url.URL
+)
+
+// SetInsecureSkipVerify disables TLS certificate verification on the shared
+// client. This is only meant for testing against self-signed servers.
+func SetInsecureSkipVerify(skip bool) {
+	insecureSkipVerify = skip
+	applyTransport()
+}
+
+// SetProxy routes all requests through the given proxy URL. An empty URL
+// restores the default of honouring HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func SetProxy(rawURL string) error {
+	if rawURL == "" {
+		proxyURL = nil
+		applyTransport()
+		return nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q", rawURL)
+	}
+	proxyURL = parsed
+	applyTransport()
+	return nil
+}
+
+// applyTransport installs a copy of the base transport carrying the current
+// proxy and TLS settings, or the base transport itself when neither is set.
+// A base transport that is not an *http.Transport cannot carry them and is
+// kept as it is.
+func applyTransport() {
+	if !insecureSkipVerify && proxyURL == nil {
+		httpClient.Transport = baseTransport
+		return
+	}
+	base, ok := baseTransport.(*http.Transport)
+	if baseTransport == nil {
+		base, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		logger.Warn("custom HTTP transport does not support the proxy and TLS settings, ignoring them")
+		httpClient.Transport = baseTransport
+		return
+	}
+	transport := base.Clone()
+	if insecureSkipVerify {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	httpClient.Transport = transport
+}
+
+// errRedirectLimit is returned when a request exceeds the redirect limit
+var errRedirectLimit = errors.New("redirect limit exceeded")
+
+// maxRedirects caps how many redirects a single request may follow
+var maxRedirects = 3
+
+// SetMaxRedirects configures how many redirects a request may follow;
+// zero disables redirect following entirely
+func SetMaxRedirects(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max redirects must not be negative, got %d", n)
+	}
+	maxRedirects = n
+	return nil
+}
+
+// checkRedirect refuses to follow more than maxRedirects redirects
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		if maxRedirects == 0 {
+			return fmt.Errorf("%w: redirect to %s refused because redirects are disabled", errRedirectLimit, req.URL.Redacted())
+		}
+		return fmt.Errorf("%w: redirect to %s refused after %d redirects", errRedirectLimit, req.URL.Redacted(), maxRedirects)
+	}
+	return nil
+}
+
+// retryPolicy controls how failed requests are retried
+type retryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var retry = retryPolicy{
+	Attempts:  3,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  30 * time.Second,
+}
+
+// SetRetryAttempts configures how many times a failed request is retried
+func SetRetryAttempts(retries int) error {
+	if retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", retries)
+	}
+	retry.Attempts = retries + 1
+	return nil
+}
+
+// SetRetryBackoff configures the initial and maximum delay between retries
+func SetRetryBackoff(base, max time.Duration) error {
+	if base <= 0 {
+		return fmt.Errorf("retry backoff base must be positive, got %s", base)
+	}
+	if max < base {
+		return fmt.Errorf("retry backoff max (%s) must not be less than base (%s)", max, base)
+	}
+	retry.BaseDelay = base
+	retry.MaxDelay = max
+	return nil
+}
+
+// backoffDelay returns a jittered exponential delay for the given attempt,
+// always between the configured base and max delays
+func backoffDelay(attempt int) time.Duration {
+	ceiling := retry.MaxDelay
+	if attempt < 32 {
+		if exp := retry.BaseDelay << attempt; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	if ceiling <= retry.BaseDelay {
+		return retry.BaseDelay
+	}
+	return retry.BaseDelay + rand.N(ceiling-retry.BaseDelay)
+}
+
+// retryAfterDelay returns the delay requested by a Retry-After header, in
+// either delay-seconds or HTTP-date form, capped at the max retry delay
+func retryAfterDelay(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+
+	return min(max(delay, 0), retry.MaxDelay), true
+}
+
+// retryStatusCodes are the response statuses that trigger a retry
+var retryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// SetRetryStatusCodes configures which response statuses trigger a retry;
+// any other status fails immediately
+func SetRetryStatusCodes(codes []int) error {
+	for _, code := range codes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid HTTP status code %d", code)
+		}
+	}
+	retryStatusCodes = slices.Clone(codes)
+	return nil
+}
+
+// isRetryableStatus reports whether a response status is worth retrying
+func isRetryableStatus(code int) bool {
+	return slices.Contains(retryStatusCodes, code)
+}
+
+// httpGet performs a GET request, retrying connection errors and retryable
+// statuses with backoff, or after the delay given by Retry-After. Other
+// statuses such as 403 and 404 are returned immediately. The last response
+// is returned once attempts run out so callers can still report its status.
+func httpGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	return pacedGet(ctx, rawURL, nil)
+}
+
+// HTTPGet performs a GET on the shared client with the same timeout and
+// retries as the pipeline's own requests
+func HTTPGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	return httpGet(ctx, rawURL)
+}
+
+// pacedGet is httpGet with every attempt, retries included, waiting on pacer
+// when it is non-nil. A throttled response whose usage headers ask for a
+// longer wait pauses the pacer, holding back other requests as well.
+func pacedGet(ctx context.Context, rawURL string, pacer *tokenBucket) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if pacer != nil {
+			if err := pacer.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := doRequest(req)
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if attempt+1 >= retry.Attempts || errors.Is(err, errRedirectLimit) || ctx.Err() != nil {
+			return resp, err
+		}
+		delay := backoffDelay(attempt)
+		if err == nil {
+			if retryAfter, ok := retryAfterDelay(resp); ok {
+				delay = retryAfter
+			} else if usage, ok := usageDelay(resp); ok {
+				delay = max(delay, usage)
+			}
+			if pacer != nil && resp.StatusCode == http.StatusTooManyRequests {
+				pacer.pause(delay)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// hostLimiter bounds concurrent downloads per host and tallies how many
+// downloads each host served
+type hostLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	slots  map[string]chan struct{}
+	counts map[string]int
+}
+
+var downloadLimiter = newHostLimiter(4)
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{
+		limit:  limit,
+		slots:  make(map[string]chan struct{}),
+		counts: make(map[string]int),
+	}
+}
+
+// SetPerHostConcurrency configures how many downloads may run at once
+// against any single host
+func SetPerHostConcurrency(n int) error {
+	if n < 1 {
+		return fmt.Errorf("per-host concurrency must be at least 1, got %d", n)
+	}
+	downloadLimiter = newHostLimiter(n)
+	return nil
+}
+
+// acquire waits for a free slot for host and returns a function releasing it
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	l.mu.Lock()
+	slot, ok := l.slots[host]
+	if !ok {
+		slot = make(chan struct{}, l.limit)
+		l.slots[host] = slot
+	}
+	l.counts[host]++
+	l.mu.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// takeCounts returns the per-host download counts and resets them
+func (l *hostLimiter) takeCounts() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := l.counts
+	l.counts = make(map[string]int)
+	return counts
+}
+
+// downloadTimeout bounds a single download, including retries; 0 disables it
+var downloadTimeout time.Duration
+
+// SetDownloadTimeout configures the maximum time a single download may take
+func SetDownloadTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("download timeout must not be negative, got %s", timeout)
+	}
+	downloadTimeout = timeout
+	return nil
+}
+
+// DefaultMaxDownloadSize caps how many bytes of a source image are read
+const DefaultMaxDownloadSize = 25 << 20
+
+// maxDownloadSize caps a source image download held in memory; 0 disables it
+var maxDownloadSize int64 = DefaultMaxDownloadSize
+
+// errDownloadTooLarge marks a source larger than the download size limit
+var errDownloadTooLarge = errors.New("download exceeds size limit")
+
+// SetMaxDownloadSize configures the largest source image, in bytes, that is
+// downloaded; zero disables the limit
+func SetMaxDownloadSize(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("max download size must not be negative, got %d", size)
+	}
+	maxDownloadSize = size
+	return nil
+}
+
+// byteUnits maps size suffixes to their multiplier, longest first so "MB"
+// is matched before "B"
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "25MB", "512K" or "1048576" into
+// bytes. Units are binary, so 1MB is 1024*1024 bytes.
+func ParseByteSize(text string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(text))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 25MB, 512KB or a number of bytes)", text)
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", text)
+	}
+	return value * multiplier, nil
+}
+
+// readLimited reads a response body, failing without reading further once it
+// passes the max download size. A declared Content-Length over the limit is
+// rejected before anything is read.
+func readLimited(resp *http.Response, body io.Reader) ([]byte, error) {
+	if maxDownloadSize <= 0 {
+		return io.ReadAll(body)
+	}
+	if resp.ContentLength > maxDownloadSize {
+		return nil, fmt.Errorf("%w: Content-Length %d is over %d bytes", errDownloadTooLarge, resp.ContentLength, maxDownloadSize)
+	}
+
+	// Read one byte past the limit to tell a body of exactly the limit from
+	// one that is larger
+	data, err := io.ReadAll(io.LimitReader(body, maxDownloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxDownloadSize {
+		return nil, fmt.Errorf("%w: body is over %d bytes", errDownloadTooLarge, maxDownloadSize)
+	}
+	return data, nil
+}
+
+// limitedGet performs a GET through the per-host download limiter. The
+// returned function releases the slot and must be called once the body has
+// been read.
+func limitedGet(ctx context.Context, rawURL string) (*http.Response, func(), error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid URL: %w", err)
+	}
+
+	release, err := downloadLimiter.acquire(ctx, parsed.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if downloadTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, downloadTimeout)
+	}
+	done := func() {
+		cancel()
+		release()
+	}
+
+	resp, err := httpGet(ctx, rawURL)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return resp, done, nil
+}
@@ -0,0 +1,331 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// restoreHTTPClient puts the shared client and its settings back once the
+// test ends
+func restoreHTTPClient(t *testing.T) {
+	t.Helper()
+	client, base, timeout := httpClient, baseTransport, httpTimeout
+	insecure, proxy := insecureSkipVerify, proxyURL
+	t.Cleanup(func() {
+		httpClient, baseTransport, httpTimeout = client, base, timeout
+		insecureSkipVerify, proxyURL = insecure, proxy
+	})
+}
+
+func TestSetHTTPClientRoutesToInjectedClient(t *testing.T) {
+	feed := numberedMedia(3, 3)
+	mediaListingServer(t, &feed, 2)
+
+	media, err := FetchRecentMediaPaged("1", "token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 3 {
+		t.Errorf("fetched %d items through the injected client, want 3", len(media))
+	}
+}
+
+func TestSetHTTPClientKeepsRedirectLimit(t *testing.T) {
+	restoreHTTPClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/again", http.StatusFound)
+	}))
+	defer server.Close()
+
+	SetHTTPClient(&http.Client{Transport: server.Client().Transport})
+	_, err := httpGet(context.Background(), server.URL)
+	if !errors.Is(err, errRedirectLimit) {
+		t.Errorf("got %v, want the redirect limit to apply to the injected client", err)
+	}
+}
+
+func TestProxyKeepsInjectedTransport(t *testing.T) {
+	restoreHTTPClient(t)
+	SetHTTPClient(&http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 7}})
+
+	if err := SetProxy("http://proxy.example:3128"); err != nil {
+		t.Fatal(err)
+	}
+	SetInsecureSkipVerify(true)
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok || transport.MaxIdleConnsPerHost != 7 {
+		t.Fatalf("transport = %#v, want the injected one carrying the proxy", httpClient.Transport)
+	}
+	if transport.Proxy == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("proxy and TLS settings were not applied")
+	}
+
+	SetInsecureSkipVerify(false)
+	if err := SetProxy(""); err != nil {
+		t.Fatal(err)
+	}
+	if transport, ok := httpClient.Transport.(*http.Transport); !ok || transport.MaxIdleConnsPerHost != 7 || transport.Proxy != nil {
+		t.Errorf("clearing the settings did not restore the injected transport")
+	}
+}
+
+func TestHTTPTimeoutLeavesSlowBodiesAlone(t *testing.T) {
+	restoreHTTPClient(t)
+	policy := retry
+	retry.Attempts = 1
+	t.Cleanup(func() { retry = policy })
+	if err := SetHTTPTimeout(200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stalled" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("first half "))
+		w.(http.Flusher).Flush()
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("second half"))
+	}))
+	defer server.Close()
+	SetHTTPClient(server.Client())
+
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := downloadToFile(context.Background(), server.URL+"/slow", path); err != nil {
+		t.Fatalf("a body outlasting the timeout was cut off: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "first half second half" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	if err := downloadToFile(context.Background(), server.URL+"/stalled", path); err == nil {
+		t.Error("got no error from a server that did not respond within the timeout")
+	}
+}
+
+func TestDownloadsRetryTransientFailures(t *testing.T) {
+	restoreHTTPClient(t)
+	policy := retry
+	retry = retryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { retry = policy })
+
+	image, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "image.png", 8, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case n == 1:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case n == 2:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(image)
+		}
+	}))
+	defer server.Close()
+	SetHTTPClient(server.Client())
+
+	t.Run("file", func(t *testing.T) {
+		hits.Store(0)
+		path := filepath.Join(t.TempDir(), "image.png")
+		if err := downloadToFile(context.Background(), server.URL+"/flaky", path); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(path); !bytes.Equal(data, image) {
+			t.Errorf("downloaded %d bytes, want the %d byte image", len(data), len(image))
+		}
+		if hits.Load() != 3 {
+			t.Errorf("server was hit %d times, want 3", hits.Load())
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		hits.Store(0)
+		data, err := downloadImageToBytes(context.Background(), server.URL+"/flaky")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, image) || hits.Load() != 3 {
+			t.Errorf("got %d bytes after %d hits, want the image after 3", len(data), hits.Load())
+		}
+	})
+
+	t.Run("not found fails fast", func(t *testing.T) {
+		hits.Store(0)
+		if _, err := downloadImageToBytes(context.Background(), server.URL+"/missing"); err == nil {
+			t.Error("got no error for a 404")
+		}
+		if hits.Load() != 1 {
+			t.Errorf("server was hit %d times for a 404, want 1", hits.Load())
+		}
+	})
+}
+
+func TestDownloadSizeCap(t *testing.T) {
+	previous := maxDownloadSize
+	t.Cleanup(func() { maxDownloadSize = previous })
+
+	// A PNG signature so the content check passes, padded to size
+	body := func(size int) []byte {
+		return append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, size-8)...)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/declared":
+			w.Header().Set("Content-Length", "4096")
+			w.Write(body(4096))
+		case "/streamed":
+			// Flushing first leaves the length undeclared
+			w.Write(body(512))
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 3584))
+		case "/exact":
+			w.Write(body(1024))
+		}
+	}))
+	defer server.Close()
+	restoreHTTPClient(t)
+	SetHTTPClient(server.Client())
+
+	tests := []struct {
+		path    string
+		limit   int64
+		wantErr string
+	}{
+		{"/declared", 1024, "Content-Length 4096"},
+		{"/streamed", 1024, "body is over 1024 bytes"},
+		{"/exact", 1024, ""},
+		{"/streamed", 0, ""},
+	}
+	for _, tt := range tests {
+		if err := SetMaxDownloadSize(tt.limit); err != nil {
+			t.Fatal(err)
+		}
+		data, err := downloadImageToBytes(context.Background(), server.URL+tt.path)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s with limit %d: %v", tt.path, tt.limit, err)
+			}
+			continue
+		}
+		if !errors.Is(err, errDownloadTooLarge) || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s with limit %d: got %v, want %q", tt.path, tt.limit, err, tt.wantErr)
+		}
+		if data != nil {
+			t.Errorf("%s with limit %d: returned %d bytes alongside the error", tt.path, tt.limit, len(data))
+		}
+	}
+
+	if err := SetMaxDownloadSize(-1); err == nil {
+		t.Error("a negative limit was accepted")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    int64
+		wantErr bool
+	}{
+		{"25MB", 25 << 20, false},
+		{"512k", 512 << 10, false},
+		{" 1 GB ", 1 << 30, false},
+		{"1048576", 1 << 20, false},
+		{"0", 0, false},
+		{"10B", 10, false},
+		{"-1MB", 0, true},
+		{"MB", 0, true},
+		{"1.5MB", 0, true},
+		{"9999999999999GB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.text)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCancelledDownloadReturnsContextError(t *testing.T) {
+	restoreHTTPClient(t)
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send the start of a PNG, then hang until the client gives up
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngHeader(64, 64))
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	SetHTTPClient(server.Client())
+
+	downloads := []struct {
+		name     string
+		download func(ctx context.Context) error
+	}{
+		{"to bytes", func(ctx context.Context) error {
+			_, err := downloadImageToBytes(ctx, server.URL+"/image.png")
+			return err
+		}},
+		{"to file", func(ctx context.Context) error {
+			return downloadToFile(ctx, server.URL+"/video.mp4", filepath.Join(t.TempDir(), "video.mp4"))
+		}},
+	}
+	for _, tt := range downloads {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+
+			begin := time.Now()
+			err := tt.download(ctx)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want context.Canceled", err)
+			}
+			if elapsed := time.Since(begin); elapsed > 5*time.Second {
+				t.Errorf("download took %s to notice the cancellation", elapsed)
+			}
+		})
+	}
+}
+
+func TestItemTimeoutStopsAHungDownload(t *testing.T) {
+	restoreHTTPClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	SetHTTPClient(server.Client())
+
+	media := []Media{{ID: "hung", MediaType: "IMAGE", MediaURL: server.URL + "/hung.jpg", Timestamp: "2024-01-01T00:00:00+0000"}}
+	opts := ProcessOptions{ItemTimeout: 200 * time.Millisecond, FailFast: true}
+	outputDir := t.TempDir()
+	begin := time.Now()
+	_, err := FetchAndTransformImagesResult(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, opts)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Errorf("got %v, want the item timeout named", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("the run took %s despite a 200ms item timeout", elapsed)
+	}
+}
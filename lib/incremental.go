@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// loadPriorManifest reads the previous run's converted_media.json keyed by
+// media ID. A missing or unreadable manifest just means nothing is reused.
+func loadPriorManifest(outputDir string) map[string]MediaFileEntry {
+	path := filepath.Join(outputDir, "converted_media.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("could not read previous manifest", "path", path, "error", err)
+		}
+		return nil
+	}
+
+	var entries []MediaFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		logger.Warn("previous manifest is not an array manifest, regenerating everything", "path", path, "error", err)
+		return nil
+	}
+
+	prior := make(map[string]MediaFileEntry, len(entries))
+	for _, entry := range entries {
+		prior[entry.MediaID] = entry
+	}
+	return prior
+}
+
+// cachedVersions returns the versions of a prior entry that still match the
+// configured sizes and output formats and whose files are still on disk, and
+// whether they cover every size currently configured. Versions of sizes no
+// longer configured are left out.
+func cachedVersions(prior MediaFileEntry, mediaDir string, opts ProcessOptions) (map[string]ImageVersionEntry, bool) {
+	cached := make(map[string]ImageVersionEntry)
+	onDisk := func(name string, version ImageVersionEntry) bool {
+		info, err := os.Stat(filepath.Join(mediaDir, version.FileName))
+		if err != nil {
+			return false
+		}
+		version.name = name
+		version.Size = info.Size()
+		cached[name] = version
+		return true
+	}
+
+	// A copied small source stands in for every size, as long as small
+	// sources are still copied
+	if prior.Passthrough {
+		if !opts.PassthroughSmall {
+			return cached, false
+		}
+		for name, version := range prior.Versions {
+			if !onDisk(name, version) {
+				return cached, false
+			}
+		}
+		return cached, len(cached) > 0
+	}
+
+	// Sources narrower than a size are kept at their own width, which the
+	// widest version records
+	sourceWidth := 0
+	for _, version := range prior.Versions {
+		sourceWidth = max(sourceWidth, version.Width)
+	}
+
+	complete := true
+	for _, size := range imageVersions {
+		version, ok := prior.Versions[size.Name]
+		want := size.Width
+		if !opts.AllowUpscale {
+			want = min(want, sourceWidth)
+		}
+		ext := "." + formatExtension(sizeFormat(size, opts))
+		if !ok || version.Width != want || path.Ext(version.FileName) != ext || !onDisk(size.Name, version) {
+			complete = false
+		}
+	}
+	return cached, complete
+}
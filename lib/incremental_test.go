@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIncrementalReusesExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "output")
+	mediaDir := filepath.Join(outputDir, "media")
+	source := func(id string) Media {
+		return Media{ID: id, MediaType: "IMAGE", MediaURL: localFileURL(filepath.Join(dir, id+".png")), Timestamp: "2024-01-01T00:00:00+0000"}
+	}
+	run := func(media ...Media) map[string]MediaFileEntry {
+		t.Helper()
+		if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, ProcessOptions{Incremental: true}); err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]MediaFileEntry)
+		for _, entry := range readManifest(t, outputDir) {
+			byID[entry.MediaID] = entry
+		}
+		return byID
+	}
+
+	// Fresh: nothing recorded yet, so every size is generated. Sources
+	// differ in size so none is deduplicated into another.
+	writeTestPNG(t, dir, "cached.png", 1200, 800)
+	writeTestPNG(t, dir, "partial.png", 1100, 800)
+	first := run(source("cached"), source("partial"))
+	for id, entry := range first {
+		if len(entry.Versions) != len(imageVersions) {
+			t.Fatalf("fresh %s has %d versions, want %d", id, len(entry.Versions), len(imageVersions))
+		}
+	}
+
+	// Backdate every file so a rewrite shows up as a new modification time
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, entry := range first {
+		for _, version := range entry.Versions {
+			if err := os.Chtimes(filepath.Join(mediaDir, version.FileName), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	missing := first["partial"].Versions["small"].FileName
+	if err := os.Remove(filepath.Join(mediaDir, missing)); err != nil {
+		t.Fatal(err)
+	}
+	// The fully cached source is gone, so it can only be reused
+	if err := os.Remove(filepath.Join(dir, "cached.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPNG(t, dir, "fresh.png", 1000, 800)
+	second := run(source("cached"), source("partial"), source("fresh"))
+	if len(second) != 3 {
+		t.Fatalf("second manifest holds %d entries, want 3", len(second))
+	}
+	if len(second["fresh"].Versions) != len(imageVersions) {
+		t.Errorf("new item has %d versions, want %d", len(second["fresh"].Versions), len(imageVersions))
+	}
+	for _, id := range []string{"cached", "partial"} {
+		for name, version := range second[id].Versions {
+			info, err := os.Stat(filepath.Join(mediaDir, version.FileName))
+			if err != nil {
+				t.Fatalf("%s %s: %v", id, name, err)
+			}
+			rewritten := !info.ModTime().Equal(old)
+			if want := version.FileName == missing; rewritten != want {
+				t.Errorf("%s %s rewritten = %v, want %v", id, name, rewritten, want)
+			}
+		}
+		if len(second[id].Versions) != len(imageVersions) {
+			t.Errorf("%s has %d versions, want %d", id, len(second[id].Versions), len(imageVersions))
+		}
+	}
+}
+
+func TestCachedVersionsMatchTheCurrentSizes(t *testing.T) {
+	mediaDir := t.TempDir()
+	// prior records a version of every configured size, the widest at
+	// sourceWidth, each written in format
+	prior := func(sourceWidth int, format string) MediaFileEntry {
+		entry := MediaFileEntry{MediaID: "42", Versions: map[string]ImageVersionEntry{}}
+		for _, size := range imageVersions {
+			width := min(size.Width, sourceWidth)
+			name := versionFileName("42", width, size.Name, format)
+			if err := os.WriteFile(filepath.Join(mediaDir, name), []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entry.Versions[size.Name] = ImageVersionEntry{FileName: name, Width: width, Height: width}
+		}
+		return entry
+	}
+
+	tests := []struct {
+		name         string
+		prior        MediaFileEntry
+		opts         ProcessOptions
+		wantCached   int
+		wantComplete bool
+	}{
+		{"unchanged", prior(2000, FormatWebP), ProcessOptions{}, len(imageVersions), true},
+		{"narrow source", prior(300, FormatWebP), ProcessOptions{}, len(imageVersions), true},
+		{"narrow source now upscaled", prior(300, FormatWebP), ProcessOptions{AllowUpscale: true}, 1, false},
+		{"format changed", prior(2000, FormatWebP), ProcessOptions{Format: FormatJPEG}, 0, false},
+		{"thumb format changed", prior(2000, FormatWebP), ProcessOptions{ThumbFormat: FormatJPEG}, len(imageVersions) - 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cached, complete := cachedVersions(tt.prior, mediaDir, tt.opts)
+			if len(cached) != tt.wantCached || complete != tt.wantComplete {
+				t.Errorf("reused %d versions, complete %v, want %d, %v", len(cached), complete, tt.wantCached, tt.wantComplete)
+			}
+		})
+	}
+
+	t.Run("size resized", func(t *testing.T) {
+		entry := prior(2000, FormatWebP)
+		large := entry.Versions["large"]
+		large.Width = 1280
+		entry.Versions["large"] = large
+		cached, complete := cachedVersions(entry, mediaDir, ProcessOptions{})
+		if _, ok := cached["large"]; ok || complete {
+			t.Errorf("reused a large version %d wide, complete %v", large.Width, complete)
+		}
+	})
+
+	t.Run("size no longer configured", func(t *testing.T) {
+		entry := prior(2000, FormatWebP)
+		entry.Versions["xlarge"] = ImageVersionEntry{FileName: entry.Versions["large"].FileName, Width: 1024}
+		cached, complete := cachedVersions(entry, mediaDir, ProcessOptions{})
+		if _, ok := cached["xlarge"]; ok || !complete {
+			t.Errorf("kept the unconfigured xlarge version, complete %v", complete)
+		}
+	})
+}
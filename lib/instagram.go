@@ -1,9 +1,14 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 )
@@ -12,6 +17,7 @@ type TokenResponse struct {
 	AccessToken string `json:"access_token"`
 	UserID      string `json:"user_id"`
 	ExpiresIn   int    `json:"expires_in"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
 }
 
 type Media struct {
@@ -22,10 +28,151 @@ type Media struct {
 	Timestamp    string `json:"timestamp"`
 	ThumbnailURL string `json:"thumbnail_url,omitempty"`
 	IsSharedToFeed bool `json:"is_shared_to_feed,omitempty"`
+	MediaProductType string `json:"media_product_type,omitempty"`
+	LikeCount int `json:"like_count,omitempty"`
+	CommentsCount int `json:"comments_count,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	Children MediaChildren `json:"children,omitempty"`
+}
+
+// MediaChildren are the items of a carousel album, in order
+type MediaChildren []Media
+
+// UnmarshalJSON accepts both the Graph API edge shape {"data": [...]} and
+// the plain array written back to recent_media.json
+func (c *MediaChildren) UnmarshalJSON(data []byte) error {
+	var items []Media
+	if err := json.Unmarshal(data, &items); err == nil {
+		*c = items
+		return nil
+	}
+
+	var edge struct {
+		Data []Media `json:"data"`
+	}
+	if err := json.Unmarshal(data, &edge); err != nil {
+		return fmt.Errorf("invalid children: %w", err)
+	}
+	*c = edge.Data
+	return nil
+}
+
+// Sentinel errors for the failure classes callers handle differently. A
+// *GraphAPIError matches them with errors.Is by its code or HTTP status.
+var (
+	// ErrInvalidToken means the access token is invalid, expired or revoked
+	ErrInvalidToken = errors.New("invalid access token")
+	// ErrRateLimited means the app or user hit a Graph API rate limit
+	ErrRateLimited = errors.New("rate limited")
+	// ErrMediaUnavailable means the requested object does not exist or is
+	// not visible to the token, e.g. a deleted or private post
+	ErrMediaUnavailable = errors.New("media unavailable")
+)
+
+// GraphAPIError is the error object the Graph API returns in place of data
+type GraphAPIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    int    `json:"code"`
+	Subcode int    `json:"error_subcode,omitempty"`
+	// StatusCode is the HTTP status the error came with
+	StatusCode int `json:"-"`
+}
+
+func (e *GraphAPIError) Error() string {
+	return fmt.Sprintf("graph API error %d (%s): %s", e.Code, e.Type, e.Message)
+}
+
+// Graph API error codes, see
+// https://developers.facebook.com/docs/graph-api/guides/error-handling
+const (
+	graphCodeUnsupportedRequest = 100
+	graphSubcodeNoSuchObject    = 33
+	graphCodeSessionInvalid     = 102
+	graphCodeInvalidToken       = 190
+)
+
+// graphRateLimitCodes are the codes of the app, user, page, custom and
+// Instagram rate limits
+var graphRateLimitCodes = []int{4, 17, 32, 613, 80002}
+
+// Is matches the sentinel error for the error's code, falling back to its
+// HTTP status
+func (e *GraphAPIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidToken:
+		return e.Code == graphCodeInvalidToken || e.Code == graphCodeSessionInvalid || e.StatusCode == http.StatusUnauthorized
+	case ErrRateLimited:
+		return slices.Contains(graphRateLimitCodes, e.Code) || e.StatusCode == http.StatusTooManyRequests
+	case ErrMediaUnavailable:
+		return (e.Code == graphCodeUnsupportedRequest && e.Subcode == graphSubcodeNoSuchObject) || e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// statusSentinel maps an HTTP status without a Graph error body to its
+// sentinel error, or nil
+func statusSentinel(status int) error {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrInvalidToken
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusNotFound:
+		return ErrMediaUnavailable
+	}
+	return nil
+}
+
+// graphErrorEnvelope covers both error shapes Instagram returns: the Graph
+// API's {"error":{...}} and the OAuth endpoint's flat error_type/error_message
+type graphErrorEnvelope struct {
+	Error        *GraphAPIError `json:"error"`
+	ErrorType    string         `json:"error_type"`
+	ErrorMessage string         `json:"error_message"`
+	Code         int            `json:"code"`
+}
+
+// decodeGraphResponse decodes a successful response into v, or turns a
+// non-200 response into a *GraphAPIError carrying the API's message
+func decodeGraphResponse(resp *http.Response, v any) error {
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("error decoding response: %w", err)
+		}
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var envelope graphErrorEnvelope
+	if err := json.Unmarshal(body, &envelope); err == nil {
+		if envelope.Error != nil {
+			envelope.Error.StatusCode = resp.StatusCode
+			return envelope.Error
+		}
+		if envelope.ErrorMessage != "" {
+			return &GraphAPIError{Message: envelope.ErrorMessage, Type: envelope.ErrorType, Code: envelope.Code, StatusCode: resp.StatusCode}
+		}
+	}
+	if sentinel := statusSentinel(resp.StatusCode); sentinel != nil {
+		return fmt.Errorf("%w: API returned status %d: %s", sentinel, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return fmt.Errorf("API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// MediaPaging holds the cursors and next-page URL of a media listing
+type MediaPaging struct {
+	Cursors struct {
+		Before string `json:"before"`
+		After  string `json:"after"`
+	} `json:"cursors"`
+	Next string `json:"next,omitempty"`
 }
 
 type MediaResponse struct {
-	Data []Media `json:"data"`
+	Data   []Media        `json:"data"`
+	Paging *MediaPaging   `json:"paging,omitempty"`
+	Error  *GraphAPIError `json:"error,omitempty"`
 }
 
 // Validate a manually entered token by making a test API call
@@ -34,35 +181,49 @@ func ValidateManualToken(accessToken string) (bool, error) {
 		"https://graph.instagram.com/me?fields=id,username&access_token=%s",
 		accessToken,
 	)
-	resp, err := http.Get(url)
+	resp, err := graphGet(context.Background(), url)
 	if err != nil {
 		return false, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("invalid token, API returned status: %d", resp.StatusCode)
+	var me struct {
+		ID string `json:"id"`
+	}
+	if err := decodeGraphResponse(resp, &me); err != nil {
+		return false, fmt.Errorf("invalid token: %w", err)
 	}
 
 	return true, nil
 }
 
 func ExchangeCodeForToken(cfg InstagramConfig, code string) (*TokenResponse, error) {
-	resp, err := http.PostForm("https://api.instagram.com/oauth/access_token", map[string][]string{
+	if err := graphLimiter.wait(context.Background()); err != nil {
+		return nil, err
+	}
+	form := url.Values{
 		"client_id":     {cfg.ClientID},
 		"client_secret": {cfg.ClientSecret},
 		"grant_type":    {"authorization_code"},
 		"redirect_uri":  {cfg.RedirectURI},
 		"code":          {code},
-	})
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://api.instagram.com/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := doRequest(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var token TokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&token)
-	return &token, err
+	if err := decodeGraphResponse(resp, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
 }
 
 func GetLongLivedToken(cfg InstagramConfig, shortToken string) (*TokenResponse, error) {
@@ -70,15 +231,17 @@ func GetLongLivedToken(cfg InstagramConfig, shortToken string) (*TokenResponse,
 		"https://graph.instagram.com/access_token?grant_type=ig_exchange_token&client_secret=%s&access_token=%s",
 		cfg.ClientSecret, shortToken,
 	)
-	resp, err := http.Get(url)
+	resp, err := graphGet(context.Background(), url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var token TokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&token)
-	return &token, err
+	if err := decodeGraphResponse(resp, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
 }
 
 func RefreshToken(currentToken string) (*TokenResponse, error) {
@@ -86,45 +249,256 @@ func RefreshToken(currentToken string) (*TokenResponse, error) {
 		"https://graph.instagram.com/refresh_access_token?grant_type=ig_refresh_token&access_token=%s",
 		currentToken,
 	)
-	resp, err := http.Get(url)
+	resp, err := graphGet(context.Background(), url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var token TokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&token)
-	return &token, err
+	if err := decodeGraphResponse(resp, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// standardMediaFields are the fields requested unless configured otherwise
+var standardMediaFields = []string{
+	"id",
+	"media_type",
+	"media_url",
+	"permalink",
+	"timestamp",
+	"thumbnail_url",
+	"is_shared_to_feed",
+	"media_product_type",
+	"caption",
+	"children{id,media_type,media_url,thumbnail_url}",
+}
+
+// MediaFieldPresets are named bundles of fields for FetchRecentMedia
+var MediaFieldPresets = map[string][]string{
+	"minimal":  {"id", "media_url", "timestamp"},
+	"standard": standardMediaFields,
+	// rich predates carousel children joining the standard set
+	"rich":     standardMediaFields,
+	"insights": append(slices.Clone(standardMediaFields), "like_count", "comments_count"),
+}
+
+// mediaFields are the fields requested by FetchRecentMedia
+var mediaFields = standardMediaFields
+
+// splitFields splits a comma-separated field list, leaving commas inside
+// nested selections such as children{id,media_url} intact
+func splitFields(list string) []string {
+	var fields []string
+	depth, start := 0, 0
+	for i, r := range list {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	fields = append(fields, strings.TrimSpace(list[start:]))
+	return slices.DeleteFunc(fields, func(field string) bool { return field == "" })
 }
 
+// ResolveMediaFields expands a preset name, letting an explicit
+// comma-separated field list take precedence when one is given
+func ResolveMediaFields(preset string, fieldList string) ([]string, error) {
+	if fields := splitFields(fieldList); len(fields) > 0 {
+		return fields, nil
+	}
+	presetFields, ok := MediaFieldPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown fields preset %q (expected minimal, standard, rich or insights)", preset)
+	}
+	return presetFields, nil
+}
+
+// SetMediaFields configures the fields requested by FetchRecentMedia
+func SetMediaFields(fields []string) error {
+	if !slices.Contains(fields, "id") {
+		return fmt.Errorf("media fields must include id")
+	}
+	mediaFields = fields
+	return nil
+}
+
+// FetchRecentMedia fetches every page of the user's media
 func FetchRecentMedia(userID, accessToken string) ([]Media, error) {
-	fields := []string{
-		"id",
-		"media_type",
-		"media_url",
-		"permalink",
-		"timestamp",
-		"thumbnail_url",
-		"is_shared_to_feed",
-	}
-	fieldsString := strings.Join(fields, ",")
-	url := fmt.Sprintf(
+	return FetchRecentMediaPaged(userID, accessToken, 0)
+}
+
+// FetchRecentMediaPaged follows paging.next until the last page, stopping
+// early once maxItems have been collected (0 means no limit)
+func FetchRecentMediaPaged(userID, accessToken string, maxItems int) ([]Media, error) {
+	return fetchMediaPages(mediaListURL(userID, accessToken), maxItems, nil)
+}
+
+// FetchRecentMediaSince returns the media published since the fetch recorded
+// in state. The listing is newest first, so it is walked from the top and
+// paging stops at the newest media state saw; an empty state fetches
+// everything.
+func FetchRecentMediaSince(userID, accessToken string, state FetchState, maxItems int) ([]Media, error) {
+	return fetchMediaPages(mediaListURL(userID, accessToken), maxItems, state.seen)
+}
+
+// mediaListURL builds the first page URL of a user's media listing
+func mediaListURL(userID, accessToken string) string {
+	fieldsString := strings.Join(mediaFields, ",")
+	return fmt.Sprintf(
 		"https://graph.instagram.com/%s/media?fields=%s&access_token=%s",
 		userID, fieldsString, accessToken,
 	)
-	resp, err := http.Get(url)
+}
+
+// fetchMediaPages walks a media listing from pageURL and returns the
+// collected media. When seen is set the walk stops at the first media it
+// reports, which is left out.
+func fetchMediaPages(pageURL string, maxItems int, seen func(Media) bool) ([]Media, error) {
+	var media []Media
+	for page := 1; pageURL != ""; page++ {
+		result, err := fetchMediaPage(pageURL)
+		if err != nil {
+			return media, fmt.Errorf("error fetching media page %d: %w", page, err)
+		}
+
+		data := result.Data
+		reached := false
+		if seen != nil {
+			if i := slices.IndexFunc(data, seen); i >= 0 {
+				logger.Debug("reached media seen by the previous fetch", "media_id", data[i].ID, "page", page)
+				data, reached = data[:i], true
+			}
+		}
+
+		media = append(media, data...)
+		pageURL = ""
+		if result.Paging != nil && !reached {
+			pageURL = result.Paging.Next
+		}
+
+		if maxItems > 0 && len(media) >= maxItems {
+			return media[:maxItems], nil
+		}
+	}
+
+	return media, nil
+}
+
+// fetchMediaPage fetches and decodes a single page of a media listing
+func fetchMediaPage(url string) (*MediaResponse, error) {
+	resp, err := graphGet(context.Background(), url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	var result MediaResponse
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	return result.Data, err
+	if err := decodeGraphResponse(resp, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &result, nil
 }
 
+// tokenRefreshWindow is how long before expiry a token is refreshed
+const tokenRefreshWindow = 7 * 24 * time.Hour
+
+// ShouldRefreshToken reports whether a token expiring at expiresAt, in Unix
+// seconds, is within a week of expiry. An expiresAt of 0 means the expiry is
+// unknown, which calls for a refresh so the expiry gets recorded.
 func ShouldRefreshToken(expiresAt int64) bool {
-	return time.Now().Unix() > expiresAt-604800 // 7 days before expiry
+	return shouldRefreshAt(expiresAt, time.Now())
+}
+
+// shouldRefreshAt is ShouldRefreshToken as of now
+func shouldRefreshAt(expiresAt int64, now time.Time) bool {
+	return expiresAt <= 0 || now.After(time.Unix(expiresAt, 0).Add(-tokenRefreshWindow))
+}
+
+// AccountInfo describes the account a token belongs to
+type AccountInfo struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	AccountType string `json:"account_type"`
+	MediaCount  int    `json:"media_count"`
+}
+
+// GetAccountInfo makes a call to the /me endpoint to describe the token's account
+func GetAccountInfo(accessToken string) (*AccountInfo, error) {
+	url := fmt.Sprintf(
+		"https://graph.instagram.com/me?fields=id,username,account_type,media_count&access_token=%s",
+		accessToken,
+	)
+	resp, err := graphGet(context.Background(), url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info AccountInfo
+	if err := decodeGraphResponse(resp, &info); err != nil {
+		return nil, err
+	}
+
+	if info.ID == "" {
+		return nil, fmt.Errorf("no user ID returned from API")
+	}
+
+	return &info, nil
+}
+
+// fetchMediaURLs fetches fresh signed URLs for a single media item
+func fetchMediaURLs(ctx context.Context, accessToken, mediaID string) (Media, error) {
+	url := fmt.Sprintf(
+		"https://graph.instagram.com/%s?fields=id,media_type,media_url,thumbnail_url&access_token=%s",
+		mediaID,
+		accessToken,
+	)
+	resp, err := graphGet(ctx, url)
+	if err != nil {
+		return Media{}, err
+	}
+	defer resp.Body.Close()
+
+	var media Media
+	if err := decodeGraphResponse(resp, &media); err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// RefreshMediaURL fetches a fresh signed URL for a media item of userID whose
+// URL has expired: the one the pipeline converts, which is the thumbnail_url
+// of a video and the media_url of anything else
+func RefreshMediaURL(userID, accessToken, mediaID string) (string, error) {
+	url, err := refreshMediaURL(context.Background(), accessToken, mediaID)
+	if err != nil && userID != "" {
+		return "", fmt.Errorf("user %s: %w", userID, err)
+	}
+	return url, err
+}
+
+// refreshMediaURL is RefreshMediaURL bounded by ctx, as the pipeline calls it
+func refreshMediaURL(ctx context.Context, accessToken, mediaID string) (string, error) {
+	media, err := fetchMediaURLs(ctx, accessToken, mediaID)
+	if err != nil {
+		return "", err
+	}
+	media.ID = mediaID
+	return sourceURL(media)
 }
 
 // GetUserIdFromToken makes a call to the /me endpoint to get the user ID
@@ -133,22 +507,17 @@ func GetUserIdFromToken(accessToken string) (string, error) {
 		"https://graph.instagram.com/me?fields=id&access_token=%s",
 		accessToken,
 	)
-	resp, err := http.Get(url)
+	resp, err := graphGet(context.Background(), url)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API returned status: %d", resp.StatusCode)
-	}
-
 	var result struct {
 		ID       string `json:"id"`
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
+	if err := decodeGraphResponse(resp, &result); err != nil {
 		return "", err
 	}
 
@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMediaDecodesCarouselChildren(t *testing.T) {
+	payload := `{
+		"data": [
+			{
+				"id": "album",
+				"media_type": "CAROUSEL_ALBUM",
+				"media_url": "https://scontent.cdninstagram.com/album.jpg",
+				"timestamp": "2024-01-01T00:00:00+0000",
+				"children": {
+					"data": [
+						{"id": "first", "media_type": "IMAGE", "media_url": "https://scontent.cdninstagram.com/first.jpg"},
+						{"id": "second", "media_type": "VIDEO", "media_url": "https://scontent.cdninstagram.com/second.mp4", "thumbnail_url": "https://scontent.cdninstagram.com/second.jpg"}
+					]
+				}
+			},
+			{"id": "single", "media_type": "IMAGE", "media_url": "https://scontent.cdninstagram.com/single.jpg"}
+		]
+	}`
+
+	var response MediaResponse
+	if err := json.Unmarshal([]byte(payload), &response); err != nil {
+		t.Fatal(err)
+	}
+	album, single := response.Data[0], response.Data[1]
+	if got, want := mediaIDs(album.Children), []string{"first", "second"}; !slices.Equal(got, want) {
+		t.Errorf("children = %v, want %v", got, want)
+	}
+	if album.Children[1].ThumbnailURL == "" {
+		t.Error("video child lost its thumbnail_url")
+	}
+	if len(single.Children) != 0 {
+		t.Errorf("single image has children %v", mediaIDs(single.Children))
+	}
+
+	// recent_media.json keeps children as a plain array, which reads back the same
+	data, err := json.Marshal(album)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reread Media
+	if err := json.Unmarshal(data, &reread); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaIDs(reread.Children), []string{"first", "second"}; !slices.Equal(got, want) {
+		t.Errorf("children after a round trip = %v, want %v", got, want)
+	}
+}
+
+func TestStandardFieldsRequestChildren(t *testing.T) {
+	fields, err := ResolveMediaFields("standard", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(fields, func(field string) bool { return strings.HasPrefix(field, "children{") }) {
+		t.Errorf("standard fields %v do not request carousel children", fields)
+	}
+}
+
+func TestFetchMediaPagesFollowsNext(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxItems  int
+		wantItems int
+		wantPages int32
+	}{
+		{"all pages", 0, 4, 2},
+		{"stops at max items", 2, 2, 1},
+		{"max items mid page", 3, 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed := numberedMedia(4, 4)
+			_, pages := mediaListingServer(t, &feed, 2)
+
+			media, err := fetchMediaPages(mediaListURL("1", "token"), tt.maxItems, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(media) != tt.wantItems || pages.Load() != tt.wantPages {
+				t.Errorf("got %d items over %d pages, want %d over %d", len(media), pages.Load(), tt.wantItems, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestCaptionSurvivesThePipeline(t *testing.T) {
+	fields, err := ResolveMediaFields("standard", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(fields, "caption") {
+		t.Errorf("standard fields %v do not request the caption", fields)
+	}
+
+	// Graph API escapes non-ASCII, including the surrogate pair of an emoji
+	payload := `{"data": [{
+		"id": "sunset",
+		"media_type": "IMAGE",
+		"caption": "Caf\u00e9 at dusk \ud83c\udf05\nSecond line\n\n#travel \u003cb>&",
+		"timestamp": "2024-01-01T00:00:00+0000"
+	}]}`
+	want := "Café at dusk 🌅\nSecond line\n\n#travel <b>&"
+
+	var response MediaResponse
+	if err := json.Unmarshal([]byte(payload), &response); err != nil {
+		t.Fatal(err)
+	}
+	media := response.Data[0]
+	if media.Caption != want {
+		t.Fatalf("caption = %q, want %q", media.Caption, want)
+	}
+
+	dir := t.TempDir()
+	media.MediaURL = localFileURL(writeTestPNG(t, dir, "sunset.png", 300, 200))
+	outputDir := filepath.Join(dir, "output")
+	if err := FetchAndTransformImages(context.Background(), []Media{media}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readManifest(t, outputDir)[0].Caption; got != want {
+		t.Errorf("manifest caption = %q, want %q", got, want)
+	}
+}
+
+func TestGraphErrorBodiesSurfaceTheMessage(t *testing.T) {
+	var body atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+	routeTo(t, server)
+	cfg := InstagramConfig{ClientID: "id", ClientSecret: "secret", RedirectURI: "https://example.com/auth/callback"}
+
+	calls := map[string]func() error{
+		"exchange code": func() error { _, err := ExchangeCodeForToken(cfg, "code"); return err },
+		"long-lived":    func() error { _, err := GetLongLivedToken(cfg, "short"); return err },
+		"refresh":       func() error { _, err := RefreshToken("token"); return err },
+		"media":         func() error { _, err := FetchRecentMedia("42", "token"); return err },
+		"account":       func() error { _, err := GetAccountInfo("token"); return err },
+	}
+	shapes := []struct {
+		name     string
+		body     string
+		wantText []string
+	}{
+		{"graph envelope", `{"error":{"message":"Invalid platform app","type":"OAuthException","code":101}}`, []string{"Invalid platform app", "OAuthException", "101"}},
+		{"oauth envelope", `{"error_type":"OAuthException","code":400,"error_message":"Invalid redirect_uri"}`, []string{"Invalid redirect_uri", "OAuthException", "400"}},
+		{"plain text", `Bad Request`, []string{"400", "Bad Request"}},
+	}
+	for _, shape := range shapes {
+		body.Store(shape.body)
+		for name, call := range calls {
+			err := call()
+			if err == nil {
+				t.Errorf("%s, %s: got no error from a 400", shape.name, name)
+				continue
+			}
+			for _, want := range shape.wantText {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("%s, %s: error %q does not mention %q", shape.name, name, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestGraphErrorsMatchSentinels(t *testing.T) {
+	policy, limiter := retry, graphLimiter
+	retry.Attempts = 1
+	graphLimiter = &tokenBucket{}
+	t.Cleanup(func() { retry, graphLimiter = policy, limiter })
+
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{"FetchRecentMedia", func() error { _, err := FetchRecentMedia("1", "token"); return err }},
+		{"GetUserIdFromToken", func() error { _, err := GetUserIdFromToken("token"); return err }},
+		{"ExchangeCodeForToken", func() error { _, err := ExchangeCodeForToken(InstagramConfig{}, "code"); return err }},
+		{"GetLongLivedToken", func() error { _, err := GetLongLivedToken(InstagramConfig{}, "short"); return err }},
+		{"RefreshToken", func() error { _, err := RefreshToken("token"); return err }},
+	}
+	sentinels := []error{ErrInvalidToken, ErrRateLimited, ErrMediaUnavailable}
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		want     error
+		wantCode int
+	}{
+		{"401 without a body", http.StatusUnauthorized, "", ErrInvalidToken, 0},
+		{"401 with a graph error", http.StatusUnauthorized, `{"error":{"message":"Session has expired","type":"OAuthException","code":102}}`, ErrInvalidToken, 102},
+		{"invalid token code", http.StatusBadRequest, `{"error":{"message":"Invalid OAuth access token","type":"OAuthException","code":190}}`, ErrInvalidToken, 190},
+		{"oauth error shape", http.StatusBadRequest, `{"error_type":"OAuthException","code":190,"error_message":"Invalid token"}`, ErrInvalidToken, 190},
+		{"429", http.StatusTooManyRequests, "", ErrRateLimited, 0},
+		{"rate limit code", http.StatusBadRequest, `{"error":{"message":"Application request limit reached","code":4}}`, ErrRateLimited, 4},
+		{"404", http.StatusNotFound, "", ErrMediaUnavailable, 0},
+		{"no such object", http.StatusBadRequest, `{"error":{"message":"Object does not exist","code":100,"error_subcode":33}}`, ErrMediaUnavailable, 100},
+		{"server error", http.StatusInternalServerError, "", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			routeTo(t, server)
+
+			for _, c := range calls {
+				err := c.call()
+				if err == nil {
+					t.Fatalf("%s: got no error", c.name)
+				}
+				for _, sentinel := range sentinels {
+					if got := errors.Is(err, sentinel); got != (sentinel == tt.want) {
+						t.Errorf("%s: errors.Is(%v, %v) = %v", c.name, err, sentinel, got)
+					}
+				}
+				var graphErr *GraphAPIError
+				if isGraph := errors.As(err, &graphErr); isGraph != (tt.wantCode != 0) {
+					t.Errorf("%s: errors.As GraphAPIError = %v for %v", c.name, isGraph, err)
+				} else if isGraph && (graphErr.Code != tt.wantCode || graphErr.StatusCode != tt.status) {
+					t.Errorf("%s: GraphAPIError code %d status %d, want %d and %d", c.name, graphErr.Code, graphErr.StatusCode, tt.wantCode, tt.status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// jsonSchemaDialect is the JSON Schema draft the manifest schema is written in
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaDescriptions documents the properties whose meaning is not obvious
+// from their name, keyed by "TypeName.json_name"
+var schemaDescriptions = map[string]string{
+	"MediaFileEntry.versions":             "Converted versions keyed by size name, e.g. \"1600\" or \"xl\"",
+	"MediaFileEntry.aspect_ratio":         "Width / height of the largest version, e.g. \"4 / 3\"",
+	"MediaFileEntry.flattened_background": "Colour a transparent source was flattened onto",
+	"MediaFileEntry.source":               "URL the versions were converted from; signed and may have expired",
+	"MediaFileEntry.passthrough":          "Set when the small source was copied instead of resized",
+	"MediaFileEntry.placeholder":          "Blurhash or \"#rrggbb\" colour to show while loading",
+	"MediaFileEntry.srcset":               "The versions as a responsive <img srcset> value",
+	"MediaFileEntry.video_file_name":      "Downloaded video the versions' poster frame came from",
+	"MediaFileEntry.preview":              "Animated WebP sampled from the video, when video previews are on",
+	"MediaFileEntry.children":             "Converted items of a carousel album, in album order",
+	"MediaFileEntry.original":             "Kept source download, when originals are kept",
+	"MediaFileEntry.embed":                "Instagram oEmbed link-preview metadata, when embeds are fetched",
+	"MediaFileEntry.dedup_of":             "Media ID whose files this entry reuses, its source being identical",
+	"ImageVersionEntry.file_name":         "File name relative to the media dir",
+	"ImageVersionEntry.size":              "File size in bytes",
+	"ImageVersionEntry.quality":           "Lossy quality chosen to meet the target size, when one was set",
+	"EmbedEntry.width":                    "Width of the thumbnail",
+	"EmbedEntry.height":                   "Height of the thumbnail",
+	"OriginalEntry.file_name":             "File name relative to the media dir, e.g. \"original/abc.jpg\"",
+}
+
+// ManifestJSONSchema returns a JSON Schema (draft 2020-12) describing the
+// manifest written in the given schema, generated from the Go types so it
+// cannot drift from what is written
+func ManifestJSONSchema(schema string) ([]byte, error) {
+	var root reflect.Type
+	var title string
+	switch schema {
+	case "", SchemaV2Array, ManifestFormatArray:
+		root = reflect.TypeOf([]MediaFileEntry{})
+		title = "Converted media manifest (" + SchemaV2Array + ")"
+	case SchemaV1Map, ManifestFormatLegacy:
+		root = reflect.TypeOf(legacyMediaFilesMap{})
+		title = "Converted media manifest (" + SchemaV1Map + ")"
+	default:
+		return nil, ValidateManifestSchema(schema)
+	}
+
+	gen := schemaGenerator{defs: make(map[string]any)}
+	doc := gen.typeSchema(root)
+	doc["$schema"] = jsonSchemaDialect
+	doc["title"] = title
+	doc["$defs"] = gen.defs
+
+	data, err := marshalIndentUnescaped(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding JSON schema: %w", err)
+	}
+	return data, nil
+}
+
+// schemaGenerator builds schemas for Go types, collecting every struct under
+// $defs so recursive types such as carousel children can refer to themselves
+type schemaGenerator struct {
+	defs map[string]any
+}
+
+// typeSchema returns the schema for t
+func (g schemaGenerator) typeSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := g.defs[name]; !ok {
+			// Reserve the name before descending so recursion stops here
+			g.defs[name] = nil
+			g.defs[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + name}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes the exported, JSON-encoded fields of a struct.
+// Fields without omitempty are always written and so are required.
+func (g schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		property := g.typeSchema(field.Type)
+		if description, ok := schemaDescriptions[t.Name()+"."+name]; ok {
+			// Since 2020-12 keywords next to $ref apply alongside it
+			property["description"] = description
+		}
+		properties[name] = property
+
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// compileManifestSchema compiles the schema generated for the given manifest
+// schema with a draft 2020-12 validator
+func compileManifestSchema(t *testing.T, schema string) *jsonschema.Schema {
+	t.Helper()
+	data, err := ManifestJSONSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("manifest.schema.json", doc); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := compiler.Compile("manifest.schema.json")
+	if err != nil {
+		t.Fatalf("generated schema does not compile: %v", err)
+	}
+	return compiled
+}
+
+// validateJSON reports whether data is valid against compiled
+func validateJSON(t *testing.T, compiled *jsonschema.Schema, data []byte) error {
+	t.Helper()
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compiled.Validate(doc)
+}
+
+func TestManifestJSONSchemaValidatesOutput(t *testing.T) {
+	dir := t.TempDir()
+	photo := Media{
+		ID:        "photo",
+		MediaType: "IMAGE",
+		MediaURL:  localFileURL(writeTestPNG(t, dir, "photo.png", 640, 480)),
+		Timestamp: "2024-01-01T00:00:00+0000",
+		Caption:   "A caption",
+		Permalink: "https://www.instagram.com/p/abc/",
+	}
+	album := carousel(t, dir, "first", "second")
+
+	for _, schema := range []string{SchemaV2Array, SchemaV1Map} {
+		t.Run(schema, func(t *testing.T) {
+			outputDir := t.TempDir()
+			opts := ProcessOptions{
+				ManifestFormat:   schema,
+				Placeholder:      PlaceholderBlurhash,
+				BaseURL:          "https://cdn.example/media/",
+				EmitAspectRatio:  true,
+				IncludeSourceURL: true,
+				KeepOriginals:    true,
+			}
+			if err := FetchAndTransformImages(context.Background(), []Media{photo, album}, filepath.Join(outputDir, "media"), outputDir, opts); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(outputDir, "converted_media.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			compiled := compileManifestSchema(t, schema)
+			if err := validateJSON(t, compiled, data); err != nil {
+				t.Errorf("written manifest does not validate: %v", err)
+			}
+		})
+	}
+}
+
+func TestManifestJSONSchemaRejectsMalformedEntries(t *testing.T) {
+	compiled := compileManifestSchema(t, SchemaV2Array)
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"not an array", `{"media_id":"1"}`},
+		{"missing media_id", `[{"timestamp":"2024-01-01T00:00:00Z","versions":{}}]`},
+		{"width is a string", `[{"media_id":"1","timestamp":"2024-01-01T00:00:00Z","versions":{"1600":{"width":"1600","height":1200,"file_name":"1-1600.webp"}}}]`},
+		{"version without file_name", `[{"media_id":"1","timestamp":"2024-01-01T00:00:00Z","versions":{"1600":{"width":1600,"height":1200}}}]`},
+		{"unknown property", `[{"media_id":"1","timestamp":"2024-01-01T00:00:00Z","versions":{},"colour":"red"}]`},
+	}
+	for _, tt := range tests {
+		if err := validateJSON(t, compiled, []byte(tt.doc)); err == nil {
+			t.Errorf("%s: validated, want it rejected", tt.name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Manifest schemas accepted by ProcessOptions.ManifestFormat. Both are
+// produced from the same processed entries:
+//
+//	v2-array  []MediaFileEntry, one object per media item sorted by timestamp
+//	v1-map    legacyMediaFilesMap keyed by media ID, see below
+const (
+	SchemaV1Map   = "v1-map"
+	SchemaV2Array = "v2-array"
+
+	// ManifestFormatArray and ManifestFormatLegacy are the earlier names of
+	// SchemaV2Array and SchemaV1Map, still accepted
+	ManifestFormatArray  = "array"
+	ManifestFormatLegacy = "legacy"
+)
+
+// ValidateManifestSchema checks that a manifest schema name is known
+func ValidateManifestSchema(schema string) error {
+	switch schema {
+	case "", SchemaV2Array, SchemaV1Map, ManifestFormatArray, ManifestFormatLegacy:
+		return nil
+	}
+	return fmt.Errorf("unknown manifest schema %q (expected %s or %s)", schema, SchemaV2Array, SchemaV1Map)
+}
+
+// legacyMediaFilesMap is the v1-map manifest shape, keyed by media ID.
+//
+// Field mapping from MediaFileEntry:
+//
+//	media_id              -> map key
+//	timestamp, permalink  -> original.timestamp, original.permalink
+//	largest version       -> original.file_name, original.width, original.height
+//	versions              -> versions (unchanged)
+//
+// Fields added since, such as aspect_ratio and source, have no legacy
+// equivalent and are dropped.
+type legacyMediaFilesMap map[string]legacyMediaFile
+
+type legacyMediaFile struct {
+	Original legacyOriginal               `json:"original"`
+	Versions map[string]ImageVersionEntry `json:"versions"`
+}
+
+type legacyOriginal struct {
+	FileName  string `json:"file_name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp string `json:"timestamp"`
+	Permalink string `json:"permalink"`
+}
+
+// toLegacyMediaFilesMap converts manifest entries to the legacy map shape
+func toLegacyMediaFilesMap(mediaFilesArray []MediaFileEntry) legacyMediaFilesMap {
+	legacy := make(legacyMediaFilesMap, len(mediaFilesArray))
+	for _, entry := range mediaFilesArray {
+		original := legacyOriginal{
+			Timestamp: entry.Timestamp,
+			Permalink: entry.Permalink,
+		}
+		if largest, ok := largestVersion(entry); ok {
+			original.FileName = largest.FileName
+			original.Width = largest.Width
+			original.Height = largest.Height
+		}
+		legacy[entry.MediaID] = legacyMediaFile{Original: original, Versions: entry.Versions}
+	}
+	return legacy
+}
+
+// marshalIndentUnescaped is json.MarshalIndent without HTML escaping, so
+// captions keep characters such as < and & as written
+func marshalIndentUnescaped(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// marshalManifest encodes the manifest in the requested schema
+func marshalManifest(mediaFilesArray []MediaFileEntry, schema string) ([]byte, error) {
+	switch schema {
+	case "", SchemaV2Array, ManifestFormatArray:
+		return marshalIndentUnescaped(mediaFilesArray)
+	case SchemaV1Map, ManifestFormatLegacy:
+		return marshalIndentUnescaped(toLegacyMediaFilesMap(mediaFilesArray))
+	}
+	return nil, ValidateManifestSchema(schema)
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestSchemasRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	media := []Media{
+		{ID: "wide", MediaType: "IMAGE", Permalink: "https://www.instagram.com/p/wide/", MediaURL: localFileURL(writeTestPNG(t, dir, "wide.png", 1200, 600)), Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "small", MediaType: "IMAGE", Permalink: "https://www.instagram.com/p/small/", MediaURL: localFileURL(writeTestPNG(t, dir, "small.png", 300, 300)), Timestamp: "2024-01-01T00:00:00+0000"},
+	}
+	run := func(schema string) ([]MediaFileEntry, []byte) {
+		t.Helper()
+		outputDir := t.TempDir()
+		entries, err := FetchAndTransformImagesResult(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{ManifestFormat: schema})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(outputDir, "converted_media.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries, data
+	}
+
+	for _, schema := range []string{"", SchemaV2Array, ManifestFormatArray} {
+		t.Run("array "+schema, func(t *testing.T) {
+			entries, data := run(schema)
+			var decoded []MediaFileEntry
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("not an array manifest: %v", err)
+			}
+			if len(decoded) != 2 || decoded[0].MediaID != "wide" || decoded[1].MediaID != "small" {
+				t.Fatalf("decoded %d entries out of timestamp order", len(decoded))
+			}
+			for i := range decoded {
+				if !reflect.DeepEqual(decoded[i].Versions, stripUnexported(entries[i].Versions)) || decoded[i].Permalink != entries[i].Permalink {
+					t.Errorf("entry %s does not round-trip", decoded[i].MediaID)
+				}
+			}
+		})
+	}
+
+	for _, schema := range []string{SchemaV1Map, ManifestFormatLegacy} {
+		t.Run("map "+schema, func(t *testing.T) {
+			entries, data := run(schema)
+			var decoded legacyMediaFilesMap
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("not a map manifest: %v", err)
+			}
+			if len(decoded) != len(entries) {
+				t.Fatalf("decoded %d items, want %d", len(decoded), len(entries))
+			}
+			for _, entry := range entries {
+				item, ok := decoded[entry.MediaID]
+				if !ok {
+					t.Fatalf("%s is missing from the map", entry.MediaID)
+				}
+				largest, _ := largestVersion(entry)
+				want := legacyOriginal{FileName: largest.FileName, Width: largest.Width, Height: largest.Height, Timestamp: entry.Timestamp, Permalink: entry.Permalink}
+				if item.Original != want {
+					t.Errorf("%s original = %+v, want %+v", entry.MediaID, item.Original, want)
+				}
+				if !reflect.DeepEqual(item.Versions, stripUnexported(entry.Versions)) {
+					t.Errorf("%s versions do not round-trip", entry.MediaID)
+				}
+			}
+		})
+	}
+}
+
+// stripUnexported returns versions without their unexported fields, which
+// never reach the manifest
+func stripUnexported(versions map[string]ImageVersionEntry) map[string]ImageVersionEntry {
+	stripped := make(map[string]ImageVersionEntry, len(versions))
+	for name, version := range versions {
+		version.name, version.digest = "", ""
+		stripped[name] = version
+	}
+	return stripped
+}
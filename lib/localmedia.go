@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// localTimestampLayout is the Graph API's timestamp layout, used for local
+// files so their manifest entries look like Instagram's
+const localTimestampLayout = "2006-01-02T15:04:05-0700"
+
+// localFileURL returns the file:// URL a local source is recorded under
+func localFileURL(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// localFilePath returns the path of a file:// URL, or false for other URLs
+func localFilePath(rawURL string) (string, bool) {
+	if !strings.HasPrefix(rawURL, "file://") {
+		return "", false
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	return filepath.FromSlash(parsed.Path), true
+}
+
+// readLocalImage reads a local source, rejecting files that are not images
+// the same way a download is rejected
+func readLocalImage(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImageContent("", data[:min(len(data), sniffLen)]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// sniffLocalFile reads the first bytes of a file for content sniffing
+func sniffLocalFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// localMediaID derives a media ID from a file name, keeping only characters
+// that are safe in the version file names built from it
+func localMediaID(path string) string {
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-':
+			return r
+		}
+		return '_'
+	}, stem)
+	if id == "" {
+		return "image"
+	}
+	return id
+}
+
+// LocalMedia lists the images in a directory, or matching a glob such as
+// "photos/*.jpg", as Media pointing at the local files. Files that are not
+// images are skipped with a warning. IDs come from the file names, with a
+// numeric suffix when two names collide, and timestamps from the
+// modification times.
+func LocalMedia(input string) ([]Media, error) {
+	var paths []string
+	if info, err := os.Stat(input); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(input)
+		if err != nil {
+			return nil, fmt.Errorf("error reading input dir: %w", err)
+		}
+		for _, entry := range entries {
+			paths = append(paths, filepath.Join(input, entry.Name()))
+		}
+	} else {
+		if paths, err = filepath.Glob(input); err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %w", input, err)
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no files match %s", input)
+		}
+	}
+	slices.Sort(paths)
+
+	var media []Media
+	taken := make(map[string]bool)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		head, err := sniffLocalFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		if err := checkImageContent("", head); err != nil {
+			logger.Warn("skipping file that is not an image", "path", path, "reason", err)
+			continue
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		base := localMediaID(path)
+		id := base
+		for n := 2; taken[id]; n++ {
+			id = base + "-" + strconv.Itoa(n)
+		}
+		taken[id] = true
+
+		media = append(media, Media{
+			ID:        id,
+			MediaType: "IMAGE",
+			MediaURL:  localFileURL(abs),
+			Timestamp: info.ModTime().UTC().Format(localTimestampLayout),
+		})
+	}
+	return media, nil
+}
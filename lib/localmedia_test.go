@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestConvertLocalDirectory(t *testing.T) {
+	input := t.TempDir()
+	writeTestPNG(t, input, "beach.png", 320, 240)
+	writeTestPNG(t, input, "city night.png", 200, 300)
+	if err := os.WriteFile(filepath.Join(input, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := LocalMedia(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaIDs(media), []string{"beach", "city_night"}; !slices.Equal(got, want) {
+		t.Fatalf("local media = %v, want %v with notes.txt skipped", got, want)
+	}
+	for _, item := range media {
+		if _, ok := localFilePath(item.MediaURL); !ok {
+			t.Errorf("%s: media URL %q is not a file:// URL", item.ID, item.MediaURL)
+		}
+	}
+
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readManifest(t, outputDir)
+	if len(entries) != 2 {
+		t.Fatalf("manifest has %d entries, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if len(entry.Versions) == 0 {
+			t.Errorf("%s: no versions written", entry.MediaID)
+		}
+		for name, version := range entry.Versions {
+			if _, err := os.Stat(filepath.Join(mediaDir, version.FileName)); err != nil {
+				t.Errorf("%s %s: %v", entry.MediaID, name, err)
+			}
+		}
+	}
+}
+
+func TestLocalMediaGlob(t *testing.T) {
+	input := t.TempDir()
+	writeTestPNG(t, input, "a.png", 40, 30)
+	writeTestPNG(t, input, "b.jpg.png", 30, 40)
+	if err := os.WriteFile(filepath.Join(input, "c.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := LocalMedia(filepath.Join(input, "*.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaIDs(media), []string{"a", "b_jpg"}; !slices.Equal(got, want) {
+		t.Errorf("glob matched %v, want %v", got, want)
+	}
+
+	if _, err := LocalMedia(filepath.Join(input, "*.gif")); err == nil {
+		t.Error("a glob matching nothing gave no error")
+	}
+}
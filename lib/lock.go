@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LockFileName is the advisory lock file created in the output directory
+const LockFileName = ".lock"
+
+// lockPollInterval is how often a waiting run checks whether the lock is free
+const lockPollInterval = 500 * time.Millisecond
+
+// ErrLocked is returned when another running process holds the output lock
+var ErrLocked = errors.New("output directory is locked by another process")
+
+// OutputLock is an advisory lock on an output directory, held by the
+// process whose PID is written in the lock file
+type OutputLock struct {
+	path string
+}
+
+// LockOutputDir takes the lock on outputDir. A lock left behind by a process
+// that is no longer running is removed and taken over. When the lock is held
+// it returns ErrLocked, or with wait polls until it is free or ctx is done.
+func LockOutputDir(ctx context.Context, outputDir string, wait bool) (*OutputLock, error) {
+	if err := ensureDirectoryExists(outputDir); err != nil {
+		return nil, fmt.Errorf("error creating output directory: %w", err)
+	}
+	path := filepath.Join(outputDir, LockFileName)
+
+	logged := false
+	for {
+		pid, err := tryLock(path)
+		if err == nil {
+			return &OutputLock{path: path}, nil
+		}
+		if !errors.Is(err, ErrLocked) || !wait {
+			return nil, err
+		}
+
+		if !logged {
+			logger.Info("waiting for the output directory lock", "path", path, "pid", pid)
+			logged = true
+		}
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lockGracePeriod is how long an empty lock file is taken to belong to a
+// process still writing its PID. Locks written by tryLock are never empty, so
+// an older empty one was left by a process that died.
+const lockGracePeriod = 10 * time.Second
+
+// tryLock links a file already holding this process's PID in as the lock, so
+// the lock never appears empty and only one process can create it. A stale
+// lock is moved aside and taken over. It returns the holder's PID alongside
+// ErrLocked.
+func tryLock(path string) (int, error) {
+	candidate, err := os.CreateTemp(filepath.Dir(path), LockFileName+"-*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating lock file %s: %w", path, err)
+	}
+	defer os.Remove(candidate.Name())
+	_, err = candidate.WriteString(strconv.Itoa(os.Getpid()))
+	if closeErr := candidate.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error writing lock file %s: %w", path, err)
+	}
+
+	for takenOver := false; ; takenOver = true {
+		err := os.Link(candidate.Name(), path)
+		if err == nil {
+			return 0, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return 0, fmt.Errorf("error creating lock file %s: %w", path, err)
+		}
+
+		pid, info, alive := lockHolder(path)
+		// After a takeover the lock can only be back because another
+		// process took it over first
+		if alive || takenOver {
+			return pid, fmt.Errorf("%w (pid %d, lock file %s)", ErrLocked, pid, path)
+		}
+		if info == nil {
+			continue
+		}
+		logger.Warn("removing stale lock", "path", path, "pid", pid)
+		if err := removeStaleLock(path, candidate.Name()+".stale", info); err != nil {
+			return 0, fmt.Errorf("error removing stale lock %s: %w", path, err)
+		}
+	}
+}
+
+// removeStaleLock moves the lock at path to aside and removes it, as long as
+// it is still the stale file described by info. Another process taking over
+// the same lock may have replaced it in between, and that lock is put back.
+func removeStaleLock(path, aside string, info fs.FileInfo) error {
+	if err := os.Rename(path, aside); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(aside)
+
+	if moved, err := os.Stat(aside); err == nil && !os.SameFile(info, moved) {
+		if err := os.Link(aside, path); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockHolder reads the PID in a lock file and reports whether that process
+// is still running, along with the file read. A missing lock is reported as
+// free with a nil file. A lock that can't be read is treated as held, and so
+// is an empty one within lockGracePeriod, since its owner may still be
+// writing the PID.
+func lockHolder(path string) (int, fs.FileInfo, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, !errors.Is(err, fs.ErrNotExist)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, true
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, info, true
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, info, len(data) == 0 && time.Since(info.ModTime()) < lockGracePeriod
+	}
+	return pid, info, processAlive(pid)
+}
+
+// processAlive reports whether a process with the given PID is running. On
+// Windows finding the process is enough; elsewhere signal 0 checks for it
+// without delivering anything, and a permission error still means it exists.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Unlock releases the lock
+func (l *OutputLock) Unlock() error {
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing lock file %s: %w", l.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLockOutputDirRejectsSecondAcquisition(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockOutputDir(context.Background(), dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LockOutputDir(context.Background(), dir, false); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second acquisition: got %v, want ErrLocked", err)
+	}
+
+	// A waiting acquisition gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := LockOutputDir(ctx, dir, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting acquisition: got %v, want the context's error", err)
+	}
+
+	// Without a deadline it gets the lock once the holder releases it
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Unlock()
+	}()
+	second, err := LockOutputDir(context.Background(), dir, true)
+	if err != nil {
+		t.Fatalf("waiting acquisition after release: %v", err)
+	}
+	if err := second.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, LockFileName)); !os.IsNotExist(err) {
+		t.Errorf("lock file left after unlock: %v", err)
+	}
+}
+
+func TestLockOutputDirTakesOverStaleLock(t *testing.T) {
+	// The PID of a process that has already exited
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, LockFileName), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := LockOutputDir(context.Background(), dir, false)
+	if err != nil {
+		t.Fatalf("stale lock was not taken over: %v", err)
+	}
+	defer lock.Unlock()
+	if data, _ := os.ReadFile(filepath.Join(dir, LockFileName)); string(data) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("lock file holds %q, want this process's PID", data)
+	}
+}
+
+func TestLockOutputDirEmptyLock(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		wantHeld bool
+	}{
+		{"being written", 0, true},
+		{"left behind", 2 * lockGracePeriod, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, LockFileName)
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			modified := time.Now().Add(-tt.age)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+
+			lock, err := LockOutputDir(context.Background(), dir, false)
+			if held := errors.Is(err, ErrLocked); held != tt.wantHeld {
+				t.Fatalf("got %v, want held %v", err, tt.wantHeld)
+			}
+			if lock != nil {
+				lock.Unlock()
+			}
+		})
+	}
+}
+
+func TestLockOutputDirStaleTakeoverHasOneWinner(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, LockFileName), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		const racers = 8
+		results := make(chan error, racers)
+		for range racers {
+			go func() {
+				_, err := LockOutputDir(context.Background(), dir, false)
+				results <- err
+			}()
+		}
+		won := 0
+		for range racers {
+			switch err := <-results; {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrLocked):
+				t.Fatal(err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%d racers took over the stale lock, want 1", won)
+		}
+
+		// Nothing but the lock is left behind
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("output dir holds %d files after the takeover, want only the lock", len(entries))
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Log formats accepted by NewLogger
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logger is the leveled logger used throughout the package
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// SetLogger replaces the logger used by the package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// NewLogger builds a logger writing to w at the given level (debug, info,
+// warn or error) in the given format (text or json)
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q: expected debug, info, warn or error", level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q: expected text or json", format)
+	}
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useLogger installs a logger at level and format writing to the returned
+// buffer until the test ends
+func useLogger(t *testing.T, level, format string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := logger
+	SetLogger(l)
+	t.Cleanup(func() { SetLogger(previous) })
+	return &buf
+}
+
+func TestWarnLevelSuppressesInfo(t *testing.T) {
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			buf := useLogger(t, "warn", format)
+
+			// One good item logs at info; the missing one logs an error
+			dir := t.TempDir()
+			media := []Media{
+				{ID: "good", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "good.png", 64, 64)), Timestamp: "2024-01-02T00:00:00+0000"},
+				{ID: "missing", MediaType: "IMAGE", MediaURL: localFileURL(filepath.Join(dir, "missing.png")), Timestamp: "2024-01-01T00:00:00+0000"},
+			}
+			if err := FetchAndTransformImages(context.Background(), media, t.TempDir(), t.TempDir(), ProcessOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			var levels []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if format == LogFormatJSON {
+					var record struct{ Level string }
+					if err := json.Unmarshal([]byte(line), &record); err != nil {
+						t.Fatalf("line %q is not JSON: %v", line, err)
+					}
+					levels = append(levels, record.Level)
+				} else if _, rest, ok := strings.Cut(line, "level="); ok {
+					level, _, _ := strings.Cut(rest, " ")
+					levels = append(levels, level)
+				}
+			}
+			if len(levels) == 0 {
+				t.Fatal("nothing was logged, want the failed item's error")
+			}
+			for _, level := range levels {
+				if level != "WARN" && level != "ERROR" {
+					t.Errorf("logged a %s line at warn level:\n%s", level, buf)
+				}
+			}
+		})
+	}
+}
+
+func TestNewLoggerRejectsUnknownSettings(t *testing.T) {
+	if _, err := NewLogger(&bytes.Buffer{}, "verbose", LogFormatText); err == nil {
+		t.Error("unknown level: got no error")
+	}
+	if _, err := NewLogger(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("unknown format: got no error")
+	}
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ManifestCache holds the parsed converted_media.json in memory, re-reading
+// it only when its modification time or size changes
+type ManifestCache struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	data    []byte
+	entries map[string]MediaFileEntry
+	err     error
+}
+
+// NewManifestCache returns a cache for the converted_media.json in outputDir
+func NewManifestCache(outputDir string) *ManifestCache {
+	return &ManifestCache{path: filepath.Join(outputDir, "converted_media.json")}
+}
+
+// load returns the raw manifest and its entries keyed by media ID. A
+// manifest that is not in array format still returns its raw bytes, with
+// the parse error in place of the entries.
+func (m *ManifestCache) load() ([]byte, map[string]MediaFileEntry, error) {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data != nil && info.ModTime().Equal(m.modTime) && info.Size() == m.size {
+		return m.data, m.entries, m.err
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []MediaFileEntry
+	m.entries, m.err = nil, nil
+	if err := json.Unmarshal(data, &entries); err != nil {
+		m.err = fmt.Errorf("manifest %s is not an array manifest: %w", m.path, err)
+	} else {
+		m.entries = make(map[string]MediaFileEntry, len(entries))
+		for _, entry := range entries {
+			m.entries[entry.MediaID] = entry
+		}
+	}
+	m.data = data
+	m.modTime = info.ModTime()
+	m.size = info.Size()
+	return m.data, m.entries, m.err
+}
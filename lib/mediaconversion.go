@@ -1,11 +1,18 @@
 package lib
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -13,10 +20,9 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/disintegration/imaging"
-	"github.com/kolesa-team/go-webp/encoder"
-	"github.com/kolesa-team/go-webp/webp"
 	"github.com/relvacode/iso8601"
 )
 
@@ -25,27 +31,242 @@ type ImageVersionEntry struct {
 	FileName string `json:"file_name"`
 	Width    int    `json:"width"`
 	Height   int    `json:"height"`
+	Checksum string `json:"checksum,omitempty"`
+	// Size is the file size in bytes after the final encode
+	Size int64 `json:"size"`
+	// Quality is the lossy quality chosen to meet the target size, when one
+	// is set
+	Quality int `json:"quality,omitempty"`
+
+	// name is the size name the version is keyed by in the manifest
+	name string
+	// digest is the hex SHA-256 of the file, when it was written this run
+	digest string
 }
 
 // MediaFileEntry represents a single media entry with original and versions
 type MediaFileEntry struct {
 	MediaID   string                       `json:"media_id"`
+	MediaType string                       `json:"media_type,omitempty"`
 	Timestamp string                       `json:"timestamp"`
 	Permalink string                       `json:"permalink"`
+	Caption   string                       `json:"caption,omitempty"`
 	Versions  map[string]ImageVersionEntry `json:"versions"`
+	// AspectRatio is the width / height of the largest version, e.g. "4 / 3"
+	AspectRatio string `json:"aspect_ratio,omitempty"`
+	// FlattenedBackground is the colour a transparent source was flattened onto
+	FlattenedBackground string `json:"flattened_background,omitempty"`
+	// Source is the URL the versions were converted from
+	Source *SourceURLEntry `json:"source,omitempty"`
+	// Passthrough is set when the small source was copied instead of resized
+	Passthrough bool `json:"passthrough,omitempty"`
+	// Placeholder is a blurhash or "#rrggbb" colour to show while loading
+	Placeholder string `json:"placeholder,omitempty"`
+	// SrcSet lists the versions as a responsive <img srcset> value
+	SrcSet string `json:"srcset,omitempty"`
+	// VideoFileName is the downloaded video the versions' poster came from
+	VideoFileName string `json:"video_file_name,omitempty"`
+	// Preview is an animated WebP sampled from the video, when requested
+	Preview *PreviewEntry `json:"preview,omitempty"`
+	// Children are the converted items of a carousel album, in album order
+	Children []MediaFileEntry `json:"children,omitempty"`
+	// Original is the kept source download, when originals are kept
+	Original *OriginalEntry `json:"original,omitempty"`
+	// Order is the 0-based display position, most recent first; children
+	// are numbered by their position in the album
+	Order int `json:"order"`
+
+	// DedupOf is the media ID whose files this entry reuses because their
+	// sources were identical
+	DedupOf string `json:"dedup_of,omitempty"`
+	// Embed is the post's oEmbed link-preview metadata, when fetched
+	Embed *EmbedEntry `json:"embed,omitempty"`
+
+	// sourceSize is the downloaded source's size in bytes, when it was
+	// downloaded this run
+	sourceSize int64
 }
 
-// Standard image sizes to generate
-var imageVersions = []struct {
+// SourceURLEntry records the source URL of a manifest entry. Instagram media
+// URLs are signed and expire, so the URL is only good for debugging and may
+// no longer resolve by the time it is read.
+type SourceURLEntry struct {
+	URL          string `json:"url"`
+	FetchedAt    string `json:"fetched_at"`
+	MayBeExpired bool   `json:"may_be_expired"`
+}
+
+// imageResult is the outcome of converting a single source image
+type imageResult struct {
+	Versions      []ImageVersionEntry
+	Background    string
+	SourceURL     string
+	Passthrough   bool
+	VideoFileName string
+	Placeholder   string
+	Original      *OriginalEntry
+	Preview       *PreviewEntry
+	// SourceSize is the size in bytes of the downloaded source image
+	SourceSize int64
+	// DedupOf is the media ID whose files an identical source reuses
+	DedupOf string
+}
+
+// ProcessOptions controls optional behaviour of FetchAndTransformImages
+type ProcessOptions struct {
+	// RSSPath, when set, is where an RSS feed of the processed media is written
+	RSSPath string
+	// Feed, FeedRSS or FeedAtom, writes a feed of the processed media to
+	// FeedFileName in the output dir, with enclosures prefixed by BaseURL
+	Feed string
+	// VerifyEncode decodes every written file to check it is a valid image
+	VerifyEncode bool
+	// Reporter, when set, receives per-item progress events
+	Reporter Reporter
+	// Progress, when set, is called once per finished item, whether it was
+	// processed, skipped or failed. Calls never overlap and done increases by
+	// one each time up to total.
+	Progress func(done, total int, currentID string)
+	// Checksum records a SHA-256 of each written file in the manifest
+	Checksum bool
+	// EmitAspectRatio records each entry's aspect ratio in the manifest
+	EmitAspectRatio bool
+	// ManifestWriter, when set, also receives the final manifest JSON
+	ManifestWriter io.Writer
+	// ReportWriter receives the dry-run listing; stdout when nil
+	ReportWriter io.Writer
+	// FlattenBackground, when set, is composited under transparent sources
+	// for the versions not encoded losslessly
+	FlattenBackground color.Color
+	// FailOnEmpty makes a run that processes no media return ErrNoMediaProcessed
+	FailOnEmpty bool
+	// ThumbFormat, when set, overrides the output format of the smallest size
+	ThumbFormat string
+	// IncludeSourceURL records the (possibly expired) source URL per entry
+	IncludeSourceURL bool
+	// MaxPixels rejects sources whose header declares more pixels (0 disables)
+	MaxPixels int
+	// SummaryPath, when set, is where a JSON summary of the run is written
+	SummaryPath string
+	// PassthroughSmall copies sources that are already smaller than the
+	// smallest size and in an efficient format instead of upscaling them
+	PassthroughSmall bool
+	// VideoPosters downloads videos and converts a poster frame extracted
+	// with ffmpeg; without ffmpeg on PATH videos are skipped as before
+	VideoPosters bool
+	// VideoPreview set to VideoPreviewFrames also writes an animated WebP of
+	// PreviewFrames frames (0 means DefaultPreviewFrames) for each video,
+	// falling back to the poster alone when ffmpeg cannot encode one
+	VideoPreview  string
+	PreviewFrames int
+	// Concurrency caps how many items are processed at once (0 is unbounded)
+	Concurrency int
+	// SizeConcurrency caps how many sizes of one image are resized at once;
+	// 0 or 1 resizes them one after another
+	SizeConcurrency int
+	// Encode controls output quality and the WebP preset
+	Encode EncodeOptions
+	// ResizeFilter names the resampling filter, e.g. "nearest" for pixel
+	// art; empty means DefaultResizeFilter
+	ResizeFilter string
+	// Format is the output format of every size; empty means FormatWebP
+	Format string
+	// ManifestFormat is the manifest schema, SchemaV2Array (the default) or
+	// SchemaV1Map
+	ManifestFormat string
+	// Placeholder is PlaceholderBlurhash, PlaceholderColor or empty for none
+	Placeholder string
+	// ContentHash adds a short hash of the encoded bytes to each file name
+	ContentHash bool
+	// BaseURL prefixes file names in each entry's srcset
+	BaseURL string
+	// DryRun lists what would be downloaded and written without doing either
+	DryRun bool
+	// Incremental reuses files recorded in the previous converted_media.json,
+	// regenerating only missing sizes, and keeps entries not in this run
+	Incremental bool
+	// AccessToken, when set, is used to refresh expired signed media URLs;
+	// without it media whose URL has expired is skipped, or fails the run
+	// under FailFast
+	AccessToken string
+	// Sprite packs every entry's smallest version into one sprite sheet
+	Sprite bool
+	// AllowUpscale resizes sources narrower than a size up to its width;
+	// by default such sizes keep the source width
+	AllowUpscale bool
+	// KeepOriginals also writes each downloaded source under original/ in
+	// the media dir and records it per entry
+	KeepOriginals bool
+	// KeepMetadata copies the source's EXIF into JPEG and WebP versions and
+	// leaves it in passthrough versions and originals; by default every
+	// written image is free of EXIF, GPS and XMP
+	KeepMetadata bool
+	// Storage, when set, receives every output as it is written, media files
+	// under "media/" and the manifest and its siblings by name. The outputs
+	// are written to the media and output dirs either way.
+	Storage Storage
+	// FailFast stops the run at the first media item that fails, cancelling
+	// items in flight and leaving the previous manifest untouched, and returns
+	// every failure joined; otherwise failures are logged and the run carries on
+	FailFast bool
+	// ItemTimeout bounds the download and conversion of a single media item,
+	// children included; zero disables it
+	ItemTimeout time.Duration
+	// Overwrite lets a run replace the manifest of an earlier run in the
+	// output dir; without it, or Incremental, such a run fails with
+	// ErrOutputExists before anything is downloaded
+	Overwrite bool
+	// ShardDepth spreads media files over this many levels of
+	// subdirectories of the media dir, up to MaxShardDepth; 0 keeps it flat
+	ShardDepth int
+	// TargetSize, when set, encodes each lossy version at the highest
+	// quality that keeps it within this many bytes, recording the quality
+	TargetSize int64
+	// FetchEmbed adds each post's oEmbed metadata to its entry, one Graph
+	// API call per item, using EmbedToken or else AccessToken
+	FetchEmbed bool
+	EmbedToken string
+
+	// dedupe shares the files of identical sources within a run
+	dedupe *sourceDedupe
+	// store is what the run writes its outputs through
+	store *runStorage
+}
+
+// outputs returns the storage the run writes through, or one writing to
+// mediaDir alone when converting outside a run
+func (opts ProcessOptions) outputs(mediaDir string) *runStorage {
+	if opts.store != nil {
+		return opts.store
+	}
+	return newRunStorage(mediaDir, "", nil)
+}
+
+// ImageSize is a target width and the name its version is keyed by
+type ImageSize struct {
 	Width int
 	Name  string
-}{
+}
+
+// Standard image sizes to generate
+var imageVersions = []ImageSize{
 	{Width: 1024, Name: "large"},
 	{Width: 768, Name: "medium"},
 	{Width: 384, Name: "small"},
 	{Width: 256, Name: "thumb"},
 }
 
+// smallestVersionWidth returns the width of the smallest generated size
+func smallestVersionWidth() int {
+	smallest := 0
+	for _, size := range imageVersions {
+		if smallest == 0 || size.Width < smallest {
+			smallest = size.Width
+		}
+	}
+	return smallest
+}
+
 func timestampCompare(i, j MediaFileEntry) int {
 	// converrt timestamp to int
 	// timestamp is in format 2025-04-16T15:58:54+0000
@@ -66,19 +287,68 @@ func timestampCompare(i, j MediaFileEntry) int {
 	return 0 // equal timestamps
 }
 
-// downloadImageToBytes downloads a file from a URL into memory
-func downloadImageToBytes(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// largestVersion returns the version with the greatest width. Sizes capped
+// at the same width by a small source are told apart by file name, so the
+// pick does not depend on map order.
+func largestVersion(entry MediaFileEntry) (ImageVersionEntry, bool) {
+	var largest ImageVersionEntry
+	found := false
+	for _, version := range entry.Versions {
+		if !found || version.Width > largest.Width || (version.Width == largest.Width && version.FileName < largest.FileName) {
+			largest = version
+			found = true
+		}
+	}
+	return largest, found
+}
+
+// aspectRatio returns the ratio of width to height in lowest terms, in the
+// form accepted by the CSS aspect-ratio property
+func aspectRatio(width, height int) string {
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d / %d", width/a, height/a)
+}
+
+// downloadImageToBytes downloads a file from a URL into memory, using the
+// download cache when one is configured. file:// URLs are read from disk.
+func downloadImageToBytes(ctx context.Context, url string) ([]byte, error) {
+	if path, ok := localFilePath(url); ok {
+		return readLocalImage(path)
+	}
+	if data, ok := readDownloadCache(url); ok {
+		return data, nil
+	}
+
+	resp, release, err := limitedGet(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("HTTP request failed: %w", err)
 	}
+	defer release()
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %s", resp.Status)
+		return nil, &statusError{Code: resp.StatusCode, Status: resp.Status}
 	}
 
-	return io.ReadAll(resp.Body)
+	// Check what the URL actually serves before reading all of it
+	body := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := body.Peek(sniffLen)
+	if err := checkImageContent(resp.Header.Get("Content-Type"), head); err != nil {
+		return nil, err
+	}
+
+	data, err := readLimited(resp, body)
+	if err != nil {
+		return nil, err
+	}
+	writeDownloadCache(url, data)
+	return data, nil
 }
 
 // ResizeByWidthWebP resizes an image and converts it to WebP format
@@ -89,49 +359,249 @@ type ResizeRes struct {
 	Width    int
 	FileName string
 	Error    error
+	Checksum string
+	Size     int64
+	Quality  int
+
+	// digest is the hex SHA-256 of the written file
+	digest string
+}
+
+// statusError reports a download that got a non-200 response
+type statusError struct {
+	Code   int
+	Status string
+}
+
+func (e *statusError) Error() string {
+	return "bad status: " + e.Status
+}
+
+// isExpiredURL reports whether a download failed because its signed CDN URL
+// has expired, which Instagram's CDN answers with 403 or 410
+func isExpiredURL(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && (status.Code == http.StatusForbidden || status.Code == http.StatusGone)
 }
 
-// resizeImageBytesByWidthWebP resizes an in-memory image and converts it to WebP
-func resizeImageBytesByWidthWebP(imageData []byte, width, height int, baseFileName, outputDir, name string) ResizeRes {
-	// Open the source image from memory
-	src, err := imaging.Decode(bytes.NewReader(imageData))
+// ErrNoMediaProcessed is returned when FailOnEmpty is set and nothing was processed
+var ErrNoMediaProcessed = errors.New("no media was processed")
+
+// ErrOutputExists is returned when the output dir already holds a manifest
+// and neither Overwrite nor Incremental is set
+var ErrOutputExists = errors.New("output dir already contains converted_media.json")
+
+// errVerifyFailed marks an output that did not decode back as expected
+var errVerifyFailed = errors.New("encode verification failed")
+
+// errImageTooLarge marks a source whose header declares too many pixels
+var errImageTooLarge = errors.New("image exceeds pixel limit")
+
+// DefaultMaxPixels is the largest source, in pixels, decoded by default
+const DefaultMaxPixels = 50_000_000
+
+// checkImageDimensions reads only the image header and rejects sources whose
+// declared dimensions exceed maxPixels, so a decompression bomb is refused
+// before its bitmap is ever allocated. It returns the header and format name.
+func checkImageDimensions(data []byte, maxPixels int) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return ResizeRes{0, 0, "", fmt.Errorf("failed to decode image: %w", err)}
+		return config, format, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return config, format, fmt.Errorf("invalid image dimensions %dx%d", config.Width, config.Height)
+	}
+	if maxPixels > 0 && config.Width > maxPixels/config.Height {
+		return config, format, fmt.Errorf("%w: %dx%d is over %d pixels", errImageTooLarge, config.Width, config.Height, maxPixels)
+	}
+	return config, format, nil
+}
+
+// passthroughExtensions maps source formats efficient enough to be served
+// as-is to the extension they are written with
+var passthroughExtensions = map[string]string{
+	"jpeg": "jpg",
+	"webp": "webp",
+}
+
+// passthroughImage writes the original bytes of a small source as its only
+// version rather than producing upscaled variants. The pixels are not
+// rotated, so a stripped copy keeps the source's EXIF orientation, and config
+// holds the displayed, oriented size.
+func passthroughImage(ctx context.Context, data []byte, config image.Config, orientation uint16, format, ext, mediaID, mediaDir string, opts ProcessOptions) (*imageResult, error) {
+	if !opts.KeepMetadata {
+		stripped, err := stripMetadata(data, format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to strip metadata: %w", err)
+		}
+		if orientation != 1 {
+			embedFormat := FormatJPEG
+			if format == "webp" {
+				embedFormat = FormatWebP
+			}
+			if stripped, err = embedEXIF(stripped, embedFormat, orientationEXIF(orientation)); err != nil {
+				return nil, fmt.Errorf("failed to keep orientation: %w", err)
+			}
+		}
+		data = stripped
+	}
+
+	destFileName := fmt.Sprintf("%s_%dw_original.%s", mediaFileBase(mediaID, opts.ShardDepth), config.Width, ext)
+	if err := opts.outputs(mediaDir).Put(ctx, mediaKey(destFileName), bytes.NewReader(data), contentTypeFor(destFileName)); err != nil {
+		return nil, fmt.Errorf("failed to write output file: %w", err)
 	}
 
+	sum := sha256.Sum256(data)
+	version := ImageVersionEntry{
+		FileName: destFileName,
+		Width:    config.Width,
+		Height:   config.Height,
+		Size:     int64(len(data)),
+		name:     "original",
+		digest:   hex.EncodeToString(sum[:]),
+	}
+	if opts.Checksum {
+		version.Checksum = "sha256:" + version.digest
+	}
+
+	result := &imageResult{Versions: []ImageVersionEntry{version}, Passthrough: true}
+	if opts.Placeholder != "" && opts.Placeholder != PlaceholderNone {
+		if src, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true)); err == nil {
+			result.Placeholder = computePlaceholder(src, opts.Placeholder)
+		}
+	}
+
+	logger.Debug("passed through original", "file", version.FileName, "width", version.Width, "height", version.Height)
+	return result, nil
+}
+
+// versionFileName names the output file of one size of a media item
+func versionFileName(mediaID string, width int, name, format string) string {
+	return fmt.Sprintf("%s_%dw_%s.%s", mediaID, width, name, formatExtension(format))
+}
+
+// contentHashLength is how many hex digits of the sha256 go in a file name
+const contentHashLength = 6
+
+// contentHashedName inserts a short content hash before the extension,
+// e.g. abc_256w_thumb.webp becomes abc_256w_thumb.8f3a2c.webp
+func contentHashedName(fileName string, sum [sha256.Size]byte) string {
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "." + hex.EncodeToString(sum[:])[:contentHashLength] + ext
+}
+
+// sizeFormat returns the output format for a size; only the smallest (thumb)
+// size honours the thumbnail format override
+func sizeFormat(size ImageSize, opts ProcessOptions) string {
+	if opts.ThumbFormat != "" && size.Width == smallestVersionWidth() {
+		return opts.ThumbFormat
+	}
+	if opts.Format == "" {
+		return FormatWebP
+	}
+	return opts.Format
+}
+
+// resizeImageByWidth resizes a decoded image and encodes it in the given format,
+// copying exif into the output when it is set. The resized copy and its
+// encoded bytes are only held until the file is written.
+func resizeImageByWidth(ctx context.Context, src image.Image, width, height int, baseFileName, outputDir, name, format string, exif []byte, opts ProcessOptions) ResizeRes {
 	// Resize the image preserving aspect ratio
+	filter := resizeFilter(opts.ResizeFilter)
 	var resized image.Image
 	if height == 0 {
-		resized = imaging.Resize(src, width, 0, imaging.Lanczos)
+		resized = imaging.Resize(src, width, 0, filter)
 	} else if width == 0 {
-		resized = imaging.Resize(src, 0, height, imaging.Lanczos)
+		resized = imaging.Resize(src, 0, height, filter)
 	} else {
-		resized = imaging.Resize(src, width, height, imaging.Lanczos)
+		resized = imaging.Resize(src, width, height, filter)
 	}
 
 	actualHeight := resized.Bounds().Dy()
 
-	destFileName := fmt.Sprintf("%s_%dw_%s.webp", baseFileName, width, name)
-	destPath := filepath.Join(outputDir, destFileName)
+	destFileName := versionFileName(baseFileName, width, name, format)
+
+	var output []byte
+	quality := 0
+	if opts.TargetSize > 0 && format != FormatWebPLossless {
+		var fits bool
+		var err error
+		output, quality, fits, err = encodeToTargetSize(ctx, resized, format, opts.Encode, opts.TargetSize)
+		if err != nil {
+			return ResizeRes{Height: actualHeight, Width: width, FileName: destFileName, Error: err}
+		}
+		if !fits {
+			logger.Warn("could not encode under the target size", "file", destFileName, "quality", quality, "bytes", len(output), "target", opts.TargetSize)
+		}
+	} else {
+		var encoded bytes.Buffer
+		if err := encodeImage(ctx, &encoded, resized, format, opts.Encode); err != nil {
+			return ResizeRes{Height: actualHeight, Width: width, FileName: destFileName, Error: err}
+		}
+		output = encoded.Bytes()
+	}
+
+	if len(exif) > 0 {
+		if withEXIF, err := embedEXIF(output, format, exif); err != nil {
+			logger.Warn("could not copy metadata", "file", destFileName, "error", err)
+		} else {
+			output = withEXIF
+		}
+	}
+
+	// Name the file after its final encoded bytes so changed output gets a new URL
+	sum := sha256.Sum256(output)
+	if opts.ContentHash {
+		destFileName = contentHashedName(destFileName, sum)
+	}
+	destPath := filepath.Join(outputDir, filepath.FromSlash(destFileName))
+
+	// Write the output file
+	if err := opts.outputs(outputDir).Put(ctx, mediaKey(destFileName), bytes.NewReader(output), contentTypeFor(destFileName)); err != nil {
+		return ResizeRes{Error: fmt.Errorf("failed to write output file: %w", err)}
+	}
+
+	if opts.VerifyEncode {
+		if err := verifyOutputFile(ctx, destPath, format, width, actualHeight); err != nil {
+			return ResizeRes{Height: actualHeight, Width: width, FileName: destFileName, Error: err}
+		}
+	}
+
+	res := ResizeRes{Height: actualHeight, Width: width, FileName: destFileName, Size: int64(len(output)), Quality: quality, digest: hex.EncodeToString(sum[:])}
+	if opts.Checksum {
+		res.Checksum = "sha256:" + res.digest
+	}
+
+	return res
+}
 
-	// Create output file
-	output, err := os.Create(destPath)
+// verifyOutputFile decodes a written output file and checks its dimensions
+func verifyOutputFile(ctx context.Context, path, format string, width, height int) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return ResizeRes{0, 0, "", fmt.Errorf("failed to create output file: %w", err)}
+		return fmt.Errorf("%w: %v", errVerifyFailed, err)
 	}
-	defer output.Close()
+	defer file.Close()
 
-	// Configure WebP encoder and save the image
-	options, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, 80)
+	decoded, err := decodeImage(ctx, file, format)
 	if err != nil {
-		return ResizeRes{0, 0, "", fmt.Errorf("failed to create encoder options: %w", err)}
+		return fmt.Errorf("%w: %s does not decode: %v", errVerifyFailed, filepath.Base(path), err)
 	}
 
-	if err := webp.Encode(output, resized, options); err != nil {
-		return ResizeRes{actualHeight, width, destFileName, fmt.Errorf("failed to encode to WebP: %w", err)}
+	bounds := decoded.Bounds()
+	if bounds.Dx() != width || bounds.Dy() != height {
+		return fmt.Errorf("%w: %s is %dx%d, expected %dx%d",
+			errVerifyFailed, filepath.Base(path), bounds.Dx(), bounds.Dy(), width, height)
 	}
 
-	return ResizeRes{actualHeight, width, destFileName, nil}
+	return nil
+}
+
+// removeVersions deletes the files of partially written versions
+func removeVersions(mediaDir string, versions []ImageVersionEntry) {
+	for _, version := range versions {
+		os.Remove(filepath.Join(mediaDir, version.FileName))
+	}
 }
 
 // EnsureDirectoryExists creates a directory if it doesn't exist
@@ -139,121 +609,552 @@ func ensureDirectoryExists(path string) error {
 	return os.MkdirAll(path, 0755)
 }
 
-// processImage downloads an image and converts it to multiple WebP sizes
-func processImage(url, mediaID, mediaDir string) ([]ImageVersionEntry, error) {
-	var versions []ImageVersionEntry
-
+// processImage downloads an image and converts it to multiple sizes.
+//
+// The source is decoded once and the sizes are produced one after another, so
+// peak memory per item is the decoded source (width x height x 4 bytes) plus a
+// single resized copy and its encoded output, on top of the compressed
+// download. That is held until the item is done, since kept originals are
+// written from it after the sizes.
+//
+// A source identical to one another item of the run converted is not encoded
+// again; the result refers to that item's files instead.
+func processImage(ctx context.Context, url, mediaID, mediaDir string, opts ProcessOptions, cached map[string]ImageVersionEntry) (result *imageResult, err error) {
 	// Ensure media directory exists
 	if err := ensureDirectoryExists(mediaDir); err != nil {
 		return nil, err
 	}
 
 	// Download original file to memory
-	imageData, err := downloadImageToBytes(url)
+	imageData, err := downloadImageToBytes(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("download failed: %w", err)
 	}
 
-	// Process each image size directly from memory
-	for _, size := range imageVersions {
-		resizeRes := resizeImageBytesByWidthWebP(imageData, size.Width, 0, mediaID, mediaDir, size.Name)
-		if resizeRes.Error != nil {
-			return nil, fmt.Errorf("failed to resize and convert to WebP: %w", resizeRes.Error)
+	source, owner := opts.dedupe.claim(imageData, mediaID)
+	if owner {
+		defer func() { source.finish(result, err) }()
+	} else {
+		shared, err := source.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if shared != nil {
+			logger.Debug("reusing files of identical source", "media_id", mediaID, "dedup_of", shared.DedupOf)
+			return shared, nil
+		}
+		// The first item with this source failed, so convert it here
+	}
+
+	// HEIC and AVIF sources have no Go decoder and are converted to PNG
+	// first, which is also what is kept as their original
+	sourceSize := int64(len(imageData))
+	if imageData, err = normalizeSource(ctx, imageData); err != nil {
+		return nil, err
+	}
+
+	result, err = convertImageData(ctx, imageData, mediaID, mediaDir, opts, cached)
+	if err != nil {
+		return nil, err
+	}
+	result.SourceSize = sourceSize
+	if !opts.KeepOriginals {
+		return result, nil
+	}
+
+	config, format, err := checkImageDimensions(imageData, 0)
+	if err != nil {
+		return nil, err
+	}
+	if result.Original, err = keepOriginal(ctx, imageData, config, format, mediaFileBase(mediaID, opts.ShardDepth), opts.outputs(mediaDir), opts.KeepMetadata); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// convertImageData decodes an encoded source image and writes every size
+// not already in cached. If ctx is cancelled part way, the sizes it wrote
+// are removed.
+func convertImageData(ctx context.Context, imageData []byte, mediaID, mediaDir string, opts ProcessOptions, cached map[string]ImageVersionEntry) (*imageResult, error) {
+	result := &imageResult{}
+	if err := ensureMediaFileDir(mediaDir, mediaFileBase(mediaID, opts.ShardDepth)); err != nil {
+		return nil, err
+	}
+
+	// Check the declared dimensions before allocating the decoded bitmap
+	config, format, err := checkImageDimensions(imageData, opts.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	// Small sources in an efficient format are copied rather than upscaled,
+	// judged by the size they are displayed at once oriented
+	thumbWidth := smallestVersionWidth()
+	if ext, ok := passthroughExtensions[format]; ok && opts.PassthroughSmall {
+		orientation := readOrientation(extractEXIF(imageData, format))
+		oriented := config
+		if orientationSwapsAxes(orientation) {
+			oriented.Width, oriented.Height = config.Height, config.Width
+		}
+		if oriented.Width < thumbWidth {
+			return passthroughImage(ctx, imageData, oriented, orientation, format, ext, mediaID, mediaDir, opts)
+		}
+	}
+
+	// Read the EXIF before the compressed bytes are dropped
+	var exif []byte
+	if opts.KeepMetadata {
+		if exif = extractEXIF(imageData, format); exif != nil {
+			exif = resetOrientation(exif)
+		}
+	}
+
+	// Decode once; the compressed bytes are not referenced afterwards.
+	// Pixels are rotated to match any EXIF orientation tag, and since the
+	// encoders write no EXIF, and copied EXIF has its orientation reset, the
+	// outputs carry no stale orientation.
+	src, err := decodeSource(ctx, imageData, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// Flatten transparent sources so they don't encode onto black, but only
+	// for the sizes still to be written in a format that loses the alpha
+	flat := src
+	flattens := func(size ImageSize) bool {
+		_, ok := cached[size.Name]
+		return !ok && !keepsAlpha(sizeFormat(size, opts))
+	}
+	if opts.FlattenBackground != nil && slices.ContainsFunc(imageVersions, flattens) {
+		var flattened bool
+		if flat, flattened = flattenAlpha(src, opts.FlattenBackground); flattened {
+			result.Background = hexColor(opts.FlattenBackground)
+		}
+	}
+
+	// Compute the placeholder once from the full decoded source
+	result.Placeholder = computePlaceholder(flat, opts.Placeholder)
+
+	// Resize every size from the decoded source, up to SizeConcurrency at
+	// once; each goroutine only writes its own slot
+	versions := make([]ImageVersionEntry, len(imageVersions))
+	errs := make([]error, len(imageVersions))
+	written := make([]bool, len(imageVersions))
+	sem := make(chan struct{}, max(opts.SizeConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, size := range imageVersions {
+		if version, ok := cached[size.Name]; ok {
+			versions[i] = version
+			continue
 		}
 
-		// Create file info for this size
-		webpInfo := ImageVersionEntry{
-			FileName: resizeRes.FileName,
-			Width:    size.Width,
-			Height:   resizeRes.Height,
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+
+			// Sources narrower than a size are kept at their own width
+			width := size.Width
+			if !opts.AllowUpscale {
+				width = min(width, src.Bounds().Dx())
+			}
+
+			format := sizeFormat(size, opts)
+			sizeSrc := flat
+			if keepsAlpha(format) {
+				sizeSrc = src
+			}
+			resizeRes := resizeImageByWidth(ctx, sizeSrc, width, 0, mediaFileBase(mediaID, opts.ShardDepth), mediaDir, size.Name, format, exif, opts)
+			if resizeRes.Error != nil {
+				errs[i] = fmt.Errorf("failed to resize and convert to %s: %w", format, resizeRes.Error)
+				return
+			}
+
+			// Create file info for this size
+			versions[i] = ImageVersionEntry{
+				FileName: resizeRes.FileName,
+				Width:    resizeRes.Width,
+				Height:   resizeRes.Height,
+				Checksum: resizeRes.Checksum,
+				Size:     resizeRes.Size,
+				Quality:  resizeRes.Quality,
+				name:     size.Name,
+				digest:   resizeRes.digest,
+			}
+			written[i] = true
+			logger.Debug("created version", "file", resizeRes.FileName, "width", resizeRes.Width, "height", resizeRes.Height)
+		}()
+	}
+	wg.Wait()
+
+	// Don't leave a partial set of sizes behind
+	if i := slices.IndexFunc(errs, func(err error) bool { return err != nil }); i >= 0 {
+		var partial []ImageVersionEntry
+		for j, ok := range written {
+			if ok {
+				partial = append(partial, versions[j])
+			}
 		}
+		removeVersions(mediaDir, partial)
+		return nil, errs[i]
+	}
+
+	result.Versions = versions
+	return result, nil
+}
 
-		versions = append(versions, webpInfo)
-		fmt.Printf("Created %s (%dx%d)\n", webpInfo.FileName, webpInfo.Width, webpInfo.Height)
+// sourceURL picks the URL to convert, preferring the thumbnail
+func sourceURL(media Media) (string, error) {
+	if media.ThumbnailURL != "" {
+		return media.ThumbnailURL, nil
+	}
+	if media.MediaURL != "" {
+		return media.MediaURL, nil
 	}
+	return "", fmt.Errorf("no URL available for media %s", media.ID)
+}
+
+// wantsVideoPoster reports whether a video should have its poster extracted
+func wantsVideoPoster(media Media, opts ProcessOptions) bool {
+	return opts.VideoPosters && media.MediaType == "VIDEO" && media.IsSharedToFeed && media.MediaURL != ""
+}
 
-	return versions, nil
+// shouldSkip reports whether media cannot be converted as an image. Sources
+// that turn out to be videos once downloaded are skipped as well.
+// See: is_shared_to_feed on https://developers.facebook.com/docs/instagram-platform/reference/instagram-media
+func shouldSkip(media Media) bool {
+	return !media.IsSharedToFeed && media.MediaType == "VIDEO"
 }
 
-// processImages handles downloading, converting, and tracking a single media item
-func processImages(media Media, mediaDir string) ([]ImageVersionEntry, error) {
+// processImages handles downloading, converting, and tracking a single media item.
+// Versions in cached are reused rather than regenerated.
+func processImages(ctx context.Context, media Media, mediaDir string, opts ProcessOptions, cached map[string]ImageVersionEntry) (*imageResult, error) {
 	// Determine which URL to use
-	var url string
-	if media.ThumbnailURL != "" {
-		url = media.ThumbnailURL
-		fmt.Printf("Processing thumbnail for %s\n", media.ID)
-	} else if media.MediaURL != "" {
-		url = media.MediaURL
-		fmt.Printf("Processing media for %s\n", media.ID)
+	url, err := sourceURL(media)
+	if err != nil {
+		return nil, err
+	}
+	if url == media.ThumbnailURL {
+		logger.Debug("processing thumbnail", "media_id", media.ID)
 	} else {
-		return nil, fmt.Errorf("no URL available for media %s", media.ID)
+		logger.Debug("processing media", "media_id", media.ID)
+	}
+
+	// Extract a poster frame from videos when asked to and ffmpeg is available
+	if wantsVideoPoster(media, opts) {
+		if ffmpeg, ok := findFFmpeg(); ok {
+			return processVideo(ctx, ffmpeg, media, mediaDir, opts, cached)
+		}
 	}
 
 	// Skip media
-	// See: is_shared_to_feed on https://developers.facebook.com/docs/instagram-platform/reference/instagram-media
-	if strings.Contains(url, ".mp4") || (!media.IsSharedToFeed && media.MediaType == "VIDEO") {
-		fmt.Printf("Skipping file: %s\n", media.ID)
+	if shouldSkip(media) {
+		logger.Info("skipping media", "media_id", media.ID)
 		return nil, nil
 	}
 
-	// Process the image
-	files, err := processImage(url, media.ID, mediaDir)
+	// Process the image, refreshing an expired signed URL once
+	result, err := processImage(ctx, url, media.ID, mediaDir, opts, cached)
+	if isExpiredURL(err) {
+		if opts.AccessToken == "" {
+			// A run meant to stop at the first failure must not pass over it
+			if opts.FailFast {
+				return nil, fmt.Errorf("media URL expired and no token was given to refresh it: %w", err)
+			}
+			logger.Warn("skipping media with an expired URL, no token to refresh it", "media_id", media.ID, "error", err)
+			return nil, nil
+		}
+		fresh, refreshErr := refreshMediaURL(ctx, opts.AccessToken, media.ID)
+		if refreshErr != nil {
+			return nil, fmt.Errorf("media URL expired and could not be refreshed: %w", refreshErr)
+		}
+		url = fresh
+		logger.Info("refreshed expired media URL", "media_id", media.ID)
+		result, err = processImage(ctx, url, media.ID, mediaDir, opts, cached)
+	}
+	if errors.Is(err, errVideoContent) {
+		logger.Info("skipping media", "media_id", media.ID, "reason", err)
+		return nil, nil
+	}
+	if errors.Is(err, errUnsupportedFormat) {
+		logger.Warn("skipping media", "media_id", media.ID, "reason", err)
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	result.SourceURL = url
+
+	return result, nil
+}
+
+// versionsByName keys converted versions by their size name
+func versionsByName(versions []ImageVersionEntry) map[string]ImageVersionEntry {
+	versionMap := make(map[string]ImageVersionEntry, len(versions))
+	for _, version := range versions {
+		versionMap[version.name] = version
+	}
+	return versionMap
+}
+
+// processChildren converts every item of a carousel album in order, sharing
+// the parent's timestamp and permalink. Children that cannot be converted as
+// images are left out; any other failure fails the whole album.
+func processChildren(ctx context.Context, media Media, mediaDir string, opts ProcessOptions) ([]MediaFileEntry, error) {
+	var children []MediaFileEntry
+	for _, child := range media.Children {
+		// Children don't report is_shared_to_feed; they share the album's
+		child.IsSharedToFeed = media.IsSharedToFeed
+
+		result, err := processImages(ctx, child, mediaDir, opts, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error processing carousel child %s: %w", child.ID, err)
+		}
+		if result == nil {
+			continue
+		}
+
+		children = append(children, MediaFileEntry{
+			MediaID:       child.ID,
+			MediaType:     child.MediaType,
+			Timestamp:     media.Timestamp,
+			Permalink:     media.Permalink,
+			Versions:      versionsByName(result.Versions),
+			Passthrough:   result.Passthrough,
+			VideoFileName: result.VideoFileName,
+			Preview:       result.Preview,
+			Placeholder:   result.Placeholder,
+			Original:      result.Original,
+			DedupOf:       result.DedupOf,
+		})
+	}
+	return children, nil
+}
+
+// FetchAndTransformImages downloads and processes multiple image items.
+// Items not yet started when ctx is cancelled are skipped.
+func FetchAndTransformImages(ctx context.Context, recentMedia []Media, mediaDir string, outputDir string, opts ProcessOptions) error {
+	_, err := FetchAndTransformImagesResult(ctx, recentMedia, mediaDir, outputDir, opts)
+	return err
+}
 
-	return files, nil
+// itemTimeoutError names the item timeout in err when it was the item's own
+// deadline, rather than the run's, that cut it short
+func itemTimeoutError(itemCtx, runCtx context.Context, err error, timeout time.Duration) error {
+	if errors.Is(itemCtx.Err(), context.DeadlineExceeded) && runCtx.Err() == nil {
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return err
 }
 
-// FetchAndTransformImages downloads and processes multiple image items
-func FetchAndTransformImages(recentMedia []Media, mediaDir string, outputDir string) {
+// FetchAndTransformImagesResult downloads and processes multiple image items
+// and returns the manifest entries sorted by timestamp. With opts.FailFast the
+// item failures are returned joined with errors.Join; otherwise failed items are left out of the
+// entries and only errors affecting the whole run are returned.
+func FetchAndTransformImagesResult(ctx context.Context, recentMedia []Media, mediaDir string, outputDir string, opts ProcessOptions) ([]MediaFileEntry, error) {
+	if opts.DryRun {
+		report := opts.ReportWriter
+		if report == nil {
+			report = os.Stdout
+		}
+		printDryRun(report, recentMedia, opts)
+		return nil, nil
+	}
+
+	if !opts.Overwrite && !opts.Incremental {
+		manifestPath := filepath.Join(outputDir, "converted_media.json")
+		if _, err := os.Stat(manifestPath); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrOutputExists, manifestPath)
+		}
+	}
+
 	if err := ensureDirectoryExists(mediaDir); err != nil {
-		fmt.Printf("Error creating media directory: %v\n", err)
-		return
+		return nil, fmt.Errorf("error creating media directory: %w", err)
 	}
 
-	fmt.Printf("Downloading and processing %d media items...\n", len(recentMedia))
+	// In fail-fast mode the first failure cancels everything still running
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	opts.dedupe = newSourceDedupe()
+	opts.store = newRunStorage(mediaDir, outputDir, opts.Storage)
+
+	embedToken := cmp.Or(opts.EmbedToken, opts.AccessToken)
+	if opts.FetchEmbed && embedToken == "" {
+		logger.Warn("no token to fetch embed metadata with, leaving it out")
+		opts.FetchEmbed = false
+	}
+	var failMu sync.Mutex
+	var failErrs []error
+
+	logger.Info("downloading and processing media", "count", len(recentMedia))
+	startedAt := time.Now()
+	downloadLimiter.takeCounts()
 
 	var wg sync.WaitGroup
 	resultChan := make(chan MediaFileEntry, len(recentMedia))
-	var skippedCountAtomic, processedCountAtomic int32
+	var skippedCountAtomic, processedCountAtomic, failedCountAtomic, verifyFailedCountAtomic, reusedCountAtomic int32
+
+	var priorEntries map[string]MediaFileEntry
+	if opts.Incremental {
+		priorEntries = loadPriorManifest(outputDir)
+	}
+
+	// Serialize progress callbacks so done is reported in order
+	var progressMu sync.Mutex
+	var doneCount int
+	finished := func(mediaID string) {
+		if opts.Progress == nil {
+			return
+		}
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		doneCount++
+		opts.Progress(doneCount, len(recentMedia), mediaID)
+	}
+
+	// A nil semaphore never blocks, leaving concurrency unbounded
+	var sem chan struct{}
+	if opts.Concurrency > 0 {
+		sem = make(chan struct{}, opts.Concurrency)
+	}
 
 	for i, media := range recentMedia {
+		// Wait for a free slot before spawning, so at most Concurrency items
+		// are in flight; once ctx is done the remaining items fail fast
+		acquired := false
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				acquired = true
+			case <-ctx.Done():
+			}
+		}
+
 		wg.Add(1)
 		go func(i int, media Media) {
 			defer wg.Done()
-			fmt.Printf("[%d/%d] Processing media ID: %s\n", i+1, len(recentMedia), media.ID)
+			if acquired {
+				defer func() { <-sem }()
+			}
+			defer finished(media.ID)
+			event := ProgressEvent{MediaID: media.ID, Index: i + 1, Total: len(recentMedia)}
+
+			if err := ctx.Err(); err != nil {
+				atomic.AddInt32(&failedCountAtomic, 1)
+				opts.report(event.with(EventFailed, err))
+				return
+			}
+
+			logger.Debug("processing media", "item", i+1, "total", len(recentMedia), "media_id", media.ID)
+			opts.report(event.with(EventStarted, nil))
+
+			// failed records a conversion error for this item, ending the run
+			// under FailFast
+			failed := func(err error) {
+				atomic.AddInt32(&failedCountAtomic, 1)
+				logger.Error("error processing media", "media_id", media.ID, "error", err)
+				opts.report(event.with(EventFailed, err))
+				// Items cut short by the cancellation are not failures of their own
+				if opts.FailFast && !errors.Is(err, context.Canceled) {
+					failMu.Lock()
+					failErrs = append(failErrs, fmt.Errorf("error processing media %s: %w", media.ID, err))
+					failMu.Unlock()
+					cancel()
+				}
+			}
+
+			var cached map[string]ImageVersionEntry
+			if prior, ok := priorEntries[media.ID]; ok {
+				var complete bool
+				if cached, complete = cachedVersions(prior, mediaDir, opts); complete {
+					logger.Debug("reusing existing files", "media_id", media.ID)
+					prior.Versions = cached
+					if err := publishEntry(ctx, opts.store, prior); err != nil {
+						failed(err)
+						return
+					}
+					prior.MediaType = media.MediaType
+					resultChan <- prior
+					atomic.AddInt32(&reusedCountAtomic, 1)
+					atomic.AddInt32(&processedCountAtomic, 1)
+					opts.report(event.with(EventProcessed, nil))
+					return
+				}
+			}
+
+			itemCtx := ctx
+			if opts.ItemTimeout > 0 {
+				var cancelItem context.CancelFunc
+				itemCtx, cancelItem = context.WithTimeout(ctx, opts.ItemTimeout)
+				defer cancelItem()
+			}
 
-			convertedFiles, err := processImages(media, mediaDir)
+			result, err := processImages(itemCtx, media, mediaDir, opts, cached)
 			if err != nil {
-				fmt.Printf("Error processing media %s: %v\n", media.ID, err)
+				err = itemTimeoutError(itemCtx, ctx, err, opts.ItemTimeout)
+				if errors.Is(err, errVerifyFailed) {
+					atomic.AddInt32(&verifyFailedCountAtomic, 1)
+				}
+				failed(err)
 				return
 			}
 
 			// Skip nil results (non-image files)
-			if convertedFiles == nil {
+			if result == nil {
 				atomic.AddInt32(&skippedCountAtomic, 1)
+				opts.report(event.with(EventSkipped, nil))
 				return
 			}
 
-			versionMap := make(map[string]ImageVersionEntry)
-			for _, file := range convertedFiles {
-				// Find and store the corresponding size name
-				for _, size := range imageVersions {
-					if size.Width == file.Width {
-						versionMap[size.Name] = file
-						break
-					}
-				}
+			children, err := processChildren(itemCtx, media, mediaDir, opts)
+			if err != nil {
+				failed(itemTimeoutError(itemCtx, ctx, err, opts.ItemTimeout))
+				return
 			}
 
-			resultChan <- MediaFileEntry{
+			entry := MediaFileEntry{
 				MediaID:   media.ID,
+				MediaType: media.MediaType,
 				Timestamp: media.Timestamp,
 				Permalink: media.Permalink,
-				Versions:  versionMap,
+				Caption:   media.Caption,
+				Versions:  versionsByName(result.Versions),
+				Children:  children,
+
+				FlattenedBackground: result.Background,
+				Passthrough:         result.Passthrough,
+				VideoFileName:       result.VideoFileName,
+				Preview:             result.Preview,
+				Placeholder:         result.Placeholder,
+				Original:            result.Original,
+				DedupOf:             result.DedupOf,
+
+				sourceSize: result.SourceSize,
+			}
+			if opts.EmitAspectRatio {
+				if largest, ok := largestVersion(entry); ok {
+					entry.AspectRatio = aspectRatio(largest.Width, largest.Height)
+				}
 			}
+			if opts.FetchEmbed {
+				entry.Embed = embedFor(itemCtx, media, embedToken)
+			}
+			if opts.IncludeSourceURL {
+				entry.Source = &SourceURLEntry{
+					URL:          result.SourceURL,
+					FetchedAt:    time.Now().UTC().Format(time.RFC3339),
+					MayBeExpired: true,
+				}
+			}
+
+			resultChan <- entry
 			atomic.AddInt32(&processedCountAtomic, 1)
+			opts.report(event.with(EventProcessed, nil))
 		}(i, media)
 	}
 
@@ -268,39 +1169,154 @@ func FetchAndTransformImages(recentMedia []Media, mediaDir string, outputDir str
 	for entry := range resultChan {
 		mediaFilesArray = append(mediaFilesArray, entry)
 	}
+	if len(failErrs) > 0 {
+		return nil, errors.Join(failErrs...)
+	}
+
+	// Keep entries from the previous run that were not part of this one
+	if len(priorEntries) > 0 {
+		current := make(map[string]bool, len(recentMedia))
+		for _, media := range recentMedia {
+			current[media.ID] = true
+		}
+		for id, entry := range priorEntries {
+			if !current[id] {
+				mediaFilesArray = append(mediaFilesArray, entry)
+			}
+		}
+	}
 
-	// sort mediaFilesArray by timestamp
-	slices.SortFunc(mediaFilesArray, timestampCompare)
+	for i := range mediaFilesArray {
+		entry := &mediaFilesArray[i]
+		entry.SrcSet = BuildSrcSet(*entry, opts.BaseURL)
+		for j := range entry.Children {
+			entry.Children[j].SrcSet = BuildSrcSet(entry.Children[j], opts.BaseURL)
+		}
+	}
+
+	// sort mediaFilesArray by timestamp, breaking ties by ID so the order is
+	// the same on every run, then number the entries in that order
+	slices.SortFunc(mediaFilesArray, func(a, b MediaFileEntry) int {
+		return cmp.Or(timestampCompare(a, b), cmp.Compare(a.MediaID, b.MediaID))
+	})
+	for i := range mediaFilesArray {
+		mediaFilesArray[i].Order = i
+		for j := range mediaFilesArray[i].Children {
+			mediaFilesArray[i].Children[j].Order = j
+		}
+	}
 
 	// Update the counts
 	skippedCount := int(skippedCountAtomic)
 	processedCount := int(processedCountAtomic)
+	failedCount := int(failedCountAtomic)
+	verifyFailedCount := int(verifyFailedCountAtomic)
+
+	// The manifests are written and published even after an interrupt, so
+	// that they describe the files the run did finish
+	finishCtx := context.WithoutCancel(ctx)
 
 	// Create the media files map
-	writeMediaInfoJSON(mediaFilesArray, outputDir)
-	fmt.Printf("Image processing complete: %d processed, %d skipped\n", processedCount, skippedCount)
+	if err := writeMediaInfoJSON(finishCtx, mediaFilesArray, opts.store, opts.ManifestFormat, opts.ManifestWriter); err != nil {
+		return nil, err
+	}
+
+	if opts.Sprite {
+		if err := writeSprite(ctx, mediaFilesArray, mediaDir, opts.store, opts.Encode); err != nil {
+			logger.Error("error writing sprite sheet", "error", err)
+		} else {
+			logger.Info("wrote sprite sheet", "path", filepath.Join(mediaDir, SpriteImageName))
+		}
+	}
+
+	if opts.RSSPath != "" {
+		if err := writeRSSFeed(mediaFilesArray, mediaDir, opts.BaseURL, opts.RSSPath); err != nil {
+			logger.Error("error writing RSS feed", "path", opts.RSSPath, "error", err)
+		} else {
+			logger.Info("wrote RSS feed", "path", opts.RSSPath)
+		}
+	}
+
+	if opts.Feed != "" {
+		feedPath := filepath.Join(outputDir, FeedFileName)
+		if err := writeFeed(opts.Feed, mediaFilesArray, mediaDir, opts.BaseURL, feedPath); err != nil {
+			logger.Error("error writing feed", "format", opts.Feed, "path", feedPath, "error", err)
+		} else if err := opts.store.publish(finishCtx, FeedFileName); err != nil {
+			return nil, err
+		} else {
+			logger.Info("wrote feed", "format", opts.Feed, "path", feedPath)
+		}
+	}
+
+	logger.Info("image processing complete", "processed", processedCount, "skipped", skippedCount, "failed", failedCount)
+	if opts.Incremental {
+		logger.Info("incremental run", "reused", reusedCountAtomic)
+	}
+	if opts.VerifyEncode {
+		logger.Info("encode verification", "failed", verifyFailedCount)
+	}
+	printHostDistribution(downloadLimiter.takeCounts())
+
+	summary := buildRunSummary(mediaFilesArray, startedAt, len(recentMedia), processedCount, skippedCount, failedCount)
+	logger.Info("generated files", "total_bytes", summary.TotalBytes, "average_bytes", summary.AverageBytes, "saved_bytes", summary.SavedBytes, "deduplicated", summary.Deduplicated)
+	if opts.SummaryPath != "" {
+		if err := writeRunSummary(summary, opts.SummaryPath); err != nil {
+			logger.Error("error writing run summary", "path", opts.SummaryPath, "error", err)
+		} else {
+			logger.Info("wrote run summary", "path", opts.SummaryPath)
+		}
+	}
+
+	if err := writeFileManifest(finishCtx, mediaFilesArray, mediaDir, outputDir, opts); err != nil {
+		return nil, fmt.Errorf("error writing file manifest: %w", err)
+	}
+	logger.Info("wrote file manifest", "path", filepath.Join(outputDir, FileManifestName))
+
+	opts.report(ProgressEvent{Type: EventComplete, Total: len(recentMedia), Processed: processedCount, Skipped: skippedCount})
+
+	if opts.FailOnEmpty && processedCount == 0 {
+		return mediaFilesArray, ErrNoMediaProcessed
+	}
+	return mediaFilesArray, nil
 }
 
-// writeMediaInfoJSON creates and writes the media info JSON file
-func writeMediaInfoJSON(mediaFilesArray []MediaFileEntry, outputDir string) {
-	// Create the output directory
-	if err := ensureDirectoryExists(outputDir); err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
-		return
+// printHostDistribution logs how many downloads each host served
+func printHostDistribution(counts map[string]int) {
+	for _, host := range slices.Sorted(maps.Keys(counts)) {
+		logger.Info("downloads per host", "host", host, "count", counts[host])
 	}
+}
 
+// publishEntry puts the files of an entry reused from an earlier run to the
+// remote storage, which may not have them yet
+func publishEntry(ctx context.Context, store *runStorage, entry MediaFileEntry) error {
+	var keys []string
+	for _, name := range entryFiles(entry) {
+		keys = append(keys, mediaKey(name))
+	}
+	return store.publish(ctx, keys...)
+}
+
+// writeMediaInfoJSON creates and writes the media info JSON file, also
+// copying it to extra when that is non-nil
+func writeMediaInfoJSON(ctx context.Context, mediaFilesArray []MediaFileEntry, store *runStorage, format string, extra io.Writer) error {
 	// Write the JSON file
-	mediaInfoPath := filepath.Join(outputDir, "converted_media.json")
-	mediaInfoJSON, err := json.MarshalIndent(mediaFilesArray, "", "  ")
+	mediaInfoPath := store.local.path("converted_media.json")
+	mediaInfoJSON, err := marshalManifest(mediaFilesArray, format)
 	if err != nil {
-		fmt.Printf("Error creating JSON: %v\n", err)
-		return
+		return fmt.Errorf("error creating JSON: %w", err)
 	}
 
-	if err := os.WriteFile(mediaInfoPath, mediaInfoJSON, 0644); err != nil {
-		fmt.Printf("Error writing media info JSON to %s: %v\n", mediaInfoPath, err)
-		return
+	if err := store.Put(ctx, "converted_media.json", bytes.NewReader(mediaInfoJSON), contentTypeFor(mediaInfoPath)); err != nil {
+		return fmt.Errorf("error writing media info JSON to %s: %w", mediaInfoPath, err)
 	}
 
-	fmt.Printf("Successfully wrote media info to %s\n", mediaInfoPath)
+	logger.Info("wrote media info", "path", mediaInfoPath)
+
+	if extra != nil {
+		if _, err := extra.Write(append(mediaInfoJSON, '\n')); err != nil {
+			return fmt.Errorf("error writing media info JSON: %w", err)
+		}
+	}
+	return nil
 }
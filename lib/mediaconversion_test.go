@@ -0,0 +1,469 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// carousel returns an album whose children are local files, missing ones
+// included, named after their IDs
+func carousel(t *testing.T, dir string, childIDs ...string) Media {
+	t.Helper()
+	album := Media{
+		ID:        "album",
+		MediaType: "CAROUSEL_ALBUM",
+		MediaURL:  localFileURL(writeTestPNG(t, dir, "album.png", 320, 240)),
+		Timestamp: "2024-01-01T00:00:00+0000",
+		Permalink: "https://www.instagram.com/p/album/",
+	}
+	for _, id := range childIDs {
+		album.Children = append(album.Children, Media{
+			ID:        id,
+			MediaType: "IMAGE",
+			MediaURL:  localFileURL(filepath.Join(dir, id+".png")),
+		})
+	}
+	return album
+}
+
+func TestCarouselChildrenGetTheirOwnVersions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, dir, "first.png", 300, 300)
+	writeTestPNG(t, dir, "second.png", 200, 100)
+	single := Media{ID: "single", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "single.png", 100, 100)), Timestamp: "2023-12-31T00:00:00+0000"}
+
+	outputDir := filepath.Join(dir, "output")
+	entries, err := FetchAndTransformImagesResult(context.Background(), []Media{carousel(t, dir, "first", "second"), single}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byID := make(map[string]MediaFileEntry)
+	for _, entry := range entries {
+		byID[entry.MediaID] = entry
+	}
+	album := byID["album"]
+	if len(album.Children) != 2 {
+		t.Fatalf("album has %d children, want 2", len(album.Children))
+	}
+	for i, want := range []string{"first", "second"} {
+		child := album.Children[i]
+		if child.MediaID != want || child.Order != i {
+			t.Errorf("child %d = %s at order %d, want %s at %d", i, child.MediaID, child.Order, want, i)
+		}
+		if len(child.Versions) == 0 {
+			t.Errorf("child %s has no versions", child.MediaID)
+		}
+		for _, version := range child.Versions {
+			if !strings.HasPrefix(version.FileName, want) {
+				t.Errorf("child %s version %s is not its own file", want, version.FileName)
+			}
+		}
+		if child.Permalink != album.Permalink || child.Timestamp != album.Timestamp {
+			t.Errorf("child %s does not share the album's permalink and timestamp", want)
+		}
+	}
+	if len(byID["single"].Children) != 0 {
+		t.Errorf("single image has children: %+v", byID["single"].Children)
+	}
+}
+
+func TestCarouselChildFailureFailsFast(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, dir, "first.png", 300, 300)
+
+	outputDir := filepath.Join(dir, "output")
+	_, err := FetchAndTransformImagesResult(context.Background(), []Media{carousel(t, dir, "first", "missing")}, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{FailFast: true})
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("got %v, want the run to fail on the missing child", err)
+	}
+}
+
+// pngHeader returns the signature and IHDR chunk of a PNG declaring the
+// given size, with no image data after it
+func pngHeader(width, height uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestDecompressionBombRejectedFromHeader(t *testing.T) {
+	bomb := pngHeader(100000, 100000)
+	if _, _, err := checkImageDimensions(bomb, DefaultMaxPixels); !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("got %v, want errImageTooLarge", err)
+	}
+
+	// The header alone is rejected: a full decode would fail on the missing
+	// image data instead
+	_, err := convertImageData(context.Background(), bomb, "bomb", t.TempDir(), ProcessOptions{MaxPixels: DefaultMaxPixels}, nil)
+	if !errors.Is(err, errImageTooLarge) {
+		t.Errorf("got %v, want errImageTooLarge before decoding", err)
+	}
+}
+
+func TestMixedImagesAndVideos(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("fake video"))
+	}))
+	defer server.Close()
+	stubFFmpeg(t, writeTestPNG(t, dir, "poster.png", 640, 360))
+
+	media := []Media{
+		{ID: "photo", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "photo.png", 1200, 900)), Timestamp: "2024-01-03T00:00:00+0000"},
+		{ID: "clip", MediaType: "VIDEO", IsSharedToFeed: true, MediaURL: server.URL + "/clip.mp4", Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "reel", MediaType: "VIDEO", MediaURL: server.URL + "/reel.mp4", Timestamp: "2024-01-01T00:00:00+0000"},
+	}
+	outputDir := filepath.Join(dir, "output")
+	if err := FetchAndTransformImages(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{VideoPosters: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readManifest(t, outputDir)
+	if len(entries) != 2 || entries[0].MediaID != "photo" || entries[1].MediaID != "clip" {
+		t.Fatalf("manifest holds %d entries, want photo then clip with the reel skipped", len(entries))
+	}
+	wantSizes := map[string]bool{}
+	for _, size := range imageVersions {
+		wantSizes[size.Name] = true
+	}
+	for _, entry := range entries {
+		if len(entry.Versions) != len(wantSizes) {
+			t.Errorf("%s has %d versions, want %d", entry.MediaID, len(entry.Versions), len(wantSizes))
+		}
+		for name := range entry.Versions {
+			if !wantSizes[name] {
+				t.Errorf("%s has a version named %q, which is not a size name", entry.MediaID, name)
+			}
+		}
+	}
+	if entries[0].VideoFileName != "" || entries[1].VideoFileName != "clip.mp4" {
+		t.Errorf("video files are %q and %q, want none for the photo and clip.mp4 for the clip", entries[0].VideoFileName, entries[1].VideoFileName)
+	}
+	if got, want := entries[1].Versions["small"].Height, 384*9/16; got != want {
+		t.Errorf("clip's small poster is %d high, want %d from the 16:9 frame", got, want)
+	}
+}
+
+func TestConcurrencyBoundsItemsInFlight(t *testing.T) {
+	dir := t.TempDir()
+	png, err := os.ReadFile(writeTestPNG(t, dir, "source.png", 64, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stub counts downloads in flight and holds each one open briefly,
+	// so overlapping items show up in the peak
+	var inFlight, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			old := peak.Load()
+			if now <= old || peak.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer server.Close()
+
+	var media []Media
+	for i := range 6 {
+		media = append(media, Media{ID: fmt.Sprint("item", i), MediaType: "IMAGE", MediaURL: fmt.Sprintf("%s/%d.png", server.URL, i), Timestamp: "2024-01-01T00:00:00+0000"})
+	}
+
+	tests := []struct {
+		concurrency int
+		wantSerial  bool
+	}{
+		{1, true},
+		{3, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.concurrency), func(t *testing.T) {
+			peak.Store(0)
+			entries, err := FetchAndTransformImagesResult(context.Background(), media, t.TempDir(), t.TempDir(), ProcessOptions{Concurrency: tt.concurrency})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(media) {
+				t.Errorf("got %d entries, want %d", len(entries), len(media))
+			}
+			if got := peak.Load(); got > int32(tt.concurrency) || (got == 1) != tt.wantSerial {
+				t.Errorf("peak of %d downloads at once with concurrency %d", got, tt.concurrency)
+			}
+		})
+	}
+}
+
+func TestFetchAndTransformImagesResult(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	older := Media{ID: "older", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "older.png", 300, 200)), Timestamp: "2024-01-01T00:00:00+0000"}
+	newer := Media{ID: "newer", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "newer.png", 200, 300)), Timestamp: "2024-01-02T00:00:00+0000"}
+	broken := Media{ID: "broken", MediaType: "IMAGE", MediaURL: server.URL + "/broken.jpg", Timestamp: "2024-01-03T00:00:00+0000"}
+
+	tests := []struct {
+		name     string
+		media    []Media
+		failFast bool
+		wantIDs  []string
+		wantErr  bool
+	}{
+		{"healthy", []Media{older, newer}, false, []string{"newer", "older"}, false},
+		{"failing, best effort", []Media{older, broken, newer}, false, []string{"newer", "older"}, false},
+		{"failing, fail fast", []Media{older, broken, newer}, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputDir := filepath.Join(t.TempDir(), "output")
+			entries, err := FetchAndTransformImagesResult(context.Background(), tt.media, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{FailFast: tt.failFast})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "broken") {
+				t.Errorf("error %q does not name the failed item", err)
+			}
+			var ids []string
+			for _, entry := range entries {
+				ids = append(ids, entry.MediaID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("returned %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestSizeConcurrencyProducesEveryVersion(t *testing.T) {
+	previous := imageVersions
+	t.Cleanup(func() { imageVersions = previous })
+	sizes, err := ParseSizes("600:xl,500,400:lg,300,200:sm,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetImageSizes(sizes); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "source.png", 800, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, len(sizes), 16} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			mediaDir := t.TempDir()
+			result, err := convertImageData(context.Background(), source, "photo", mediaDir, ProcessOptions{SizeConcurrency: workers}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Versions) != len(sizes) {
+				t.Fatalf("got %d versions, want %d", len(result.Versions), len(sizes))
+			}
+			// Versions come back in size order whichever worker finished first
+			for i, size := range sizes {
+				version := result.Versions[i]
+				if version.name != size.Name || version.Width != size.Width || version.Height != size.Width*3/4 {
+					t.Errorf("version %d = %s %dx%d, want %s at %d wide", i, version.name, version.Width, version.Height, size.Name, size.Width)
+				}
+				if _, err := os.Stat(filepath.Join(mediaDir, version.FileName)); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkResizeSizes(b *testing.B) {
+	dir := b.TempDir()
+	img := image.NewNRGBA(image.Rect(0, 0, 4000, 3000))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 31)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		b.Fatal(err)
+	}
+	source := buf.Bytes()
+
+	for _, workers := range []int{1, len(imageVersions)} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := ProcessOptions{SizeConcurrency: workers, Encode: EncodeOptions{Quality: 80}}
+			for b.Loop() {
+				if _, err := convertImageData(context.Background(), source, "bench", dir, opts, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestKeepsMediaTypeAndPermalink(t *testing.T) {
+	dir := t.TempDir()
+	media := []Media{
+		{ID: "older", MediaType: "IMAGE", Permalink: "https://www.instagram.com/p/older/", MediaURL: localFileURL(writeTestPNG(t, dir, "older.png", 200, 200)), Timestamp: "2024-01-01T00:00:00+0000"},
+		{ID: "newer", MediaType: "VIDEO", IsSharedToFeed: true, Permalink: "https://www.instagram.com/reel/newer/", ThumbnailURL: localFileURL(writeTestPNG(t, dir, "newer.png", 180, 320)), Timestamp: "2024-01-02T00:00:00+0000"},
+	}
+	outputDir := filepath.Join(dir, "output")
+	if err := FetchAndTransformImages(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "converted_media.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]any
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{
+		{"media_id": "newer", "media_type": "VIDEO", "permalink": "https://www.instagram.com/reel/newer/"},
+		{"media_id": "older", "media_type": "IMAGE", "permalink": "https://www.instagram.com/p/older/"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("manifest holds %d entries, want %d", len(entries), len(want))
+	}
+	for i, fields := range want {
+		for key, value := range fields {
+			if entries[i][key] != value {
+				t.Errorf("entry %d %s = %v, want %q", i, key, entries[i][key], value)
+			}
+		}
+	}
+}
+
+func TestOrderFollowsSortedPositions(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	photo := func(id string, width int, day int) Media {
+		return Media{
+			ID:        id,
+			MediaType: "IMAGE",
+			MediaURL:  localFileURL(writeTestPNG(t, dir, id+".png", width, 200)),
+			Timestamp: fmt.Sprintf("2024-01-%02dT00:00:00+0000", day),
+		}
+	}
+	// Out of order, with a skipped reel and a failed download between them
+	media := []Media{
+		photo("third", 300, 2),
+		{ID: "reel", MediaType: "VIDEO", MediaURL: server.URL + "/reel.mp4", Timestamp: "2024-01-05T00:00:00+0000"},
+		photo("first", 500, 6),
+		{ID: "broken", MediaType: "IMAGE", MediaURL: server.URL + "/broken.jpg", Timestamp: "2024-01-04T00:00:00+0000"},
+		photo("fourth", 200, 1),
+		photo("second", 400, 3),
+	}
+	outputDir := filepath.Join(dir, "output")
+	if err := FetchAndTransformImages(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readManifest(t, outputDir)
+	wantIDs := []string{"first", "second", "third", "fourth"}
+	if len(entries) != len(wantIDs) {
+		t.Fatalf("manifest holds %d entries, want %d", len(entries), len(wantIDs))
+	}
+	for i, entry := range entries {
+		if entry.MediaID != wantIDs[i] || entry.Order != i {
+			t.Errorf("entry %d = %s at order %d, want %s at %d", i, entry.MediaID, entry.Order, wantIDs[i], i)
+		}
+	}
+
+	// The first entry's 0 is written rather than omitted
+	data, err := os.ReadFile(filepath.Join(outputDir, "converted_media.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw []map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if order, ok := raw[0]["order"]; !ok || order != 0.0 {
+		t.Errorf("first entry has order %v, want 0 written out", order)
+	}
+}
+
+func TestRecordedSizesMatchTheFiles(t *testing.T) {
+	for _, format := range []string{FormatWebP, FormatWebPLossless, FormatJPEG} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			source := writeTestPNG(t, dir, "source.png", 900, 600)
+			sourceInfo, err := os.Stat(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			media := []Media{{ID: "sized", MediaType: "IMAGE", MediaURL: localFileURL(source), Timestamp: "2024-01-01T00:00:00+0000"}}
+
+			outputDir := filepath.Join(dir, "output")
+			mediaDir := filepath.Join(outputDir, "media")
+			summaryPath := filepath.Join(outputDir, "summary.json")
+			opts := ProcessOptions{Format: format, SummaryPath: summaryPath}
+			if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := readManifest(t, outputDir)
+			if len(entries) != 1 {
+				t.Fatalf("manifest has %d entries, want 1", len(entries))
+			}
+			// Savings compare the source with the widest version, the file
+			// served in its place
+			var onDisk, largest int64
+			widest := 0
+			for name, version := range entries[0].Versions {
+				info, err := os.Stat(filepath.Join(mediaDir, version.FileName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if version.Size != info.Size() {
+					t.Errorf("%s: recorded size %d, the file is %d bytes", name, version.Size, info.Size())
+				}
+				onDisk += info.Size()
+				if version.Width > widest {
+					widest, largest = version.Width, info.Size()
+				}
+			}
+
+			data, err := os.ReadFile(summaryPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var summary RunSummary
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.TotalBytes != onDisk || summary.AverageBytes != onDisk {
+				t.Errorf("summary totals %d bytes, averaging %d, want %d for the one entry", summary.TotalBytes, summary.AverageBytes, onDisk)
+			}
+			if summary.SourceBytes != sourceInfo.Size() || summary.SavedBytes != sourceInfo.Size()-largest {
+				t.Errorf("summary has %d source bytes and %d saved, want %d and %d", summary.SourceBytes, summary.SavedBytes, sourceInfo.Size(), sourceInfo.Size()-largest)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// LoadMediaFile reads a JSON array of media, as written by manual-token
+func LoadMediaFile(path string) ([]Media, error) {
+	jsonData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JSON file %s: %w", path, err)
+	}
+
+	var media []Media
+	if err := json.Unmarshal(jsonData, &media); err != nil {
+		return nil, fmt.Errorf("error parsing JSON from file %s: %w", path, err)
+	}
+
+	// Other JSON arrays parse as media too, e.g. converted_media.json with
+	// its media_id, but none of their items has an id
+	for i, item := range media {
+		if item.ID == "" {
+			return nil, fmt.Errorf("error parsing JSON from file %s: item %d has no id", path, i)
+		}
+	}
+
+	return media, nil
+}
+
+// outputJSONNames are the JSON files the tool writes besides media lists,
+// which a directory given as a media source is likely to hold as well
+var outputJSONNames = []string{
+	"converted_media.json",
+	FileManifestName,
+	FetchStateFileName,
+	SpriteMapName,
+}
+
+// expandMediaPaths expands glob patterns into file paths, and directories
+// into the .json files directly inside them other than the tool's own
+// outputs. Patterns without glob
+// characters are passed through so missing files produce a clear error. A
+// file matched more than once is only listed the first time.
+func expandMediaPaths(patterns []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[filepath.Clean(path)] {
+			seen[filepath.Clean(path)] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.IsDir() {
+				add(match)
+				continue
+			}
+			files, err := filepath.Glob(filepath.Join(match, "*.json"))
+			if err != nil {
+				return nil, err
+			}
+			files = slices.DeleteFunc(files, func(file string) bool {
+				return slices.Contains(outputJSONNames, filepath.Base(file))
+			})
+			if len(files) == 0 {
+				return nil, fmt.Errorf("no .json files in directory %s", match)
+			}
+			for _, file := range files {
+				add(file)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// LoadMediaFiles reads media from several JSON files, glob patterns or
+// directories and merges them, keeping the first occurrence of each media
+// ID. Every file is read even when one is invalid, and the errors of all
+// invalid files are returned together.
+func LoadMediaFiles(patterns []string) ([]Media, error) {
+	paths, err := expandMediaPaths(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []Media
+	var errs []error
+	duplicates := 0
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		media, err := LoadMediaFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("loaded media items", "count", len(media), "path", path)
+
+		for _, item := range media {
+			if seen[item.ID] {
+				duplicates++
+				continue
+			}
+			seen[item.ID] = true
+			merged = append(merged, item)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if len(paths) > 1 {
+		logger.Info("merged media items", "count", len(merged), "files", len(paths), "duplicates", duplicates)
+	}
+	return merged, nil
+}
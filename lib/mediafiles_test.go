@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadMediaFilesMergesOverlappingIDs(t *testing.T) {
+	dir := t.TempDir()
+	first := writeMediaJSON(t, dir, "first.json", []Media{{ID: "1", Caption: "first"}, {ID: "2", Caption: "first"}})
+	second := writeMediaJSON(t, dir, "second.json", []Media{{ID: "2", Caption: "second"}, {ID: "3", Caption: "second"}})
+
+	media, err := LoadMediaFiles([]string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mediaIDs(media), []string{"1", "2", "3"}; !slices.Equal(got, want) {
+		t.Fatalf("merged %v, want %v", got, want)
+	}
+	if media[1].Caption != "first" {
+		t.Errorf("duplicate ID 2 kept the %s file's item, want the first", media[1].Caption)
+	}
+}
+
+func TestLoadMediaFilesDirectorySkipsOutputs(t *testing.T) {
+	dir := t.TempDir()
+	writeMediaJSON(t, dir, "recent_media.json", []Media{{ID: "1"}})
+	writeMediaJSON(t, dir, "older.json", []Media{{ID: "1"}, {ID: "2"}})
+	for _, name := range outputJSONNames {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(`{"files": []}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	media, err := LoadMediaFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mediaIDs(media); len(got) != 2 {
+		t.Errorf("loaded %v, want the two media items", got)
+	}
+}
+
+func TestLoadMediaFileRejectsItemsWithoutID(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "converted.json")
+	if err := os.WriteFile(path, []byte(`[{"media_id": "1", "media_type": "IMAGE"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadMediaFiles([]string{writeMediaJSON(t, dir, "valid.json", []Media{{ID: "1"}}), path})
+	if err == nil || !strings.Contains(err.Error(), "converted.json") {
+		t.Errorf("got %v, want an error naming the file without ids", err)
+	}
+}
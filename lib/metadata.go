@@ -0,0 +1,413 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Metadata handling for the container formats sources arrive in and versions
+// are written as. The encoders write pixels only: go-webp emits a bare VP8 or
+// VP8L chunk, image/jpeg writes no APPn segments and AVIF is encoded from a
+// metadata-free PNG, so re-encoded versions carry no EXIF, GPS or XMP unless
+// it is copied in. Bytes written as-is, passthrough versions and kept
+// originals, have it stripped here instead.
+
+// exifHeader prefixes the TIFF data of an EXIF APP1 segment in JPEG
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegMaxSegment is the largest JPEG segment payload, length field included
+const jpegMaxSegment = 0xFFFF
+
+// webpFlagEXIF and webpFlagXMP are VP8X feature flags; webpFlagAlpha marks a
+// canvas with transparency
+const (
+	webpFlagXMP   = 0x04
+	webpFlagEXIF  = 0x08
+	webpFlagAlpha = 0x10
+)
+
+// exifOrientationTag is the IFD0 tag holding the EXIF orientation
+const exifOrientationTag = 0x0112
+
+// jpegSegment is one marker segment of a JPEG file, marker bytes included
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// jpegSegments splits a JPEG into the segments before the scan data and the
+// remainder, which starts at the start-of-scan marker
+func jpegSegments(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, fmt.Errorf("not a JPEG")
+	}
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, fmt.Errorf("malformed JPEG marker at offset %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte before a marker
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return segments, data[pos:], nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, nil, fmt.Errorf("truncated JPEG segment at offset %d", pos)
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[pos:end]})
+		pos = end
+	}
+	return nil, nil, fmt.Errorf("JPEG has no scan data")
+}
+
+// riffChunk is one chunk of a WebP RIFF container
+type riffChunk struct {
+	fourCC  string
+	payload []byte
+}
+
+// webpChunks splits a WebP file into its chunks
+func webpChunks(data []byte) ([]riffChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP")
+	}
+	var chunks []riffChunk
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(data) {
+			return nil, fmt.Errorf("truncated WebP chunk at offset %d", pos)
+		}
+		chunks = append(chunks, riffChunk{fourCC: string(data[pos : pos+4]), payload: data[pos+8 : end]})
+		// Chunks are padded to an even size
+		pos = end + size%2
+	}
+	return chunks, nil
+}
+
+// writeWebP assembles chunks into a WebP file
+func writeWebP(chunks []riffChunk) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		body.WriteString(chunk.fourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(chunk.payload)))
+		body.Write(chunk.payload)
+		if len(chunk.payload)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	out := make([]byte, 0, 8+body.Len())
+	out = append(out, "RIFF"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// pngChunk is one chunk of a PNG file, length, type and CRC included
+type pngChunk struct {
+	chunkType string
+	data      []byte
+}
+
+// pngSignature starts every PNG file
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunks splits a PNG into its chunks
+func pngChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a PNG")
+	}
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk at offset %d", pos)
+		}
+		chunks = append(chunks, pngChunk{chunkType: string(data[pos+4 : pos+8]), data: data[pos:end]})
+		pos = end
+	}
+	return chunks, nil
+}
+
+// stripMetadata removes EXIF, XMP and IPTC metadata from an encoded image in
+// the given format ("jpeg", "webp" or "png"), leaving pixels and colour
+// profiles alone. Other formats are returned unchanged.
+func stripMetadata(data []byte, format string) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		segments, rest, err := jpegSegments(data)
+		if err != nil {
+			return nil, err
+		}
+		out := append(make([]byte, 0, len(data)), data[:2]...)
+		for _, segment := range segments {
+			// APP1 holds EXIF and XMP, APP13 holds IPTC
+			if segment.marker == 0xE1 || segment.marker == 0xED {
+				continue
+			}
+			out = append(out, segment.data...)
+		}
+		return append(out, rest...), nil
+
+	case "webp":
+		chunks, err := webpChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		kept := chunks[:0:0]
+		for _, chunk := range chunks {
+			switch chunk.fourCC {
+			case "EXIF", "XMP ":
+				continue
+			case "VP8X":
+				if len(chunk.payload) > 0 {
+					payload := bytes.Clone(chunk.payload)
+					payload[0] &^= webpFlagEXIF | webpFlagXMP
+					chunk.payload = payload
+				}
+			}
+			kept = append(kept, chunk)
+		}
+		return writeWebP(kept), nil
+
+	case "png":
+		chunks, err := pngChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		out := append(make([]byte, 0, len(data)), pngSignature...)
+		for _, chunk := range chunks {
+			// Text chunks can carry XMP or a raw EXIF profile
+			switch chunk.chunkType {
+			case "eXIf", "tEXt", "zTXt", "iTXt":
+				continue
+			}
+			out = append(out, chunk.data...)
+		}
+		return out, nil
+	}
+	return data, nil
+}
+
+// extractEXIF returns the TIFF-encoded EXIF block of an encoded image, or
+// nil when it has none or the format is not one EXIF is read from
+func extractEXIF(data []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		segments, _, err := jpegSegments(data)
+		if err != nil {
+			return nil
+		}
+		for _, segment := range segments {
+			// Skip the marker and length to reach the payload
+			if payload := segment.data[4:]; segment.marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+				return payload[len(exifHeader):]
+			}
+		}
+	case "webp":
+		chunks, err := webpChunks(data)
+		if err != nil {
+			return nil
+		}
+		for _, chunk := range chunks {
+			if chunk.fourCC == "EXIF" {
+				// Some writers keep the JPEG-style header
+				return bytes.TrimPrefix(chunk.payload, exifHeader)
+			}
+		}
+	case "png":
+		chunks, err := pngChunks(data)
+		if err != nil {
+			return nil
+		}
+		for _, chunk := range chunks {
+			if chunk.chunkType == "eXIf" {
+				return chunk.data[8 : len(chunk.data)-4]
+			}
+		}
+	}
+	return nil
+}
+
+// orientationValue finds the orientation value in an EXIF block, returning
+// its byte order and offset, or a nil order when the block has none
+func orientationValue(exif []byte) (binary.ByteOrder, int) {
+	if len(exif) < 8 {
+		return nil, 0
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0
+	}
+
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 0 || ifd+2 > len(exif) {
+		return nil, 0
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			break
+		}
+		// Orientation is a single SHORT stored inline in the value field
+		if order.Uint16(exif[entry:]) == exifOrientationTag && order.Uint16(exif[entry+2:]) == 3 {
+			return order, entry + 8
+		}
+	}
+	return nil, 0
+}
+
+// readOrientation returns the EXIF orientation of a block, 1 (normal) when
+// it has none or it is out of range
+func readOrientation(exif []byte) uint16 {
+	order, offset := orientationValue(exif)
+	if order == nil {
+		return 1
+	}
+	if orientation := order.Uint16(exif[offset:]); orientation >= 1 && orientation <= 8 {
+		return orientation
+	}
+	return 1
+}
+
+// orientationSwapsAxes reports whether an EXIF orientation turns the image
+// a quarter, so that its displayed width is its stored height
+func orientationSwapsAxes(orientation uint16) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orientationEXIF returns a big-endian TIFF EXIF block whose IFD0 holds only
+// the given orientation
+func orientationEXIF(orientation uint16) []byte {
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	exif = binary.BigEndian.AppendUint16(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, exifOrientationTag)
+	exif = binary.BigEndian.AppendUint16(exif, 3)
+	exif = binary.BigEndian.AppendUint32(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, orientation)
+	exif = append(exif, 0, 0)
+	return binary.BigEndian.AppendUint32(exif, 0)
+}
+
+// resetOrientation returns a copy of an EXIF block with its orientation set
+// to normal. Versions are decoded with the orientation applied to the pixels,
+// so a copied tag would rotate them a second time.
+func resetOrientation(exif []byte) []byte {
+	exif = bytes.Clone(exif)
+	if order, offset := orientationValue(exif); order != nil {
+		order.PutUint16(exif[offset:], 1)
+	}
+	return exif
+}
+
+// embedEXIF writes an EXIF block into an encoded version. JPEG gets an APP1
+// segment; WebP gets an EXIF chunk, moving to the extended format if needed.
+// AVIF versions are left without metadata.
+func embedEXIF(data []byte, format string, exif []byte) ([]byte, error) {
+	switch format {
+	case FormatJPEG:
+		length := 2 + len(exifHeader) + len(exif)
+		if length > jpegMaxSegment {
+			return nil, fmt.Errorf("EXIF block of %d bytes does not fit a JPEG segment", len(exif))
+		}
+		if len(data) < 2 {
+			return nil, fmt.Errorf("not a JPEG")
+		}
+		out := make([]byte, 0, len(data)+2+length)
+		out = append(out, data[:2]...)
+		out = append(out, 0xFF, 0xE1)
+		out = binary.BigEndian.AppendUint16(out, uint16(length))
+		out = append(out, exifHeader...)
+		out = append(out, exif...)
+		return append(out, data[2:]...), nil
+
+	case FormatWebP, FormatWebPLossless:
+		chunks, err := webpChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunks) == 0 {
+			return nil, fmt.Errorf("WebP has no image data")
+		}
+		if chunks[0].fourCC != "VP8X" {
+			header, err := vp8xHeader(chunks[0])
+			if err != nil {
+				return nil, err
+			}
+			chunks = append([]riffChunk{header}, chunks...)
+		}
+		header := bytes.Clone(chunks[0].payload)
+		header[0] |= webpFlagEXIF
+		chunks[0].payload = header
+		return writeWebP(append(chunks, riffChunk{fourCC: "EXIF", payload: exif})), nil
+	}
+	return data, nil
+}
+
+// vp8xHeader builds the extended-format header for a simple WebP whose only
+// chunk is image, reading the canvas size from the bitstream
+func vp8xHeader(bitstream riffChunk) (riffChunk, error) {
+	var width, height int
+	var flags byte
+	payload := bitstream.payload
+	switch bitstream.fourCC {
+	case "VP8 ":
+		// A key frame header: 3 bytes of frame tag, a 3 byte start code, then
+		// 14-bit width and height each followed by 2 bits of scaling
+		if len(payload) < 10 {
+			return riffChunk{}, fmt.Errorf("truncated VP8 header")
+		}
+		width = int(binary.LittleEndian.Uint16(payload[6:]) & 0x3FFF)
+		height = int(binary.LittleEndian.Uint16(payload[8:]) & 0x3FFF)
+	case "VP8L":
+		// A signature byte, then 14-bit width-1, 14-bit height-1 and the
+		// alpha-used bit packed little endian
+		if len(payload) < 5 || payload[0] != 0x2F {
+			return riffChunk{}, fmt.Errorf("truncated VP8L header")
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:])
+		width = int(bits&0x3FFF) + 1
+		height = int(bits>>14&0x3FFF) + 1
+		if bits>>28&1 == 1 {
+			flags |= webpFlagAlpha
+		}
+	default:
+		return riffChunk{}, fmt.Errorf("unexpected WebP chunk %q", bitstream.fourCC)
+	}
+
+	header := make([]byte, 10)
+	header[0] = flags
+	putUint24(header[4:], uint32(width-1))
+	putUint24(header[7:], uint32(height-1))
+	return riffChunk{fourCC: "VP8X", payload: header}, nil
+}
+
+// putUint24 writes v as a 24-bit little endian integer
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// uint24 reads a 24-bit little endian integer
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// exifOrientation reads the orientation back from a block written by
+// orientationEXIF
+func exifOrientation(t *testing.T, exif []byte) uint16 {
+	t.Helper()
+	if len(exif) < 20 {
+		t.Fatalf("EXIF block of %d bytes has no orientation entry", len(exif))
+	}
+	return binary.BigEndian.Uint16(exif[18:])
+}
+
+// orientedJPEG encodes a width x height JPEG carrying an EXIF orientation
+func orientedJPEG(t *testing.T, width, height int, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := embedEXIF(buf.Bytes(), FormatJPEG, orientationEXIF(orientation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEXIFOrientationRotatesVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		orientation  uint16
+		wantPortrait bool
+	}{
+		{"normal", 1, false},
+		{"rotated 90", 6, true},
+		{"rotated 270", 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stored landscape, so only the orientation makes it portrait
+			source := orientedJPEG(t, 200, 100, tt.orientation)
+			mediaDir := t.TempDir()
+			opts := ProcessOptions{Format: FormatJPEG, KeepMetadata: true}
+			result, err := convertImageData(context.Background(), source, "oriented", mediaDir, opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, version := range result.Versions {
+				if portrait := version.Height > version.Width; portrait != tt.wantPortrait {
+					t.Errorf("%s is %dx%d, want portrait %v", version.FileName, version.Width, version.Height, tt.wantPortrait)
+				}
+				data, err := os.ReadFile(filepath.Join(mediaDir, version.FileName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if config.Width != version.Width || config.Height != version.Height {
+					t.Errorf("%s holds %dx%d pixels, recorded as %dx%d", version.FileName, config.Width, config.Height, version.Width, version.Height)
+				}
+				// The pixels are already turned, so the copied tag must not turn them again
+				if orientation := exifOrientation(t, extractEXIF(data, "jpeg")); orientation != 1 {
+					t.Errorf("%s kept orientation %d, want 1", version.FileName, orientation)
+				}
+			}
+		})
+	}
+}
+
+func TestPassthroughKeepsOrientation(t *testing.T) {
+	tests := []struct {
+		name        string
+		orientation uint16
+		wantWidth   int
+		wantHeight  int
+	}{
+		{"normal", 1, 100, 60},
+		{"rotated 90", 6, 60, 100},
+		// Stored wider than the smallest version, but narrower once turned
+		{"rotated 270 from wide", 8, 100, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := orientedJPEG(t, tt.wantWidth, tt.wantHeight, tt.orientation)
+			if orientationSwapsAxes(tt.orientation) {
+				source = orientedJPEG(t, tt.wantHeight, tt.wantWidth, tt.orientation)
+			}
+			mediaDir := t.TempDir()
+			result, err := convertImageData(context.Background(), source, "oriented", mediaDir, ProcessOptions{PassthroughSmall: true}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Versions) != 1 {
+				t.Fatalf("wrote %d versions, want the source passed through", len(result.Versions))
+			}
+			version := result.Versions[0]
+			if version.Width != tt.wantWidth || version.Height != tt.wantHeight {
+				t.Errorf("recorded %dx%d, want the upright %dx%d", version.Width, version.Height, tt.wantWidth, tt.wantHeight)
+			}
+			data, err := os.ReadFile(filepath.Join(mediaDir, version.FileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The pixels are copied as stored, so only the tag turns them upright
+			exif := extractEXIF(data, "jpeg")
+			if tt.orientation == 1 && exif != nil {
+				t.Errorf("%s kept EXIF with nothing to orient", version.FileName)
+			}
+			if got := readOrientation(exif); got != tt.orientation {
+				t.Errorf("%s has orientation %d, want %d", version.FileName, got, tt.orientation)
+			}
+		})
+	}
+}
+
+// gpsEXIF returns a big-endian TIFF EXIF block whose IFD0 points to a GPS
+// IFD holding a latitude reference
+func gpsEXIF() []byte {
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	// IFD0 at 8: one GPSInfo entry pointing to the GPS IFD at 26
+	exif = binary.BigEndian.AppendUint16(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, 0x8825)
+	exif = binary.BigEndian.AppendUint16(exif, 4)
+	exif = binary.BigEndian.AppendUint32(exif, 1)
+	exif = binary.BigEndian.AppendUint32(exif, 26)
+	exif = binary.BigEndian.AppendUint32(exif, 0)
+	// GPS IFD at 26: GPSLatitudeRef "N"
+	exif = binary.BigEndian.AppendUint16(exif, 1)
+	exif = binary.BigEndian.AppendUint16(exif, 0x0001)
+	exif = binary.BigEndian.AppendUint16(exif, 2)
+	exif = binary.BigEndian.AppendUint32(exif, 2)
+	exif = append(exif, 'N', 0, 0, 0)
+	return binary.BigEndian.AppendUint32(exif, 0)
+}
+
+// gpsJPEG encodes a width x height JPEG carrying gpsEXIF
+func gpsJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := embedEXIF(buf.Bytes(), FormatJPEG, gpsEXIF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// hasMetadata reports whether an encoded JPEG or WebP holds an EXIF or XMP
+// segment or chunk
+func hasMetadata(t *testing.T, data []byte, format string) bool {
+	t.Helper()
+	switch format {
+	case "jpeg":
+		segments, _, err := jpegSegments(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, segment := range segments {
+			if segment.marker == 0xe1 {
+				return true
+			}
+		}
+	case "webp":
+		chunks, err := webpChunks(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range chunks {
+			if chunk.fourCC == "EXIF" || chunk.fourCC == "XMP " {
+				return true
+			}
+		}
+	default:
+		t.Fatalf("no metadata check for %s", format)
+	}
+	return false
+}
+
+func TestOutputCarriesNoEXIFUnlessKept(t *testing.T) {
+	large, small := gpsJPEG(t, 600, 400), gpsJPEG(t, 120, 80)
+	if extractEXIF(large, "jpeg") == nil {
+		t.Fatal("fixture carries no EXIF")
+	}
+
+	tests := []struct {
+		name   string
+		source []byte
+		opts   ProcessOptions
+		format string
+	}{
+		{"webp", large, ProcessOptions{}, "webp"},
+		{"jpeg", large, ProcessOptions{Format: FormatJPEG}, "jpeg"},
+		{"passthrough", small, ProcessOptions{PassthroughSmall: true}, "jpeg"},
+	}
+	for _, tt := range tests {
+		for _, keep := range []bool{false, true} {
+			name := tt.name + "/stripped"
+			if keep {
+				name = tt.name + "/kept"
+			}
+			t.Run(name, func(t *testing.T) {
+				mediaDir := t.TempDir()
+				opts := tt.opts
+				opts.KeepMetadata = keep
+				result, err := convertImageData(context.Background(), tt.source, "gps", mediaDir, opts, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.Versions) == 0 {
+					t.Fatal("no versions written")
+				}
+				for _, version := range result.Versions {
+					data, err := os.ReadFile(filepath.Join(mediaDir, version.FileName))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := hasMetadata(t, data, tt.format); got != keep {
+						t.Errorf("%s: has metadata = %v, want %v", version.FileName, got, keep)
+					}
+					if keep && !bytes.Contains(extractEXIF(data, tt.format), gpsEXIF()[26:]) {
+						t.Errorf("%s: kept EXIF lost the GPS IFD", version.FileName)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"path"
+)
+
+// originalsDirName is the subdirectory of the media dir originals are kept in
+const originalsDirName = "original"
+
+// OriginalEntry records a kept original download in the manifest
+type OriginalEntry struct {
+	// FileName is relative to the media dir, e.g. "original/abc.jpg"
+	FileName string `json:"file_name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+
+	// size and digest are the byte size and hex SHA-256 of the written file
+	size   int64
+	digest string
+}
+
+// originalExtensions maps decoded image format names to the extension an
+// original in that format is written with
+var originalExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+}
+
+// keepOriginal writes the downloaded source bytes under the originals dir,
+// named after the media file base with the extension of the detected format.
+// Unless keepMetadata is set the EXIF, GPS and XMP are stripped first.
+func keepOriginal(ctx context.Context, data []byte, config image.Config, format, baseName string, store *runStorage, keepMetadata bool) (*OriginalEntry, error) {
+	if !keepMetadata {
+		stripped, err := stripMetadata(data, format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to strip metadata from original: %w", err)
+		}
+		data = stripped
+	}
+
+	ext, ok := originalExtensions[format]
+	if !ok {
+		ext = "." + format
+	}
+	fileName := path.Join(originalsDirName, baseName+ext)
+
+	if err := store.Put(ctx, mediaKey(fileName), bytes.NewReader(data), contentTypeFor(fileName)); err != nil {
+		return nil, fmt.Errorf("failed to write original: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return &OriginalEntry{
+		FileName: fileName,
+		Width:    config.Width,
+		Height:   config.Height,
+		size:     int64(len(data)),
+		digest:   hex.EncodeToString(sum[:]),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepOriginals(t *testing.T) {
+	dir := t.TempDir()
+	png, err := os.ReadFile(writeTestPNG(t, dir, "photo.png", 320, 240))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 200, 100)), nil); err != nil {
+		t.Fatal(err)
+	}
+	video := []byte("fake video")
+	// Extensionless URLs, so the extension can only come from the content
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/png":
+			w.Write(png)
+		case "/jpeg":
+			w.Write(jpg.Bytes())
+		default:
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Write(video)
+		}
+	}))
+	defer server.Close()
+	stubFFmpeg(t, writeTestPNG(t, dir, "poster.png", 160, 90))
+
+	tests := []struct {
+		media      Media
+		wantFile   string
+		wantBytes  []byte
+		wantWidth  int
+		wantHeight int
+	}{
+		{Media{ID: "png", MediaType: "IMAGE", MediaURL: server.URL + "/png"}, "original/png.png", png, 320, 240},
+		{Media{ID: "jpeg", MediaType: "IMAGE", MediaURL: server.URL + "/jpeg"}, "original/jpeg.jpg", jpg.Bytes(), 200, 100},
+		{Media{ID: "clip", MediaType: "VIDEO", IsSharedToFeed: true, MediaURL: server.URL + "/clip"}, "clip.mp4", video, 160, 90},
+	}
+	for _, tt := range tests {
+		t.Run(tt.media.ID, func(t *testing.T) {
+			tt.media.Timestamp = "2024-01-01T00:00:00+0000"
+			outputDir := t.TempDir()
+			mediaDir := filepath.Join(outputDir, "media")
+			opts := ProcessOptions{KeepOriginals: true, VideoPosters: true}
+			if err := FetchAndTransformImages(context.Background(), []Media{tt.media}, mediaDir, outputDir, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			original := readManifest(t, outputDir)[0].Original
+			if original == nil {
+				t.Fatal("manifest has no original")
+			}
+			want := OriginalEntry{FileName: tt.wantFile, Width: tt.wantWidth, Height: tt.wantHeight}
+			if *original != want {
+				t.Errorf("original = %+v, want %+v", *original, want)
+			}
+			data, err := os.ReadFile(filepath.Join(mediaDir, filepath.FromSlash(original.FileName)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != len(tt.wantBytes) || !bytes.Equal(data, tt.wantBytes) {
+				t.Errorf("original holds %d bytes, want the %d source bytes", len(data), len(tt.wantBytes))
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Placeholder kinds accepted by ProcessOptions.Placeholder
+const (
+	PlaceholderNone     = "none"
+	PlaceholderBlurhash = "blurhash"
+	PlaceholderColor    = "color"
+)
+
+// placeholderSampleWidth is the width the source is shrunk to before
+// computing a placeholder; the result is too blurry to need more detail
+const placeholderSampleWidth = 32
+
+// blurhash component counts along x and y
+const (
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+)
+
+// ValidatePlaceholder checks that kind is a supported placeholder kind
+func ValidatePlaceholder(kind string) error {
+	switch kind {
+	case "", PlaceholderNone, PlaceholderBlurhash, PlaceholderColor:
+		return nil
+	}
+	return fmt.Errorf("unknown placeholder %q (expected blurhash, color or none)", kind)
+}
+
+// computePlaceholder returns a placeholder of the given kind for src, or ""
+// when placeholders are disabled
+func computePlaceholder(src image.Image, kind string) string {
+	if kind == "" || kind == PlaceholderNone {
+		return ""
+	}
+	bounds := src.Bounds()
+	if bounds.Dx() <= 0 || bounds.Dy() <= 0 {
+		return ""
+	}
+
+	switch kind {
+	case PlaceholderColor:
+		pixel := imaging.Resize(src, 1, 1, imaging.Box)
+		return fmt.Sprintf("#%02x%02x%02x", pixel.Pix[0], pixel.Pix[1], pixel.Pix[2])
+	case PlaceholderBlurhash:
+		sample := src
+		if bounds.Dx() > placeholderSampleWidth {
+			sample = imaging.Resize(src, placeholderSampleWidth, 0, imaging.Box)
+		}
+		return encodeBlurhash(imaging.Clone(sample))
+	}
+	return ""
+}
+
+// encodeBlurhash encodes img as a blurhash string, following the reference
+// algorithm at https://github.com/woltapp/blurhash
+func encodeBlurhash(img *image.NRGBA) string {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	factors := make([][3]float64, 0, blurhashComponentsX*blurhashComponentsY)
+	for j := 0; j < blurhashComponentsY; j++ {
+		for i := 0; i < blurhashComponentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					offset := y*img.Stride + x*4
+					r += basis * srgbToLinear(img.Pix[offset])
+					g += basis * srgbToLinear(img.Pix[offset+1])
+					b += basis * srgbToLinear(img.Pix[offset+2])
+				}
+			}
+
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var hash strings.Builder
+	sizeFlag := (blurhashComponentsX - 1) + (blurhashComponentsY-1)*9
+	hash.WriteString(encodeBase83(sizeFlag, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	actualMaximum := 0.0
+	for _, factor := range ac {
+		for _, value := range factor {
+			actualMaximum = math.Max(actualMaximum, math.Abs(value))
+		}
+	}
+	if actualMaximum > 0 {
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range ac {
+		quant := func(value float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quant(factor[0])*19*19+quant(factor[1])*19+quant(factor[2]), 2))
+	}
+
+	return hash.String()
+}
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBase83 encodes value as length base83 digits
+func encodeBase83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Characters[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
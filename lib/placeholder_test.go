@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestComputePlaceholder(t *testing.T) {
+	path := writeTestPNG(t, t.TempDir(), "fixture.png", 120, 80)
+	fixture, err := imaging.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	white := imaging.New(50, 30, color.White)
+
+	tests := []struct {
+		name string
+		src  image.Image
+		kind string
+		want string
+	}{
+		// Pinned values: any change to sampling or encoding shows up here
+		{"white blurhash", white, PlaceholderBlurhash, "LGTSUA?bfQ?b~qoffQoffQfQfQfQ"},
+		{"white colour", white, PlaceholderColor, "#ffffff"},
+		{"fixture blurhash", fixture, PlaceholderBlurhash, "LB83r#2bwxW@r4WXjtf8f%fQfQfQ"},
+		{"fixture colour", fixture, PlaceholderColor, "#3c2880"},
+		{"single pixel", imaging.New(1, 1, color.NRGBA{R: 255, A: 255}), PlaceholderColor, "#ff0000"},
+		{"single pixel blurhash", imaging.New(1, 1, color.NRGBA{R: 255, A: 255}), PlaceholderBlurhash, "L~TI:j|c|c|c|c|c|c|c|c|c|c|c"},
+		{"empty image", image.NewNRGBA(image.Rect(0, 0, 0, 0)), PlaceholderBlurhash, ""},
+		{"disabled", fixture, PlaceholderNone, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := computePlaceholder(tt.src, tt.kind); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The entry's placeholder comes from the decoded source, before resizing
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := convertImageData(context.Background(), data, "fixture", t.TempDir(), ProcessOptions{Placeholder: PlaceholderBlurhash}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Placeholder != "LB83r#2bwxW@r4WXjtf8f%fQfQfQ" {
+		t.Errorf("converted fixture has placeholder %q", result.Placeholder)
+	}
+}
@@ -0,0 +1,43 @@
+package lib
+
+// Progress event types emitted by FetchAndTransformImages
+const (
+	EventStarted   = "started"
+	EventProcessed = "processed"
+	EventSkipped   = "skipped"
+	EventFailed    = "failed"
+	EventComplete  = "complete"
+)
+
+// ProgressEvent describes a change in the state of a run
+type ProgressEvent struct {
+	Type      string `json:"type"`
+	MediaID   string `json:"media_id,omitempty"`
+	Index     int    `json:"index,omitempty"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed,omitempty"`
+	Skipped   int    `json:"skipped,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Reporter receives progress events during a run. Events are sent from the
+// processing goroutines, so implementations must be safe for concurrent use.
+type Reporter interface {
+	Report(event ProgressEvent)
+}
+
+// with returns a copy of the event with the given type and error
+func (e ProgressEvent) with(eventType string, err error) ProgressEvent {
+	e.Type = eventType
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// report forwards an event to the configured reporter, if any
+func (opts ProcessOptions) report(event ProgressEvent) {
+	if opts.Reporter != nil {
+		opts.Reporter.Report(event)
+	}
+}
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestProgressCalledOncePerItem(t *testing.T) {
+	dir := t.TempDir()
+	var media []Media
+	for i := range 8 {
+		media = append(media, Media{ID: fmt.Sprint("photo", i), MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, fmt.Sprint(i, ".png"), 40+i, 40)), Timestamp: "2024-01-01T00:00:00+0000"})
+	}
+	// A failed and a skipped item count as done too
+	media = append(media,
+		Media{ID: "missing", MediaType: "IMAGE", MediaURL: localFileURL(filepath.Join(dir, "missing.png")), Timestamp: "2024-01-01T00:00:00+0000"},
+		Media{ID: "reel", MediaType: "VIDEO", MediaURL: "https://example.com/reel.mp4", Timestamp: "2024-01-01T00:00:00+0000"},
+	)
+
+	var mu sync.Mutex
+	var done []int
+	var ids []string
+	opts := ProcessOptions{Concurrency: 4, Progress: func(d, total int, currentID string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if total != len(media) {
+			t.Errorf("total = %d, want %d", total, len(media))
+		}
+		done = append(done, d)
+		ids = append(ids, currentID)
+	}}
+	if err := FetchAndTransformImages(context.Background(), media, t.TempDir(), t.TempDir(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(done) != len(media) {
+		t.Fatalf("called %d times, want %d", len(done), len(media))
+	}
+	for i, d := range done {
+		if d != i+1 {
+			t.Fatalf("done went %v, want 1 to %d in order", done, len(media))
+		}
+	}
+	slices.Sort(ids)
+	want := mediaIDs(media)
+	slices.Sort(want)
+	if !slices.Equal(ids, want) {
+		t.Errorf("reported %v, want each item once", ids)
+	}
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a client-side rate limiter. Tokens refill at rate per
+// second up to burst; a zero rate never limits. A pause, set after the
+// server reports throttling, holds every caller until it ends.
+type tokenBucket struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// graphLimiter paces every Graph API request
+var graphLimiter = &tokenBucket{}
+
+// SetRequestsPerSecond configures how many Graph API requests may be made
+// per second; zero removes the limit
+func SetRequestsPerSecond(rps float64) error {
+	if rps < 0 {
+		return fmt.Errorf("requests per second must not be negative, got %g", rps)
+	}
+	graphLimiter.mu.Lock()
+	defer graphLimiter.mu.Unlock()
+	graphLimiter.rate = rps
+	graphLimiter.burst = max(rps, 1)
+	graphLimiter.tokens = graphLimiter.burst
+	graphLimiter.last = time.Now()
+	return nil
+}
+
+// wait blocks until a request may be made or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		var delay time.Duration
+		if now.Before(b.pausedUntil) {
+			delay = b.pausedUntil.Sub(now)
+		} else if b.rate <= 0 {
+			b.mu.Unlock()
+			return nil
+		} else {
+			b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+			b.last = now
+			if b.tokens >= 1 {
+				b.tokens--
+				b.mu.Unlock()
+				return nil
+			}
+			delay = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pause holds every caller for at least d
+func (b *tokenBucket) pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// graphGet performs a Graph API GET, paced by graphLimiter
+func graphGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	return pacedGet(ctx, rawURL, graphLimiter)
+}
+
+// appUsage is the X-App-Usage header: percentages of the app's quota used
+type appUsage struct {
+	CallCount    float64 `json:"call_count"`
+	TotalTime    float64 `json:"total_time"`
+	TotalCPUTime float64 `json:"total_cputime"`
+}
+
+// businessUseCaseUsage is one entry of the X-Business-Use-Case-Usage header
+type businessUseCaseUsage struct {
+	appUsage
+	EstimatedTimeToRegainAccess int `json:"estimated_time_to_regain_access"`
+}
+
+// usageDelay returns how long to back off after a throttled response,
+// according to its usage headers. The business use case header names the
+// minutes until access is regained; a quota at 100% in either header waits
+// the max retry delay. The result is capped at the max retry delay.
+func usageDelay(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	var delay time.Duration
+	exhausted := func(u appUsage) bool {
+		return max(u.CallCount, u.TotalTime, u.TotalCPUTime) >= 100
+	}
+
+	if header := resp.Header.Get("X-Business-Use-Case-Usage"); header != "" {
+		var usage map[string][]businessUseCaseUsage
+		if err := json.Unmarshal([]byte(header), &usage); err == nil {
+			for _, entries := range usage {
+				for _, entry := range entries {
+					delay = max(delay, time.Duration(entry.EstimatedTimeToRegainAccess)*time.Minute)
+					if exhausted(entry.appUsage) {
+						delay = max(delay, retry.MaxDelay)
+					}
+				}
+			}
+		}
+	}
+
+	if header := resp.Header.Get("X-App-Usage"); header != "" {
+		var usage appUsage
+		if err := json.Unmarshal([]byte(header), &usage); err == nil && exhausted(usage) {
+			delay = max(delay, retry.MaxDelay)
+		}
+	}
+
+	if delay <= 0 {
+		return 0, false
+	}
+	return min(delay, retry.MaxDelay), true
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottledResponseDelaysTheRetry(t *testing.T) {
+	policy, limiter := retry, graphLimiter
+	retry.BaseDelay, retry.MaxDelay = 10*time.Millisecond, 300*time.Millisecond
+	graphLimiter = &tokenBucket{}
+	t.Cleanup(func() { retry, graphLimiter = policy, limiter })
+
+	var mu sync.Mutex
+	var hits []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits = append(hits, time.Now())
+		first := len(hits) == 1
+		mu.Unlock()
+		if first {
+			w.Header().Set("X-App-Usage", `{"call_count":100,"total_time":12,"total_cputime":8}`)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+	routeTo(t, server)
+
+	resp, err := graphGet(context.Background(), "https://graph.instagram.com/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want the retry to succeed", resp.StatusCode)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hits) != 2 {
+		t.Fatalf("server was hit %d times, want 2", len(hits))
+	}
+	// The backoff alone is at most 20ms; the exhausted quota asks for the max
+	if gap := hits[1].Sub(hits[0]); gap < retry.MaxDelay {
+		t.Errorf("retried after %s, want at least %s", gap, retry.MaxDelay)
+	}
+	graphLimiter.mu.Lock()
+	pausedUntil := graphLimiter.pausedUntil
+	graphLimiter.mu.Unlock()
+	if !pausedUntil.After(hits[0]) {
+		t.Error("the throttled response did not pause the limiter for other callers")
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	paused := &tokenBucket{}
+	paused.pause(200 * time.Millisecond)
+	started := time.Now()
+	if err := paused.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond {
+		t.Errorf("a paused bucket let a caller through after %s, want 200ms", elapsed)
+	}
+
+	// Two requests per second with a burst of two: the third waits ~500ms
+	paced := &tokenBucket{rate: 2, burst: 2, tokens: 2, last: time.Now()}
+	started = time.Now()
+	for range 3 {
+		if err := paced.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("three requests at 2/s took %s, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	paused.pause(time.Minute)
+	if err := paused.wait(ctx); err != context.Canceled {
+		t.Errorf("cancelled wait returned %v, want context.Canceled", err)
+	}
+}
+
+func TestUsageDelay(t *testing.T) {
+	policy := retry
+	retry.MaxDelay = 30 * time.Second
+	t.Cleanup(func() { retry = policy })
+
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		want    time.Duration
+		wantOK  bool
+	}{
+		{"not throttled", http.StatusOK, map[string]string{"X-App-Usage": `{"call_count":100}`}, 0, false},
+		{"no headers", http.StatusTooManyRequests, nil, 0, false},
+		{"quota left", http.StatusTooManyRequests, map[string]string{"X-App-Usage": `{"call_count":80,"total_time":10}`}, 0, false},
+		{"app quota used up", http.StatusTooManyRequests, map[string]string{"X-App-Usage": `{"total_cputime":100}`}, 30 * time.Second, true},
+		{"regain access capped", http.StatusTooManyRequests, map[string]string{
+			"X-Business-Use-Case-Usage": `{"1784":[{"type":"instagram","call_count":40,"estimated_time_to_regain_access":5}]}`,
+		}, 30 * time.Second, true},
+		{"malformed header", http.StatusTooManyRequests, map[string]string{"X-App-Usage": `call_count=100`}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for key, value := range tt.headers {
+				resp.Header.Set(key, value)
+			}
+			got, ok := usageDelay(resp)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
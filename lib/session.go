@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+)
+
+// MinSessionSecretLength is the shortest session secret accepted
+const MinSessionSecretLength = 32
+
+// sessionMaxAge is how long a login lasts, in seconds
+const sessionMaxAge = 30 * 24 * 60 * 60
+
+// sessionOptions are the attributes of the session cookie; a negative
+// maxAge deletes it. The cookie holds an access token, so scripts and
+// plain HTTP never see it and cross-site requests don't carry it.
+func sessionOptions(maxAge int) sessions.Options {
+	return sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// NewSessionStore returns the cookie store for the web login. Keys for
+// signing and for encrypting the cookie are both derived from secret, so
+// the token in it can neither be forged nor read.
+func NewSessionStore(secret string) (sessions.Store, error) {
+	if len(secret) < MinSessionSecretLength {
+		return nil, fmt.Errorf("SESSION_SECRET must be set to at least %d characters, got %d", MinSessionSecretLength, len(secret))
+	}
+	authKey := hmacSHA256([]byte(secret), "session authentication")
+	encryptionKey := hmacSHA256([]byte(secret), "session encryption")
+
+	store := cookie.NewStore(authKey, encryptionKey)
+	store.Options(sessionOptions(sessionMaxAge))
+	return store, nil
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MaxShardDepth is the deepest the media dir can be sharded
+const MaxShardDepth = 2
+
+// shardWidth is how many characters of the media ID name a shard directory
+const shardWidth = 2
+
+// ValidateShardDepth checks that a shard depth is between 0 (flat) and
+// MaxShardDepth
+func ValidateShardDepth(depth int) error {
+	if depth < 0 || depth > MaxShardDepth {
+		return fmt.Errorf("shard depth must be between 0 and %d, got %d", MaxShardDepth, depth)
+	}
+	return nil
+}
+
+// mediaFileBase returns the slash-separated path, relative to the media dir,
+// that a media item's file names start with: the ID under depth levels of
+// directories named by successive pairs of its leading characters, e.g.
+// "17/89/17895695668004550". IDs too short for every level are padded with
+// underscores, and characters other than letters, digits, "-" and "_" are
+// replaced by one, so a shard name can never be "..".
+func mediaFileBase(mediaID string, depth int) string {
+	if depth <= 0 {
+		return mediaID
+	}
+	depth = min(depth, MaxShardDepth)
+	prefix := []byte(mediaID)
+	for len(prefix) < depth*shardWidth {
+		prefix = append(prefix, '_')
+	}
+
+	parts := make([]string, 0, depth+1)
+	for level := range depth {
+		shard := prefix[level*shardWidth : (level+1)*shardWidth]
+		parts = append(parts, strings.Map(shardRune, string(shard)))
+	}
+	return path.Join(append(parts, mediaID)...)
+}
+
+// shardRune keeps the characters safe in a shard directory name
+func shardRune(r rune) rune {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+		return r
+	}
+	return '_'
+}
+
+// ensureMediaFileDir creates the directory a media file name is written in.
+// Concurrent calls for the same shard are safe, as MkdirAll accepts a
+// directory that appeared in the meantime.
+func ensureMediaFileDir(mediaDir, fileName string) error {
+	return ensureDirectoryExists(filepath.Dir(filepath.Join(mediaDir, filepath.FromSlash(fileName))))
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardedPathsAtDepthTwo(t *testing.T) {
+	dir := t.TempDir()
+	var media []Media
+	for i := range 6 {
+		id := fmt.Sprint(17895695668004550 + i)
+		media = append(media, Media{
+			ID:        id,
+			MediaType: "IMAGE",
+			MediaURL:  localFileURL(writeTestPNG(t, dir, id+".png", 200+i, 150)),
+			Timestamp: fmt.Sprintf("2024-01-%02dT00:00:00+0000", i+1),
+		})
+	}
+
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	opts := ProcessOptions{ShardDepth: 2, Concurrency: 6}
+	if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readManifest(t, outputDir)
+	if len(entries) != len(media) {
+		t.Fatalf("manifest has %d entries, want %d", len(entries), len(media))
+	}
+	for _, entry := range entries {
+		shard := path.Join(entry.MediaID[0:2], entry.MediaID[2:4])
+		for name, version := range entry.Versions {
+			if dir, file := path.Split(version.FileName); path.Clean(dir) != shard || !strings.HasPrefix(file, entry.MediaID+"_") {
+				t.Errorf("%s %s: file_name %s, want %s/%s_...", entry.MediaID, name, version.FileName, shard, entry.MediaID)
+			}
+			if _, err := os.Stat(filepath.Join(mediaDir, filepath.FromSlash(version.FileName))); err != nil {
+				t.Errorf("%s %s: %v", entry.MediaID, name, err)
+			}
+		}
+	}
+
+	// Nothing but shard directories is left at the top of the media dir
+	top, err := os.ReadDir(mediaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range top {
+		if !file.IsDir() || len(file.Name()) != shardWidth {
+			t.Errorf("media dir holds %s, want only shard directories", file.Name())
+		}
+	}
+}
+
+func TestMediaFileBase(t *testing.T) {
+	tests := []struct {
+		id    string
+		depth int
+		want  string
+	}{
+		{"17895695668004550", 0, "17895695668004550"},
+		{"17895695668004550", 1, "17/17895695668004550"},
+		{"17895695668004550", 2, "17/89/17895695668004550"},
+		{"17895695668004550", 3, "17/89/17895695668004550"},
+		{"42", 2, "42/__/42"},
+		{"7", 1, "7_/7"},
+		{"a.b.c", 2, "a_/b_/a.b.c"},
+	}
+	for _, tt := range tests {
+		if got := mediaFileBase(tt.id, tt.depth); got != tt.want {
+			t.Errorf("%s at depth %d: got %q, want %q", tt.id, tt.depth, got, tt.want)
+		}
+	}
+
+	for depth, wantErr := range map[int]bool{-1: true, 0: false, 2: false, 3: true} {
+		if err := ValidateShardDepth(depth); (err != nil) != wantErr {
+			t.Errorf("ValidateShardDepth(%d) = %v, want error %v", depth, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultResizeFilter is the resampling filter used unless configured
+const DefaultResizeFilter = "lanczos"
+
+// resizeFilters maps filter names to imaging resampling filters
+var resizeFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+}
+
+// ValidateResizeFilter checks that a resize filter name is known
+func ValidateResizeFilter(name string) error {
+	if _, ok := resizeFilters[name]; ok || name == "" {
+		return nil
+	}
+	return fmt.Errorf("unknown resize filter %q (expected lanczos, catmullrom, linear, nearest or box)", name)
+}
+
+// resizeFilter returns the resampling filter for a name, defaulting to Lanczos
+func resizeFilter(name string) imaging.ResampleFilter {
+	if filter, ok := resizeFilters[name]; ok {
+		return filter
+	}
+	return imaging.Lanczos
+}
+
+// ParseSizes parses a comma-separated size list such as "1600:xl,800:md,400".
+// Names default to the width when omitted and must be unique.
+func ParseSizes(spec string) ([]ImageSize, error) {
+	var sizes []ImageSize
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		widthText, name, hasName := strings.Cut(part, ":")
+		width, err := strconv.Atoi(strings.TrimSpace(widthText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: width is not a number", part)
+		}
+		if width <= 0 {
+			return nil, fmt.Errorf("invalid size %q: width must be positive", part)
+		}
+
+		name = strings.TrimSpace(name)
+		if !hasName || name == "" {
+			name = strconv.Itoa(width)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate size name %q", name)
+		}
+		seen[name] = true
+
+		sizes = append(sizes, ImageSize{Width: width, Name: name})
+	}
+
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no sizes given")
+	}
+	return sizes, nil
+}
+
+// SetImageSizes configures the sizes generated for every image
+func SetImageSizes(sizes []ImageSize) error {
+	if len(sizes) == 0 {
+		return fmt.Errorf("at least one size is required")
+	}
+	imageVersions = sizes
+	return nil
+}
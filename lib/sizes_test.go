@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSizes(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []ImageSize
+		wantErr bool
+	}{
+		{"1600,800,400", []ImageSize{{1600, "1600"}, {800, "800"}, {400, "400"}}, false},
+		{"1600:xl, 800:md ,400", []ImageSize{{1600, "xl"}, {800, "md"}, {400, "400"}}, false},
+		{"800:,", []ImageSize{{800, "800"}}, false},
+		{"abc", nil, true},
+		{"800:md,abc:sm", nil, true},
+		{"-400", nil, true},
+		{"0:none", nil, true},
+		{"800:md,400:md", nil, true},
+		{"800,800", nil, true},
+		{"", nil, true},
+		{" , ", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSizes(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSizes(%q): got error %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSizes(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestImageSizesKeyVersionsByName(t *testing.T) {
+	sizes, err := ParseSizes("600:md,200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := imageVersions
+	t.Cleanup(func() { imageVersions = previous })
+	if err := SetImageSizes(sizes); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	media := []Media{{ID: "photo", MediaType: "IMAGE", MediaURL: localFileURL(writeTestPNG(t, dir, "photo.png", 1000, 500)), Timestamp: "2024-01-01T00:00:00+0000"}}
+	entries, err := FetchAndTransformImagesResult(context.Background(), media, t.TempDir(), t.TempDir(), ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := entries[0].Versions
+	if names := slices.Sorted(maps.Keys(versions)); !slices.Equal(names, []string{"200", "md"}) {
+		t.Fatalf("versions are keyed %v, want [200 md]", names)
+	}
+	if versions["md"].Width != 600 || versions["200"].Width != 200 {
+		t.Errorf("md is %d wide and 200 is %d wide", versions["md"].Width, versions["200"].Width)
+	}
+}
+
+func TestSmallSourcesAreNotUpscaled(t *testing.T) {
+	source, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "small.png", 300, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		allowUpscale bool
+	}{
+		{"default", false},
+		{"allow upscale", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mediaDir := t.TempDir()
+			result, err := convertImageData(context.Background(), source, "small", mediaDir, ProcessOptions{AllowUpscale: tt.allowUpscale}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, size := range imageVersions {
+				version := result.Versions[i]
+				wantWidth := min(size.Width, 300)
+				if tt.allowUpscale {
+					wantWidth = size.Width
+				}
+				wantHeight := (wantWidth*2 + 1) / 3 // 3:2, rounded
+				if version.Width != wantWidth || version.Height != wantHeight {
+					t.Errorf("%s is %dx%d, want %dx%d", size.Name, version.Width, version.Height, wantWidth, wantHeight)
+				}
+				// The recorded size is what was written
+				file, err := os.Open(filepath.Join(mediaDir, version.FileName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				img, err := decodeImage(context.Background(), file, FormatWebP)
+				file.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if img.Bounds().Dx() != version.Width {
+					t.Errorf("%s file is %d wide, recorded as %d", size.Name, img.Bounds().Dx(), version.Width)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeFilterChangesThePixels(t *testing.T) {
+	// A one-pixel checkerboard: nearest keeps pure black and white, while
+	// lanczos blends neighbours into greys
+	board := image.NewGray(image.Rect(0, 0, 1024, 512))
+	for y := 0; y < 512; y++ {
+		for x := 0; x < 1024; x++ {
+			if (x+y)%2 == 0 {
+				board.Pix[y*board.Stride+x] = 255
+			}
+		}
+	}
+	var source bytes.Buffer
+	if err := png.Encode(&source, board); err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func(filter string) (image.Image, []byte) {
+		t.Helper()
+		mediaDir := t.TempDir()
+		opts := ProcessOptions{Format: FormatWebPLossless, ResizeFilter: filter}
+		result, err := convertImageData(context.Background(), source.Bytes(), "board", mediaDir, opts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", filter, err)
+		}
+		thumb, _ := smallestVersion(MediaFileEntry{Versions: versionsByName(result.Versions)})
+		data, err := os.ReadFile(filepath.Join(mediaDir, thumb.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeImage(context.Background(), bytes.NewReader(data), FormatWebPLossless)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img, data
+	}
+	// greys counts the pixels that are neither black nor white
+	greys := func(img image.Image) int {
+		count := 0
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r != 0 && r != 0xffff {
+					count++
+				}
+			}
+		}
+		return count
+	}
+
+	nearest, nearestData := convert("nearest")
+	lanczos, lanczosData := convert("lanczos")
+	if bytes.Equal(nearestData, lanczosData) {
+		t.Fatal("nearest and lanczos wrote identical files")
+	}
+	if n := greys(nearest); n != 0 {
+		t.Errorf("nearest produced %d grey pixels, want none", n)
+	}
+	if n, total := greys(lanczos), lanczos.Bounds().Dx()*lanczos.Bounds().Dy(); n < total/2 {
+		t.Errorf("lanczos produced %d grey pixels of %d, want most of them", n, total)
+	}
+}
+
+func TestValidateResizeFilter(t *testing.T) {
+	for _, name := range []string{"", "lanczos", "catmullrom", "linear", "nearest", "box"} {
+		if err := ValidateResizeFilter(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	err := ValidateResizeFilter("bicubic")
+	if err == nil || !strings.Contains(err.Error(), "lanczos, catmullrom, linear, nearest or box") {
+		t.Errorf("got %v, want an error listing the known filters", err)
+	}
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/disintegration/imaging"
+)
+
+// Source formats told apart by sniffSourceFormat that image.Decode has no
+// decoder registered for
+const (
+	sourceHEIC = "heic"
+	sourceAVIF = "avif"
+)
+
+// errUnsupportedFormat marks a source in a format that cannot be decoded
+var errUnsupportedFormat = errors.New("unsupported format")
+
+// heifBrands maps ISO BMFF major brands to the source format they carry
+var heifBrands = map[string]string{
+	"heic": sourceHEIC,
+	"heix": sourceHEIC,
+	"heim": sourceHEIC,
+	"heis": sourceHEIC,
+	"hevc": sourceHEIC,
+	"hevx": sourceHEIC,
+	"mif1": sourceHEIC,
+	"msf1": sourceHEIC,
+	"avif": sourceAVIF,
+	"avis": sourceAVIF,
+}
+
+// sniffSourceFormat names the format of an encoded source from its magic
+// bytes, or returns "" when it is not one that needs converting first.
+// HEIF images whose major brand is the generic mif1 are counted as HEIC.
+func sniffSourceFormat(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	return heifBrands[string(data[8:12])]
+}
+
+// sourceConverters are the tools, in order of preference, that convert a
+// source format to PNG, called as "<tool> <in> <out.png>". libheif renamed
+// heif-convert to heif-dec.
+var sourceConverters = map[string][]string{
+	sourceHEIC: {"heif-dec", "heif-convert"},
+	sourceAVIF: {"avifdec"},
+}
+
+// normalizeSource converts a HEIC or AVIF source to PNG with the first
+// converter found on PATH, so it can be decoded like any other source. Other
+// sources are returned unchanged. Without a converter the source fails with
+// errUnsupportedFormat naming its format.
+func normalizeSource(ctx context.Context, data []byte) ([]byte, error) {
+	format := sniffSourceFormat(data)
+	if format == "" {
+		return data, nil
+	}
+
+	var tool string
+	for _, candidate := range sourceConverters[format] {
+		if path, err := exec.LookPath(candidate); err == nil {
+			tool = path
+			break
+		}
+	}
+	if tool == "" {
+		return nil, fmt.Errorf("%w: %s (install %s to convert it)", errUnsupportedFormat, format, sourceConverters[format][0])
+	}
+
+	var converted []byte
+	err := withTempFile("source-in-*."+format, func(src *os.File) error {
+		if _, err := src.Write(data); err != nil {
+			return err
+		}
+		if err := src.Close(); err != nil {
+			return err
+		}
+
+		return withTempFile("source-out-*.png", func(dst *os.File) error {
+			cmd := exec.CommandContext(ctx, tool, src.Name(), dst.Name())
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("converting %s source failed: %w: %s", format, err, bytes.TrimSpace(output))
+			}
+
+			var err error
+			converted, err = io.ReadAll(dst)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("converted source to PNG", "format", format, "tool", tool)
+	return converted, nil
+}
+
+// decodeSource decodes a source whose header reported format. WebP goes
+// straight to the libwebp decoder; everything else through imaging, which
+// rotates the pixels to match any EXIF orientation tag.
+func decodeSource(ctx context.Context, data []byte, format string) (image.Image, error) {
+	if format == FormatWebP {
+		return decodeImage(ctx, bytes.NewReader(data), FormatWebP)
+	}
+	return imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+}
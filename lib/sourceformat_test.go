@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// heicHeader is the start of a HEIC file: an ftyp box with the heic brand
+var heicHeader = []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+
+func TestSniffSourceFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"heic", heicHeader, sourceHEIC},
+		{"generic heif", []byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00"), sourceHEIC},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), sourceAVIF},
+		{"mp4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x00\x00"), ""},
+		{"png", pngHeader(8, 8), ""},
+		{"short", []byte("ftyp"), ""},
+	}
+	for _, tt := range tests {
+		if got := sniffSourceFormat(tt.data); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebPDecodedAndHEICSkipped(t *testing.T) {
+	// No HEIC converter is reachable
+	t.Setenv("PATH", t.TempDir())
+	logs := useLogger(t, "warn", LogFormatText)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	var webpSource bytes.Buffer
+	if err := encodeImage(context.Background(), &webpSource, img, FormatWebPLossless, EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photo.webp":
+			w.Header().Set("Content-Type", "image/webp")
+			w.Write(webpSource.Bytes())
+		case "/photo.heic":
+			w.Header().Set("Content-Type", "image/heic")
+			w.Write(append(heicHeader, make([]byte, 64)...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	routeTo(t, server)
+
+	media := []Media{
+		{ID: "webp", MediaType: "IMAGE", MediaURL: server.URL + "/photo.webp", Timestamp: "2024-01-02T00:00:00+0000"},
+		{ID: "heic", MediaType: "IMAGE", MediaURL: server.URL + "/photo.heic", Timestamp: "2024-01-01T00:00:00+0000"},
+	}
+	outputDir := t.TempDir()
+	entries, err := FetchAndTransformImagesResult(context.Background(), media, filepath.Join(outputDir, "media"), outputDir, ProcessOptions{FailFast: true})
+	if err != nil {
+		t.Fatalf("a HEIC source failed the run: %v", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.MediaID)
+	}
+	if !slices.Equal(ids, []string{"webp"}) {
+		t.Fatalf("manifest holds %v, want only the WebP source", ids)
+	}
+	if large := entries[0].Versions["large"]; large.Width != 300 || large.Height != 200 {
+		t.Errorf("WebP source converted to %dx%d, want 300x200", large.Width, large.Height)
+	}
+
+	warning := logs.String()
+	if !strings.Contains(warning, "skipping media") || !strings.Contains(warning, "media_id=heic") || !strings.Contains(warning, "unsupported format: heic") {
+		t.Errorf("warnings do not name the skipped HEIC source:\n%s", warning)
+	}
+}
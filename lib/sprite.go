@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sprite file names; the image is written to the media dir next to the
+// versions and the map to the output dir next to the manifest
+const (
+	SpriteImageName = "sprite.webp"
+	SpriteMapName   = "sprite.json"
+)
+
+// SpriteMap locates each media item's thumbnail within the sprite sheet
+type SpriteMap struct {
+	Image  string                `json:"image"`
+	Width  int                   `json:"width"`
+	Height int                   `json:"height"`
+	Items  map[string]SpriteRect `json:"items"`
+}
+
+// SpriteRect is a thumbnail's position and size in the sheet, in pixels
+type SpriteRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// smallestVersion returns the version with the smallest width
+func smallestVersion(entry MediaFileEntry) (ImageVersionEntry, bool) {
+	var smallest ImageVersionEntry
+	found := false
+	for _, version := range entry.Versions {
+		if !found || version.Width < smallest.Width {
+			smallest = version
+			found = true
+		}
+	}
+	return smallest, found
+}
+
+// formatFromFileName returns the output format a version file was written in
+func formatFromFileName(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".avif":
+		return FormatAVIF
+	default:
+		return FormatWebP
+	}
+}
+
+// packSprite lays thumbnails out on a grid of roughly square shape, each
+// row as tall as its tallest thumbnail and each column as wide as the widest
+func packSprite(ids []string, thumbs []image.Image) (SpriteMap, *image.NRGBA) {
+	sprite := SpriteMap{Image: SpriteImageName, Items: make(map[string]SpriteRect, len(ids))}
+	columns := int(math.Ceil(math.Sqrt(float64(len(thumbs)))))
+
+	cellWidth := 0
+	for _, thumb := range thumbs {
+		cellWidth = max(cellWidth, thumb.Bounds().Dx())
+	}
+
+	y := 0
+	for row := 0; row*columns < len(thumbs); row++ {
+		rowHeight := 0
+		for col := 0; col < columns && row*columns+col < len(thumbs); col++ {
+			i := row*columns + col
+			bounds := thumbs[i].Bounds()
+			sprite.Items[ids[i]] = SpriteRect{X: col * cellWidth, Y: y, Width: bounds.Dx(), Height: bounds.Dy()}
+			rowHeight = max(rowHeight, bounds.Dy())
+		}
+		y += rowHeight
+	}
+	sprite.Width = min(columns, len(thumbs)) * cellWidth
+	sprite.Height = y
+
+	sheet := image.NewNRGBA(image.Rect(0, 0, sprite.Width, sprite.Height))
+	for i, thumb := range thumbs {
+		rect := sprite.Items[ids[i]]
+		dest := image.Rect(rect.X, rect.Y, rect.X+rect.Width, rect.Y+rect.Height)
+		draw.Draw(sheet, dest, thumb, thumb.Bounds().Min, draw.Src)
+	}
+	return sprite, sheet
+}
+
+// writeSprite packs the smallest version of every entry into a single sprite
+// sheet and writes it with a map of where each thumbnail sits. Nothing is
+// written when there are no thumbnails.
+func writeSprite(ctx context.Context, mediaFilesArray []MediaFileEntry, mediaDir string, store *runStorage, opts EncodeOptions) error {
+	var ids []string
+	var thumbs []image.Image
+	for _, entry := range mediaFilesArray {
+		version, ok := smallestVersion(entry)
+		if !ok {
+			continue
+		}
+		file, err := os.Open(filepath.Join(mediaDir, version.FileName))
+		if err != nil {
+			return fmt.Errorf("error opening thumbnail: %w", err)
+		}
+		thumb, err := decodeImage(ctx, file, formatFromFileName(version.FileName))
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error decoding thumbnail %s: %w", version.FileName, err)
+		}
+		ids = append(ids, entry.MediaID)
+		thumbs = append(thumbs, thumb)
+	}
+
+	if len(thumbs) == 0 {
+		logger.Info("no thumbnails to pack, skipping the sprite sheet")
+		return nil
+	}
+
+	sprite, sheet := packSprite(ids, thumbs)
+
+	var encoded bytes.Buffer
+	if err := encodeImage(ctx, &encoded, sheet, FormatWebP, opts); err != nil {
+		return fmt.Errorf("error encoding sprite sheet: %w", err)
+	}
+	if err := store.Put(ctx, mediaKey(SpriteImageName), &encoded, contentTypeFor(SpriteImageName)); err != nil {
+		return fmt.Errorf("error writing sprite sheet: %w", err)
+	}
+
+	spriteJSON, err := json.MarshalIndent(sprite, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error creating sprite map JSON: %w", err)
+	}
+	return store.Put(ctx, SpriteMapName, bytes.NewReader(spriteJSON), contentTypeFor(SpriteMapName))
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// solidImage returns a width x height image filled with c
+func solidImage(width, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestPackSprite(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	thumbs := []image.Image{solidImage(100, 80, red), solidImage(120, 60, green), solidImage(90, 100, blue)}
+
+	sprite, sheet := packSprite([]string{"a", "b", "c"}, thumbs)
+
+	// Two columns of the widest thumbnail; rows as tall as their tallest
+	if sprite.Width != 240 || sprite.Height != 180 {
+		t.Errorf("sprite is %dx%d, want 240x180", sprite.Width, sprite.Height)
+	}
+	if got := sheet.Bounds().Size(); got.X != sprite.Width || got.Y != sprite.Height {
+		t.Errorf("sheet is %dx%d, the map says %dx%d", got.X, got.Y, sprite.Width, sprite.Height)
+	}
+	want := map[string]SpriteRect{
+		"a": {X: 0, Y: 0, Width: 100, Height: 80},
+		"b": {X: 120, Y: 0, Width: 120, Height: 60},
+		"c": {X: 0, Y: 80, Width: 90, Height: 100},
+	}
+	colors := map[string]color.NRGBA{"a": red, "b": green, "c": blue}
+	for id, rect := range want {
+		if sprite.Items[id] != rect {
+			t.Errorf("%s is at %+v, want %+v", id, sprite.Items[id], rect)
+		}
+		// Every corner of the rectangle holds the thumbnail, and the pixels
+		// just outside it to the right and below do not
+		for _, p := range []image.Point{
+			{rect.X, rect.Y}, {rect.X + rect.Width - 1, rect.Y},
+			{rect.X, rect.Y + rect.Height - 1}, {rect.X + rect.Width - 1, rect.Y + rect.Height - 1},
+		} {
+			if got := sheet.NRGBAAt(p.X, p.Y); got != colors[id] {
+				t.Errorf("%s: pixel %v is %v, want %v", id, p, got, colors[id])
+			}
+		}
+		for _, p := range []image.Point{{rect.X + rect.Width, rect.Y}, {rect.X, rect.Y + rect.Height}} {
+			if p.In(sheet.Bounds()) && sheet.NRGBAAt(p.X, p.Y) == colors[id] {
+				t.Errorf("%s: pixel %v outside its rectangle holds its colour", id, p)
+			}
+		}
+	}
+}
+
+func TestSpriteIsWrittenAfterProcessing(t *testing.T) {
+	dir := t.TempDir()
+	var media []Media
+	for i, width := range []int{400, 300, 200} {
+		id := string(rune('a' + i))
+		media = append(media, Media{
+			ID:        id,
+			MediaType: "IMAGE",
+			MediaURL:  localFileURL(writeTestPNG(t, dir, id+".png", width, 200)),
+			Timestamp: "2024-01-01T00:00:00+0000",
+		})
+	}
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	if err := FetchAndTransformImages(context.Background(), media, mediaDir, outputDir, ProcessOptions{Sprite: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, SpriteMapName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sprite SpriteMap
+	if err := json.Unmarshal(data, &sprite); err != nil {
+		t.Fatal(err)
+	}
+	if len(sprite.Items) != len(media) {
+		t.Errorf("sprite map has %d items, want %d", len(sprite.Items), len(media))
+	}
+	for _, entry := range readManifest(t, outputDir) {
+		smallest, _ := smallestVersion(entry)
+		rect, ok := sprite.Items[entry.MediaID]
+		if !ok {
+			t.Errorf("%s is missing from the sprite map", entry.MediaID)
+			continue
+		}
+		if rect.Width != smallest.Width || rect.Height != smallest.Height {
+			t.Errorf("%s is %dx%d in the sprite, its smallest version is %dx%d", entry.MediaID, rect.Width, rect.Height, smallest.Width, smallest.Height)
+		}
+	}
+
+	file, err := os.Open(filepath.Join(mediaDir, SpriteImageName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sheet, err := decodeImage(context.Background(), file, FormatWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sheet.Bounds().Size(); got.X != sprite.Width || got.Y != sprite.Height {
+		t.Errorf("sprite.webp is %dx%d, the map says %dx%d", got.X, got.Y, sprite.Width, sprite.Height)
+	}
+}
+
+func TestSpriteSkippedWithoutImages(t *testing.T) {
+	outputDir := t.TempDir()
+	mediaDir := filepath.Join(outputDir, "media")
+	if err := FetchAndTransformImages(context.Background(), nil, mediaDir, outputDir, ProcessOptions{Sprite: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(outputDir, SpriteMapName), filepath.Join(mediaDir, SpriteImageName)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want it not written", path, err)
+		}
+	}
+}
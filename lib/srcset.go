@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// BuildSrcSet returns a srcset attribute value for the entry's versions,
+// ordered by ascending width, e.g. "base/abc_256w_thumb.webp 256w, ...".
+// Width descriptors use each version's stored width; versions capped at the
+// same width are ordered by file name so the output is stable.
+func BuildSrcSet(entry MediaFileEntry, baseURL string) string {
+	versions := slices.SortedFunc(maps.Values(entry.Versions), func(a, b ImageVersionEntry) int {
+		return cmp.Or(cmp.Compare(a.Width, b.Width), cmp.Compare(a.FileName, b.FileName))
+	})
+
+	prefix := ""
+	if baseURL != "" {
+		prefix = strings.TrimSuffix(baseURL, "/") + "/"
+	}
+
+	candidates := make([]string, 0, len(versions))
+	for _, version := range versions {
+		if version.FileName == "" || version.Width <= 0 {
+			continue
+		}
+		candidates = append(candidates, fmt.Sprintf("%s%s %dw", prefix, version.FileName, version.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
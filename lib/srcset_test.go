@@ -0,0 +1,35 @@
+package lib
+
+import "testing"
+
+func TestBuildSrcSet(t *testing.T) {
+	// A 600px source: large and medium are capped at its real width, and
+	// the small size was never written
+	entry := MediaFileEntry{
+		MediaID: "abc",
+		Versions: map[string]ImageVersionEntry{
+			"large":  {FileName: "abc_1024w_large.webp", Width: 600, Height: 400},
+			"thumb":  {FileName: "abc_256w_thumb.webp", Width: 256, Height: 171},
+			"medium": {FileName: "abc_768w_medium.webp", Width: 600, Height: 400},
+			"broken": {FileName: "", Width: 384},
+		},
+	}
+
+	tests := []struct {
+		baseURL string
+		want    string
+	}{
+		{"https://cdn.example.com/media/", "https://cdn.example.com/media/abc_256w_thumb.webp 256w, https://cdn.example.com/media/abc_1024w_large.webp 600w, https://cdn.example.com/media/abc_768w_medium.webp 600w"},
+		{"/media", "/media/abc_256w_thumb.webp 256w, /media/abc_1024w_large.webp 600w, /media/abc_768w_medium.webp 600w"},
+		{"", "abc_256w_thumb.webp 256w, abc_1024w_large.webp 600w, abc_768w_medium.webp 600w"},
+	}
+	for _, tt := range tests {
+		if got := BuildSrcSet(entry, tt.baseURL); got != tt.want {
+			t.Errorf("BuildSrcSet(%q) =\n%s\nwant\n%s", tt.baseURL, got, tt.want)
+		}
+	}
+
+	if got := BuildSrcSet(MediaFileEntry{}, "/media"); got != "" {
+		t.Errorf("entry without versions gave %q", got)
+	}
+}
@@ -0,0 +1,319 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is where finished outputs are published, keyed by slash-separated
+// paths such as "media/abc_1024w_large.webp" or "converted_media.json".
+// Put gives up once ctx is done.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+}
+
+// storageMediaPrefix is the key prefix media files are published under
+const storageMediaPrefix = "media/"
+
+// contentTypes covers output extensions the system MIME table may lack
+var contentTypes = map[string]string{
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".mp4":  "video/mp4",
+	".json": "application/json",
+	".xml":  "application/xml",
+}
+
+// contentTypeFor returns the content type a file is published with
+func contentTypeFor(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// mediaKey returns the storage key of a media dir file
+func mediaKey(name string) string {
+	return path.Join(storageMediaPrefix, name)
+}
+
+// LocalStorage publishes to a directory on the local filesystem
+type LocalStorage struct {
+	Dir string
+	// MediaDir, when set, holds the keys under "media/" in place of
+	// Dir/media
+	MediaDir string
+}
+
+// NewLocalStorage returns a Storage writing under dir
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+// path returns the file a key is stored in
+func (s *LocalStorage) path(key string) string {
+	if name, ok := strings.CutPrefix(key, storageMediaPrefix); ok && s.MediaDir != "" {
+		return filepath.Join(s.MediaDir, filepath.FromSlash(name))
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+// Put writes the object atomically under the storage dir. Local writes are
+// quick, so they are made even once ctx is done.
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dest := s.path(key)
+	if err := ensureDirectoryExists(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	return WriteFileAtomic(dest, data, 0644)
+}
+
+// runStorage is what a run writes its outputs through. Every output lands in
+// the local media and output dirs, which incremental runs, verification and
+// the sprite read back, and is also put to remote as it is written when
+// one is configured.
+type runStorage struct {
+	local  *LocalStorage
+	remote Storage
+}
+
+// newRunStorage returns the storage for a run writing to mediaDir and
+// outputDir, and to remote when it is non-nil
+func newRunStorage(mediaDir, outputDir string, remote Storage) *runStorage {
+	return &runStorage{local: &LocalStorage{Dir: outputDir, MediaDir: mediaDir}, remote: remote}
+}
+
+// Put writes the object locally, then to the remote storage
+func (s *runStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := s.local.Put(ctx, key, bytes.NewReader(data), contentType); err != nil {
+		return err
+	}
+	if s.remote == nil {
+		return nil
+	}
+	if err := s.remote.Put(ctx, key, bytes.NewReader(data), contentType); err != nil {
+		return fmt.Errorf("error publishing %s: %w", key, err)
+	}
+	logger.Debug("published", "key", key)
+	return nil
+}
+
+// publish puts files already in the local dirs, such as a streamed video
+// or a version reused from an earlier run, to the remote storage
+func (s *runStorage) publish(ctx context.Context, keys ...string) error {
+	if s.remote == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := putFile(ctx, s.remote, s.local.path(key), key); err != nil {
+			return fmt.Errorf("error publishing %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// S3Storage publishes to an S3-compatible bucket such as S3, R2 or MinIO,
+// using path-style URLs and SigV4-signed PUT requests
+type S3Storage struct {
+	Bucket string
+	// Endpoint is the service URL, e.g. "https://<account>.r2.cloudflarestorage.com";
+	// empty uses AWS S3 in Region
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// NewS3Storage returns a Storage for bucket, reading credentials and region
+// from the standard AWS environment variables
+func NewS3Storage(bucket, endpoint string) (*S3Storage, error) {
+	s := &S3Storage{
+		Bucket:          bucket,
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.Region == "" {
+		s.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to publish to S3")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+	}
+	return s, nil
+}
+
+// Put uploads the object with a PUT request, retrying connection errors and
+// retryable statuses with the same backoff as downloads
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	objectURL := s.Endpoint + "/" + s3Escape(s.Bucket) + "/" + s3Escape(key)
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.put(ctx, objectURL, data, contentType)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt+1 >= retry.Attempts || ctx.Err() != nil {
+			return fmt.Errorf("S3 upload of %s failed: %w", key, err)
+		}
+		select {
+		case <-time.After(backoffDelay(attempt)):
+		case <-ctx.Done():
+			return fmt.Errorf("S3 upload of %s failed: %w", key, ctx.Err())
+		}
+	}
+}
+
+// put makes one signed PUT attempt, reporting whether a failure is worth
+// retrying
+func (s *S3Storage) put(ctx context.Context, objectURL string, data []byte, contentType string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("invalid S3 request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, data, time.Now().UTC())
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return isRetryableStatus(resp.StatusCode), fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return false, nil
+}
+
+// sign adds AWS Signature Version 4 headers to an S3 request
+func (s *S3Storage) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	// Header names are signed in sorted order, lower-cased
+	signedNames := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if s.SessionToken != "" {
+		signedNames = append(signedNames, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range signedNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(signedNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a key for an S3 URL path, keeping slashes and
+// the characters SigV4 leaves unreserved
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// putFile publishes a local file under key
+func putFile(ctx context.Context, storage Storage, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := storage.Put(ctx, key, file, contentTypeFor(localPath)); err != nil {
+		return err
+	}
+	logger.Debug("published", "key", key)
+	return nil
+}
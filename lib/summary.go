@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// RunSummary is the machine-readable outcome of a processing run
+type RunSummary struct {
+	Version         string                 `json:"version"`
+	StartedAt       string                 `json:"started_at"`
+	FinishedAt      string                 `json:"finished_at"`
+	DurationSeconds float64                `json:"duration_seconds"`
+	Total           int                    `json:"total"`
+	Processed       int                    `json:"processed"`
+	Skipped         int                    `json:"skipped"`
+	Failed          int                    `json:"failed"`
+	TotalBytes      int64                  `json:"total_bytes"`
+	AverageBytes    int64                  `json:"average_bytes"`
+	SourceBytes     int64                  `json:"source_bytes"`
+	SavedBytes      int64                  `json:"saved_bytes"`
+	Deduplicated    int                    `json:"deduplicated"`
+	Sizes           map[string]SizeSummary `json:"sizes"`
+}
+
+// SizeSummary aggregates the files written for one named size
+type SizeSummary struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// buildRunSummary aggregates the processed entries and run counts.
+// AverageBytes is per entry. Entries reusing the files of an identical
+// source count as deduplicated rather than towards the bytes. SavedBytes
+// compares each source downloaded this run with its largest version, the
+// file served in its place; entries reused from an earlier run are left out
+// of SourceBytes and SavedBytes.
+func buildRunSummary(mediaFilesArray []MediaFileEntry, startedAt time.Time, total, processed, skipped, failed int) RunSummary {
+	finishedAt := time.Now()
+	summary := RunSummary{
+		Version:         Version,
+		StartedAt:       startedAt.UTC().Format(time.RFC3339),
+		FinishedAt:      finishedAt.UTC().Format(time.RFC3339),
+		DurationSeconds: finishedAt.Sub(startedAt).Seconds(),
+		Total:           total,
+		Processed:       processed,
+		Skipped:         skipped,
+		Failed:          failed,
+		Sizes:           make(map[string]SizeSummary),
+	}
+
+	written := 0
+	for _, entry := range mediaFilesArray {
+		if entry.DedupOf != "" {
+			summary.Deduplicated++
+			continue
+		}
+		written++
+		for name, version := range entry.Versions {
+			size := summary.Sizes[name]
+			size.Count++
+			size.Bytes += version.Size
+			summary.Sizes[name] = size
+			summary.TotalBytes += version.Size
+		}
+		if entry.sourceSize > 0 {
+			if largest, ok := largestVersion(entry); ok {
+				summary.SourceBytes += entry.sourceSize
+				summary.SavedBytes += entry.sourceSize - largest.Size
+			}
+		}
+	}
+	if written > 0 {
+		summary.AverageBytes = summary.TotalBytes / int64(written)
+	}
+
+	return summary
+}
+
+// writeRunSummary writes a run summary as indented JSON to path
+func writeRunSummary(summary RunSummary, path string) error {
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error creating summary JSON: %w", err)
+	}
+
+	if err := ensureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, summaryJSON, 0644)
+}
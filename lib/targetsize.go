@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+)
+
+// Quality range searched when encoding to a target size
+const (
+	targetQualityMin = 30
+	targetQualityMax = 90
+)
+
+// maxTargetAttempts caps the encodes spent searching for a quality; a
+// binary search of the range needs at most six
+const maxTargetAttempts = 7
+
+// encodeToTargetSize binary-searches the lossy quality for the highest one
+// whose encoded output is no larger than target bytes, returning that output
+// and quality. When even the lowest quality is too large, the smallest output
+// tried is returned with fits false.
+func encodeToTargetSize(ctx context.Context, img image.Image, format string, opts EncodeOptions, target int64) (output []byte, quality int, fits bool, err error) {
+	low, high := targetQualityMin, targetQualityMax
+	var smallest []byte
+	smallestQuality := 0
+
+	for attempt := 0; attempt < maxTargetAttempts && low <= high; attempt++ {
+		mid := (low + high) / 2
+		opts.Quality = mid
+
+		var encoded bytes.Buffer
+		if err := encodeImage(ctx, &encoded, img, format, opts); err != nil {
+			return nil, 0, false, err
+		}
+
+		if int64(encoded.Len()) <= target {
+			output, quality = encoded.Bytes(), mid
+			low = mid + 1
+		} else {
+			if smallest == nil || mid < smallestQuality {
+				smallest, smallestQuality = encoded.Bytes(), mid
+			}
+			high = mid - 1
+		}
+	}
+
+	if output == nil {
+		return smallest, smallestQuality, false, nil
+	}
+	return output, quality, true, nil
+}
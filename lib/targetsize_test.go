@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stubSizedAVIF puts an avifenc on PATH whose output is 100 bytes per point
+// of quality, so the quality meeting a target is known, and returns a
+// function counting the encodes run so far
+func stubSizedAVIF(t *testing.T) func() int {
+	t.Helper()
+	log := filepath.Join(t.TempDir(), "encodes")
+	stubTool(t, "avifenc", `echo "$2" >> `+log+`
+head -c $(( $2 * 100 )) /dev/zero > "$4"`)
+	return func() int {
+		data, err := os.ReadFile(log)
+		if err != nil {
+			return 0
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+}
+
+func TestEncodeToTargetSize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	tests := []struct {
+		name        string
+		target      int64
+		wantQuality int
+		wantFits    bool
+	}{
+		{"between the bounds", 5000, 50, true},
+		{"just under a quality", 6789, 67, true},
+		{"roomier than the top quality", 100000, targetQualityMax, true},
+		{"below the lowest quality", 1000, targetQualityMin, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encodes := stubSizedAVIF(t)
+			output, quality, fits, err := encodeToTargetSize(context.Background(), img, FormatAVIF, EncodeOptions{}, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quality != tt.wantQuality || fits != tt.wantFits {
+				t.Errorf("got quality %d, fits %v, want %d, %v", quality, fits, tt.wantQuality, tt.wantFits)
+			}
+			if len(output) != quality*100 {
+				t.Errorf("returned %d bytes, not the output of quality %d", len(output), quality)
+			}
+			if tt.wantFits && int64(len(output)) > tt.target {
+				t.Errorf("output of %d bytes is over the %d byte target", len(output), tt.target)
+			}
+			// A binary search of the 61 qualities needs at most six encodes
+			if n := encodes(); n > 6 {
+				t.Errorf("used %d encodes, want at most 6", n)
+			}
+		})
+	}
+}
+
+func TestTargetSizeRecordsQualityPerVersion(t *testing.T) {
+	encodes := stubSizedAVIF(t)
+	source, err := os.ReadFile(writeTestPNG(t, t.TempDir(), "source.png", 800, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaDir := t.TempDir()
+	opts := ProcessOptions{Format: FormatAVIF, TargetSize: 4200}
+	result, err := convertImageData(context.Background(), source, "budget", mediaDir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range result.Versions {
+		info, err := os.Stat(filepath.Join(mediaDir, version.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > opts.TargetSize || version.Quality != 42 {
+			t.Errorf("%s: %d bytes at quality %d, want at most %d at quality 42", version.FileName, info.Size(), version.Quality, opts.TargetSize)
+		}
+	}
+	if n, limit := encodes(), 6*len(result.Versions); n > limit {
+		t.Errorf("used %d encodes for %d versions, want at most %d", n, len(result.Versions), limit)
+	}
+}
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFilePrefix marks temporary files created by this tool
+const tempFilePrefix = "instagram-recents-"
+
+// tempDir is where temporary files are created; empty means os.TempDir()
+var tempDir string
+
+// SetTempDir configures the directory used for temporary files. The
+// directory must exist and be writable; an empty dir restores the default.
+func SetTempDir(dir string) error {
+	if dir == "" {
+		tempDir = ""
+		return nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("temp dir %s is not usable: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("temp dir %s is not a directory", dir)
+	}
+
+	probe, err := os.CreateTemp(dir, tempFilePrefix+"probe-*")
+	if err != nil {
+		return fmt.Errorf("temp dir %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	tempDir = dir
+	return nil
+}
+
+// TempDir returns the directory used for temporary files
+func TempDir() string {
+	if tempDir == "" {
+		return os.TempDir()
+	}
+	return tempDir
+}
+
+// withTempFile creates a temporary file, passes it to fn and removes it
+// afterwards, whether or not fn succeeded
+func withTempFile(pattern string, fn func(file *os.File) error) error {
+	file, err := os.CreateTemp(TempDir(), tempFilePrefix+pattern)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	return fn(file)
+}
+
+// moveFile renames src to dst, copying it instead when they are on different
+// filesystems, as the temp dir and the output often are
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dir, base := filepath.Split(dst)
+	out, err := os.CreateTemp(cmp.Or(dir, "."), "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// CleanupTempFiles removes temporary files and directories created by this
+// tool that were last modified more than olderThan ago. Only entries carrying
+// the tool's prefix are considered. It returns the paths removed.
+func CleanupTempFiles(olderThan time.Duration) ([]string, error) {
+	dir := TempDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading temp dir %s: %w", dir, err)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var removed []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return removed, fmt.Errorf("error removing %s: %w", path, err)
+		}
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers see either the old file or the complete new one
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "converted_media.json")
+	if err := os.WriteFile(path, []byte(`[{"id":"old"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader racing the writes only ever sees a whole manifest
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("reader: %v", err)
+				return
+			}
+			var entries []Media
+			if err := json.Unmarshal(data, &entries); err != nil {
+				t.Errorf("reader saw a partial file: %v", err)
+				return
+			}
+		}
+	}()
+	for i := range 200 {
+		entries := numberedMedia(i+100, i+1)
+		data, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteFileAtomic(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Media
+	if err := json.Unmarshal(data, &entries); err != nil || len(entries) != 200 {
+		t.Fatalf("final file holds %d entries, %v, want the last write", len(entries), err)
+	}
+	if info, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0644) {
+		t.Errorf("final file mode = %v, %v, want 0644", info.Mode().Perm(), err)
+	}
+	if names := dirNames(t, dir); !slices.Equal(names, []string{"converted_media.json"}) {
+		t.Errorf("dir holds %v, want only the final file", names)
+	}
+}
+
+func TestWriteFileAtomicCleansUpOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	// A directory in the way makes the final rename fail
+	if err := os.Mkdir(filepath.Join(dir, "manifest.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "manifest.json"), []byte("{}"), 0644); err == nil {
+		t.Fatal("got no error renaming over a directory")
+	}
+	for _, name := range dirNames(t, dir) {
+		if strings.Contains(name, ".tmp-") {
+			t.Errorf("temp file %s left behind", name)
+		}
+	}
+}
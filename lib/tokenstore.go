@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// TokenStore persists a long-lived token as JSON at Path
+type TokenStore struct {
+	Path string
+
+	// now replaces the clock in tests; nil uses time.Now
+	now func() time.Time
+}
+
+// clock returns the current time
+func (s TokenStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// storedToken is the on-disk form of a token
+type storedToken struct {
+	AccessToken string `json:"access_token"`
+	UserID      string `json:"user_id"`
+	ExpiresAt   int64  `json:"expires_at"`
+	// SeededFrom is the SHA-256 of the token the store was seeded with, kept
+	// across refreshes so the stored token is known to continue it
+	SeededFrom string `json:"seeded_from,omitempty"`
+}
+
+// tokenDigest returns the hex SHA-256 of a token, recorded instead of the
+// token itself
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// load reads the stored token in its on-disk form, or nil when nothing has
+// been stored yet
+func (s TokenStore) load() (*storedToken, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file %s: %w", s.Path, err)
+	}
+
+	var stored storedToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("token file %s is corrupt: %w", s.Path, err)
+	}
+	if stored.AccessToken == "" {
+		return nil, fmt.Errorf("token file %s has no access token", s.Path)
+	}
+	return &stored, nil
+}
+
+// Load reads the stored token. It returns nil and no error when nothing has
+// been stored yet, and an error when the file exists but is unusable.
+func (s TokenStore) Load() (*TokenResponse, error) {
+	stored, err := s.load()
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken: stored.AccessToken,
+		UserID:      stored.UserID,
+		ExpiresAt:   stored.ExpiresAt,
+	}, nil
+}
+
+// Save writes tok to the store, readable only by the current user. When
+// tok has no ExpiresAt it is derived from ExpiresIn.
+func (s TokenStore) Save(tok *TokenResponse) error {
+	return s.save(tok, "")
+}
+
+// save writes tok to the store along with the digest of the token the
+// store was seeded with
+func (s TokenStore) save(tok *TokenResponse, seededFrom string) error {
+	expiresAt := tok.ExpiresAt
+	if expiresAt == 0 && tok.ExpiresIn > 0 {
+		expiresAt = s.clock().Unix() + int64(tok.ExpiresIn)
+	}
+
+	data, err := json.MarshalIndent(storedToken{
+		AccessToken: tok.AccessToken,
+		UserID:      tok.UserID,
+		ExpiresAt:   expiresAt,
+		SeededFrom:  seededFrom,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling token: %w", err)
+	}
+
+	if err := WriteFileAtomic(s.Path, data, 0600); err != nil {
+		return fmt.Errorf("error writing token file %s: %w", s.Path, err)
+	}
+	return nil
+}
+
+// Seed stores tok when no token is stored yet, so a token first used from
+// elsewhere, such as the environment or a web login, is kept and refreshed
+// from then on. It reports whether tok was stored; a corrupt store is left
+// alone and reported.
+func (s TokenStore) Seed(tok *TokenResponse) (bool, error) {
+	stored, err := s.Load()
+	if err != nil || stored != nil {
+		return false, err
+	}
+	if err := s.save(tok, tokenDigest(tok.AccessToken)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SeededFrom reports whether the store was seeded with token, so that the
+// stored token, refreshed or not, continues it. A token that has since been
+// rotated no longer matches.
+func (s TokenStore) SeededFrom(token string) (bool, error) {
+	stored, err := s.load()
+	if err != nil || stored == nil {
+		return false, err
+	}
+	return stored.SeededFrom == tokenDigest(token), nil
+}
+
+// RefreshIfNeeded refreshes the stored token when it is close to expiry, or
+// its expiry is unknown, and saves the result. It returns the current token,
+// or nil if none is stored. A token of unknown expiry that cannot be
+// refreshed yet, e.g. because it is under a day old, is returned as is.
+func (s TokenStore) RefreshIfNeeded() (*TokenResponse, error) {
+	stored, err := s.load()
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	tok := &TokenResponse{AccessToken: stored.AccessToken, UserID: stored.UserID, ExpiresAt: stored.ExpiresAt}
+	if !shouldRefreshAt(tok.ExpiresAt, s.clock()) {
+		return tok, nil
+	}
+
+	refreshed, err := RefreshToken(tok.AccessToken)
+	if err != nil {
+		if tok.ExpiresAt == 0 {
+			logger.Warn("could not refresh stored token of unknown expiry", "path", s.Path, "error", err)
+			return tok, nil
+		}
+		return nil, fmt.Errorf("error refreshing stored token: %w", err)
+	}
+	if refreshed.UserID == "" {
+		refreshed.UserID = tok.UserID
+	}
+	if err := s.save(refreshed, stored.SeededFrom); err != nil {
+		return nil, err
+	}
+
+	logger.Info("refreshed stored token", "path", s.Path)
+	return s.Load()
+}
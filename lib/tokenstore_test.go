@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// refreshServer mocks the Graph API refresh endpoint, returning newToken
+// valid for 60 days, and counts the refreshes
+func refreshServer(t *testing.T, newToken string) *atomic.Int32 {
+	t.Helper()
+	refreshes := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/refresh_access_token" {
+			http.NotFound(w, r)
+			return
+		}
+		refreshes.Add(1)
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: newToken, ExpiresIn: 60 * 24 * 60 * 60})
+	}))
+	t.Cleanup(server.Close)
+	routeTo(t, server)
+	return refreshes
+}
+
+func TestTokenStoreRefreshIfNeeded(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		expiresAt   int64
+		wantRefresh bool
+	}{
+		{"refresh needed within a week of expiry", now.Add(3 * 24 * time.Hour).Unix(), true},
+		{"refresh needed once expired", now.Add(-time.Hour).Unix(), true},
+		{"refresh not needed", now.Add(30 * 24 * time.Hour).Unix(), false},
+		{"refresh needed when the expiry is unknown", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refreshes := refreshServer(t, "new-token")
+			store := TokenStore{Path: filepath.Join(t.TempDir(), "token.json"), now: func() time.Time { return now }}
+			if err := store.Save(&TokenResponse{AccessToken: "old-token", UserID: "42", ExpiresAt: tt.expiresAt}); err != nil {
+				t.Fatal(err)
+			}
+
+			tok, err := store.RefreshIfNeeded()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refreshed := refreshes.Load() > 0; refreshed != tt.wantRefresh {
+				t.Fatalf("refreshed = %v, want %v", refreshed, tt.wantRefresh)
+			}
+
+			if !tt.wantRefresh {
+				if tok.AccessToken != "old-token" || tok.ExpiresAt != tt.expiresAt {
+					t.Errorf("token = %+v, want the stored one unchanged", tok)
+				}
+				return
+			}
+			wantExpiry := now.Add(60 * 24 * time.Hour).Unix()
+			if tok.AccessToken != "new-token" || tok.UserID != "42" || tok.ExpiresAt != wantExpiry {
+				t.Errorf("token = %+v, want new-token for user 42 expiring at %d", tok, wantExpiry)
+			}
+		})
+	}
+}
+
+func TestTokenStoreLoadMissingAndCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	tok, err := TokenStore{Path: filepath.Join(dir, "missing.json")}.Load()
+	if tok != nil || err != nil {
+		t.Errorf("missing file: got %v, %v, want nil, nil", tok, err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (TokenStore{Path: corrupt}).Load(); err == nil {
+		t.Error("corrupt file: got no error")
+	}
+}
+
+func TestTokenStoreSeed(t *testing.T) {
+	store := TokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+	seeded, err := store.Seed(&TokenResponse{AccessToken: "first", UserID: "42"})
+	if err != nil || !seeded {
+		t.Fatalf("first seed: got %v, %v, want true, nil", seeded, err)
+	}
+	seeded, err = store.Seed(&TokenResponse{AccessToken: "second", UserID: "42"})
+	if err != nil || seeded {
+		t.Fatalf("second seed: got %v, %v, want false, nil", seeded, err)
+	}
+
+	tok, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "first" || tok.ExpiresAt != 0 {
+		t.Errorf("stored token = %+v, want the first one with an unknown expiry", tok)
+	}
+}
+
+func TestTokenStoreSeededTokenIsRefreshed(t *testing.T) {
+	refreshes := refreshServer(t, "refreshed")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := TokenStore{Path: filepath.Join(t.TempDir(), "token.json"), now: func() time.Time { return now }}
+	if _, err := store.Seed(&TokenResponse{AccessToken: "from-env", UserID: "42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := store.RefreshIfNeeded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshes.Load() != 1 || tok.AccessToken != "refreshed" || tok.ExpiresAt != now.Add(60*24*time.Hour).Unix() {
+		t.Errorf("after %d refreshes got %+v, want the seeded token refreshed with its expiry recorded", refreshes.Load(), tok)
+	}
+
+	// The refreshed token still continues the seed, a rotated one does not
+	for token, want := range map[string]bool{"from-env": true, "rotated": false} {
+		if seeded, err := store.SeededFrom(token); err != nil || seeded != want {
+			t.Errorf("SeededFrom(%q) = %v, %v, want %v", token, seeded, err, want)
+		}
+	}
+}
+
+func TestTokenStoreUnknownExpiryKeptWhenRefreshFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"Token must be at least 24 hours old","code":190}}`))
+	}))
+	defer server.Close()
+	routeTo(t, server)
+
+	store := TokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+	if _, err := store.Seed(&TokenResponse{AccessToken: "fresh", UserID: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := store.RefreshIfNeeded()
+	if err != nil || tok == nil || tok.AccessToken != "fresh" {
+		t.Errorf("got %+v, %v, want the seeded token kept until it can be refreshed", tok, err)
+	}
+}
@@ -0,0 +1,5 @@
+package lib
+
+// Version is the tool version, set at build time with
+// -ldflags "-X github.com/agoodkind/instagram-recents-go/lib.Version=..."
+var Version = "dev"
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// lookupFFmpeg finds ffmpeg on PATH once per process, warning if it is missing
+var lookupFFmpeg = sync.OnceValue(func() string {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		logger.Warn("ffmpeg not found on PATH, videos will be skipped instead of converted")
+		return ""
+	}
+	return path
+})
+
+// findFFmpeg returns the ffmpeg path and whether it is available
+func findFFmpeg() (string, bool) {
+	path := lookupFFmpeg()
+	return path, path != ""
+}
+
+// processVideo downloads a video, extracts its first frame with ffmpeg and
+// converts that frame to the usual sizes
+func processVideo(ctx context.Context, ffmpeg string, media Media, mediaDir string, opts ProcessOptions, cached map[string]ImageVersionEntry) (*imageResult, error) {
+	if err := ensureDirectoryExists(mediaDir); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("processing video", "media_id", media.ID)
+	videoFileName := mediaFileBase(media.ID, opts.ShardDepth) + ".mp4"
+	if err := ensureMediaFileDir(mediaDir, videoFileName); err != nil {
+		return nil, err
+	}
+	videoPath := filepath.Join(mediaDir, filepath.FromSlash(videoFileName))
+	if err := downloadToFile(ctx, media.MediaURL, videoPath); err != nil {
+		return nil, fmt.Errorf("video download failed: %w", err)
+	}
+	if !opts.KeepMetadata {
+		if err := stripVideoMetadata(ctx, ffmpeg, videoPath); err != nil {
+			os.Remove(videoPath)
+			return nil, err
+		}
+	}
+	if err := opts.outputs(mediaDir).publish(ctx, mediaKey(videoFileName)); err != nil {
+		return nil, err
+	}
+
+	var frame []byte
+	err := withTempFile("poster-*.png", func(file *os.File) error {
+		cmd := exec.CommandContext(ctx, ffmpeg,
+			"-y", "-loglevel", "error",
+			"-i", videoPath,
+			"-frames:v", "1",
+			"-f", "image2", "-c:v", "png",
+			file.Name(),
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("ffmpeg failed: %w: %s", err, output)
+		}
+
+		var err error
+		frame, err = os.ReadFile(file.Name())
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract poster frame: %w", err)
+	}
+
+	result, err := convertImageData(ctx, frame, media.ID, mediaDir, opts, cached)
+	if err != nil {
+		return nil, err
+	}
+	result.SourceURL = media.MediaURL
+	result.VideoFileName = videoFileName
+
+	// The poster is kept whatever happens, so a failed preview only warns
+	if opts.VideoPreview == VideoPreviewFrames {
+		preview, err := makeVideoPreview(ctx, ffmpeg, videoPath, media.ID, mediaDir, opts)
+		if err != nil {
+			logger.Warn("could not make an animated preview, keeping the poster only", "media_id", media.ID, "error", err)
+		} else if preview != nil {
+			if err := opts.outputs(mediaDir).publish(ctx, mediaKey(preview.FileName)); err != nil {
+				return nil, err
+			}
+		}
+		result.Preview = preview
+	}
+
+	// The downloaded video is the original; the poster frame has its dimensions
+	if opts.KeepOriginals {
+		if config, _, err := image.DecodeConfig(bytes.NewReader(frame)); err == nil {
+			result.Original = &OriginalEntry{FileName: videoFileName, Width: config.Width, Height: config.Height}
+		}
+	}
+
+	return result, nil
+}
+
+// stripVideoMetadata remuxes a video in place without its global and stream
+// metadata, such as the recording location, copying the streams unchanged.
+// The remux is written in the temp dir, so the media dir only ever holds
+// the original or the stripped video.
+func stripVideoMetadata(ctx context.Context, ffmpeg, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return withTempFile("stripped-*.mp4", func(file *os.File) error {
+		file.Close()
+		cmd := exec.CommandContext(ctx, ffmpeg,
+			"-y", "-loglevel", "error",
+			"-i", path,
+			"-map", "0", "-map_metadata", "-1", "-c", "copy",
+			"-f", "mp4", file.Name(),
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to strip video metadata: %w: %s", err, output)
+		}
+		if err := moveFile(file.Name(), path); err != nil {
+			return err
+		}
+		return os.Chmod(path, info.Mode().Perm())
+	})
+}
+
+// downloadToFile streams a download to path without holding it in memory
+func downloadToFile(ctx context.Context, url, path string) error {
+	resp, release, err := limitedGet(ctx, url)
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer release()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
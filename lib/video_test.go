@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// dirNames lists the names in dir
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestStripVideoMetadataWritesInTempDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+		want    string
+	}{
+		// The stub copies -i's argument to the last argument, adding a marker
+		{"remuxed", `while [ $# -gt 1 ]; do [ "$1" = -i ] && in=$2; shift; done; { cat "$in"; printf stripped; } > "$1"`, false, "videostripped"},
+		{"ffmpeg fails", `while [ $# -gt 1 ]; do shift; done; printf partial > "$1"; exit 1`, true, "video"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubTool(t, "ffmpeg", tt.script)
+			temp := t.TempDir()
+			if err := SetTempDir(temp); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { SetTempDir("") })
+
+			mediaDir := t.TempDir()
+			path := filepath.Join(mediaDir, "video.mp4")
+			if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := stripVideoMetadata(context.Background(), "ffmpeg", path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if data, _ := os.ReadFile(path); string(data) != tt.want {
+				t.Errorf("video holds %q, want %q", data, tt.want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+				t.Errorf("video mode = %v, %v, want 0644", info.Mode().Perm(), err)
+			}
+			if names := dirNames(t, mediaDir); !slices.Equal(names, []string{"video.mp4"}) {
+				t.Errorf("media dir holds %v, want only the video", names)
+			}
+			if names := dirNames(t, temp); len(names) != 0 {
+				t.Errorf("temp dir left holding %v", names)
+			}
+		})
+	}
+}
+
+// stubFFmpeg puts an ffmpeg on PATH that writes poster as any PNG output
+// and copies its input to any other output, and makes it the one used
+func stubFFmpeg(t *testing.T, poster string) {
+	t.Helper()
+	stubTool(t, "ffmpeg", `out=; for arg; do out=$arg; done
+case " $* " in
+*" png "*) cp "$POSTER" "$out" ;;
+*) while [ $# -gt 1 ]; do [ "$1" = -i ] && in=$2; shift; done; cp "$in" "$out" ;;
+esac`)
+	t.Setenv("POSTER", poster)
+	useFFmpeg(t, func() string {
+		path, _ := exec.LookPath("ffmpeg")
+		return path
+	})
+}
+
+// useFFmpeg replaces the ffmpeg lookup until the test ends
+func useFFmpeg(t *testing.T, lookup func() string) {
+	t.Helper()
+	previous := lookupFFmpeg
+	lookupFFmpeg = lookup
+	t.Cleanup(func() { lookupFFmpeg = previous })
+}
+
+func TestVideoPosterWithStubFFmpeg(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("fake video"))
+	}))
+	defer server.Close()
+	video := Media{ID: "clip", MediaType: "VIDEO", IsSharedToFeed: true, MediaURL: server.URL + "/clip.mp4", Timestamp: "2024-01-01T00:00:00+0000"}
+
+	tests := []struct {
+		name        string
+		ffmpeg      bool
+		wantEntries int
+	}{
+		{"ffmpeg on PATH", true, 1},
+		{"no ffmpeg", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ffmpeg {
+				stubFFmpeg(t, writeTestPNG(t, dir, "poster.png", 320, 180))
+			} else {
+				useFFmpeg(t, func() string { return "" })
+			}
+
+			outputDir := filepath.Join(t.TempDir(), "output")
+			mediaDir := filepath.Join(outputDir, "media")
+			entries, err := FetchAndTransformImagesResult(context.Background(), []Media{video}, mediaDir, outputDir, ProcessOptions{VideoPosters: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.wantEntries {
+				t.Fatalf("got %d entries, want %d", len(entries), tt.wantEntries)
+			}
+			if !tt.ffmpeg {
+				return
+			}
+
+			entry := entries[0]
+			if entry.VideoFileName != "clip.mp4" || len(entry.Versions) == 0 {
+				t.Errorf("entry has video %q and %d versions, want clip.mp4 and the poster sizes", entry.VideoFileName, len(entry.Versions))
+			}
+			if data, _ := os.ReadFile(filepath.Join(mediaDir, "clip.mp4")); string(data) != "fake video" {
+				t.Errorf("video file holds %q", data)
+			}
+			for _, version := range entry.Versions {
+				if wantHeight := version.Width * 9 / 16; version.Width > 320 || version.Height < wantHeight || version.Height > wantHeight+1 {
+					t.Errorf("%s is %dx%d, not a size of the 320x180 poster", version.FileName, version.Width, version.Height)
+				}
+			}
+		})
+	}
+}
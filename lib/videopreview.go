@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Video preview modes, chosen by ProcessOptions.VideoPreview
+const (
+	// VideoPreviewNone skips videos
+	VideoPreviewNone = "none"
+	// VideoPreviewPoster converts a single poster frame
+	VideoPreviewPoster = "poster"
+	// VideoPreviewFrames also writes an animated WebP of sampled frames
+	VideoPreviewFrames = "frames"
+)
+
+// DefaultPreviewFrames is how many frames an animated preview samples
+const DefaultPreviewFrames = 8
+
+// previewFrameRate is how many preview frames are shown per second
+const previewFrameRate = 2
+
+// PreviewEntry records an animated preview of a video in the manifest
+type PreviewEntry struct {
+	FileName string `json:"file_name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Frames   int    `json:"frames"`
+}
+
+// errNoAnimatedWebP marks an ffmpeg built without a WebP encoder
+var errNoAnimatedWebP = errors.New("ffmpeg has no WebP encoder")
+
+// ValidateVideoPreview checks that a video preview mode is known
+func ValidateVideoPreview(mode string) error {
+	switch mode {
+	case "", VideoPreviewNone, VideoPreviewPoster, VideoPreviewFrames:
+		return nil
+	}
+	return fmt.Errorf("unknown video preview %q (expected %s, %s or %s)", mode, VideoPreviewFrames, VideoPreviewPoster, VideoPreviewNone)
+}
+
+// lookupWebPEncoder finds which of ffmpeg's WebP encoders can write an
+// animation, once per process; empty when there is none
+var lookupWebPEncoder = sync.OnceValue(func() string {
+	ffmpeg, ok := findFFmpeg()
+	if !ok {
+		return ""
+	}
+	output, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return ""
+	}
+	for _, encoder := range []string{"libwebp_anim", "libwebp"} {
+		if strings.Contains(string(output), " "+encoder+" ") {
+			return encoder
+		}
+	}
+	return ""
+})
+
+// durationPattern matches the duration ffmpeg reports for an input
+var durationPattern = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// videoDuration reads a video's duration from ffmpeg's input summary
+func videoDuration(ctx context.Context, ffmpeg, path string) (time.Duration, bool) {
+	// Without an output ffmpeg exits non-zero after printing the summary
+	output, _ := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-i", path).CombinedOutput()
+	match := durationPattern.FindStringSubmatch(string(output))
+	if match == nil {
+		return 0, false
+	}
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+	duration := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+	return duration, duration > 0
+}
+
+// makeVideoPreview samples evenly spaced frames from a video into an
+// animated WebP the width of the smallest size. Videos too short to yield
+// more than one frame get no preview, as it would only repeat the poster.
+func makeVideoPreview(ctx context.Context, ffmpeg, videoPath, mediaID, mediaDir string, opts ProcessOptions) (*PreviewEntry, error) {
+	encoder := lookupWebPEncoder()
+	if encoder == "" {
+		return nil, errNoAnimatedWebP
+	}
+
+	frames := opts.PreviewFrames
+	if frames <= 0 {
+		frames = DefaultPreviewFrames
+	}
+
+	// Sample across the whole video when its length is known, otherwise
+	// take the first frames; sources narrower than the size keep their width
+	filter := fmt.Sprintf("scale=w=min(iw\\,%d):h=-2,setpts=N/(%d*TB)", smallestVersionWidth(), previewFrameRate)
+	if duration, ok := videoDuration(ctx, ffmpeg, videoPath); ok {
+		filter = fmt.Sprintf("fps=%g,", float64(frames)/duration.Seconds()) + filter
+	}
+
+	fileName := mediaFileBase(mediaID, opts.ShardDepth) + "_preview.webp"
+	dest := filepath.Join(mediaDir, filepath.FromSlash(fileName))
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-y", "-loglevel", "error",
+		"-i", videoPath,
+		"-an", "-map_metadata", "-1",
+		"-vf", filter,
+		"-frames:v", strconv.Itoa(frames),
+		"-c:v", encoder,
+		"-quality", strconv.Itoa(opts.Encode.withDefaults().Quality),
+		"-loop", "0",
+		"-f", "webp", dest,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dest)
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, output)
+	}
+
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		return nil, err
+	}
+	preview, err := webpAnimationInfo(data)
+	if err != nil {
+		os.Remove(dest)
+		return nil, fmt.Errorf("unreadable preview: %w", err)
+	}
+	if preview.Frames < 2 {
+		os.Remove(dest)
+		logger.Debug("video too short for an animated preview", "media_id", mediaID)
+		return nil, nil
+	}
+
+	preview.FileName = fileName
+	logger.Debug("created video preview", "file", fileName, "frames", preview.Frames)
+	return preview, nil
+}
+
+// webpAnimationInfo reads the canvas size and frame count of a WebP. A file
+// without animation frames counts as a single frame.
+func webpAnimationInfo(data []byte) (*PreviewEntry, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("WebP has no image data")
+	}
+
+	// A simple WebP has its size in the bitstream; read it the same way
+	header := chunks[0]
+	if header.fourCC != "VP8X" {
+		if header, err = vp8xHeader(header); err != nil {
+			return nil, err
+		}
+	}
+	if len(header.payload) < 10 {
+		return nil, fmt.Errorf("truncated VP8X header")
+	}
+	preview := &PreviewEntry{
+		Width:  int(uint24(header.payload[4:])) + 1,
+		Height: int(uint24(header.payload[7:])) + 1,
+		Frames: 1,
+	}
+
+	animationFrames := 0
+	for _, chunk := range chunks {
+		if chunk.fourCC == "ANMF" {
+			animationFrames++
+		}
+	}
+	if animationFrames > 0 {
+		preview.Frames = animationFrames
+	}
+	return preview, nil
+}
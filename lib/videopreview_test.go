@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// animatedWebP returns a WebP canvas of width x height holding the given
+// number of animation frames
+func animatedWebP(width, height, frames int) []byte {
+	header := make([]byte, 10)
+	header[0] = 0x02 // animation
+	putUint24(header[4:], uint32(width-1))
+	putUint24(header[7:], uint32(height-1))
+	chunks := []riffChunk{{fourCC: "VP8X", payload: header}, {fourCC: "ANIM", payload: make([]byte, 6)}}
+	for range frames {
+		chunks = append(chunks, riffChunk{fourCC: "ANMF", payload: make([]byte, 16)})
+	}
+	return writeWebP(chunks)
+}
+
+// stubPreviewFFmpeg puts an ffmpeg on PATH that reports the given duration,
+// writes poster as any PNG output and preview as any WebP output, and logs
+// its arguments to the returned file
+func stubPreviewFFmpeg(t *testing.T, poster string, preview []byte, duration string) string {
+	t.Helper()
+	dir := t.TempDir()
+	previewPath := filepath.Join(dir, "preview.webp")
+	if err := os.WriteFile(previewPath, preview, 0644); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "ffmpeg.log")
+	stubTool(t, "ffmpeg", `echo "$*" >> "$FFMPEG_LOG"
+prev=; out=; for arg; do prev=$out; out=$arg; done
+if [ "$prev" = -i ]; then echo "  Duration: $DURATION, start: 0.000000, bitrate: 1 kb/s" >&2; exit 1; fi
+case " $* " in
+*" png "*) cp "$POSTER" "$out" ;;
+*" webp "*) cp "$PREVIEW" "$out" ;;
+*) while [ $# -gt 1 ]; do [ "$1" = -i ] && in=$2; shift; done; cp "$in" "$out" ;;
+esac`)
+	t.Setenv("POSTER", poster)
+	t.Setenv("PREVIEW", previewPath)
+	t.Setenv("DURATION", duration)
+	t.Setenv("FFMPEG_LOG", log)
+	useFFmpeg(t, func() string {
+		path, _ := exec.LookPath("ffmpeg")
+		return path
+	})
+	return log
+}
+
+// useWebPEncoder replaces the WebP animation encoder lookup until the test
+// ends
+func useWebPEncoder(t *testing.T, encoder string) {
+	t.Helper()
+	previous := lookupWebPEncoder
+	lookupWebPEncoder = func() string { return encoder }
+	t.Cleanup(func() { lookupWebPEncoder = previous })
+}
+
+func TestVideoPreviewFrames(t *testing.T) {
+	dir := t.TempDir()
+	poster := writeTestPNG(t, dir, "poster.png", 640, 360)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("fake video"))
+	}))
+	defer server.Close()
+	video := Media{ID: "clip", MediaType: "VIDEO", IsSharedToFeed: true, MediaURL: server.URL + "/clip.mp4", Timestamp: "2024-01-01T00:00:00+0000"}
+
+	tests := []struct {
+		name        string
+		encoder     string
+		frames      int
+		wantPreview *PreviewEntry
+	}{
+		// Fewer frames than the 8 asked for, as from a short video
+		{"frames", "libwebp_anim", 3, &PreviewEntry{FileName: "clip_preview.webp", Width: 256, Height: 144, Frames: 3}},
+		{"single frame", "libwebp_anim", 1, nil},
+		{"no encoder", "", 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := stubPreviewFFmpeg(t, poster, animatedWebP(256, 144, tt.frames), "00:00:04.00")
+			useWebPEncoder(t, tt.encoder)
+
+			outputDir := filepath.Join(t.TempDir(), "output")
+			mediaDir := filepath.Join(outputDir, "media")
+			opts := ProcessOptions{VideoPosters: true, VideoPreview: VideoPreviewFrames}
+			entries, err := FetchAndTransformImagesResult(context.Background(), []Media{video}, mediaDir, outputDir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || len(entries[0].Versions) != len(imageVersions) {
+				t.Fatalf("got %+v, want one entry with the poster sizes", entries)
+			}
+
+			preview := entries[0].Preview
+			_, statErr := os.Stat(filepath.Join(mediaDir, "clip_preview.webp"))
+			if tt.wantPreview == nil {
+				if preview != nil || !os.IsNotExist(statErr) {
+					t.Errorf("preview = %+v (file: %v), want the poster only", preview, statErr)
+				}
+				return
+			}
+			if preview == nil || *preview != *tt.wantPreview {
+				t.Fatalf("preview = %+v, want %+v", preview, tt.wantPreview)
+			}
+			if statErr != nil {
+				t.Errorf("preview file: %v", statErr)
+			}
+
+			// 8 frames over 4 seconds samples two a second
+			args, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var previewArgs string
+			for _, line := range strings.Split(string(args), "\n") {
+				if strings.HasSuffix(line, "clip_preview.webp") {
+					previewArgs = line
+				}
+			}
+			if !strings.Contains(previewArgs, "-vf fps=2,") || !strings.Contains(previewArgs, "-frames:v 8") || !strings.Contains(previewArgs, "-c:v libwebp_anim") {
+				t.Errorf("preview was made with %q, want 8 frames at fps=2 with libwebp_anim", previewArgs)
+			}
+		})
+	}
+}
+
+func TestValidateVideoPreview(t *testing.T) {
+	for _, mode := range []string{"", VideoPreviewNone, VideoPreviewPoster, VideoPreviewFrames} {
+		if err := ValidateVideoPreview(mode); err != nil {
+			t.Errorf("%q: %v", mode, err)
+		}
+	}
+	if err := ValidateVideoPreview("gif"); err == nil {
+		t.Error("unknown mode gif was accepted")
+	}
+}